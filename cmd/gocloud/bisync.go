@@ -0,0 +1,769 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// syncStateFile is where bisync keeps, inside the local folder, what both
+// sides had after the last sync. Its name is skipped by the scans.
+const syncStateFile = ".gocloud-sync.json"
+
+// syncEntry is a file or folder on one side of a two-way sync, or as both
+// sides last had it
+type syncEntry struct {
+	IsDir   bool   `json:"isDir,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`  // Empty when the server doesn't know it yet
+	ETag    string `json:"etag,omitempty"`    // Of the remote file
+	Size    int64  `json:"size,omitempty"`    // Of files
+	ModTime int64  `json:"modTime,omitempty"` // Of the local file, Unix nanoseconds
+}
+
+// syncState is what bisync remembers between runs
+type syncState struct {
+	Server   string `json:"server"`
+	Username string `json:"username,omitempty"`
+	Remote   string `json:"remote"`
+	// Cursor is the position in the server's change journal Snapshot is at
+	Cursor   string                `json:"cursor"`
+	Snapshot map[string]*syncEntry `json:"snapshot"`
+	// Base is what both sides had after the last sync: a side that differs
+	// from it changed since
+	Base map[string]*syncEntry `json:"base"`
+	// Local caches the hashes of local files by size and modification time
+	Local map[string]*syncEntry `json:"local"`
+}
+
+// SyncReport is the outcome of a two-way sync
+type SyncReport struct {
+	Success    bool        `json:"success"`
+	Uploaded   []*Transfer `json:"uploaded"`
+	Downloaded []*Transfer `json:"downloaded"`
+	Folders    []string    `json:"folders,omitempty"`   // Created, local or remote
+	Deleted    []string    `json:"deleted,omitempty"`   // Local or remote
+	Conflicts  []string    `json:"conflicts,omitempty"` // Local copies kept of files changed on both sides
+	Skipped    []string    `json:"skipped,omitempty"`   // Changed on both sides in ways left to the user
+	Errors     []string    `json:"errors,omitempty"`
+}
+
+// runBisync makes a local and a remote folder converge: changes made on
+// either side since the last run are applied to the other one
+func runBisync(args []string) error {
+	fs := newFlags("bisync")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be done")
+	parallel := fs.Int("p", defaultParallel, "Number of files transferred at once")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	local, remote := fs.Arg(0), joinRemote(fs.Arg(1))
+
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	client := newClient(creds.Server, creds.Key)
+
+	state, err := loadSyncState(local)
+	if err != nil {
+		return err
+	}
+	// The state of another pair of folders tells nothing about this one
+	if state.Server != creds.Server || state.Username != creds.Username || state.Remote != remote {
+		state = &syncState{Server: creds.Server, Username: creds.Username, Remote: remote}
+	}
+
+	snapshot, cursor, err := remoteSnapshot(client, remote, state, *dryRun)
+	if err != nil {
+		return err
+	}
+	locals, err := localSnapshot(local, state.Local)
+	if err != nil {
+		return err
+	}
+
+	plan := planSync(state.Base, locals, snapshot)
+	if *dryRun {
+		return reportSyncPlan(local, remote, plan)
+	}
+
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	report := plan.run(client, local, remote, *parallel)
+
+	// The journal is read again from where this run started, which also
+	// brings back its own changes; they match the new base
+	state.Cursor, state.Snapshot = cursor, snapshot
+	state.Base, state.Local = plan.base, plan.locals
+	if err := saveSyncState(local, state); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	report.Success = len(report.Errors) == 0
+	var failed error
+	if !report.Success {
+		failed = fmt.Errorf("%d changes failed, the next sync tries them again", len(report.Errors))
+	}
+	if !jsonOutput {
+		for _, e := range report.Errors {
+			fmt.Fprintln(os.Stderr, "gocloud:", e)
+		}
+	}
+	return finish(report, failed)
+}
+
+// loadSyncState reads the state of the last sync of a local folder, empty
+// if there was none
+func loadSyncState(local string) (*syncState, error) {
+	state := &syncState{}
+	data, err := os.ReadFile(filepath.Join(local, syncStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(local, syncStateFile), err)
+		}
+	}
+	return state, nil
+}
+
+// saveSyncState replaces the state of a local folder
+func saveSyncState(local string, state *syncState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(local, ".gocloud-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(local, syncStateFile))
+}
+
+// remoteSnapshot brings the snapshot of the remote folder up to date with
+// the server's change journal, listing the folder again when the journal
+// can't tell what changed. It returns the snapshot and the cursor it is at.
+func remoteSnapshot(client *Client, remote string, state *syncState, dryRun bool) (map[string]*syncEntry, string, error) {
+	snapshot := make(map[string]*syncEntry)
+	for p, entry := range state.Snapshot {
+		snapshot[p] = entry
+	}
+	cursor := state.Cursor
+	refresh := make(map[string]bool)
+
+	for {
+		page, err := client.Changes(remote, cursor)
+		if isNotFound(err) {
+			// A folder synced before doesn't vanish without its content
+			// having to be deleted locally, which is left to the user
+			if len(state.Base) > 0 {
+				return nil, "", fmt.Errorf("%s no longer exists, remove %s to sync the folders again", remote, syncStateFile)
+			}
+			if dryRun {
+				return map[string]*syncEntry{}, "", nil
+			}
+			if err := client.Mkdir(remote); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		cursor = page.Cursor
+		if page.Reset {
+			items, err := scanRemote(client, remote, false)
+			if err != nil {
+				return nil, "", err
+			}
+			snapshot = make(map[string]*syncEntry, len(items))
+			for p, item := range items {
+				if p != "" {
+					snapshot[p] = remoteEntry(item)
+				}
+			}
+			break
+		}
+		for _, change := range page.Changes {
+			applyChange(snapshot, change, refresh)
+		}
+		if !page.HasMore {
+			break
+		}
+	}
+
+	// Folders moved in from elsewhere come without their content
+	for _, p := range sortedKeys(refresh) {
+		if entry := snapshot[p]; entry == nil || !entry.IsDir {
+			continue
+		}
+		items, err := listTree(client, joinRemote(remote, p), true)
+		if err != nil && !isNotFound(err) {
+			return nil, "", err
+		}
+		for _, item := range items {
+			snapshot[strings.TrimPrefix(strings.TrimPrefix(item.Path, remote), "/")] = remoteEntry(item)
+		}
+	}
+
+	// Files the server hadn't hashed yet may be by now
+	for _, p := range sortedKeys(snapshot) {
+		entry := snapshot[p]
+		if entry.IsDir || entry.SHA256 != "" {
+			continue
+		}
+		item, err := client.Stat(joinRemote(remote, p))
+		if err == nil && !item.IsDir() && item.ETag == entry.ETag {
+			snapshot[p] = remoteEntry(*item)
+		}
+	}
+	return snapshot, cursor, nil
+}
+
+// remoteEntry describes a listed remote item
+func remoteEntry(item Item) *syncEntry {
+	if item.IsDir() {
+		return &syncEntry{IsDir: true}
+	}
+	return &syncEntry{SHA256: item.SHA256, ETag: item.ETag, Size: item.Bytes}
+}
+
+// applyChange updates a snapshot with a change from the journal. Changes
+// the snapshot already reflects, as after a listing, leave it as is.
+// Folders whose content isn't known are added to refresh.
+func applyChange(snapshot map[string]*syncEntry, change Change, refresh map[string]bool) {
+	p := change.Path
+	switch change.Type {
+	case "delete":
+		removeTree(snapshot, p)
+		return
+
+	case "rename":
+		var old map[string]*syncEntry
+		if change.OldPath != "" {
+			old = subtree(snapshot, change.OldPath)
+			removeTree(snapshot, change.OldPath)
+		}
+		removeTree(snapshot, p)
+		switch {
+		case change.IsDir && old[""] != nil && old[""].IsDir:
+			for rel, entry := range old {
+				snapshot[p+rel] = entry
+			}
+		case change.IsDir:
+			snapshot[p] = &syncEntry{IsDir: true}
+			refresh[p] = true
+		default:
+			entry := &syncEntry{SHA256: change.SHA256, ETag: change.ETag, Size: change.Size}
+			// Moving keeps the content, and so its hash
+			if prev := old[""]; entry.SHA256 == "" && prev != nil && prev.ETag == change.ETag {
+				entry.SHA256 = prev.SHA256
+			}
+			snapshot[p] = entry
+		}
+
+	default:
+		if change.IsDir {
+			if entry := snapshot[p]; entry == nil || !entry.IsDir {
+				removeTree(snapshot, p)
+				snapshot[p] = &syncEntry{IsDir: true}
+			}
+		} else {
+			removeTree(snapshot, p)
+			snapshot[p] = &syncEntry{SHA256: change.SHA256, ETag: change.ETag, Size: change.Size}
+		}
+	}
+
+	// Folders created along with their content are only implied
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if entry := snapshot[dir]; entry == nil || !entry.IsDir {
+			snapshot[dir] = &syncEntry{IsDir: true}
+		}
+	}
+}
+
+// subtree returns the entries of p and below it, by path relative to p
+func subtree(snapshot map[string]*syncEntry, p string) map[string]*syncEntry {
+	entries := make(map[string]*syncEntry)
+	for q, entry := range snapshot {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			entries[q[len(p):]] = entry
+		}
+	}
+	return entries
+}
+
+// removeTree removes p and everything below it from a snapshot
+func removeTree(snapshot map[string]*syncEntry, p string) {
+	for q := range snapshot {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			delete(snapshot, q)
+		}
+	}
+}
+
+// localSnapshot scans the local folder, hashing the files that changed
+// since they were cached
+func localSnapshot(local string, cache map[string]*syncEntry) (map[string]*syncEntry, error) {
+	entries, err := scanLocal(local, false)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[string]*syncEntry, len(entries))
+	for p, entry := range entries {
+		if entry.info.IsDir() {
+			snapshot[p] = &syncEntry{IsDir: true}
+			continue
+		}
+		current := &syncEntry{Size: entry.info.Size(), ModTime: entry.info.ModTime().UnixNano()}
+		if cached := cache[p]; cached != nil && cached.Size == current.Size && cached.ModTime == current.ModTime {
+			current.SHA256 = cached.SHA256
+		} else if current.SHA256, err = hashFile(entry.path); err != nil {
+			return nil, err
+		}
+		snapshot[p] = current
+	}
+	return snapshot, nil
+}
+
+// sameEntry reports whether two entries have the same type and content.
+// Without hashes, only the same remote ETag tells the content is the same.
+func sameEntry(a, b *syncEntry) bool {
+	switch {
+	case a == nil || b == nil:
+		return a == b
+	case a.IsDir || b.IsDir:
+		return a.IsDir == b.IsDir
+	case a.SHA256 == "" || b.SHA256 == "":
+		return a.ETag != "" && a.ETag == b.ETag
+	}
+	return a.SHA256 == b.SHA256
+}
+
+// syncPlan is what a two-way sync does, and then what both sides have
+type syncPlan struct {
+	final     map[string]*syncEntry // What both sides have once synced
+	base      map[string]*syncEntry // Previous base, updated as changes succeed
+	locals    map[string]*syncEntry // Local files, updated as changes succeed
+	remotes   map[string]*syncEntry
+	conflicts map[string]string // Conflicted copy of each file changed on both sides
+	copies    map[string]bool   // The conflicted copies
+	skipped   []string          // Left alone, with what is below them
+}
+
+// planSync decides, for every path, what both sides should have: the side
+// that changed since the base wins. When both changed a file differently,
+// the remote version keeps the name and the local one is kept as a
+// conflicted copy next to it.
+func planSync(base, locals, remotes map[string]*syncEntry) *syncPlan {
+	plan := &syncPlan{
+		final:     make(map[string]*syncEntry),
+		base:      make(map[string]*syncEntry),
+		locals:    make(map[string]*syncEntry),
+		remotes:   remotes,
+		conflicts: make(map[string]string),
+		copies:    make(map[string]bool),
+	}
+	paths := make(map[string]bool)
+	for _, m := range []map[string]*syncEntry{base, locals, remotes} {
+		for p := range m {
+			if !syncIgnored(p) {
+				paths[p] = true
+			}
+		}
+	}
+	for p, entry := range base {
+		plan.base[p] = entry
+	}
+	for p, entry := range locals {
+		plan.locals[p] = entry
+	}
+
+	for _, p := range sortedKeys(paths) {
+		b, l, r := base[p], locals[p], remotes[p]
+		localChanged, remoteChanged := !sameEntry(b, l), !sameEntry(b, r)
+		var final *syncEntry
+		switch {
+		case !localChanged && !remoteChanged:
+			final = b
+		case !remoteChanged:
+			final = l
+		case !localChanged:
+			final = r
+		case sameEntry(l, r):
+			final = r
+		case l == nil:
+			// Deleted on one side, changed on the other: the change wins
+			final = r
+		case r == nil:
+			final = l
+		case !l.IsDir:
+			copyName := conflictName(p, func(name string) bool {
+				return paths[name] || plan.final[name] != nil
+			})
+			plan.conflicts[p] = copyName
+			plan.copies[copyName] = true
+			plan.final[copyName] = l
+			final = r
+		default:
+			// A local folder where a remote file now is
+			plan.skipped = append(plan.skipped, p)
+		}
+		if final != nil {
+			plan.final[p] = final
+		}
+	}
+
+	// Folders stay as long as something below them does
+	keys := sortedKeys(plan.final)
+	for p := range paths {
+		if plan.final[p] == nil {
+			keys = append(keys, p)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	needed := make(map[string]bool)
+	for _, p := range keys {
+		final := plan.final[p]
+		if needed[p] {
+			if final == nil {
+				final = &syncEntry{IsDir: true}
+				plan.final[p] = final
+			} else if !final.IsDir {
+				plan.skipped = append(plan.skipped, p)
+			}
+		}
+		if final != nil {
+			needed[path.Dir(p)] = true
+		}
+	}
+	sort.Strings(plan.skipped)
+	return plan
+}
+
+// syncIgnored reports whether a path is one of the client's own files
+func syncIgnored(p string) bool {
+	for _, name := range strings.Split(p, "/") {
+		if strings.HasPrefix(name, ".gocloud-") {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictName returns a free name for the local copy of a file changed on
+// both sides, like "notes (conflicted copy laptop 2026-01-02 150405).txt"
+func conflictName(p string, taken func(string) bool) string {
+	dir, name := path.Split(p)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	host, _ := os.Hostname()
+	label := strings.TrimSpace("conflicted copy " + host + " " + time.Now().Format("2006-01-02 150405"))
+	candidate := fmt.Sprintf("%s%s (%s)%s", dir, stem, label, ext)
+	for i := 2; taken(candidate); i++ {
+		candidate = fmt.Sprintf("%s%s (%s %d)%s", dir, stem, label, i, ext)
+	}
+	return candidate
+}
+
+// isSkipped reports whether p is, or is below, a path left alone
+func (plan *syncPlan) isSkipped(p string) bool {
+	for _, s := range plan.skipped {
+		if p == s || strings.HasPrefix(p, s+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// syncActions are the changes that make both sides match the plan
+type syncActions struct {
+	localDeletes, remoteDeletes []string // Only the topmost of deleted trees
+	localFolders, remoteFolders []string
+	uploads, downloads          []string
+}
+
+// actions compares each side with the plan
+func (plan *syncPlan) actions() *syncActions {
+	a := &syncActions{}
+	paths := make(map[string]bool)
+	for _, m := range []map[string]*syncEntry{plan.final, plan.locals, plan.remotes} {
+		for p := range m {
+			if !syncIgnored(p) && !plan.isSkipped(p) {
+				paths[p] = true
+			}
+		}
+	}
+
+	for _, p := range sortedKeys(paths) {
+		f, l, r := plan.final[p], plan.locals[p], plan.remotes[p]
+		// The local file of a conflict is moved aside rather than deleted
+		if l != nil && (f == nil || l.IsDir != f.IsDir) && plan.conflicts[p] == "" && !underDeleted(p, a.localDeletes) {
+			a.localDeletes = append(a.localDeletes, p)
+		}
+		if r != nil && (f == nil || r.IsDir != f.IsDir) && !underDeleted(p, a.remoteDeletes) {
+			a.remoteDeletes = append(a.remoteDeletes, p)
+		}
+		switch {
+		case f == nil:
+		case f.IsDir:
+			if l == nil || !l.IsDir {
+				a.localFolders = append(a.localFolders, p)
+			}
+			if r == nil || !r.IsDir {
+				a.remoteFolders = append(a.remoteFolders, p)
+			}
+		case sameEntry(f, l) || plan.copies[p]:
+			if !sameEntry(f, r) {
+				a.uploads = append(a.uploads, p)
+			}
+		case f == r || sameEntry(f, r):
+			a.downloads = append(a.downloads, p)
+		}
+	}
+	return a
+}
+
+// run applies the plan to both sides. Each path whose change failed keeps
+// its previous base, so the next sync sees it as changed again.
+func (plan *syncPlan) run(client *Client, local, remote string, parallel int) *SyncReport {
+	report := &SyncReport{Uploaded: []*Transfer{}, Downloaded: []*Transfer{}, Skipped: plan.skipped}
+	var failed []string
+	fail := func(p string, err error) {
+		failed = append(failed, p)
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", p, err))
+	}
+	localPath := func(p string) string {
+		return filepath.Join(local, filepath.FromSlash(p))
+	}
+
+	// Local files changed on both sides move aside first
+	for _, p := range sortedKeys(plan.conflicts) {
+		if plan.isSkipped(p) {
+			continue
+		}
+		copyName := plan.conflicts[p]
+		if err := os.Rename(localPath(p), localPath(copyName)); err != nil {
+			fail(p, err)
+			fail(copyName, err)
+			continue
+		}
+		plan.locals[copyName] = plan.locals[p]
+		delete(plan.locals, p)
+		report.Conflicts = append(report.Conflicts, localPath(copyName))
+	}
+
+	a := plan.actions()
+	for _, p := range a.remoteDeletes {
+		dir, name := splitRemote(joinRemote(remote, p))
+		var cond Precondition
+		if r := plan.remotes[p]; !r.IsDir {
+			cond.IfMatch = r.ETag
+		}
+		if err := client.DeleteIf(dir, []string{name}, cond); err != nil && !isNotFound(err) {
+			if isPreconditionFailed(err) {
+				err = errors.New("changed on the server during the sync")
+				plan.refreshRemote(client, remote, p)
+			}
+			fail(p, err)
+			continue
+		}
+		report.Deleted = append(report.Deleted, joinRemote(remote, p))
+	}
+	for _, p := range a.localDeletes {
+		if err := os.RemoveAll(localPath(p)); err != nil {
+			fail(p, err)
+			continue
+		}
+		removeTree(plan.locals, p)
+		report.Deleted = append(report.Deleted, localPath(p))
+	}
+	for _, p := range a.remoteFolders {
+		if underDeleted(p+"/", failed) {
+			continue
+		}
+		if err := client.Mkdir(joinRemote(remote, p)); err != nil {
+			fail(p, err)
+			continue
+		}
+		report.Folders = append(report.Folders, joinRemote(remote, p))
+	}
+	for _, p := range a.localFolders {
+		if underDeleted(p+"/", failed) {
+			continue
+		}
+		if err := os.MkdirAll(localPath(p), 0755); err != nil {
+			fail(p, err)
+			continue
+		}
+		plan.locals[p] = &syncEntry{IsDir: true}
+		report.Folders = append(report.Folders, localPath(p))
+	}
+
+	// Files replace exactly the version the plan was made with, anything
+	// changed meanwhile is left for the next sync
+	transfers := make(map[*Transfer]string)
+	for _, p := range a.uploads {
+		if underDeleted(p+"/", failed) {
+			continue
+		}
+		t := &Transfer{Local: localPath(p), Remote: joinRemote(remote, p), Bytes: plan.locals[p].Size}
+		if r := plan.remotes[p]; r != nil && !r.IsDir && !underDeleted(p+"/", a.remoteDeletes) {
+			t.cond.IfMatch = r.ETag
+		} else {
+			t.cond.IfNoneMatch = "*"
+		}
+		transfers[t] = p
+		report.Uploaded = append(report.Uploaded, t)
+	}
+	for _, p := range a.downloads {
+		if underDeleted(p+"/", failed) {
+			continue
+		}
+		r := plan.remotes[p]
+		t := &Transfer{Local: localPath(p), Remote: joinRemote(remote, p), Bytes: r.Size}
+		transfers[t] = p
+		report.Downloaded = append(report.Downloaded, t)
+	}
+	if len(report.Uploaded) > 0 {
+		runTransfers("Uploaded", report.Uploaded, parallel, func(t *Transfer, progress *Progress) error {
+			err := upload(client, t, progress)
+			if isPreconditionFailed(err) {
+				err = errors.New("changed on the server during the sync")
+			}
+			return err
+		})
+	}
+	if len(report.Downloaded) > 0 {
+		runTransfers("Downloaded", report.Downloaded, parallel, func(t *Transfer, progress *Progress) error {
+			return download(client, t, progress)
+		})
+	}
+	for t, p := range transfers {
+		if t.Error != "" {
+			fail(p, errors.New(t.Error))
+			plan.refreshRemote(client, remote, p)
+			continue
+		}
+		// Downloads learn the hash of files the server hadn't hashed yet
+		if final := plan.final[p]; final.SHA256 == "" {
+			plan.final[p] = &syncEntry{SHA256: t.SHA256, ETag: final.ETag, Size: final.Size}
+		}
+		if info, err := os.Stat(t.Local); err == nil {
+			plan.locals[p] = &syncEntry{SHA256: t.SHA256, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		}
+	}
+
+	// Paths that are in sync now get the plan as their base
+	for p, final := range plan.final {
+		if !plan.isSkipped(p) && !underDeleted(p+"/", failed) {
+			plan.base[p] = final
+		}
+	}
+	for p := range plan.base {
+		if plan.final[p] == nil && !plan.isSkipped(p) && !underDeleted(p+"/", failed) {
+			delete(plan.base, p)
+		}
+	}
+
+	if !jsonOutput {
+		for _, p := range report.Deleted {
+			fmt.Println("deleted", p)
+		}
+		for _, p := range report.Folders {
+			fmt.Println("created", p)
+		}
+		for _, p := range report.Conflicts {
+			fmt.Println("conflict, local version kept as", p)
+		}
+		for _, p := range report.Skipped {
+			fmt.Println("skipped", p, "(a folder on one side and a file on the other, both changed)")
+		}
+		if len(report.Deleted)+len(report.Folders)+len(report.Uploaded)+len(report.Downloaded)+len(report.Conflicts)+len(failed) == 0 {
+			fmt.Println("Everything is in sync")
+		}
+	}
+	return report
+}
+
+// refreshRemote updates the snapshot entry of a remote item whose change
+// failed, which may be because it changed meanwhile, so the next sync
+// compares with what is there now
+func (plan *syncPlan) refreshRemote(client *Client, remote, p string) {
+	item, err := client.Stat(joinRemote(remote, p))
+	switch {
+	case err == nil && item.IsDir():
+		if r := plan.remotes[p]; r == nil || !r.IsDir {
+			plan.remotes[p] = &syncEntry{IsDir: true}
+		}
+	case err == nil:
+		plan.remotes[p] = remoteEntry(*item)
+	case isNotFound(err):
+		removeTree(plan.remotes, p)
+	}
+}
+
+// reportSyncPlan shows what a two-way sync would do
+func reportSyncPlan(local, remote string, plan *syncPlan) error {
+	a := plan.actions()
+	localPath := func(p string) string {
+		return filepath.Join(local, filepath.FromSlash(p))
+	}
+
+	var lines []string
+	var conflicts []string
+	for _, p := range sortedKeys(plan.conflicts) {
+		conflicts = append(conflicts, localPath(plan.conflicts[p]))
+		lines = append(lines, "conflict "+localPath(p)+" -> "+localPath(plan.conflicts[p]))
+	}
+	for _, p := range a.remoteDeletes {
+		lines = append(lines, "delete   "+joinRemote(remote, p))
+	}
+	for _, p := range a.localDeletes {
+		lines = append(lines, "delete   "+localPath(p))
+	}
+	for _, p := range a.remoteFolders {
+		lines = append(lines, "mkdir    "+joinRemote(remote, p))
+	}
+	for _, p := range a.localFolders {
+		lines = append(lines, "mkdir    "+localPath(p))
+	}
+	for _, p := range a.uploads {
+		lines = append(lines, "upload   "+joinRemote(remote, p))
+	}
+	for _, p := range a.downloads {
+		lines = append(lines, "download "+localPath(p))
+	}
+	for _, p := range plan.skipped {
+		lines = append(lines, "skip     "+localPath(p))
+	}
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"success": true, "plan": lines, "conflicts": conflicts, "skipped": plan.skipped})
+		return nil
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listPageSize is how many items are asked for per listing request
+const listPageSize = 1000
+
+// Client calls the file API of a server
+type Client struct {
+	server string
+	token  string // API key or session token
+	http   *http.Client
+}
+
+// newClient creates a client for a server, signed in with token (may be empty)
+func newClient(server, token string) *Client {
+	return &Client{
+		server: strings.TrimRight(server, "/"),
+		token:  token,
+		http:   &http.Client{},
+	}
+}
+
+// APIError is an error response of the server
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// isNotFound reports whether err is a 404 from the server
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.Status == http.StatusNotFound
+}
+
+// Item is a file or folder as listed by the server
+type Item struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"` // "file" or "folder"
+	Path       string `json:"path"`
+	Bytes      int64  `json:"bytes"`
+	ModifiedAt string `json:"modifiedAt"`
+	MimeType   string `json:"mimeType,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	ETag       string `json:"etag,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+}
+
+// IsDir reports whether the item is a folder
+func (it Item) IsDir() bool {
+	return it.Type == "folder"
+}
+
+// Share is a share link
+type Share struct {
+	ID           string     `json:"id"`
+	URL          string     `json:"url"`
+	Path         string     `json:"path"`
+	Name         string     `json:"name"`
+	Type         string     `json:"type"`
+	Permission   string     `json:"permission"`
+	HasPassword  bool       `json:"hasPassword"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Status       string     `json:"status"`
+}
+
+// ShareOptions are the optional settings of a new share link
+type ShareOptions struct {
+	Permission   string     `json:"permission,omitempty"`
+	Password     string     `json:"password,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+}
+
+// apiPath turns a remote path ("/docs/a.txt", "docs/a.txt") into the form the
+// API takes: relative to the user's root, which is "root"
+func apiPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if cleaned == "/" {
+		return "root"
+	}
+	return cleaned[1:]
+}
+
+// splitRemote returns the folder holding a remote item, in API form, and its name
+func splitRemote(p string) (string, string) {
+	cleaned := path.Clean("/" + p)
+	return apiPath(path.Dir(cleaned)), path.Base(cleaned)
+}
+
+// joinRemote joins remote path elements into a path starting with "/"
+func joinRemote(elem ...string) string {
+	return path.Clean("/" + path.Join(elem...))
+}
+
+// newRequest prepares a request to an endpoint of the server
+func (c *Client) newRequest(method, endpoint string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.server + endpoint
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request and returns the response, or the error the server answered with
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// responseError reads the error of a failed response: JSON with an "error"
+// (or "message", for logins) from most endpoints, plain text from some
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil {
+		if body.Error != "" {
+			message = body.Error
+		} else if body.Message != "" {
+			message = body.Message
+		}
+	}
+	if message == "" {
+		message = resp.Status
+	}
+	return &APIError{Status: resp.StatusCode, Message: message}
+}
+
+// call sends in as JSON, if not nil, and decodes the JSON response into out, if not nil
+func (c *Client) call(method, endpoint string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := c.newRequest(method, endpoint, query, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Login exchanges a username and password for a session token
+func (c *Client) Login(username, password string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := c.call(http.MethodPost, "/api/login", nil, map[string]string{
+		"username": username,
+		"password": password,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+// Logout revokes the session token of the client
+func (c *Client) Logout() error {
+	return c.call(http.MethodPost, "/api/logout", nil, nil, nil)
+}
+
+// CreateAPIKey creates an API key, returning the key and its ID
+func (c *Client) CreateAPIKey(name string) (string, string, error) {
+	var resp struct {
+		Key    string `json:"key"`
+		APIKey struct {
+			ID string `json:"id"`
+		} `json:"apiKey"`
+	}
+	if err := c.call(http.MethodPost, "/api/account/keys", nil, map[string]string{"name": name}, &resp); err != nil {
+		return "", "", err
+	}
+	return resp.Key, resp.APIKey.ID, nil
+}
+
+// DeleteAPIKey revokes an API key of the user
+func (c *Client) DeleteAPIKey(id string) error {
+	return c.call(http.MethodDelete, "/api/account/keys", nil, map[string]string{"id": id}, nil)
+}
+
+// List returns all the items of a remote folder
+func (c *Client) List(dir string) ([]Item, error) {
+	items := []Item{}
+	cursor := ""
+	for {
+		query := url.Values{
+			"path":  {apiPath(dir)},
+			"limit": {strconv.Itoa(listPageSize)},
+		}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		var page struct {
+			Items      []Item `json:"items"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := c.call(http.MethodGet, "/api/files", query, nil, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		if page.NextCursor == "" {
+			return items, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// Stat describes a remote item
+func (c *Client) Stat(p string) (*Item, error) {
+	dir, name := splitRemote(p)
+	if name == "/" {
+		return &Item{Name: "/", Type: "folder", Path: ""}, nil
+	}
+
+	// Narrow the listing down when the name can be used as a pattern
+	query := url.Values{"path": {dir}}
+	if !strings.ContainsAny(name, `*?[]\`) {
+		query.Set("pattern", name)
+	}
+	var resp struct {
+		Items []Item `json:"items"`
+	}
+	notFound := &APIError{Status: http.StatusNotFound, Message: "no such file or folder: " + joinRemote(p)}
+	if err := c.call(http.MethodGet, "/api/files", query, nil, &resp); err != nil {
+		if isNotFound(err) {
+			return nil, notFound
+		}
+		return nil, err
+	}
+	for i := range resp.Items {
+		if resp.Items[i].Name == name {
+			return &resp.Items[i], nil
+		}
+	}
+	return nil, notFound
+}
+
+// Mkdir creates a remote folder; it's not an error if it exists
+func (c *Client) Mkdir(p string) error {
+	dir, name := splitRemote(p)
+	if name == "/" {
+		return nil
+	}
+	return c.call(http.MethodPost, "/api/files/folder", nil, map[string]string{
+		"path":       dir,
+		"folderName": name,
+	}, nil)
+}
+
+// Move moves or renames a remote item to dst, replacing a file there
+func (c *Client) Move(src, dst string) error {
+	srcDir, srcName := splitRemote(src)
+	dstDir, dstName := splitRemote(dst)
+	req := map[string]string{
+		"path":    srcDir,
+		"oldName": srcName,
+		"newName": dstName,
+	}
+	if dstDir != srcDir {
+		req["destination"] = dstDir
+	}
+	return c.call(http.MethodPost, "/api/files/rename", nil, req, nil)
+}
+
+// Delete deletes items of a remote folder
+func (c *Client) Delete(dir string, names []string) error {
+	return c.DeleteIf(dir, names, Precondition{})
+}
+
+// DeleteIf deletes items of a remote folder if they are still as expected
+func (c *Client) DeleteIf(dir string, names []string, cond Precondition) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"path":  apiPath(dir),
+		"names": names,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(http.MethodDelete, "/api/files", nil, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	cond.apply(req)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Precondition makes a change conditional on the state of the remote file:
+// If-Match holds the ETag it must still have, If-None-Match "*" requires
+// that no file exists yet
+type Precondition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// apply sets the precondition headers of a request
+func (p Precondition) apply(req *http.Request) {
+	if p.IfMatch != "" {
+		req.Header.Set("If-Match", p.IfMatch)
+	}
+	if p.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", p.IfNoneMatch)
+	}
+}
+
+// isPreconditionFailed reports whether err is the server turning down a
+// conditional change because the item changed meanwhile
+func isPreconditionFailed(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.Status == http.StatusPreconditionFailed
+}
+
+// UploadResult is what the server reports about an uploaded file
+type UploadResult struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
+// Upload stores size bytes from src as the file name of the remote folder dir,
+// replacing any file there
+func (c *Client) Upload(dir, name string, src io.Reader, size int64) (*UploadResult, error) {
+	return c.UploadIf(dir, name, src, size, Precondition{})
+}
+
+// UploadIf is Upload, if the file being replaced is still as expected
+func (c *Client) UploadIf(dir, name string, src io.Reader, size int64, cond Precondition) (*UploadResult, error) {
+	// The multipart envelope is built up front so the request has a length,
+	// and uploads over the server's limit are turned down before being sent
+	var envelope bytes.Buffer
+	mw := multipart.NewWriter(&envelope)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, escapeQuotes(name)))
+	header.Set("Content-Type", "application/octet-stream")
+	if _, err := mw.CreatePart(header); err != nil {
+		return nil, err
+	}
+	head := append([]byte(nil), envelope.Bytes()...)
+	envelope.Reset()
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	tail := append([]byte(nil), envelope.Bytes()...)
+
+	body := io.MultiReader(bytes.NewReader(head), io.LimitReader(src, size), bytes.NewReader(tail))
+	req, err := c.newRequest(http.MethodPost, "/api/files/upload", url.Values{"path": {apiPath(dir)}}, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(head)) + size + int64(len(tail))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	cond.apply(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Failed files come with a report explaining why, prefer it to the summary
+	data, _ := io.ReadAll(resp.Body)
+	var report struct {
+		Files []UploadResult `json:"files"`
+		Error string         `json:"error"`
+	}
+	json.Unmarshal(data, &report)
+	if len(report.Files) > 0 && !report.Files[0].Success && report.Files[0].Error != "" {
+		return nil, &APIError{Status: resp.StatusCode, Message: report.Files[0].Error}
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return nil, responseError(resp)
+	}
+	if len(report.Files) == 0 {
+		return nil, fmt.Errorf("unexpected response: %s", strings.TrimSpace(string(data)))
+	}
+	return &report.Files[0], nil
+}
+
+// escapeQuotes escapes a file name for a Content-Disposition header
+func escapeQuotes(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// Download writes the content of a remote file to dst and returns the
+// Digest header sent with it, if any
+func (c *Client) Download(p string, dst io.Writer) (string, error) {
+	dir, name := splitRemote(p)
+	req, err := c.newRequest(http.MethodGet, "/api/files/download", url.Values{
+		"path": {dir},
+		"name": {name},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("Digest"), nil
+}
+
+// Change is a change made below a remote folder, as recorded by the server.
+// Paths are relative to the folder.
+type Change struct {
+	Seq     int64  `json:"seq"`
+	Type    string `json:"type"` // "create", "modify", "rename" or "delete"
+	Path    string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"` // Empty for items moved in from outside the folder
+	IsDir   bool   `json:"isDir"`
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	ETag    string `json:"etag,omitempty"`
+}
+
+// ChangePage is a batch of changes after a cursor
+type ChangePage struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	HasMore bool     `json:"hasMore"`
+	Reset   bool     `json:"reset"` // The changes are unknown, the folder has to be listed again
+}
+
+// Changes returns the changes made below a remote folder since cursor. An
+// empty cursor gets a reset page with the current cursor.
+func (c *Client) Changes(dir, cursor string) (*ChangePage, error) {
+	query := url.Values{"path": {apiPath(dir)}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	var page ChangePage
+	if err := c.call(http.MethodGet, "/api/sync/changes", query, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// CreateShare creates a share link to a remote item
+func (c *Client) CreateShare(p string, opts ShareOptions) (*Share, error) {
+	dir, name := splitRemote(p)
+	req := struct {
+		Path string `json:"path"`
+		Name string `json:"name"`
+		ShareOptions
+	}{dir, name, opts}
+
+	var resp struct {
+		Share Share `json:"share"`
+	}
+	if err := c.call(http.MethodPost, "/api/shares", nil, req, &resp); err != nil {
+		return nil, err
+	}
+	resp.Share.URL = c.absoluteURL(resp.Share.URL)
+	return &resp.Share, nil
+}
+
+// ListShares returns the user's share links
+func (c *Client) ListShares() ([]Share, error) {
+	var resp struct {
+		Shares []Share `json:"shares"`
+	}
+	if err := c.call(http.MethodGet, "/api/shares", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	for i := range resp.Shares {
+		resp.Shares[i].URL = c.absoluteURL(resp.Shares[i].URL)
+	}
+	return resp.Shares, nil
+}
+
+// RevokeShare revokes a share link
+func (c *Client) RevokeShare(id string) error {
+	return c.call(http.MethodDelete, "/api/shares", nil, map[string]string{"id": id}, nil)
+}
+
+// absoluteURL resolves a link the server returned relative to itself
+func (c *Client) absoluteURL(link string) string {
+	if strings.HasPrefix(link, "/") {
+		return c.server + link
+	}
+	return link
+}
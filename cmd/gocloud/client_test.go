@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"GoCloudComputingServers/server"
+)
+
+// newTestClient starts a server over a temporary data directory and returns
+// a client signed in as a new user
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := server.NewAPIHandler(server.Config{DataDir: dataDir, WebDir: t.TempDir()})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/register", h.HandleRegister)
+	mux.HandleFunc("/api/login", h.HandleLogin)
+	mux.HandleFunc("/api/files", h.HandleFiles)
+	mux.HandleFunc("/api/files/upload", h.HandleUpload)
+	mux.HandleFunc("/api/files/folder", h.HandleCreateFolder)
+	mux.HandleFunc("/api/files/download", h.HandleDownload)
+	mux.HandleFunc("/api/files/rename", h.HandleRename)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	client := newClient(ts.URL, "")
+	credentials := map[string]string{"username": "alice", "password": "alicepass1"}
+	if err := client.call(http.MethodPost, "/api/register", nil, credentials, nil); err != nil {
+		t.Fatal(err)
+	}
+	token, err := client.Login("alice", "alicepass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClient(ts.URL, token)
+}
+
+func TestClient(t *testing.T) {
+	client := newTestClient(t)
+
+	if err := client.Mkdir("/docs/"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.Upload("/docs", `say "hi".txt`, strings.NewReader("hello"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success {
+		t.Fatalf("upload: %+v", result)
+	}
+
+	item, err := client.Stat("docs/" + `say "hi".txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Bytes != 5 || item.IsDir() || item.ETag == "" {
+		t.Errorf("stat: %+v", item)
+	}
+	if _, err := client.Stat("/docs/missing.txt"); !isNotFound(err) {
+		t.Errorf("stat of a missing file: %v", err)
+	}
+
+	if err := client.Move("/docs/"+`say "hi".txt`, "/hello.txt"); err != nil {
+		t.Fatal(err)
+	}
+	var content bytes.Buffer
+	if _, err := client.Download("/hello.txt", &content); err != nil || content.String() != "hello" {
+		t.Fatalf("download: %q (%v)", content.String(), err)
+	}
+
+	if err := client.Delete("/", []string{"docs"}); err != nil {
+		t.Fatal(err)
+	}
+	items, err := client.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name != "hello.txt" {
+		t.Errorf("listing: %+v", items)
+	}
+
+	// Errors carry the server's status and message
+	_, err = client.Download("/missing.txt", &content)
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Status != http.StatusNotFound || apiErr.Message == "" {
+		t.Errorf("download of a missing file: %#v", err)
+	}
+}
+
+func TestRemotePaths(t *testing.T) {
+	for _, tt := range []struct {
+		path, dir, name string
+	}{
+		{"/", "root", "/"},
+		{"a.txt", "root", "a.txt"},
+		{"/docs/a.txt", "docs", "a.txt"},
+		{"docs/sub/../a.txt/", "docs", "a.txt"},
+	} {
+		if dir, name := splitRemote(tt.path); dir != tt.dir || name != tt.name {
+			t.Errorf("%s: got %s %s, want %s %s", tt.path, dir, name, tt.dir, tt.name)
+		}
+	}
+	if p := joinRemote("docs", "../..", "a.txt"); p != "/a.txt" {
+		t.Errorf("join: got %s", p)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Environment variables overriding the stored credentials, for scripts and CI
+const (
+	serverEnv = "GOCLOUD_SERVER"
+	keyEnv    = "GOCLOUD_API_KEY"
+	configEnv = "GOCLOUD_CONFIG"
+)
+
+// errNotLoggedIn is returned when no credentials are stored or given
+var errNotLoggedIn = errors.New("not logged in, run \"gocloud login\" first")
+
+// Credentials is what login stores: an API key created for this machine, so
+// the CLI keeps working after session tokens expire
+type Credentials struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Key      string `json:"key"`
+	KeyID    string `json:"keyId,omitempty"`
+}
+
+// configPath returns where the credentials are stored
+func configPath() (string, error) {
+	if p := os.Getenv(configEnv); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gocloud", "credentials.json"), nil
+}
+
+// loadCredentials reads the stored credentials, with the environment taking precedence
+func loadCredentials() (*Credentials, error) {
+	creds := &Credentials{}
+	if p, err := configPath(); err == nil {
+		if data, err := os.ReadFile(p); err == nil {
+			if err := json.Unmarshal(data, creds); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if server := os.Getenv(serverEnv); server != "" {
+		creds.Server = server
+	}
+	if key := os.Getenv(keyEnv); key != "" {
+		creds.Key = key
+		creds.KeyID = ""
+	}
+	if creds.Server == "" || creds.Key == "" {
+		return nil, errNotLoggedIn
+	}
+	return creds, nil
+}
+
+// saveCredentials stores credentials, readable by the user only
+func saveCredentials(creds *Credentials) error {
+	p, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0600)
+}
+
+// removeCredentials forgets the stored credentials
+func removeCredentials() error {
+	p, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
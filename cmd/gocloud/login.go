@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// runLogin signs in and stores the credentials. The password is only used to
+// create an API key for this machine, which is what gets stored.
+func runLogin(args []string) error {
+	fs := newFlags("login")
+	server := fs.String("server", "", "URL of the server (default: the one of the last login)")
+	username := fs.String("username", "", "Username (asked if not given)")
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from stdin")
+	key := fs.String("key", "", "Use an existing API key instead of a password")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	previous, _ := loadCredentials()
+	if *server == "" && previous != nil {
+		*server = previous.Server
+	}
+	if *server == "" {
+		return errors.New("the server is needed on first login (-server URL)")
+	}
+	if !strings.Contains(*server, "://") {
+		*server = "http://" + *server
+	}
+
+	creds := &Credentials{Server: strings.TrimRight(*server, "/"), Username: *username, Key: *key}
+	if creds.Key == "" {
+		stdin := bufio.NewReader(os.Stdin)
+		if creds.Username == "" {
+			fmt.Fprint(os.Stderr, "Username: ")
+			line, err := stdin.ReadString('\n')
+			if err != nil && line == "" {
+				return err
+			}
+			creds.Username = strings.TrimSpace(line)
+		}
+		password, err := readPassword(stdin, *passwordStdin)
+		if err != nil {
+			return err
+		}
+
+		token, err := newClient(creds.Server, "").Login(creds.Username, password)
+		if err != nil {
+			return err
+		}
+		session := newClient(creds.Server, token)
+		hostname, _ := os.Hostname()
+		creds.Key, creds.KeyID, err = session.CreateAPIKey("gocloud CLI on " + hostname)
+		session.Logout()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Check the key works before storing it
+	client := newClient(creds.Server, creds.Key)
+	if _, err := client.List("/"); err != nil {
+		return err
+	}
+
+	// A new login replaces the key of the previous one
+	if previous != nil && previous.KeyID != "" && previous.Server == creds.Server && previous.Username == creds.Username {
+		client.DeleteAPIKey(previous.KeyID)
+	}
+	if err := saveCredentials(creds); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"success": true, "server": creds.Server, "username": creds.Username})
+		return nil
+	}
+	if creds.Username != "" {
+		fmt.Printf("Logged in to %s as %s\n", creds.Server, creds.Username)
+	} else {
+		fmt.Printf("Logged in to %s\n", creds.Server)
+	}
+	return nil
+}
+
+// readPassword reads the password from the terminal without echoing it, or
+// from stdin when asked to
+func readPassword(stdin *bufio.Reader, fromStdin bool) (string, error) {
+	if fromStdin {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("no terminal to ask the password on, use -password-stdin")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
+
+// runLogout revokes the API key created by login and forgets the credentials
+func runLogout(args []string) error {
+	fs := newFlags("logout")
+	fs.Parse(args)
+
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	if creds.KeyID != "" {
+		if err := newClient(creds.Server, creds.Key).DeleteAPIKey(creds.KeyID); err != nil {
+			fmt.Fprintln(os.Stderr, "gocloud: the API key could not be revoked:", err)
+		}
+	}
+	if err := removeCredentials(); err != nil {
+		return err
+	}
+	return finish(map[string]bool{"success": true}, nil)
+}
@@ -0,0 +1,438 @@
+// Command gocloud is a command-line client for the file API of the server.
+//
+//	gocloud login -server http://localhost:8080
+//	gocloud put -r ./photos /backup
+//	gocloud ls -l /backup/photos
+//
+// Run "gocloud help" for the list of commands.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultParallel is how many files are transferred at once by default
+const defaultParallel = 4
+
+// jsonOutput makes commands print their result as JSON on stdout
+var jsonOutput bool
+
+// command is a subcommand of the CLI
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"login":  {"login [-server URL] [-username NAME] [-password-stdin | -key KEY]", "Sign in and store the credentials", runLogin},
+		"logout": {"logout", "Revoke and forget the stored credentials", runLogout},
+		"ls":     {"ls [-l] [-r] [PATH]", "List a folder", runList},
+		"put":    {"put [-r] [-p N] LOCAL... REMOTE", "Upload files and folders", runPut},
+		"get":    {"get [-r] [-p N] REMOTE... [LOCAL]", "Download files and folders", runGet},
+		"mkdir":  {"mkdir [-p] PATH...", "Create folders", runMkdir},
+		"mv":     {"mv SOURCE... DESTINATION", "Move or rename files and folders", runMove},
+		"rm":     {"rm [-r] [-f] PATH...", "Delete files and folders", runRemove},
+		"share":  {"share [-permission P] [-password PW] [-expires DURATION] [-max-downloads N] PATH | share -l | share -revoke ID", "Create, list and revoke share links", runShare},
+		"sync":   {"sync [-down] [-delete] [-dry-run] [-p N] LOCAL REMOTE", "Make a remote folder match a local one, or the reverse", runSync},
+		"bisync": {"bisync [-dry-run] [-p N] LOCAL REMOTE", "Keep a local and a remote folder in sync both ways", runBisync},
+	}
+}
+
+// errReported is an error whose details were already printed, as part of a
+// JSON result
+type errReported struct {
+	err error
+}
+
+func (e *errReported) Error() string {
+	return e.err.Error()
+}
+
+func main() {
+	flag.BoolVar(&jsonOutput, "json", false, "Print results as JSON")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" {
+		usage()
+		return
+	}
+	cmd, found := commands[args[0]]
+	if !found {
+		fmt.Fprintf(os.Stderr, "gocloud: unknown command %q\n\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(args[1:]); err != nil {
+		var reported *errReported
+		switch {
+		case errors.As(err, &reported) && jsonOutput:
+		case jsonOutput:
+			printJSON(map[string]interface{}{"success": false, "error": err.Error()})
+		default:
+			fmt.Fprintln(os.Stderr, "gocloud:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// usage prints the list of commands
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: gocloud [-json] COMMAND [ARGS]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-8s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintln(out, "\nRun \"gocloud COMMAND -h\" for the options of a command.")
+	fmt.Fprintf(out, "The server and API key can also be given in $%s and $%s.\n", serverEnv, keyEnv)
+}
+
+// newFlags creates the flag set of a command, which also takes -json
+func newFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "Print results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gocloud %s\n\n%s\n\n", commands[name].usage, commands[name].help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// printJSON prints v as indented JSON on stdout
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// finish prints the result of a command in JSON mode. An error is then only
+// reported by the exit status, as the result describes it.
+func finish(result interface{}, err error) error {
+	if !jsonOutput {
+		return err
+	}
+	printJSON(result)
+	if err != nil {
+		return &errReported{err}
+	}
+	return nil
+}
+
+// signedIn returns a client signed in with the stored credentials
+func signedIn() (*Client, error) {
+	creds, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return newClient(creds.Server, creds.Key), nil
+}
+
+// runList lists a folder, or describes a file
+func runList(args []string) error {
+	fs := newFlags("ls")
+	long := fs.Bool("l", false, "Show type, size and modification time")
+	recursive := fs.Bool("r", false, "List subfolders too")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target := joinRemote(fs.Arg(0))
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+	item, err := client.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	var items []Item
+	if item.IsDir() {
+		items, err = listTree(client, target, *recursive)
+		if err != nil {
+			return err
+		}
+	} else {
+		item.Path = target
+		items = []Item{*item}
+	}
+
+	if jsonOutput {
+		printJSON(map[string]interface{}{"success": true, "items": items})
+		return nil
+	}
+	for _, it := range items {
+		name := it.Name
+		if *recursive {
+			name = strings.TrimPrefix(strings.TrimPrefix(it.Path, target), "/")
+		}
+		if it.IsDir() {
+			name += "/"
+		}
+		if !*long {
+			fmt.Println(name)
+			continue
+		}
+		kind, size := "-", formatSize(it.Bytes)
+		if it.IsDir() {
+			kind, size = "d", ""
+		}
+		modified := it.ModifiedAt
+		if len(modified) > 19 {
+			modified = strings.Replace(modified[:19], "T", " ", 1)
+		}
+		fmt.Printf("%s %10s  %s  %s\n", kind, size, modified, name)
+	}
+	return nil
+}
+
+// listTree lists a remote folder, and its subfolders when recursive. The
+// paths of the items are set to their full remote path.
+func listTree(client *Client, dir string, recursive bool) ([]Item, error) {
+	items, err := client.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]Item, 0, len(items))
+	for _, item := range items {
+		item.Path = joinRemote(dir, item.Name)
+		all = append(all, item)
+		if recursive && item.IsDir() {
+			sub, err := listTree(client, item.Path, true)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, sub...)
+		}
+	}
+	return all, nil
+}
+
+// runPut uploads local files and folders
+func runPut(args []string) error {
+	fs := newFlags("put")
+	recursive := fs.Bool("r", false, "Upload folders with their content")
+	parallel := fs.Int("p", defaultParallel, "Number of files uploaded at once")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sources, dst := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+
+	// Like cp: into dst when it's a folder, as dst when there's a single source
+	dstItem, err := client.Stat(dst)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if (dstItem == nil || !dstItem.IsDir()) && len(sources) > 1 {
+		return fmt.Errorf("%s is not a folder", joinRemote(dst))
+	}
+
+	var transfers []*Transfer
+	var folders []string
+	for _, src := range sources {
+		sub, subFolders, err := planUpload(src, remoteTarget(dstItem, dst, filepath.Base(src)), *recursive)
+		if err != nil {
+			return err
+		}
+		transfers = append(transfers, sub...)
+		folders = append(folders, subFolders...)
+	}
+
+	for _, folder := range folders {
+		if err := client.Mkdir(folder); err != nil {
+			return fmt.Errorf("%s: %w", folder, err)
+		}
+	}
+	report, err := runTransfers("Uploaded", transfers, *parallel, func(t *Transfer, progress *Progress) error {
+		return upload(client, t, progress)
+	})
+	report.Folders = folders
+	return finish(report, err)
+}
+
+// runGet downloads remote files and folders
+func runGet(args []string) error {
+	fs := newFlags("get")
+	recursive := fs.Bool("r", false, "Download folders with their content")
+	parallel := fs.Int("p", defaultParallel, "Number of files downloaded at once")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sources, dst := fs.Args(), "."
+	if fs.NArg() > 1 {
+		sources, dst = fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+	}
+	if info, err := os.Stat(dst); len(sources) > 1 && (err != nil || !info.IsDir()) {
+		return fmt.Errorf("%s is not a folder", dst)
+	}
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+
+	var transfers []*Transfer
+	var folders []string
+	for _, src := range sources {
+		item, err := client.Stat(src)
+		if err != nil {
+			return err
+		}
+		sub, subFolders, err := planDownload(client, item, src, localTarget(dst, src), *recursive)
+		if err != nil {
+			return err
+		}
+		transfers = append(transfers, sub...)
+		folders = append(folders, subFolders...)
+	}
+
+	for _, folder := range folders {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			return err
+		}
+	}
+	report, err := runTransfers("Downloaded", transfers, *parallel, func(t *Transfer, progress *Progress) error {
+		return download(client, t, progress)
+	})
+	report.Folders = folders
+	return finish(report, err)
+}
+
+// runMkdir creates remote folders
+func runMkdir(args []string) error {
+	fs := newFlags("mkdir")
+	parents := fs.Bool("p", false, "Create parent folders as needed, and don't fail on existing folders")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+	for _, p := range fs.Args() {
+		if !*parents {
+			if _, err := client.Stat(p); err == nil {
+				return fmt.Errorf("%s already exists", joinRemote(p))
+			}
+			dir := path.Dir(joinRemote(p))
+			parent, err := client.Stat(dir)
+			if err != nil {
+				return err
+			}
+			if !parent.IsDir() {
+				return fmt.Errorf("%s is not a folder", dir)
+			}
+		}
+		if err := client.Mkdir(p); err != nil {
+			return fmt.Errorf("%s: %w", joinRemote(p), err)
+		}
+	}
+	return finish(map[string]bool{"success": true}, nil)
+}
+
+// runMove moves or renames remote items
+func runMove(args []string) error {
+	fs := newFlags("mv")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sources, dst := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+	dstItem, err := client.Stat(dst)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if (dstItem == nil || !dstItem.IsDir()) && len(sources) > 1 {
+		return fmt.Errorf("%s is not a folder", joinRemote(dst))
+	}
+
+	for _, src := range sources {
+		target := remoteTarget(dstItem, dst, path.Base(joinRemote(src)))
+		if err := client.Move(src, target); err != nil {
+			return fmt.Errorf("%s: %w", joinRemote(src), err)
+		}
+	}
+	return finish(map[string]bool{"success": true}, nil)
+}
+
+// runRemove deletes remote items
+func runRemove(args []string) error {
+	fs := newFlags("rm")
+	recursive := fs.Bool("r", false, "Delete folders with their content")
+	force := fs.Bool("f", false, "Ignore items that don't exist")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+	deleted := []string{}
+	for _, p := range fs.Args() {
+		item, err := client.Stat(p)
+		if isNotFound(err) && *force {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if joinRemote(p) == "/" {
+			return errors.New("the root folder can't be deleted")
+		}
+		if item.IsDir() && !*recursive {
+			return fmt.Errorf("%s is a folder (use -r)", joinRemote(p))
+		}
+
+		dir, name := splitRemote(p)
+		if err := client.Delete(dir, []string{name}); err != nil {
+			return fmt.Errorf("%s: %w", joinRemote(p), err)
+		}
+		deleted = append(deleted, joinRemote(p))
+	}
+	return finish(map[string]interface{}{"success": true, "deleted": deleted}, nil)
+}
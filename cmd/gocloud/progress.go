@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn
+const progressInterval = 200 * time.Millisecond
+
+// Progress shows how far a transfer of several files is on stderr, on a
+// single line redrawn in place. It stays quiet when stderr isn't a terminal
+// or output is JSON, so scripts only get the final result.
+type Progress struct {
+	enabled    bool
+	start      time.Time
+	totalFiles int64
+	totalBytes int64
+	files      atomic.Int64
+	bytes      atomic.Int64
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// newProgress starts showing the progress of a transfer
+func newProgress(totalFiles, totalBytes int64) *Progress {
+	p := &Progress{
+		enabled:    !jsonOutput && isTerminal(os.Stderr),
+		start:      time.Now(),
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		stop:       make(chan struct{}),
+	}
+	if p.enabled {
+		p.wg.Add(1)
+		go p.run()
+	}
+	return p
+}
+
+// run redraws the progress line until the transfer is over
+func (p *Progress) run() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.draw()
+		case <-p.stop:
+			p.draw()
+			fmt.Fprintln(os.Stderr)
+			return
+		}
+	}
+}
+
+// draw writes the progress line
+func (p *Progress) draw() {
+	done := p.bytes.Load()
+	rate := float64(done) / time.Since(p.start).Seconds()
+	fmt.Fprintf(os.Stderr, "\r%d/%d files  %s / %s  %s/s\033[K",
+		p.files.Load(), p.totalFiles, formatSize(done), formatSize(p.totalBytes), formatSize(int64(rate)))
+}
+
+// Log prints a line above the progress line
+func (p *Progress) Log(format string, args ...interface{}) {
+	if jsonOutput {
+		return
+	}
+	if p.enabled {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// FileDone counts a file as transferred
+func (p *Progress) FileDone() {
+	p.files.Add(1)
+}
+
+// Reader counts the bytes read from r as transferred
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+// Writer counts the bytes written to w as transferred
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	return &progressWriter{w: w, p: p}
+}
+
+// Done stops showing the progress
+func (p *Progress) Done() {
+	if p.enabled {
+		close(p.stop)
+		p.wg.Wait()
+	}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.bytes.Add(int64(n))
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.bytes.Add(int64(n))
+	return n, err
+}
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// formatSize formats a size in bytes for display
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// runParallel runs jobs on up to workers goroutines and returns the errors
+// of those that failed
+func runParallel(workers int, jobs []func() error) []error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		mu     sync.Mutex
+		errs   []error
+		wg     sync.WaitGroup
+		queued = make(chan func() error)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queued {
+				if err := job(); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queued <- job
+	}
+	close(queued)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// runShare creates a share link to a remote item, or lists or revokes links
+func runShare(args []string) error {
+	fs := newFlags("share")
+	list := fs.Bool("l", false, "List the share links")
+	revoke := fs.String("revoke", "", "Revoke the share link with this ID")
+	permission := fs.String("permission", "", "read (default), upload or drop, the last two for folders only")
+	password := fs.String("password", "", "Password visitors have to give")
+	expires := fs.Duration("expires", 0, "How long the link works, like 72h (default: no expiry)")
+	maxDownloads := fs.Int("max-downloads", 0, "How many downloads the link allows (default: unlimited)")
+	fs.Parse(args)
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *list:
+		shares, err := client.ListShares()
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			printJSON(map[string]interface{}{"success": true, "shares": shares})
+			return nil
+		}
+		for _, share := range shares {
+			fmt.Printf("%s  %-9s  %-10s  %s  %s\n", share.ID, share.Status, share.Permission, joinRemote(share.Path), share.URL)
+		}
+		return nil
+
+	case *revoke != "":
+		if err := client.RevokeShare(*revoke); err != nil {
+			return err
+		}
+		return finish(map[string]bool{"success": true}, nil)
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := ShareOptions{
+		Permission:   *permission,
+		Password:     *password,
+		MaxDownloads: *maxDownloads,
+	}
+	if *expires > 0 {
+		expiresAt := time.Now().Add(*expires).UTC()
+		opts.ExpiresAt = &expiresAt
+	}
+
+	share, err := client.CreateShare(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		printJSON(map[string]interface{}{"success": true, "share": share})
+		return nil
+	}
+	fmt.Println(share.URL)
+	return nil
+}
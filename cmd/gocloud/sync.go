@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localEntry is a file or folder of the local side of a sync
+type localEntry struct {
+	path string
+	info os.FileInfo
+}
+
+// runSync makes a remote folder match a local one, or the reverse with -down
+func runSync(args []string) error {
+	fs := newFlags("sync")
+	down := fs.Bool("down", false, "Make the local folder match the remote one instead")
+	del := fs.Bool("delete", false, "Delete what only exists on the side being updated")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be done")
+	parallel := fs.Int("p", defaultParallel, "Number of files transferred at once")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	local, remote := fs.Arg(0), joinRemote(fs.Arg(1))
+
+	client, err := signedIn()
+	if err != nil {
+		return err
+	}
+
+	locals, err := scanLocal(local, !*down)
+	if err != nil {
+		return err
+	}
+	remotes, err := scanRemote(client, remote, *down)
+	if err != nil {
+		return err
+	}
+
+	if *down {
+		return syncDown(client, local, remote, locals, remotes, *del, *dryRun, *parallel)
+	}
+	return syncUp(client, local, remote, locals, remotes, *del, *dryRun, *parallel)
+}
+
+// scanLocal lists a local folder tree by path relative to it, with "/"
+// separators. A missing folder is empty, unless it must exist.
+func scanLocal(root string, mustExist bool) (map[string]localEntry, error) {
+	entries := make(map[string]localEntry)
+	if info, err := os.Stat(root); err != nil {
+		if os.IsNotExist(err) && !mustExist {
+			return entries, nil
+		}
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", root)
+	}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		// Downloads in progress
+		if strings.HasPrefix(d.Name(), ".gocloud-") {
+			return nil
+		}
+
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Mode().IsRegular() {
+			entries[filepath.ToSlash(rel)] = localEntry{path: p, info: info}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// scanRemote lists a remote folder tree by path relative to it, the folder
+// itself being "". A missing folder is empty, unless it must exist.
+func scanRemote(client *Client, root string, mustExist bool) (map[string]Item, error) {
+	entries := make(map[string]Item)
+	item, err := client.Stat(root)
+	if err != nil {
+		if isNotFound(err) && !mustExist {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if !item.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", root)
+	}
+
+	items, err := listTree(client, root, true)
+	if err != nil {
+		return nil, err
+	}
+	entries[""] = *item
+	for _, item := range items {
+		rel := strings.TrimPrefix(strings.TrimPrefix(item.Path, root), "/")
+		if root == "/" && virtualFolders[strings.Split(rel, "/")[0]] {
+			continue
+		}
+		entries[rel] = item
+	}
+	return entries, nil
+}
+
+// virtualFolders are listed at the top of every user's tree to reach what
+// others share with them. Their names are reserved there, so no file or
+// folder of the user's own has them.
+var virtualFolders = map[string]bool{"Shared with me": true, "Team spaces": true}
+
+// sameContent reports whether a local file has the content of a remote one:
+// the same hash when the server knows it, the same modification time as left
+// by a download otherwise
+func sameContent(local localEntry, item Item) bool {
+	if local.info.Size() != item.Bytes {
+		return false
+	}
+	if item.SHA256 != "" {
+		sum, err := hashFile(local.path)
+		return err == nil && sum == item.SHA256
+	}
+	modified, err := time.Parse(time.RFC3339Nano, item.ModifiedAt)
+	return err == nil && local.info.ModTime().Equal(modified)
+}
+
+// hashFile returns the hex SHA-256 of a local file
+func hashFile(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sortedKeys returns the paths of a tree in order, so parents come before children
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// underDeleted reports whether p is inside one of the folders being deleted
+func underDeleted(p string, deleted []string) bool {
+	for _, d := range deleted {
+		if strings.HasPrefix(p, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// syncUp uploads what changed locally into the remote folder
+func syncUp(client *Client, local, remote string, locals map[string]localEntry, remotes map[string]Item, del, dryRun bool, parallel int) error {
+	var deleted, folders []string
+	var transfers []*Transfer
+
+	// What only exists remotely, or has another type there, goes first
+	for _, rel := range sortedKeys(remotes) {
+		if rel == "" || underDeleted(rel, deleted) {
+			continue
+		}
+		entry, exists := locals[rel]
+		if exists && entry.info.IsDir() == remotes[rel].IsDir() {
+			continue
+		}
+		if exists && !del {
+			return fmt.Errorf("%s is a file on one side and a folder on the other (use -delete to replace it)", joinRemote(remote, rel))
+		}
+		if del {
+			deleted = append(deleted, rel)
+		}
+	}
+
+	if _, exists := remotes[""]; !exists {
+		folders = append(folders, remote)
+	}
+	for _, rel := range sortedKeys(locals) {
+		entry := locals[rel]
+		// Items deleted above, or inside deleted folders, are gone
+		item, exists := remotes[rel]
+		if exists && underDeleted(rel+"/", deleted) {
+			exists = false
+		}
+		if entry.info.IsDir() {
+			if !exists {
+				folders = append(folders, joinRemote(remote, rel))
+			}
+			continue
+		}
+		if !exists || !sameContent(entry, item) {
+			transfers = append(transfers, &Transfer{Local: entry.path, Remote: joinRemote(remote, rel), Bytes: entry.info.Size()})
+		}
+	}
+	for i, rel := range deleted {
+		deleted[i] = joinRemote(remote, rel)
+	}
+
+	if dryRun {
+		return reportPlan(deleted, folders, transfers, "upload", func(t *Transfer) string { return t.Remote })
+	}
+	for _, p := range deleted {
+		dir, name := splitRemote(p)
+		if err := client.Delete(dir, []string{name}); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	for _, folder := range folders {
+		if err := client.Mkdir(folder); err != nil {
+			return fmt.Errorf("%s: %w", folder, err)
+		}
+	}
+	report, err := runTransfers("Uploaded", transfers, parallel, func(t *Transfer, progress *Progress) error {
+		return upload(client, t, progress)
+	})
+	report.Folders, report.Deleted = folders, deleted
+	return finish(report, err)
+}
+
+// syncDown downloads what changed remotely into the local folder
+func syncDown(client *Client, local, remote string, locals map[string]localEntry, remotes map[string]Item, del, dryRun bool, parallel int) error {
+	var deleted, folders []string
+	var transfers []*Transfer
+
+	for _, rel := range sortedKeys(locals) {
+		if underDeleted(rel, deleted) {
+			continue
+		}
+		item, exists := remotes[rel]
+		if exists && item.IsDir() == locals[rel].info.IsDir() {
+			continue
+		}
+		if exists && !del {
+			return fmt.Errorf("%s is a file on one side and a folder on the other (use -delete to replace it)", locals[rel].path)
+		}
+		if del {
+			deleted = append(deleted, rel)
+		}
+	}
+
+	folders = append(folders, local)
+	for _, rel := range sortedKeys(remotes) {
+		if rel == "" {
+			continue
+		}
+		item := remotes[rel]
+		// Items deleted above, or inside deleted folders, are gone
+		entry, exists := locals[rel]
+		if exists && underDeleted(rel+"/", deleted) {
+			exists = false
+		}
+		target := filepath.Join(local, filepath.FromSlash(rel))
+		if item.IsDir() {
+			if !exists {
+				folders = append(folders, target)
+			}
+			continue
+		}
+		if !exists || !sameContent(entry, item) {
+			transfers = append(transfers, remoteTransfer(&item, path.Join(remote, rel), target))
+		}
+	}
+	for i, rel := range deleted {
+		deleted[i] = filepath.Join(local, filepath.FromSlash(rel))
+	}
+
+	if dryRun {
+		return reportPlan(deleted, folders[1:], transfers, "download", func(t *Transfer) string { return t.Local })
+	}
+	for _, p := range deleted {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	for _, folder := range folders {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			return err
+		}
+	}
+	report, err := runTransfers("Downloaded", transfers, parallel, func(t *Transfer, progress *Progress) error {
+		return download(client, t, progress)
+	})
+	report.Folders, report.Deleted = folders, deleted
+	return finish(report, err)
+}
+
+// reportPlan shows what a sync would do
+func reportPlan(deleted, folders []string, transfers []*Transfer, verb string, target func(*Transfer) string) error {
+	if jsonOutput {
+		printJSON(&TransferReport{Success: true, Files: transfers, Folders: folders, Deleted: deleted})
+		return nil
+	}
+	for _, p := range deleted {
+		fmt.Println("delete", p)
+	}
+	for _, p := range folders {
+		fmt.Println("mkdir ", p)
+	}
+	for _, t := range transfers {
+		fmt.Println(verb, target(t))
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Transfer is a file to upload or download, and how it went
+type Transfer struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	modified time.Time    // Of the remote file, for downloads
+	cond     Precondition // The remote file being replaced must meet, for uploads
+}
+
+// TransferReport is the outcome of a put, get or sync
+type TransferReport struct {
+	Success bool        `json:"success"`
+	Files   []*Transfer `json:"files"`
+	Folders []string    `json:"folders,omitempty"` // Created
+	Deleted []string    `json:"deleted,omitempty"`
+	Bytes   int64       `json:"bytes"`
+}
+
+// runTransfers runs transfers on parallel workers with a progress line and
+// reports how they went. verb describes them in the summary, like "Uploaded".
+func runTransfers(verb string, transfers []*Transfer, parallel int, run func(*Transfer, *Progress) error) (*TransferReport, error) {
+	var total int64
+	for _, t := range transfers {
+		total += t.Bytes
+	}
+
+	progress := newProgress(int64(len(transfers)), total)
+	jobs := make([]func() error, len(transfers))
+	for i, t := range transfers {
+		t := t
+		jobs[i] = func() error {
+			err := run(t, progress)
+			if err != nil {
+				t.Error = err.Error()
+				progress.Log("%s: %v", t.Local, err)
+			}
+			progress.FileDone()
+			return err
+		}
+	}
+	errs := runParallel(parallel, jobs)
+	progress.Done()
+
+	report := &TransferReport{Success: len(errs) == 0, Files: transfers}
+	for _, t := range transfers {
+		if t.Error == "" {
+			report.Bytes += t.Bytes
+		}
+	}
+	if !jsonOutput {
+		fmt.Printf("%s %d of %d files (%s)\n", verb, len(transfers)-len(errs), len(transfers), formatSize(report.Bytes))
+	}
+	if len(errs) > 0 {
+		return report, fmt.Errorf("%d of %d files failed", len(errs), len(transfers))
+	}
+	return report, nil
+}
+
+// planUpload lists the files to upload from src, a local file or folder, to
+// dst, the remote path it's uploaded as, and the remote folders to create
+// first, parents before children
+func planUpload(src, dst string, recursive bool) ([]*Transfer, []string, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.IsDir() {
+		return []*Transfer{{Local: src, Remote: dst, Bytes: info.Size()}}, nil, nil
+	}
+	if !recursive {
+		return nil, nil, fmt.Errorf("%s is a folder (use -r)", src)
+	}
+
+	var transfers []*Transfer
+	var folders []string
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		remote := joinRemote(dst, filepath.ToSlash(rel))
+		if d.IsDir() {
+			folders = append(folders, remote)
+			return nil
+		}
+
+		// Links are followed to the files they point to, other special files are skipped
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			transfers = append(transfers, &Transfer{Local: p, Remote: remote, Bytes: info.Size()})
+		}
+		return nil
+	})
+	return transfers, folders, err
+}
+
+// upload sends a local file to the server, checking it arrived intact
+func upload(client *Client, t *Transfer, progress *Progress) error {
+	file, err := os.Open(t.Local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	src := progress.Reader(io.TeeReader(file, hash))
+	dir, name := splitRemote(t.Remote)
+	result, err := client.UploadIf(dir, name, src, t.Bytes, t.cond)
+	if err != nil {
+		return err
+	}
+
+	t.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if result.Size != t.Bytes {
+		return fmt.Errorf("the server stored %d bytes of %d, the file may have changed during the upload", result.Size, t.Bytes)
+	}
+	if result.SHA256 != "" && result.SHA256 != t.SHA256 {
+		return errors.New("checksum mismatch, the file was damaged on the way")
+	}
+	return nil
+}
+
+// planDownload lists the files to download from src, a remote item, to dst,
+// the local path it's saved as, and the local folders to create first
+func planDownload(client *Client, src *Item, srcPath, dst string, recursive bool) ([]*Transfer, []string, error) {
+	if !src.IsDir() {
+		return []*Transfer{remoteTransfer(src, srcPath, dst)}, nil, nil
+	}
+	if !recursive {
+		return nil, nil, fmt.Errorf("%s is a folder (use -r)", joinRemote(srcPath))
+	}
+
+	transfers := []*Transfer{}
+	folders := []string{dst}
+	items, err := client.List(srcPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range items {
+		item := &items[i]
+		sub, subFolders, err := planDownload(client, item, joinRemote(srcPath, item.Name), filepath.Join(dst, localName(item.Name)), true)
+		if err != nil {
+			return nil, nil, err
+		}
+		transfers = append(transfers, sub...)
+		folders = append(folders, subFolders...)
+	}
+	return transfers, folders, nil
+}
+
+// remoteTransfer describes the download of a remote file
+func remoteTransfer(item *Item, remote, local string) *Transfer {
+	modified, _ := time.Parse(time.RFC3339Nano, item.ModifiedAt)
+	return &Transfer{Local: local, Remote: joinRemote(remote), Bytes: item.Bytes, SHA256: item.SHA256, modified: modified}
+}
+
+// localName makes a remote name safe to use as a local file name
+func localName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// download saves a remote file, replacing the local file only once the
+// whole content arrived and matches the hash the server sent
+func download(client *Client, t *Transfer, progress *Progress) error {
+	dir := filepath.Dir(t.Local)
+	tmp, err := os.CreateTemp(dir, ".gocloud-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	digest, err := client.Download(t.Remote, progress.Writer(io.MultiWriter(tmp, hash)))
+	if err != nil {
+		return err
+	}
+	sum := hash.Sum(nil)
+	if expected, found := strings.CutPrefix(digest, "sha-256="); found && expected != base64.StdEncoding.EncodeToString(sum) {
+		return errors.New("checksum mismatch, the file was damaged on the way")
+	}
+	t.SHA256 = hex.EncodeToString(sum)
+
+	// Temporary files are private, the file itself isn't
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), t.Local); err != nil {
+		return err
+	}
+	if !t.modified.IsZero() {
+		os.Chtimes(t.Local, t.modified, t.modified)
+	}
+	return nil
+}
+
+// remoteTarget returns where an item called name goes when copied to dst,
+// the way cp does: into dst when it's a folder, as dst otherwise
+func remoteTarget(dstItem *Item, dst, name string) string {
+	if dstItem != nil && dstItem.IsDir() {
+		return joinRemote(dst, name)
+	}
+	return joinRemote(dst)
+}
+
+// localTarget is remoteTarget for local destinations
+func localTarget(dst, src string) string {
+	if info, err := os.Stat(dst); err == nil && info.IsDir() && joinRemote(src) != "/" {
+		return filepath.Join(dst, localName(path.Base(joinRemote(src))))
+	}
+	return dst
+}
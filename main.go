@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"path/filepath"
+	"time"
 
 	"GoCloudComputingServers/server"
 )
@@ -11,10 +13,30 @@ import (
 func main() {
 	// Define flags for configuration
 	port := flag.String("port", "8080", "Server port")
+	sftpPort := flag.String("sftp", "", "SFTP server port (empty = disabled)")
+	s3Port := flag.String("s3", "", "S3 gateway port (empty = disabled)")
 	webDir := flag.String("web", "./web", "Web files directory")
 	dataDir := flag.String("data", "./data", "Data directory")
+	quota := flag.Int64("quota", 0, "Default per-user storage quota in MB (0 = unlimited)")
+	maxUpload := flag.Int64("maxupload", 2048, "Maximum upload request size in MB (0 = unlimited)")
+	cas := flag.Bool("cas", false, "Store identical files of a user once, deduplicated by hash")
+	watch := flag.Bool("watch", false, "Report changes made to the files directory outside of the server")
+	scrub := flag.Duration("scrub", 24*time.Hour, "Interval between integrity checks of stored files (0 = disabled)")
+	keyFile := flag.String("keyfile", "", "File with master keys for encryption at rest (default: $"+server.MasterKeyEnv+")")
+	genKey := flag.Bool("genkey", false, "Print a new master key and exit")
+	encryptExisting := flag.Bool("encrypt-existing", false, "Encrypt files stored before encryption was enabled and exit")
+	rotateKeys := flag.Bool("rotate-keys", false, "Re-wrap all file keys with the first master key and exit")
 	flag.Parse()
 
+	if *genKey {
+		key, err := server.GenerateKey()
+		if err != nil {
+			log.Fatal("Error generating key:", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
 	// Convert to absolute paths
 	webPath, err := filepath.Abs(*webDir)
 	if err != nil {
@@ -26,14 +48,71 @@ func main() {
 		log.Fatal("Error getting absolute path of data directory:", err)
 	}
 
+	keys, err := server.LoadKeyRing(*keyFile)
+	if err != nil {
+		log.Fatal("Error loading master keys:", err)
+	}
+
+	cfg := server.Config{
+		Port:          *port,
+		SFTPPort:      *sftpPort,
+		S3Port:        *s3Port,
+		WebDir:        webPath,
+		DataDir:       dataPath,
+		DefaultQuota:  *quota << 20,
+		MaxUploadSize: *maxUpload << 20,
+		ScrubInterval: *scrub,
+		CAS:           *cas,
+		Watch:         *watch,
+		Keys:          keys,
+	}
+
+	// Maintenance commands run on the data directory while the server is stopped
+	if *encryptExisting {
+		count, err := server.EncryptExistingFiles(cfg)
+		if err != nil {
+			log.Fatalf("Error encrypting files after %d files: %v", count, err)
+		}
+		log.Printf("Encrypted %d files", count)
+		return
+	}
+	if *rotateKeys {
+		count, err := server.RotateKeys(cfg)
+		if err != nil {
+			log.Fatalf("Error rotating keys after %d files: %v", count, err)
+		}
+		log.Printf("Re-wrapped the keys of %d files with master key %s", count, keys.ActiveKeyID())
+		return
+	}
+
 	log.Println("=== File Manager Server ===")
 	log.Printf("Port: %s", *port)
+	if *sftpPort != "" {
+		log.Printf("SFTP Port: %s", *sftpPort)
+	}
+	if *s3Port != "" {
+		log.Printf("S3 Port: %s", *s3Port)
+	}
 	log.Printf("Web Directory: %s", webPath)
 	log.Printf("Data Directory: %s", dataPath)
+	if *quota > 0 {
+		log.Printf("Default Quota: %d MB", *quota)
+	} else {
+		log.Println("Default Quota: unlimited")
+	}
+	if *cas {
+		log.Println("Storage: content-addressable (deduplicated)")
+	}
+	if *watch {
+		log.Println("File watcher: enabled")
+	}
+	if keys != nil {
+		log.Printf("Encryption at rest: enabled (master key %s)", keys.ActiveKeyID())
+	}
 	log.Println("==========================")
 
 	// Start server
-	if err := server.StartServer(*port, webPath, dataPath); err != nil {
+	if err := server.StartServer(cfg); err != nil {
 		log.Fatal("Error starting server:", err)
 	}
 }
@@ -0,0 +1,758 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Folder access levels, each allowing everything the previous one does
+const (
+	AccessRead   = "read"   // List, download and preview
+	AccessWrite  = "write"  // Also upload, create, edit, rename and delete
+	AccessManage = "manage" // Also change who the folder is shared with
+)
+
+// SharedRoot is the virtual folder at the top of every user's tree holding the
+// folders other users shared with them, as SharedRoot/<owner>/<folder>
+const SharedRoot = "Shared with me"
+
+var (
+	// ErrAccessDenied is returned for operations the user's access doesn't allow
+	ErrAccessDenied = errors.New("access denied")
+	// ErrReservedName is returned for items named like the virtual folders of shared items and team spaces
+	ErrReservedName = errors.New("this name is reserved")
+)
+
+// accessRank orders the access levels, no access being 0
+func accessRank(access string) int {
+	switch access {
+	case AccessRead:
+		return 1
+	case AccessWrite:
+		return 2
+	case AccessManage:
+		return 3
+	}
+	return 0
+}
+
+// allows reports whether access includes required
+func allows(access, required string) bool {
+	return accessRank(access) > 0 && accessRank(access) >= accessRank(required)
+}
+
+// ACLEntry gives a user, or every member of a group, access to a folder
+type ACLEntry struct {
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Access string `json:"access"`
+}
+
+// FolderACL lists who a folder is shared with. Entries apply to everything
+// inside the folder too.
+type FolderACL struct {
+	ID      string     `json:"id"`
+	Owner   string     `json:"owner"`
+	Path    string     `json:"path"` // Relative to the owner's directory
+	Entries []ACLEntry `json:"entries"`
+	Created time.Time  `json:"created"`
+}
+
+// accessOf returns the access the ACL gives to a user in groups ("" = none)
+func (acl *FolderACL) accessOf(username string, groups []string) string {
+	best := ""
+	for _, entry := range acl.Entries {
+		if entry.User == username || entry.Group != "" && slices.Contains(groups, entry.Group) {
+			if accessRank(entry.Access) > accessRank(best) {
+				best = entry.Access
+			}
+		}
+	}
+	return best
+}
+
+// Mount is a folder shared with a user, as it appears in SharedRoot
+type Mount struct {
+	Owner  string
+	Path   string    // Relative to the owner's directory
+	Name   string    // Unique among the folders shared by the same owner
+	Access string    // What the user may do in the folder
+	Shared time.Time // When the folder was shared
+}
+
+// Location is a folder path seen by a user, resolved to the tree holding it
+type Location struct {
+	Owner  string // User or space whose directory holds the folder ("" for the virtual folders)
+	Path   string // Relative to the owner's directory
+	Access string // What the user may do in the folder
+	view   string // Path of the folder the user sees for root ("" in their own tree)
+	root   string // Shared folder the path is in, relative to the owner's directory ("" in a space)
+	sharer string // Owner listed by the virtual folder SharedRoot/<owner>
+}
+
+// Allows reports whether the user may do what required access allows in the folder
+func (loc *Location) Allows(required string) bool {
+	return allows(loc.Access, required)
+}
+
+// ViewPath translates a path relative to the owner's directory into the path
+// the user sees ("" if it isn't in the shared folder)
+func (loc *Location) ViewPath(ownerPath string) string {
+	switch {
+	case loc.view == "":
+		return ownerPath
+	case ownerPath == loc.root:
+		return loc.view
+	case loc.root == "":
+		return loc.view + "/" + ownerPath
+	case strings.HasPrefix(ownerPath, loc.root+"/"):
+		return loc.view + ownerPath[len(loc.root):]
+	}
+	return ""
+}
+
+// virtualParts splits a path below the virtual folder root into its elements,
+// which are empty for root itself. It returns nil for paths outside root.
+func virtualParts(root, p string) []string {
+	clean := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+	if clean == root {
+		return []string{}
+	}
+	if rest, found := strings.CutPrefix(clean, root+"/"); found {
+		return strings.Split(rest, "/")
+	}
+	return nil
+}
+
+// ACLStore keeps the access control lists of shared folders in a single JSON
+// file. Access is computed from them on every request, so a revoked entry
+// applies at once, to users already browsing the folder too. ACLs follow
+// their folder when it is renamed and disappear when it is deleted.
+type ACLStore struct {
+	file        string
+	fileManager *FileManager
+	groupsOf    func(username string) []string      // Returns the groups a user belongs to
+	groupRole   func(group, username string) string // Returns the role of a user in a group
+	acls        map[string]*FolderACL               // By ID
+	mu          sync.RWMutex
+}
+
+// NewACLStore loads the ACLs kept in file and subscribes the store to fm's changes
+func NewACLStore(file string, fm *FileManager, groupsOf func(username string) []string, groupRole func(group, username string) string) *ACLStore {
+	as := &ACLStore{
+		file:        file,
+		fileManager: fm,
+		groupsOf:    groupsOf,
+		groupRole:   groupRole,
+		acls:        make(map[string]*FolderACL),
+	}
+
+	if data, err := os.ReadFile(file); err == nil {
+		var acls []*FolderACL
+		if err := json.Unmarshal(data, &acls); err != nil {
+			log.Printf("Error loading ACLs: %v", err)
+		}
+		for _, acl := range acls {
+			as.acls[acl.ID] = acl
+		}
+	}
+
+	fm.OnChange(as.apply)
+	return as
+}
+
+// apply moves or removes the ACLs of a folder after a change
+func (as *ACLStore) apply(event FileEvent) {
+	if event.Type != EventRename && event.Type != EventDelete {
+		return
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	changed := false
+	for id, acl := range as.acls {
+		if acl.Owner != event.Username {
+			continue
+		}
+		switch {
+		case event.Type == EventDelete && withinRel(event.Path, acl.Path):
+			delete(as.acls, id)
+			changed = true
+		case event.Type == EventRename && withinRel(event.OldPath, acl.Path):
+			acl.Path = event.Path + strings.TrimPrefix(acl.Path, event.OldPath)
+			changed = true
+		case event.Type == EventRename && withinRel(event.Path, acl.Path):
+			// The folder was replaced by the rename
+			delete(as.acls, id)
+			changed = true
+		}
+	}
+	if changed {
+		if err := as.saveLocked(); err != nil {
+			log.Printf("Error saving ACLs: %v", err)
+		}
+	}
+}
+
+// Get returns the ACL of a folder (relative to the owner's directory), nil if it isn't shared
+func (as *ACLStore) Get(owner, rel string) *FolderACL {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	for _, acl := range as.acls {
+		if acl.Owner == owner && acl.Path == rel {
+			copied := *acl
+			copied.Entries = append([]ACLEntry(nil), acl.Entries...)
+			return &copied
+		}
+	}
+	return nil
+}
+
+// Set replaces the entries of a folder's ACL. Without entries the folder is no longer shared.
+func (as *ACLStore) Set(owner, rel string, entries []ACLEntry) (*FolderACL, error) {
+	if rel == "" || rel == "." {
+		return nil, errors.New("the home folder can't be shared")
+	}
+
+	// A user or group appears once, the last entry wins
+	merged := make([]ACLEntry, 0, len(entries))
+	index := make(map[string]int)
+	for _, entry := range entries {
+		if (entry.User == "") == (entry.Group == "") {
+			return nil, errors.New("each entry needs either a user or a group")
+		}
+		if accessRank(entry.Access) == 0 {
+			return nil, fmt.Errorf("invalid access %q", entry.Access)
+		}
+		if entry.User == owner {
+			return nil, errors.New("the owner always has full access")
+		}
+		key := "user:" + entry.User
+		if entry.Group != "" {
+			key = "group:" + entry.Group
+		}
+		if i, exists := index[key]; exists {
+			merged[i] = entry
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, entry)
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	var acl *FolderACL
+	for _, existing := range as.acls {
+		if existing.Owner == owner && existing.Path == rel {
+			acl = existing
+			break
+		}
+	}
+
+	if len(merged) == 0 {
+		if acl == nil {
+			return nil, nil
+		}
+		delete(as.acls, acl.ID)
+		return nil, as.saveLocked()
+	}
+
+	if acl == nil {
+		acl = &FolderACL{ID: randomHex(8), Owner: owner, Path: rel, Created: time.Now()}
+		as.acls[acl.ID] = acl
+	}
+	acl.Entries = merged
+	if err := as.saveLocked(); err != nil {
+		return nil, err
+	}
+
+	copied := *acl
+	copied.Entries = append([]ACLEntry(nil), merged...)
+	return &copied, nil
+}
+
+// SharedBy returns the ACLs of the folders a user shares, by path
+func (as *ACLStore) SharedBy(owner string) []FolderACL {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	acls := []FolderACL{}
+	for _, acl := range as.acls {
+		if acl.Owner == owner {
+			copied := *acl
+			copied.Entries = append([]ACLEntry(nil), acl.Entries...)
+			acls = append(acls, copied)
+		}
+	}
+	sort.Slice(acls, func(i, j int) bool {
+		return acls[i].Path < acls[j].Path
+	})
+	return acls
+}
+
+// Access returns what a user may do in a path of the owner's tree: everything
+// in their own tree, elsewhere the highest access given by their group's
+// space and the ACLs of the folders containing it ("" = none)
+func (as *ACLStore) Access(username, owner, rel string) string {
+	if username == owner {
+		return AccessManage
+	}
+	groups := as.groupsOf(username)
+	best := as.spaceAccess(username, owner)
+
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	if access := as.accessLocked(username, groups, owner, rel); accessRank(access) > accessRank(best) {
+		best = access
+	}
+	return best
+}
+
+// accessLocked is Access for another user's tree (caller must hold as.mu)
+func (as *ACLStore) accessLocked(username string, groups []string, owner, rel string) string {
+	best := ""
+	for _, acl := range as.acls {
+		if acl.Owner != owner || !withinRel(acl.Path, rel) {
+			continue
+		}
+		if access := acl.accessOf(username, groups); accessRank(access) > accessRank(best) {
+			best = access
+		}
+	}
+	return best
+}
+
+// Mounts returns the folders shared with a user, by owner and in the order
+// they were shared. Folders of the spaces they're in are reached from there.
+func (as *ACLStore) Mounts(username string) []Mount {
+	groups := as.groupsOf(username)
+
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	var acls []*FolderACL
+	for _, acl := range as.acls {
+		if acl.Owner != username && acl.accessOf(username, groups) != "" && as.spaceAccess(username, acl.Owner) == "" {
+			acls = append(acls, acl)
+		}
+	}
+	sort.Slice(acls, func(i, j int) bool {
+		if acls[i].Owner != acls[j].Owner {
+			return acls[i].Owner < acls[j].Owner
+		}
+		if !acls[i].Created.Equal(acls[j].Created) {
+			return acls[i].Created.Before(acls[j].Created)
+		}
+		return acls[i].ID < acls[j].ID
+	})
+
+	mounts := make([]Mount, 0, len(acls))
+	taken := make(map[string]bool)
+	for _, acl := range acls {
+		base := path.Base(acl.Path)
+		name := base
+		for n := 2; taken[acl.Owner+"/"+name]; n++ {
+			name = fmt.Sprintf("%s (%d)", base, n)
+		}
+		taken[acl.Owner+"/"+name] = true
+
+		mounts = append(mounts, Mount{
+			Owner:  acl.Owner,
+			Path:   acl.Path,
+			Name:   name,
+			Access: as.accessLocked(username, groups, acl.Owner, acl.Path),
+			Shared: acl.Created,
+		})
+	}
+	return mounts
+}
+
+// Resolve finds where a folder path seen by a user is. Paths below SharedRoot
+// lead to the folders shared with them, paths below SpacesRoot to the spaces
+// of their groups, or are the virtual folders listing them; anything else is
+// in their own tree.
+func (as *ACLStore) Resolve(username, p string) (*Location, error) {
+	if parts := virtualParts(SpacesRoot, p); parts != nil {
+		return as.resolveSpace(username, parts)
+	}
+	parts := virtualParts(SharedRoot, p)
+	if parts == nil {
+		return &Location{Owner: username, Path: p, Access: AccessManage}, nil
+	}
+	if len(parts) == 0 {
+		return &Location{Path: SharedRoot, Access: AccessRead, view: SharedRoot}, nil
+	}
+
+	owner := parts[0]
+	for _, mount := range as.Mounts(username) {
+		if mount.Owner != owner {
+			continue
+		}
+		if len(parts) == 1 {
+			return &Location{Path: SharedRoot + "/" + owner, Access: AccessRead, view: SharedRoot + "/" + owner, sharer: owner}, nil
+		}
+		if mount.Name != parts[1] {
+			continue
+		}
+
+		rel := path.Join(append([]string{mount.Path}, parts[2:]...)...)
+		access := as.Access(username, owner, rel)
+		if access == "" {
+			return nil, ErrAccessDenied
+		}
+		return &Location{
+			Owner:  owner,
+			Path:   rel,
+			Access: access,
+			view:   SharedRoot + "/" + owner + "/" + mount.Name,
+			root:   mount.Path,
+		}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// saveLocked writes all ACLs to the store file (caller must hold as.mu)
+func (as *ACLStore) saveLocked() error {
+	acls := make([]*FolderACL, 0, len(as.acls))
+	for _, acl := range as.acls {
+		acls = append(acls, acl)
+	}
+	sort.Slice(acls, func(i, j int) bool {
+		return acls[i].Created.Before(acls[j].Created)
+	})
+
+	data, err := json.MarshalIndent(acls, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(as.file), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(as.file, data)
+}
+
+// locate resolves a folder path of the user for an operation needing the given
+// access there. It writes the error response and returns nil when it isn't allowed.
+func (h *APIHandler) locate(w http.ResponseWriter, username, folder, access string) *Location {
+	loc, err := h.acls.Resolve(username, folder)
+	if err == nil && (loc.Owner == "" || !loc.Allows(access)) {
+		// The virtual folders can only be listed
+		err = ErrAccessDenied
+	}
+	if err != nil {
+		writeAccessError(w, err)
+		return nil
+	}
+	return loc
+}
+
+// locateFolder is locate for reading a folder that has to exist. It also
+// returns the folder's path relative to the owner's directory, "" being the
+// directory itself. It writes the error response and returns nil when the
+// folder can't be reached.
+func (h *APIHandler) locateFolder(w http.ResponseWriter, username, folder string) (*Location, string) {
+	loc := h.locate(w, username, folder, AccessRead)
+	if loc == nil {
+		return nil, ""
+	}
+	fullPath, err := h.fileManager.resolvePath(loc.Owner, loc.Path)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(fullPath); err == nil && !info.IsDir() {
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		writeAccessError(w, os.ErrNotExist)
+		return nil, ""
+	}
+
+	rel := h.fileManager.relPath(loc.Owner, fullPath)
+	if rel == "." {
+		rel = ""
+	}
+	return loc, rel
+}
+
+// locateItem resolves the item called name inside a folder of the user, for
+// operations that only read it. It returns the folder holding the item and
+// the item's name there: the items of the virtual folders are the shared
+// folders themselves. It writes the error response and returns nil when the
+// item can't be reached.
+func (h *APIHandler) locateItem(w http.ResponseWriter, username, folder, name string) (*Location, string) {
+	loc, err := h.acls.Resolve(username, folder)
+	if err != nil {
+		writeAccessError(w, err)
+		return nil, ""
+	}
+	if loc.Owner != "" {
+		return loc, name
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		writeAccessError(w, errors.New("invalid name"))
+		return nil, ""
+	}
+	item, err := h.acls.Resolve(username, path.Join(folder, name))
+	if err == nil && (item.Owner == "" || item.Path == "") {
+		// Neither virtual folders nor whole spaces are items of a folder
+		err = ErrAccessDenied
+	}
+	if err != nil {
+		writeAccessError(w, err)
+		return nil, ""
+	}
+
+	parent := *item
+	parent.Path = path.Dir(item.Path)
+	if parent.Path == "." {
+		parent.Path = ""
+	}
+	return &parent, path.Base(item.Path)
+}
+
+// writeAccessError reports why a path of the user couldn't be used
+func writeAccessError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+		status = http.StatusForbidden
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+		err = errors.New("folder not found")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// showItem presents an item of loc's tree the way the user sees it: with the
+// path they reach it by, and only the permissions their access gives
+func (h *APIHandler) showItem(username string, loc *Location, item *FileItem) {
+	// Items of the virtual folders are already built that way
+	if loc.Owner == username || loc.Owner == "" {
+		return
+	}
+
+	rel := item.Path
+	item.Path = loc.ViewPath(rel)
+	item.Owner = loc.Owner
+
+	// Shared folders themselves are only renamed or deleted by their owner
+	parentWritable := loc.Allows(AccessWrite) && rel != loc.root
+	item.Permissions.Delete = item.Permissions.Delete && parentWritable
+	item.Permissions.Rename = item.Permissions.Rename && parentWritable
+	item.Permissions.Write = item.Permissions.Write && allows(h.acls.Access(username, loc.Owner, rel), AccessWrite)
+}
+
+// virtualFolder builds the item of a virtual folder, or of a folder listed in one
+func virtualFolder(name, folder string, modified time.Time) FileItem {
+	return FileItem{
+		ID:          name,
+		Name:        name,
+		Type:        "folder",
+		Path:        folder,
+		Modified:    modified.Format("2006-01-02"),
+		ModifiedAt:  modified.Format(time.RFC3339Nano),
+		MimeType:    "inode/directory",
+		Permissions: ItemPermissions{Read: true},
+	}
+}
+
+// sharedRootItem returns the item of SharedRoot listed in the user's home
+// folder, nil while nothing is shared with them
+func (h *APIHandler) sharedRootItem(username string) *FileItem {
+	mounts := h.acls.Mounts(username)
+	if len(mounts) == 0 {
+		return nil
+	}
+
+	var latest time.Time
+	for _, mount := range mounts {
+		if mount.Shared.After(latest) {
+			latest = mount.Shared
+		}
+	}
+	item := virtualFolder(SharedRoot, SharedRoot, latest)
+	return &item
+}
+
+// listShared lists a virtual folder: SharedRoot holds a folder per user sharing
+// folders with the user, and SharedRoot/<owner> the folders that user shares.
+// They are small, so they are sorted by name and returned in a single page.
+func (h *APIHandler) listShared(username string, loc *Location, opts ListOptions) (*ListPage, error) {
+	var items []FileItem
+	for _, mount := range h.acls.Mounts(username) {
+		if loc.sharer == "" {
+			// One folder stands for all the folders of an owner, dated by the latest
+			item := virtualFolder(mount.Owner, loc.view+"/"+mount.Owner, mount.Shared)
+			item.Owner = mount.Owner
+			if n := len(items); n > 0 && items[n-1].Name == mount.Owner {
+				items[n-1] = item
+			} else {
+				items = append(items, item)
+			}
+			continue
+		}
+
+		if mount.Owner != loc.sharer {
+			continue
+		}
+		fullPath, err := h.fileManager.resolvePath(mount.Owner, mount.Path)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		item := h.fileManager.newFileItem(mount.Owner, fullPath, info, false)
+		item.ID, item.Name = mount.Name, mount.Name
+		item.Path = loc.view + "/" + mount.Name
+		item.Owner = mount.Owner
+		item.Permissions.Write = allows(mount.Access, AccessWrite)
+		items = append(items, item)
+	}
+	return virtualPage(items, opts)
+}
+
+// virtualPage filters and sorts the items of a virtual folder into a single page
+func virtualPage(items []FileItem, opts ListOptions) (*ListPage, error) {
+	pattern := strings.ToLower(opts.Pattern)
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%w: bad pattern", ErrInvalidListOptions)
+	}
+	if opts.Cursor != "" {
+		return nil, ErrInvalidCursor
+	}
+
+	page := &ListPage{Items: []FileItem{}}
+	for _, item := range items {
+		if opts.Type == "file" {
+			break
+		}
+		if pattern != "" {
+			if matched, _ := filepath.Match(pattern, strings.ToLower(item.Name)); !matched {
+				continue
+			}
+		}
+		page.Items = append(page.Items, item)
+		if modified, err := time.Parse(time.RFC3339Nano, item.ModifiedAt); err == nil && modified.After(page.LastModified) {
+			page.LastModified = modified
+		}
+	}
+	sort.Slice(page.Items, func(i, j int) bool {
+		a, b := strings.ToLower(page.Items[i].Name), strings.ToLower(page.Items[j].Name)
+		if opts.Desc {
+			return a > b
+		}
+		return a < b
+	})
+	page.Total = len(page.Items)
+	return page, nil
+}
+
+// HandleACL manages who folders are shared with. Without a name, GET lists
+// the folders the user shares. With the path and name of a folder, GET reads
+// its ACL, PUT replaces its entries and DELETE stops sharing it, all of which
+// need manage access to the folder.
+func (h *APIHandler) HandleACL(w http.ResponseWriter, r *http.Request) {
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && query.Get("name") == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"folders": h.acls.SharedBy(username),
+		})
+		return
+	case r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	loc, name := h.locateItem(w, username, query.Get("path"), query.Get("name"))
+	if loc == nil {
+		return
+	}
+	fullPath, err := h.fileManager.resolveItem(loc.Owner, loc.Path, name)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+	if info, err := os.Stat(fullPath); err != nil || !info.IsDir() {
+		writeAccessError(w, os.ErrNotExist)
+		return
+	}
+	rel := h.fileManager.relPath(loc.Owner, fullPath)
+	if !allows(h.acls.Access(username, loc.Owner, rel), AccessManage) {
+		writeAccessError(w, ErrAccessDenied)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Entries []ACLEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Error processing request", http.StatusBadRequest)
+			return
+		}
+		for _, entry := range req.Entries {
+			switch {
+			case entry.User != "" && !h.authManager.UserExists(entry.User):
+				err = fmt.Errorf("user not found: %s", entry.User)
+			case entry.Group != "" && !h.authManager.GroupExists(entry.Group):
+				err = fmt.Errorf("group not found: %s", entry.Group)
+			}
+		}
+		if err == nil {
+			_, err = h.acls.Set(loc.Owner, rel, req.Entries)
+		}
+	case http.MethodDelete:
+		_, err = h.acls.Set(loc.Owner, rel, nil)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	entries := []ACLEntry{}
+	if acl := h.acls.Get(loc.Owner, rel); acl != nil {
+		entries = acl.Entries
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"owner":   loc.Owner,
+		"path":    loc.ViewPath(rel),
+		"entries": entries,
+	})
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestACLStore creates an ACL store over a file manager holding files,
+// where alice is a member of the group team
+func newTestACLStore(t *testing.T, files ...string) (*ACLStore, *FileManager) {
+	t.Helper()
+	fm, _ := newTestFileManager(t, files...)
+	groupsOf := func(username string) []string {
+		if username == "alice" {
+			return []string{"team"}
+		}
+		return nil
+	}
+	groupRole := func(group, username string) string { return "" }
+	return NewACLStore(filepath.Join(t.TempDir(), "acls.json"), fm, groupsOf, groupRole), fm
+}
+
+func TestACLResolve(t *testing.T) {
+	as, fm := newTestACLStore(t,
+		"alice/docs/notes.txt",
+		"bob/Projects/plan/a.txt",
+		"bob/Archive/Projects/old.txt",
+		"bob/Private/secret.txt",
+	)
+	for _, share := range []struct {
+		path    string
+		entries []ACLEntry
+	}{
+		{"Projects", []ACLEntry{{User: "alice", Access: AccessRead}}},
+		{"Projects/plan", []ACLEntry{{Group: "team", Access: AccessWrite}}},
+		{"Archive/Projects", []ACLEntry{{User: "alice", Access: AccessRead}, {User: "carol", Access: AccessManage}}},
+	} {
+		if _, err := as.Set("bob", share.path, share.entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path   string
+		owner  string
+		rel    string
+		access string
+		err    error
+	}{
+		{"docs", "alice", "docs", AccessManage, nil},
+		{SharedRoot, "", SharedRoot, AccessRead, nil},
+		{SharedRoot + "/bob", "", SharedRoot + "/bob", AccessRead, nil},
+		{SharedRoot + "/bob/Projects", "bob", "Projects", AccessRead, nil},
+		// Access given by a group to a subfolder adds to the folder's
+		{SharedRoot + "/bob/Projects/plan", "bob", "Projects/plan", AccessWrite, nil},
+		{SharedRoot + "/bob/plan", "bob", "Projects/plan", AccessWrite, nil},
+		// Folders of the same name are told apart in the order they were shared
+		{SharedRoot + "/bob/Projects (2)", "bob", "Archive/Projects", AccessRead, nil},
+		{SharedRoot + "/bob/Private", "", "", "", os.ErrNotExist},
+		{SharedRoot + "/bob/Projects/../Private", "", "", "", os.ErrNotExist},
+		{SharedRoot + "/bob/Archive", "", "", "", os.ErrNotExist},
+		{SharedRoot + "/carol", "", "", "", os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			loc, err := as.Resolve("alice", tt.path)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if loc.Owner != tt.owner || loc.Path != tt.rel || loc.Access != tt.access {
+				t.Errorf("got %s %s %s, want %s %s %s", loc.Owner, loc.Path, loc.Access, tt.owner, tt.rel, tt.access)
+			}
+		})
+	}
+
+	loc, err := as.Resolve("alice", SharedRoot+"/bob/Projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view := loc.ViewPath("Projects/plan/a.txt"); view != SharedRoot+"/bob/Projects/plan/a.txt" {
+		t.Errorf("view path: got %q", view)
+	}
+	if view := loc.ViewPath("Private/secret.txt"); view != "" {
+		t.Errorf("view path outside the shared folder: got %q", view)
+	}
+
+	// ACLs follow their folder, and revoking applies at once
+	if err := fm.RenameItem("bob", "", "Projects", "Work"); err != nil {
+		t.Fatal(err)
+	}
+	if loc, err := as.Resolve("alice", SharedRoot+"/bob/Work/plan"); err != nil || loc.Path != "Work/plan" {
+		t.Errorf("renamed folder: got %+v (%v)", loc, err)
+	}
+	if _, err := as.Set("bob", "Work", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.Resolve("alice", SharedRoot+"/bob/Work"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("revoked folder: got %v", err)
+	}
+	if loc, err := as.Resolve("alice", SharedRoot+"/bob/plan"); err != nil || loc.Access != AccessWrite {
+		t.Errorf("subfolder still shared: got %+v (%v)", loc, err)
+	}
+}
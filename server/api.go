@@ -1,36 +1,113 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// maxListLimit caps the page size of directory listings
+const maxListLimit = 5000
+
 // APIHandler manages API endpoints
 type APIHandler struct {
-	authManager *AuthManager
-	fileManager *FileManager
-	dataDir     string
+	authManager   *AuthManager
+	fileManager   *FileManager
+	dataDir       string
+	maxUploadSize int64 // Maximum upload request size in bytes (0 = unlimited)
+	tusStore      *TusStore
+	s3Uploads     *S3UploadStore
+	extractLimits ExtractLimits
+	contentIndex  *ContentIndex
+	checksums     *ChecksumStore
+	journal       *ChangeJournal
+	events        *EventHub
+	blobs         *BlobStore // nil unless content-addressable storage is enabled
+	thumbnails    *ThumbnailService
+	shares        *ShareStore
+	acls          *ACLStore
+	audit         *AuditLog
+	davLocks      sync.Map // WebDAV lock systems by username
+	webDir        string
 }
 
 // NewAPIHandler creates a new API handler
-func NewAPIHandler(dataDir string) *APIHandler {
-	filesDir := filepath.Join(dataDir, "files")
+func NewAPIHandler(cfg Config) *APIHandler {
+	filesDir := filepath.Join(cfg.DataDir, "files")
+
+	authManager := NewAuthManager(cfg.DataDir, cfg.DefaultQuota)
+	fileManager := NewFileManager(filesDir, authManager.GetQuota)
+	if cfg.Keys != nil {
+		fileManager.UseEncryption(cfg.Keys)
+	}
+
+	checksums := NewChecksumStore(filepath.Join(cfg.DataDir, "checksums"), fileManager)
+	if cfg.ScrubInterval > 0 {
+		go checksums.RunScrubber(cfg.ScrubInterval)
+	}
+
+	var blobs *BlobStore
+	if cfg.CAS {
+		blobs = NewBlobStore(filepath.Join(cfg.DataDir, "cas"), fileManager)
+		go blobs.RunGC(blobGCInterval)
+	}
 
-	// Path to credentials file in admin folder
-	adminDir := filepath.Join(filesDir, "admin")
-	credsFile := filepath.Join(adminDir, "USER_CREDS.json")
+	tusStore := NewTusStore(filepath.Join(cfg.DataDir, "tus"), fileManager)
+	go tusStore.RunSweeper(tusSweepInterval)
+	s3Uploads := NewS3UploadStore(filepath.Join(cfg.DataDir, "s3uploads"), fileManager)
+	go s3Uploads.RunSweeper(s3SweepInterval)
+
+	// Changes made behind the server's back become regular events
+	if cfg.Watch {
+		watcher, err := NewWatcher(fileManager)
+		if err != nil {
+			log.Printf("Failed to watch the files directory: %v", err)
+		} else {
+			go watcher.Run()
+		}
+	}
 
 	return &APIHandler{
-		authManager: NewAuthManager(credsFile),
-		fileManager: NewFileManager(filesDir),
-		dataDir:     dataDir,
+		authManager:   authManager,
+		fileManager:   fileManager,
+		dataDir:       cfg.DataDir,
+		maxUploadSize: cfg.MaxUploadSize,
+		tusStore:      tusStore,
+		s3Uploads:     s3Uploads,
+		contentIndex:  NewContentIndex(filepath.Join(cfg.DataDir, "index"), fileManager),
+		checksums:     checksums,
+		journal:       NewChangeJournal(filepath.Join(cfg.DataDir, "journal"), fileManager),
+		events:        NewEventHub(fileManager),
+		blobs:         blobs,
+		thumbnails:    NewThumbnailService(filepath.Join(cfg.DataDir, "thumbnails"), fileManager),
+		shares:        NewShareStore(filepath.Join(cfg.DataDir, "shares.json"), fileManager),
+		acls:          NewACLStore(filepath.Join(cfg.DataDir, "acls.json"), fileManager, authManager.GroupsOf, authManager.GroupRole),
+		audit:         NewAuditLog(filepath.Join(cfg.DataDir, "audit.jsonl")),
+		webDir:        cfg.WebDir,
+		extractLimits: DefaultExtractLimits,
 	}
 }
 
+// isBadItem reports whether an error is about the path or name of an item
+// given by the client
+func isBadItem(err error) bool {
+	return errors.Is(err, ErrReservedName) || errors.Is(err, ErrInvalidName) || errors.Is(err, ErrInvalidPath)
+}
+
+// credentialsPath returns the path of the credentials file, in the admin folder
+func credentialsPath(dataDir string) string {
+	return filepath.Join(dataDir, "files", "admin", "USER_CREDS.json")
+}
+
 // LoginRequest represents a login request
 type LoginRequest struct {
 	Username string `json:"username"`
@@ -150,6 +227,14 @@ func (h *APIHandler) getUsernameFromToken(r *http.Request) (string, error) {
 		token = strings.TrimPrefix(token, "Bearer ")
 	}
 
+	// Scripts may use an API key instead of a session token
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		if username, ok := h.authManager.AuthenticateKey(token); ok {
+			return username, nil
+		}
+		return "", errors.New("invalid API key")
+	}
+
 	t, err := h.authManager.ValidateToken(token)
 	if err != nil {
 		return "", err
@@ -186,7 +271,80 @@ func (h *APIHandler) handleListFiles(w http.ResponseWriter, r *http.Request, use
 		path = "root"
 	}
 
-	items, err := h.fileManager.ListFiles(username, path)
+	query := r.URL.Query()
+	opts := DefaultListOptions
+	opts.Sort = query.Get("sort")
+	opts.Desc = query.Get("order") == "desc"
+	opts.Type = query.Get("type")
+	opts.Pattern = query.Get("pattern")
+	opts.Cursor = query.Get("cursor")
+	if query.Get("foldersFirst") == "false" {
+		opts.FoldersFirst = false
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid limit"})
+			return
+		}
+		opts.Limit = min(n, maxListLimit)
+	}
+
+	loc, err := h.acls.Resolve(username, path)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+
+	var page *ListPage
+	switch {
+	case loc.view == SpacesRoot:
+		page, err = h.listSpaces(username, opts)
+	case loc.Owner == "":
+		page, err = h.listShared(username, loc, opts)
+	default:
+		page, err = h.fileManager.ListFilesPage(loc.Owner, loc.Path, opts)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidCursor) || errors.Is(err, ErrInvalidListOptions):
+			status = http.StatusBadRequest
+		case os.IsNotExist(err):
+			status = http.StatusNotFound
+			err = errors.New("folder not found")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	for i := range page.Items {
+		h.showItem(username, loc, &page.Items[i])
+	}
+
+	// The folders shared with the user and their team spaces are reached from their home folder
+	if loc.Owner == username && (path == "root" || path == "/") && opts.Cursor == "" && opts.Type != "file" {
+		for _, item := range []*FileItem{h.spacesRootItem(username), h.sharedRootItem(username)} {
+			if item == nil {
+				continue
+			}
+			if matched, _ := filepath.Match(strings.ToLower(opts.Pattern), strings.ToLower(item.Name)); opts.Pattern == "" || matched {
+				page.Items = append([]FileItem{*item}, page.Items...)
+				page.Total++
+			}
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"success":    true,
+		"items":      page.Items,
+		"total":      page.Total,
+		"nextCursor": page.NextCursor,
+	})
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -194,11 +352,20 @@ func (h *APIHandler) handleListFiles(w http.ResponseWriter, r *http.Request, use
 		return
 	}
 
+	// Listings are revalidated on every use, unchanged ones aren't sent again
+	etag := contentETag(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", page.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Authorization")
+	if notModified(r, etag, page.LastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"items":   items,
-	})
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	w.Write(append(body, '\n'))
 }
 
 // handleDeleteFiles deletes files
@@ -220,9 +387,28 @@ func (h *APIHandler) handleDeleteFiles(w http.ResponseWriter, r *http.Request, u
 		return
 	}
 
-	if err := h.fileManager.DeleteItems(username, req.Path, req.Names); err != nil {
+	loc := h.locate(w, username, req.Path, AccessWrite)
+	if loc == nil {
+		return
+	}
+
+	// Every item must still be the version the client saw, If-Match lists their ETags
+	if err := h.fileManager.checkItems(loc.Owner, loc.Path, req.Names, r.Header.Get("If-Match")); err != nil {
+		writePreconditionFailed(w)
+		return
+	}
+
+	err := h.fileManager.DeleteItems(loc.Owner, loc.Path, req.Names)
+	for _, name := range req.Names {
+		h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditDelete, Owner: loc.Owner, Path: auditPath(loc.Path, name)}, err)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if isBadItem(err) {
+			status = http.StatusBadRequest
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
@@ -231,7 +417,18 @@ func (h *APIHandler) handleDeleteFiles(w http.ResponseWriter, r *http.Request, u
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
-// HandleUpload processes file uploads
+// UploadResult describes the outcome of a single uploaded file
+type UploadResult struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HandleUpload processes file uploads.
+// The multipart body is streamed part by part straight into the destination
+// folder, so nothing is buffered in memory or spooled to temporary files.
 func (h *APIHandler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -253,68 +450,225 @@ func (h *APIHandler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 		path = "root"
 	}
 
-	// Parse multipart form
-	err = r.ParseMultipartForm(10 << 20) // 10 MB max
-	if err != nil {
-		http.Error(w, "Error processing form", http.StatusBadRequest)
+	loc := h.locate(w, username, path, AccessWrite)
+	if loc == nil {
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
+	h.receiveUpload(w, r, loc.Owner, loc.Path, uploadOptions{audit: AuditEntry{Protocol: AuditHTTP, User: username}})
+}
+
+// uploadOptions controls how receiveUpload stores the files of a request
+type uploadOptions struct {
+	keepExisting bool       // Give files a unique name instead of replacing existing ones
+	hideNames    bool       // Report files under the name they were sent with, not the one they got
+	namePrefix   string     // Prepended to the name of every file
+	maxFileSize  int64      // Largest file accepted (0 = unlimited)
+	maxBytes     int64      // Total bytes the request may store (0 = unlimited)
+	audit        AuditEntry // Who uploads, recorded in the audit log for every file
+}
+
+var (
+	// ErrFileTooLarge is returned for a file above the size limit of an upload
+	ErrFileTooLarge = errors.New("file exceeds the size limit")
+	// ErrUploadLimit is returned when an upload goes over the total it may store
+	ErrUploadLimit = errors.New("upload limit reached")
+)
+
+// cappedReader fails with err once more than remaining bytes are read
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (cr *cappedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > cr.remaining+1 {
+		p = p[:cr.remaining+1]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if cr.remaining < 0 {
+		return n, cr.err
+	}
+	return n, err
+}
+
+// receiveUpload streams the files of a multipart request into path (relative
+// to the user directory, who is charged for them) and writes the JSON report
+// of the upload. It returns
+// how many bytes and files were stored.
+func (h *APIHandler) receiveUpload(w http.ResponseWriter, r *http.Request, username, path string, uploadOpts uploadOptions) (int64, int) {
+	// Reject requests that are known to be too big before reading them
+	if h.maxUploadSize > 0 {
+		if r.ContentLength > h.maxUploadSize {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Upload too large"})
+			return 0, 0
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize)
+	}
+
+	if r.ContentLength > 0 {
+		used, quota, err := h.fileManager.GetUsage(username)
+		if err == nil && quota > 0 && used+r.ContentLength > quota {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInsufficientStorage)
+			json.NewEncoder(w).Encode(map[string]string{"error": ErrQuotaExceeded.Error()})
+			return 0, 0
+		}
+	}
+
+	// Digest headers on the request describe its only file, parts can carry their own
+	requestDigests, err := ParseDigests(r.Header)
+	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "No files uploaded"})
-		return
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return 0, 0
 	}
 
-	// Get user directory
-	userDir := h.fileManager.GetUserDir(username)
+	// Preconditions on the request protect the file its only part replaces
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
 
-	// Normalize path
-	if path == "root" || path == "/" {
-		path = userDir
-	} else {
-		path = filepath.Join(userDir, path)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Error processing form", http.StatusBadRequest)
+		return 0, 0
 	}
 
+	results := []UploadResult{}
 	uploaded := 0
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
+	var stored int64
+	status := http.StatusOK
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			continue
+			if status = uploadErrorStatus(err); status == 0 {
+				status = http.StatusBadRequest
+			}
+			break
 		}
 
-		dstPath := filepath.Join(path, fileHeader.Filename)
-
-		// Check security
-		absUserDir, _ := filepath.Abs(userDir)
-		absDst, _ := filepath.Abs(dstPath)
-		if !strings.HasPrefix(absDst, absUserDir) {
-			file.Close()
+		if part.FormName() != "files" || part.FileName() == "" {
+			part.Close()
 			continue
 		}
 
-		dst, err := os.Create(dstPath)
+		result := UploadResult{Name: part.FileName()}
+		opts := SaveOptions{
+			IfMatch:     part.Header.Get("If-Match"),
+			IfNoneMatch: part.Header.Get("If-None-Match"),
+		}
+		opts.Expect, err = ParseDigests(http.Header(part.Header))
+		if err == nil && opts.Expect.Empty() && !requestDigests.Empty() {
+			if len(results) > 0 {
+				err = errors.New("Digest headers on the request only apply to single file uploads")
+			}
+			opts.Expect = requestDigests
+		}
+		if err == nil && opts.IfMatch == "" && opts.IfNoneMatch == "" && (ifMatch != "" || ifNoneMatch != "") {
+			if len(results) > 0 {
+				err = errors.New("Precondition headers on the request only apply to single file uploads")
+			}
+			opts.IfMatch, opts.IfNoneMatch = ifMatch, ifNoneMatch
+		}
+		name := uploadOpts.namePrefix + part.FileName()
+		if err == nil && uploadOpts.keepExisting {
+			name, err = h.fileManager.freeName(username, path, name)
+			if !uploadOpts.hideNames {
+				result.Name = name
+			}
+		}
+		var src io.Reader = part
+		if uploadOpts.maxFileSize > 0 {
+			src = &cappedReader{r: src, remaining: uploadOpts.maxFileSize, err: ErrFileTooLarge}
+		}
+		if uploadOpts.maxBytes > 0 {
+			src = &cappedReader{r: src, remaining: uploadOpts.maxBytes - stored, err: ErrUploadLimit}
+		}
+		var size int64
+		if err == nil {
+			size, result.SHA256, err = h.fileManager.SaveFile(username, path, name, src, opts)
+			entry := uploadOpts.audit
+			entry.Action, entry.Owner, entry.Path = AuditUpload, username, auditPath(path, name)
+			h.audit.Record(entry, err)
+		}
+		part.Close()
 		if err != nil {
-			file.Close()
+			result.Error = err.Error()
+			results = append(results, result)
+
+			// Stop when the request itself can't go on
+			if s := uploadErrorStatus(err); s != 0 {
+				status = s
+				break
+			}
 			continue
 		}
 
-		_, err = io.Copy(dst, file)
-		file.Close()
-		dst.Close()
+		result.Size = size
+		result.Success = true
+		results = append(results, result)
+		uploaded++
+		stored += size
+	}
 
-		if err == nil {
-			uploaded++
+	// Nobody is listening anymore, partial files were already removed
+	if r.Context().Err() != nil {
+		return stored, uploaded
+	}
+
+	if len(results) == 0 && status == http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No files uploaded"})
+		return 0, 0
+	}
+
+	response := map[string]interface{}{
+		"success":  status == http.StatusOK && uploaded == len(results),
+		"uploaded": uploaded,
+		"files":    results,
+	}
+	switch status {
+	case http.StatusInsufficientStorage:
+		response["error"] = ErrQuotaExceeded.Error()
+	case http.StatusRequestEntityTooLarge:
+		response["error"] = "Upload too large"
+		if len(results) > 0 && results[len(results)-1].Error == ErrUploadLimit.Error() {
+			response["error"] = ErrUploadLimit.Error()
 		}
+	case http.StatusBadRequest:
+		response["error"] = "Upload interrupted"
+	case http.StatusPreconditionFailed:
+		response["error"] = "The item was changed by someone else"
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":  true,
-		"uploaded": uploaded,
-	})
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+	return stored, uploaded
+}
+
+// uploadErrorStatus maps errors that abort a whole upload to an HTTP status (0 if it can go on)
+func uploadErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.As(err, &maxBytesErr), errors.Is(err, ErrUploadLimit):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, context.Canceled):
+		return http.StatusBadRequest
+	}
+	return 0
 }
 
 // HandleCreateFolder processes folder creation
@@ -350,9 +704,20 @@ func (h *APIHandler) HandleCreateFolder(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := h.fileManager.CreateFolder(username, req.Path, req.FolderName); err != nil {
+	loc := h.locate(w, username, req.Path, AccessWrite)
+	if loc == nil {
+		return
+	}
+
+	err = h.fileManager.CreateFolder(loc.Owner, loc.Path, req.FolderName)
+	h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditMkdir, Owner: loc.Owner, Path: auditPath(loc.Path, req.FolderName)}, err)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if isBadItem(err) {
+			status = http.StatusBadRequest
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
@@ -378,29 +743,32 @@ func (h *APIHandler) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	path := r.URL.Query().Get("path")
-	name := r.URL.Query().Get("name")
+	names := r.URL.Query()["name"]
+	format := r.URL.Query().Get("format")
 
-	if name == "" {
+	if len(names) == 0 || names[0] == "" {
 		http.Error(w, "File name not specified", http.StatusBadRequest)
 		return
 	}
 
-	// Get user directory
-	userDir := h.fileManager.GetUserDir(username)
-
-	// Normalize path
-	if path == "" || path == "root" || path == "/" {
-		path = userDir
-	} else {
-		path = filepath.Join(userDir, path)
+	// Several items are always sent as an archive
+	if len(names) > 1 {
+		if loc := h.locate(w, username, path, AccessRead); loc != nil {
+			for _, name := range names {
+				h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditDownload, Owner: loc.Owner, Path: auditPath(loc.Path, name)}, nil)
+			}
+			h.serveArchive(w, loc.Owner, loc.Path, names, format)
+		}
+		return
 	}
 
-	filePath := filepath.Join(path, name)
+	loc, name := h.locateItem(w, username, path, names[0])
+	if loc == nil {
+		return
+	}
 
-	// Check security
-	absUserDir, _ := filepath.Abs(userDir)
-	absFilePath, _ := filepath.Abs(filePath)
-	if !strings.HasPrefix(absFilePath, absUserDir) {
+	filePath, err := h.fileManager.resolveItem(loc.Owner, loc.Path, name)
+	if err != nil {
 		http.Error(w, "Invalid path", http.StatusForbidden)
 		return
 	}
@@ -411,14 +779,45 @@ func (h *APIHandler) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
-	if info.IsDir() {
-		http.Error(w, "Cannot download a folder", http.StatusBadRequest)
+	h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditDownload, Owner: loc.Owner, Path: auditPath(loc.Path, name)}, nil)
+	if info.IsDir() || format != "" {
+		h.serveArchive(w, loc.Owner, loc.Path, []string{name}, format)
 		return
 	}
 
-	// Serve the file
-	w.Header().Set("Content-Disposition", "attachment; filename="+name)
-	http.ServeFile(w, r, filePath)
+	h.serveFile(w, r, loc.Owner, filePath, info, "attachment; filename="+names[0])
+}
+
+// serveFile sends a stored file of username's tree with its validators, digest and
+// Content-Disposition, decrypting it on the fly. ServeContent answers If-None-Match, If-Modified-Since, If-Range
+// and ranges from them, and only the requested chunks are decrypted.
+func (h *APIHandler) serveFile(w http.ResponseWriter, r *http.Request, username, fullPath string, info os.FileInfo, disposition string) {
+	// Let clients check what they received against the stored hash
+	if sum := h.checksums.Lookup(username, h.fileManager.relPath(username, fullPath), info); sum != "" {
+		w.Header().Set("Digest", digestHeader(sum))
+	}
+
+	file, err := h.fileManager.openFile(fullPath)
+	if err != nil {
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Catch unreadable files before the response starts, later chunks are checked while sent
+	if file.Size() > 0 {
+		if _, err := file.ReadAt(make([]byte, 1), 0); err != nil {
+			log.Printf("Error reading %s: %v", fullPath, err)
+			http.Error(w, "Error reading file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Authorization")
+	w.Header().Set("Content-Disposition", disposition)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
 }
 
 // HandleRename processes file renaming
@@ -438,9 +837,10 @@ func (h *APIHandler) HandleRename(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Path    string `json:"path"`
-		OldName string `json:"oldName"`
-		NewName string `json:"newName"`
+		Path        string `json:"path"`
+		OldName     string `json:"oldName"`
+		NewName     string `json:"newName"`
+		Destination string `json:"destination"` // Folder to move the item to (default: path)
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -455,9 +855,46 @@ func (h *APIHandler) HandleRename(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.fileManager.RenameItem(username, req.Path, req.OldName, req.NewName); err != nil {
+	loc := h.locate(w, username, req.Path, AccessWrite)
+	if loc == nil {
+		return
+	}
+
+	// Don't rename an item changed since the client last saw it
+	if err := h.fileManager.checkItems(loc.Owner, loc.Path, []string{req.OldName}, r.Header.Get("If-Match")); err != nil {
+		writePreconditionFailed(w)
+		return
+	}
+
+	if req.Destination != "" {
+		// Items can only be moved within the tree that holds them
+		dest := h.locate(w, username, req.Destination, AccessWrite)
+		if dest == nil {
+			return
+		}
+		if dest.Owner != loc.Owner {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Items can only be moved within the tree that holds them"})
+			return
+		}
+		err = h.fileManager.MoveItem(loc.Owner, loc.Path, req.OldName, dest.Path, req.NewName)
+		h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditMove, Owner: loc.Owner, Path: auditPath(loc.Path, req.OldName), Target: auditPath(dest.Path, req.NewName)}, err)
+	} else {
+		err = h.fileManager.RenameItem(loc.Owner, loc.Path, req.OldName, req.NewName)
+		h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditRename, Owner: loc.Owner, Path: auditPath(loc.Path, req.OldName), Target: auditPath(loc.Path, req.NewName)}, err)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case isBadItem(err):
+			status = http.StatusBadRequest
+		case os.IsNotExist(err):
+			status = http.StatusNotFound
+			err = errors.New("item not found")
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
@@ -465,3 +902,132 @@ func (h *APIHandler) HandleRename(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
+
+// HandleUsage returns the storage usage and quota of the user
+func (h *APIHandler) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	used, quota, err := h.fileManager.GetUsage(username)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":       true,
+		"used":          used,
+		"quota":         quota,
+		"usedFormatted": formatSize(used),
+	}
+	if quota > 0 {
+		response["quotaFormatted"] = formatSize(quota)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleQuota changes the storage quota of a user (PUT). Admin only.
+func (h *APIHandler) HandleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+	if username != "admin" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Admin only"})
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Quota    int64  `json:"quota"` // Bytes, 0 = server default, negative = unlimited
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.authManager.SetQuota(req.Username, req.Quota); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	quota := h.authManager.GetQuota(req.Username)
+	response := map[string]interface{}{
+		"success": true,
+		"quota":   quota,
+	}
+	if quota > 0 {
+		response["quotaFormatted"] = formatSize(quota)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveArchive streams the named items inside path as a ZIP or tar.gz archive
+func (h *APIHandler) serveArchive(w http.ResponseWriter, username, path string, names []string, format string) {
+	if format == "" {
+		format = FormatZip
+	}
+	if !ValidArchiveFormat(format) {
+		http.Error(w, "Invalid archive format", http.StatusBadRequest)
+		return
+	}
+
+	// Check every item before the response starts, errors can't be reported afterwards
+	for _, name := range names {
+		itemPath, err := h.fileManager.resolveItem(username, path, name)
+		if err != nil {
+			http.Error(w, "Invalid path", http.StatusForbidden)
+			return
+		}
+		if _, err := os.Stat(itemPath); err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	archiveName := "download." + format
+	if len(names) == 1 {
+		archiveName = names[0] + "." + format
+	}
+
+	if format == FormatZip {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName}))
+
+	if err := h.fileManager.WriteArchive(w, username, path, names, format); err != nil {
+		log.Printf("Error streaming archive for %s: %v", username, err)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestAPIHandler creates a server over a temporary data directory, with
+// one user, alice
+func newTestAPIHandler(t *testing.T) *APIHandler {
+	t.Helper()
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := NewAPIHandler(Config{DataDir: dataDir, WebDir: t.TempDir()})
+	if err := h.authManager.CreateUser("alice", "alicepass1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.fileManager.EnsureUserDir("alice"); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// writeUserFile writes a file of alice's directory
+func writeUserFile(t *testing.T, h *APIHandler, path, content string) {
+	t.Helper()
+	fullPath := filepath.Join(h.fileManager.baseDir, "alice", filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// apiRequest sends a request to an API handler, signed in as username
+func apiRequest(t *testing.T, h *APIHandler, handler http.HandlerFunc, username, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := h.authManager.GenerateToken(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// uploadRequest uploads one file into alice's root folder
+func uploadRequest(t *testing.T, h *APIHandler, name, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("files", name)
+	part.Write([]byte(content))
+	mw.Close()
+
+	token, err := h.authManager.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.HandleUpload(w, r)
+	return w
+}
+
+func TestAdminQuota(t *testing.T) {
+	h := newTestAPIHandler(t)
+
+	if w := apiRequest(t, h, h.HandleQuota, "alice", http.MethodPut, "/api/admin/quota", `{"username": "alice", "quota": -1}`); w.Code != http.StatusForbidden {
+		t.Errorf("quota set by a user: status %d, want 403", w.Code)
+	}
+	if w := apiRequest(t, h, h.HandleQuota, "admin", http.MethodPut, "/api/admin/quota", `{"username": "nobody", "quota": 10}`); w.Code != http.StatusNotFound {
+		t.Errorf("quota of an unknown user: status %d, want 404", w.Code)
+	}
+
+	w := apiRequest(t, h, h.HandleQuota, "admin", http.MethodPut, "/api/admin/quota", `{"username": "alice", "quota": 10}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set quota: status %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Quota int64 `json:"quota"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Quota != 10 {
+		t.Errorf("set quota: got %d (%v), want 10", resp.Quota, err)
+	}
+	if w := uploadRequest(t, h, "big.txt", "more than ten bytes"); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload over the quota: status %d, want 507", w.Code)
+	}
+
+	// Negative quotas are unlimited
+	if w := apiRequest(t, h, h.HandleQuota, "admin", http.MethodPut, "/api/admin/quota", `{"username": "alice", "quota": -1}`); w.Code != http.StatusOK {
+		t.Fatalf("remove quota: status %d", w.Code)
+	}
+	if w := uploadRequest(t, h, "big.txt", "more than ten bytes"); w.Code != http.StatusOK {
+		t.Errorf("upload without quota: status %d %s", w.Code, w.Body)
+	}
+}
+
+// Uploads are written to disk as they arrive, whatever their size
+func TestUploadStreams(t *testing.T) {
+	h := newTestAPIHandler(t)
+	content := strings.Repeat("0123456789abcdef", 1<<20)
+
+	if w := uploadRequest(t, h, "big.bin", content); w.Code != http.StatusOK {
+		t.Fatalf("upload: status %d %s", w.Code, w.Body)
+	}
+	stored, err := os.ReadFile(filepath.Join(h.fileManager.baseDir, "alice", "big.bin"))
+	if err != nil || string(stored) != content {
+		t.Fatalf("stored %d bytes (%v), want %d", len(stored), err, len(content))
+	}
+
+	// An interrupted upload leaves nothing behind
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("files", "cut.bin")
+	part.Write([]byte(content))
+	token, err := h.authManager.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", bytes.NewReader(body.Bytes()[:body.Len()/2]))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.HandleUpload(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("interrupted upload: status %d, want 400", w.Code)
+	}
+	entries, err := os.ReadDir(filepath.Join(h.fileManager.baseDir, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("alice's directory holds %d entries, want big.bin only", len(entries))
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, so they can be told apart from session tokens
+const apiKeyPrefix = "gck_"
+
+// ErrAPIKeyNotFound is returned for unknown API keys
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey lets scripts and clients such as WebDAV sign in as a user without
+// their password. Only a hash of the key is kept, the key itself is shown once.
+type APIKey struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash,omitempty"` // Hex SHA-256 of the key
+	Created  time.Time `json:"created"`
+}
+
+// hashAPIKey returns the hex SHA-256 of a key. Keys are random, so they need no salt.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey creates a key for a user and returns it with its secret value
+func (am *AuthManager) CreateAPIKey(username, name string) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("the key needs a name")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	id := randomHex(8)
+	key := apiKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.users[username]; !exists {
+		return nil, "", errors.New("user not found")
+	}
+	apiKey := &APIKey{ID: id, Username: username, Name: name, Hash: hashAPIKey(key), Created: time.Now()}
+	am.apiKeys[id] = apiKey
+	if err := am.saveAPIKeysLocked(); err != nil {
+		delete(am.apiKeys, id)
+		return nil, "", err
+	}
+
+	copied := *apiKey
+	copied.Hash = ""
+	return &copied, key, nil
+}
+
+// ListAPIKeys returns the keys of a user, oldest first, without their hashes
+func (am *AuthManager) ListAPIKeys(username string) []APIKey {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, apiKey := range am.apiKeys {
+		if apiKey.Username == username {
+			copied := *apiKey
+			copied.Hash = ""
+			keys = append(keys, copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// DeleteAPIKey revokes one of a user's keys
+func (am *AuthManager) DeleteAPIKey(username, id string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	apiKey, exists := am.apiKeys[id]
+	if !exists || apiKey.Username != username {
+		return ErrAPIKeyNotFound
+	}
+	delete(am.apiKeys, id)
+	return am.saveAPIKeysLocked()
+}
+
+// AuthenticateKey returns the user an API key belongs to
+func (am *AuthManager) AuthenticateKey(key string) (string, bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found {
+		return "", false
+	}
+	id, _, found := strings.Cut(rest, "_")
+	if !found {
+		return "", false
+	}
+
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	apiKey, exists := am.apiKeys[id]
+	if !exists || subtle.ConstantTimeCompare([]byte(apiKey.Hash), []byte(hashAPIKey(key))) != 1 {
+		return "", false
+	}
+	if _, exists := am.users[apiKey.Username]; !exists {
+		return "", false
+	}
+	return apiKey.Username, true
+}
+
+// AuthenticateSecret checks the password of a user, or one of their API keys
+// given in its place by clients that only know of passwords
+func (am *AuthManager) AuthenticateSecret(username, secret string) bool {
+	if am.Authenticate(username, secret) {
+		return true
+	}
+	owner, valid := am.AuthenticateKey(secret)
+	return valid && owner == username
+}
+
+// loadAPIKeys reads the API keys file, if it exists
+func (am *AuthManager) loadAPIKeys() error {
+	if am.keysFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(am.keysFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, apiKey := range keys {
+		am.apiKeys[apiKey.ID] = apiKey
+	}
+	return nil
+}
+
+// saveAPIKeysLocked writes the API keys to the JSON file (caller must hold am.mu)
+func (am *AuthManager) saveAPIKeysLocked() error {
+	if am.keysFile == "" {
+		return nil
+	}
+
+	keys := make([]*APIKey, 0, len(am.apiKeys))
+	for _, apiKey := range am.apiKeys {
+		keys = append(keys, apiKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(am.keysFile), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(am.keysFile, data)
+}
+
+// HandleAPIKeys lists (GET), creates (POST) and revokes (DELETE) the user's API keys
+func (h *APIHandler) HandleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"keys":    h.authManager.ListAPIKeys(username),
+		})
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := h.authManager.DeleteAPIKey(username, req.ID); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+
+	apiKey, key, err := h.authManager.CreateAPIKey(username, req.Name)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"key":     key,
+		"apiKey":  apiKey,
+	})
+}
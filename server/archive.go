@@ -0,0 +1,196 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Archive formats
+const (
+	FormatZip    = "zip"
+	FormatTar    = "tar"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+)
+
+// archiveWriter adds entries to an archive being streamed
+type archiveWriter interface {
+	AddDir(name string, info fs.FileInfo) error
+	AddFile(name string, info fs.FileInfo, content io.Reader) error
+	Close() error
+}
+
+// WriteArchive streams the items called names inside path (relative to user directory)
+// to w as an archive. Folders are added recursively, one file at a time, so memory
+// usage doesn't depend on the size of the tree.
+func (fm *FileManager) WriteArchive(w io.Writer, username, path string, names []string, format string) error {
+	items := make([]string, 0, len(names))
+	for _, name := range names {
+		itemPath, err := fm.resolveItem(username, path, name)
+		if err != nil {
+			return err
+		}
+		items = append(items, itemPath)
+	}
+
+	var aw archiveWriter
+	switch format {
+	case FormatZip:
+		aw = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	case FormatTarGz:
+		gw := gzip.NewWriter(w)
+		aw = &tarArchiveWriter{gw: gw, tw: tar.NewWriter(gw)}
+	default:
+		return errors.New("unsupported archive format")
+	}
+
+	for _, itemPath := range items {
+		if err := fm.addToArchive(aw, itemPath); err != nil {
+			return err
+		}
+	}
+
+	return aw.Close()
+}
+
+// ValidArchiveFormat reports whether format can be produced by WriteArchive
+func ValidArchiveFormat(format string) bool {
+	return format == FormatZip || format == FormatTarGz
+}
+
+// addToArchive adds a file or folder (recursively) to the archive, named relative to its parent
+func (fm *FileManager) addToArchive(aw archiveWriter, root string) error {
+	base := filepath.Dir(root)
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip uploads in progress and anything that isn't a plain file or folder (e.g. symlinks)
+		if strings.HasPrefix(d.Name(), uploadTempPrefix) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			return aw.AddDir(name, info)
+		}
+
+		file, err := fm.openFile(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return aw.AddFile(name, sizedFileInfo{info, file.Size()}, file)
+	})
+}
+
+// sizedFileInfo reports the size of a file's content instead of its size on disk
+type sizedFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i sizedFileInfo) Size() int64 {
+	return i.size
+}
+
+// zipArchiveWriter writes entries to a ZIP archive
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) AddDir(name string, info fs.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+
+	_, err = a.zw.CreateHeader(header)
+	return err
+}
+
+func (a *zipArchiveWriter) AddFile(name string, info fs.FileInfo, content io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	fw, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, content)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// tarArchiveWriter writes entries to a gzip compressed tar archive
+type tarArchiveWriter struct {
+	gw *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchiveWriter) AddDir(name string, info fs.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+
+	return a.tw.WriteHeader(header)
+}
+
+func (a *tarArchiveWriter) AddFile(name string, info fs.FileInfo, content io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// The header already promised Size bytes, the file may have changed since
+	_, err = io.CopyN(a.tw, content, header.Size)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gw.Close()
+}
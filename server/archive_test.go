@@ -0,0 +1,101 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveContents reads back the entries of an archive written by WriteArchive
+func archiveContents(t *testing.T, data []byte, format string) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	switch format {
+	case FormatZip:
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range zr.File {
+			rc, err := entry.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			contents[entry.Name] = string(content)
+		}
+	case FormatTarGz:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(tr)
+			contents[header.Name] = string(content)
+		}
+	}
+	return contents
+}
+
+func TestWriteArchive(t *testing.T) {
+	fm, baseDir := newTestFileManager(t,
+		"alice/docs/a.txt",
+		"alice/docs/sub/b.txt",
+		"alice/docs/.upload-123",
+		"alice/docs/.upload-extract-1/partial.txt",
+		"alice/notes.txt",
+		"bob/secret.txt",
+	)
+	if err := os.Symlink(filepath.Join(baseDir, "bob", "secret.txt"), filepath.Join(baseDir, "alice", "docs", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads in progress and links are left out
+	want := map[string]string{
+		"docs/":          "",
+		"docs/a.txt":     "alice/docs/a.txt",
+		"docs/sub/":      "",
+		"docs/sub/b.txt": "alice/docs/sub/b.txt",
+		"notes.txt":      "alice/notes.txt",
+	}
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := fm.WriteArchive(&buf, "alice", "", []string{"docs", "notes.txt"}, format); err != nil {
+				t.Fatal(err)
+			}
+			got := archiveContents(t, buf.Bytes(), format)
+			for name, content := range want {
+				if got[name] != content {
+					t.Errorf("%s: got %q, want %q", name, got[name], content)
+				}
+			}
+			for name := range got {
+				if _, ok := want[name]; !ok {
+					t.Errorf("unexpected entry %s", name)
+				}
+			}
+		})
+	}
+
+	if err := fm.WriteArchive(io.Discard, "alice", "", []string{"../bob"}, FormatZip); err == nil {
+		t.Error("archive of another user's directory")
+	}
+	if err := fm.WriteArchive(io.Discard, "alice", "", []string{"docs"}, "rar"); err == nil {
+		t.Error("archive in an unsupported format")
+	}
+}
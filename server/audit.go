@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Protocols of audited operations
+const (
+	AuditHTTP   = "http"
+	AuditWebDAV = "webdav"
+	AuditSFTP   = "sftp"
+	AuditS3     = "s3"
+	AuditShare  = "share" // Visitors of share links
+)
+
+// Audited actions
+const (
+	AuditUpload   = "upload"
+	AuditDownload = "download"
+	AuditDelete   = "delete"
+	AuditMkdir    = "mkdir"
+	AuditRename   = "rename"
+	AuditMove     = "move"
+	AuditExtract  = "extract"
+)
+
+// AuditEntry is a file operation recorded in the audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	User     string    `json:"user,omitempty"`  // Who made it, empty for visitors of share links
+	Share    string    `json:"share,omitempty"` // Share link visitors used
+	Action   string    `json:"action"`
+	Owner    string    `json:"owner"`            // User or space whose tree holds the item
+	Path     string    `json:"path"`             // Relative to the owner's directory
+	Target   string    `json:"target,omitempty"` // Where an item was renamed or moved to, or an archive extracted
+	Error    string    `json:"error,omitempty"`  // Why the operation failed
+}
+
+// AuditLog records the file operations made through every protocol, and who
+// made them, in an append-only JSON lines file. The file is opened for every
+// entry, so it can be rotated by moving it away.
+type AuditLog struct {
+	file string
+	mu   sync.Mutex
+}
+
+// NewAuditLog creates an audit log writing to file
+func NewAuditLog(file string) *AuditLog {
+	return &AuditLog{file: file}
+}
+
+// Record appends an operation to the log, err being how it ended
+func (al *AuditLog) Record(entry AuditEntry, err error) {
+	entry.Time = time.Now().UTC()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error writing the audit log: %v", err)
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(al.file), 0755); err != nil {
+		log.Printf("Error writing the audit log: %v", err)
+		return
+	}
+	file, err := os.OpenFile(al.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Error writing the audit log: %v", err)
+		return
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing the audit log: %v", err)
+	}
+	file.Close()
+}
+
+// auditPath returns the path of the item called name inside folder dir
+func auditPath(dir, name string) string {
+	return path.Join(dir, name)
+}
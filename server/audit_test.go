@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// auditEntries reads the audit log of a server
+func auditEntries(t *testing.T, h *APIHandler) []AuditEntry {
+	t.Helper()
+	file, err := os.Open(h.audit.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// The HTTP API, WebDAV and SFTP record their file operations in the same log
+func TestAuditLog(t *testing.T) {
+	h := newTestAPIHandler(t)
+	writeUserFile(t, h, "notes.txt", "notes")
+
+	token, err := h.authManager.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/folders", strings.NewReader(`{"path":"","folderName":"docs"}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.HandleCreateFolder(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create folder: %d %s", w.Code, w.Body)
+	}
+
+	for _, step := range []struct {
+		method, target string
+		header         map[string]string
+		body           string
+		want           int
+	}{
+		{"PUT", "/dav/docs/plan.txt", nil, "plan", http.StatusCreated},
+		// Describing files opens them, that isn't a download
+		{"PROPFIND", "/dav/docs/", map[string]string{"Depth": "1"}, "", http.StatusMultiStatus},
+		{"GET", "/dav/docs/plan.txt", nil, "", http.StatusOK},
+		{"GET", "/dav/missing.txt", nil, "", http.StatusNotFound},
+		{"MOVE", "/dav/docs/plan.txt", map[string]string{"Destination": "/dav/plan.txt"}, "", http.StatusCreated},
+	} {
+		if w := davRequest(h, step.method, step.target, step.header, step.body); w.Code != step.want {
+			t.Fatalf("%s %s: got %d, want %d", step.method, step.target, w.Code, step.want)
+		}
+	}
+
+	s := &sftpHandler{fs: &davFS{h: h, username: "alice", protocol: AuditSFTP}}
+	reader, err := s.Fileread(sftp.NewRequest("Get", "/notes.txt"))
+	if err != nil {
+		t.Fatalf("sftp read: %v", err)
+	}
+	if content, _ := io.ReadAll(io.NewSectionReader(reader, 0, 5)); string(content) != "notes" {
+		t.Errorf("sftp read: got %q", content)
+	}
+	reader.(io.Closer).Close()
+	if err := s.Filecmd(sftp.NewRequest("Remove", "/notes.txt")); err != nil {
+		t.Fatalf("sftp remove: %v", err)
+	}
+	move := sftp.NewRequest("PosixRename", "/plan.txt")
+	move.Target = "/missing/plan.txt"
+	if err := s.PosixRename(move); err == nil {
+		t.Fatal("sftp move into a missing folder worked")
+	}
+
+	want := []AuditEntry{
+		{Protocol: AuditHTTP, Action: AuditMkdir, Path: "docs"},
+		{Protocol: AuditWebDAV, Action: AuditUpload, Path: "docs/plan.txt"},
+		{Protocol: AuditWebDAV, Action: AuditDownload, Path: "docs/plan.txt"},
+		{Protocol: AuditWebDAV, Action: AuditMove, Path: "docs/plan.txt", Target: "plan.txt"},
+		{Protocol: AuditSFTP, Action: AuditDownload, Path: "notes.txt"},
+		{Protocol: AuditSFTP, Action: AuditDelete, Path: "notes.txt"},
+		{Protocol: AuditSFTP, Action: AuditMove, Path: "plan.txt", Target: "missing/plan.txt", Error: "no such file"},
+	}
+	got := auditEntries(t, h)
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i, entry := range got {
+		if entry.User != "alice" || entry.Owner != "alice" || entry.Time.IsZero() {
+			t.Errorf("entry %d: %+v", i, entry)
+		}
+		if (entry.Error == "") != (want[i].Error == "") || !strings.Contains(entry.Error, want[i].Error) {
+			t.Errorf("entry %d error: got %q, want %q", i, entry.Error, want[i].Error)
+		}
+		if entry.Protocol != want[i].Protocol || entry.Action != want[i].Action || entry.Path != want[i].Path || entry.Target != want[i].Target {
+			t.Errorf("entry %d: got %s %s %s %s, want %s %s %s %s", i,
+				entry.Protocol, entry.Action, entry.Path, entry.Target,
+				want[i].Protocol, want[i].Action, want[i].Path, want[i].Target)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(h.fileManager.baseDir, "alice", "plan.txt")); err != nil {
+		t.Errorf("moved file: %v", err)
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
@@ -22,22 +25,63 @@ type Token struct {
 type User struct {
 	Username string
 	Password string
+	Quota    int64 // Storage quota in bytes (0 = server default, negative = unlimited)
 }
 
+// Group is a named set of users that folders can be shared with. Every group
+// also owns a team space, managed by its admins.
+type Group struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Admins  []string `json:"admins,omitempty"` // Members who manage the group and its space
+	Quota   int64    `json:"quota,omitempty"`  // Storage quota of the space in bytes (0 = server default, negative = unlimited)
+}
+
+// Roles of a user in a group
+const (
+	GroupMember = "member"
+	GroupAdmin  = "admin"
+)
+
+var (
+	// ErrGroupNotFound is returned for unknown groups
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrGroupExists is returned when creating a group whose name is taken
+	ErrGroupExists = errors.New("group already exists")
+)
+
 // AuthManager manages authentication
 type AuthManager struct {
-	tokens    map[string]*Token
-	users     map[string]*User
-	mu        sync.RWMutex
-	credsFile string // Path to USER_CREDS.json file
+	tokens       map[string]*Token
+	users        map[string]*User
+	groups       map[string]*Group
+	apiKeys      map[string]*APIKey // By ID
+	sshKeys      map[string]*SSHKey // By ID
+	s3Keys       map[string]*S3Key  // By access key ID
+	mu           sync.RWMutex
+	credsFile    string // Path to USER_CREDS.json file
+	groupsFile   string // Path to the groups JSON file
+	keysFile     string // Path to the API keys JSON file
+	sshKeysFile  string // Path to the SSH public keys JSON file
+	s3KeysFile   string // Path to the S3 access keys JSON file
+	defaultQuota int64  // Quota applied to users without their own (0 = unlimited)
 }
 
-// NewAuthManager creates a new authentication manager
-func NewAuthManager(credsFilePath string) *AuthManager {
+// NewAuthManager creates a new authentication manager, keeping its files in dataDir
+func NewAuthManager(dataDir string, defaultQuota int64) *AuthManager {
 	am := &AuthManager{
-		tokens:    make(map[string]*Token),
-		users:     make(map[string]*User),
-		credsFile: credsFilePath,
+		tokens:       make(map[string]*Token),
+		users:        make(map[string]*User),
+		groups:       make(map[string]*Group),
+		apiKeys:      make(map[string]*APIKey),
+		sshKeys:      make(map[string]*SSHKey),
+		s3Keys:       make(map[string]*S3Key),
+		credsFile:    credentialsPath(dataDir),
+		groupsFile:   filepath.Join(dataDir, "groups.json"),
+		keysFile:     filepath.Join(dataDir, "apikeys.json"),
+		sshKeysFile:  filepath.Join(dataDir, "sshkeys.json"),
+		s3KeysFile:   filepath.Join(dataDir, "s3keys.json"),
+		defaultQuota: defaultQuota,
 	}
 
 	// Create default admin user
@@ -52,6 +96,19 @@ func NewAuthManager(credsFilePath string) *AuthManager {
 	// Save credentials (to create file if it doesn't exist)
 	am.SaveUsersToFile()
 
+	if err := am.loadGroups(); err != nil {
+		log.Printf("Error loading groups: %v", err)
+	}
+	if err := am.loadAPIKeys(); err != nil {
+		log.Printf("Error loading API keys: %v", err)
+	}
+	if err := am.loadSSHKeys(); err != nil {
+		log.Printf("Error loading SSH keys: %v", err)
+	}
+	if err := am.loadS3Keys(); err != nil {
+		log.Printf("Error loading S3 keys: %v", err)
+	}
+
 	return am
 }
 
@@ -146,11 +203,8 @@ func (am *AuthManager) CreateUser(username, password string) error {
 	}
 
 	// Validate username characters (only letters, numbers and underscore)
-	for _, char := range username {
-		if !((char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
-			(char >= '0' && char <= '9') || char == '_') {
-			return errors.New("username contains invalid characters")
-		}
+	if !validName(username) {
+		return errors.New("username contains invalid characters")
 	}
 
 	am.mu.Lock()
@@ -168,7 +222,7 @@ func (am *AuthManager) CreateUser(username, password string) error {
 	}
 
 	// Save credentials to file
-	if err := am.SaveUsersToFile(); err != nil {
+	if err := am.saveUsersLocked(); err != nil {
 		// Log error but don't fail user creation
 		// In production, should log this properly
 		return err
@@ -203,11 +257,13 @@ func (am *AuthManager) LoadUsersFromFile() error {
 		return err
 	}
 
-	// Load users (except admin which already exists)
+	// Load users (except admin which already exists, only its quota is kept)
 	for _, user := range users {
 		if user.Username != "admin" {
 			userCopy := user // Create copy to avoid pointer issue
 			am.users[user.Username] = &userCopy
+		} else {
+			am.users["admin"].Quota = user.Quota
 		}
 	}
 
@@ -223,6 +279,15 @@ func (am *AuthManager) SaveUsersToFile() error {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
+	return am.saveUsersLocked()
+}
+
+// saveUsersLocked writes users to the JSON file (caller must hold am.mu)
+func (am *AuthManager) saveUsersLocked() error {
+	if am.credsFile == "" {
+		return nil
+	}
+
 	// Convert map to slice
 	users := make([]User, 0, len(am.users))
 	for _, user := range am.users {
@@ -252,3 +317,275 @@ func (am *AuthManager) UserExists(username string) bool {
 	_, exists := am.users[username]
 	return exists
 }
+
+// GetQuota returns a user's storage quota in bytes (0 = unlimited). The
+// owners of team spaces have their group's quota.
+func (am *AuthManager) GetQuota(username string) int64 {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	if name, isSpace := spaceGroup(username); isSpace {
+		group, exists := am.groups[name]
+		if !exists || group.Quota == 0 {
+			return am.defaultQuota
+		}
+		if group.Quota < 0 {
+			return 0
+		}
+		return group.Quota
+	}
+
+	user, exists := am.users[username]
+	if !exists || user.Quota == 0 {
+		return am.defaultQuota
+	}
+	if user.Quota < 0 {
+		return 0
+	}
+	return user.Quota
+}
+
+// SetQuota changes a user's storage quota (0 = server default, negative = unlimited)
+func (am *AuthManager) SetQuota(username string, quota int64) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[username]
+	if !exists {
+		return errors.New("user not found")
+	}
+	user.Quota = quota
+
+	return am.saveUsersLocked()
+}
+
+// validName reports whether a user or group name only has letters, numbers and underscores
+func validName(name string) bool {
+	for _, char := range name {
+		if !((char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9') || char == '_') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// CreateGroup creates an empty group
+func (am *AuthManager) CreateGroup(name string) error {
+	if !validName(name) {
+		return errors.New("group name contains invalid characters")
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.groups[name]; exists {
+		return ErrGroupExists
+	}
+	am.groups[name] = &Group{Name: name, Members: []string{}}
+
+	return am.saveGroupsLocked()
+}
+
+// DeleteGroup removes a group
+func (am *AuthManager) DeleteGroup(name string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.groups[name]; !exists {
+		return ErrGroupNotFound
+	}
+	delete(am.groups, name)
+
+	return am.saveGroupsLocked()
+}
+
+// AddGroupMember adds a user to a group
+func (am *AuthManager) AddGroupMember(name, username string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	group, exists := am.groups[name]
+	if !exists {
+		return ErrGroupNotFound
+	}
+	if _, exists := am.users[username]; !exists {
+		return errors.New("user not found")
+	}
+	if slices.Contains(group.Members, username) {
+		return nil
+	}
+	group.Members = append(group.Members, username)
+	sort.Strings(group.Members)
+
+	return am.saveGroupsLocked()
+}
+
+// RemoveGroupMember removes a user from a group
+func (am *AuthManager) RemoveGroupMember(name, username string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	group, exists := am.groups[name]
+	if !exists {
+		return ErrGroupNotFound
+	}
+	group.Members = slices.DeleteFunc(group.Members, func(member string) bool {
+		return member == username
+	})
+	group.Admins = slices.DeleteFunc(group.Admins, func(admin string) bool {
+		return admin == username
+	})
+
+	return am.saveGroupsLocked()
+}
+
+// SetGroupAdmin makes a member of a group one of its admins, or a plain member again
+func (am *AuthManager) SetGroupAdmin(name, username string, admin bool) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	group, exists := am.groups[name]
+	if !exists {
+		return ErrGroupNotFound
+	}
+	if !slices.Contains(group.Members, username) {
+		return errors.New("user is not a member of the group")
+	}
+	isAdmin := slices.Contains(group.Admins, username)
+	switch {
+	case admin && !isAdmin:
+		group.Admins = append(group.Admins, username)
+		sort.Strings(group.Admins)
+	case !admin && isAdmin:
+		group.Admins = slices.DeleteFunc(group.Admins, func(a string) bool {
+			return a == username
+		})
+	default:
+		return nil
+	}
+
+	return am.saveGroupsLocked()
+}
+
+// SetGroupQuota changes the storage quota of a group's space (0 = server default, negative = unlimited)
+func (am *AuthManager) SetGroupQuota(name string, quota int64) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	group, exists := am.groups[name]
+	if !exists {
+		return ErrGroupNotFound
+	}
+	group.Quota = quota
+
+	return am.saveGroupsLocked()
+}
+
+// GroupRole returns the role of a user in a group: GroupAdmin, GroupMember or "" if they're not in it
+func (am *AuthManager) GroupRole(name, username string) string {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	group, exists := am.groups[name]
+	switch {
+	case !exists || !slices.Contains(group.Members, username):
+		return ""
+	case slices.Contains(group.Admins, username):
+		return GroupAdmin
+	}
+	return GroupMember
+}
+
+// GroupExists checks if a group exists
+func (am *AuthManager) GroupExists(name string) bool {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	_, exists := am.groups[name]
+	return exists
+}
+
+// GroupsOf returns the names of the groups a user belongs to
+func (am *AuthManager) GroupsOf(username string) []string {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	var names []string
+	for _, group := range am.groups {
+		if slices.Contains(group.Members, username) {
+			names = append(names, group.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListGroups returns all groups, by name
+func (am *AuthManager) ListGroups() []Group {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	groups := make([]Group, 0, len(am.groups))
+	for _, group := range am.groups {
+		copied := *group
+		copied.Members = slices.Clone(group.Members)
+		copied.Admins = slices.Clone(group.Admins)
+		groups = append(groups, copied)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// loadGroups reads the groups file, if it exists
+func (am *AuthManager) loadGroups() error {
+	if am.groupsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(am.groupsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var groups []*Group
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, group := range groups {
+		am.groups[group.Name] = group
+	}
+	return nil
+}
+
+// saveGroupsLocked writes groups to the JSON file (caller must hold am.mu)
+func (am *AuthManager) saveGroupsLocked() error {
+	if am.groupsFile == "" {
+		return nil
+	}
+
+	groups := make([]*Group, 0, len(am.groups))
+	for _, group := range am.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(am.groupsFile), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(am.groupsFile, data)
+}
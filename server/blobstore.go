@@ -0,0 +1,238 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// blobGCInterval is how often unreferenced blobs are removed
+const blobGCInterval = time.Hour
+
+// BlobStats describes the content of the blob store
+type BlobStats struct {
+	Blobs        int   `json:"blobs"`
+	Bytes        int64 `json:"bytes"`        // Space actually used by blobs
+	LogicalBytes int64 `json:"logicalBytes"` // Space the referencing files would use without deduplication
+	Reclaimed    int   `json:"reclaimed"`    // Blobs removed by the last collection
+}
+
+// BlobStore keeps file contents once, named by their SHA-256. Files in user
+// trees are hard links to their blob, so every existing reader sees a regular
+// file, and the link count of a blob is its reference count: deleting or
+// replacing a file drops a reference, and the garbage collector removes blobs
+// nothing points to anymore.
+//
+// Every user (or space) has their own blobs. Files linked to the same blob
+// share its inode, modification time and ETag, which across users would tell
+// one user when another stored the same content.
+type BlobStore struct {
+	dir string
+	mu  sync.Mutex // Held while a blob gains a reference or is collected
+}
+
+// NewBlobStore creates a blob store in dir and makes fm store new files in it
+func NewBlobStore(dir string, fm *FileManager) *BlobStore {
+	os.MkdirAll(dir, 0755)
+
+	bs := &BlobStore{dir: dir}
+	fm.blobs = bs
+	return bs
+}
+
+// Put stores the content of tmpPath, a finished temporary file, as owner's blob
+// sum unless it already exists. It returns the path of a temporary file next to
+// tmpPath that is a link to the blob, ready to be renamed into place; tmpPath
+// itself is removed if it isn't that file.
+func (bs *BlobStore) Put(owner, tmpPath, sum string) (string, error) {
+	if len(sum) != 64 {
+		return "", errors.New("invalid blob hash")
+	}
+	tmpInfo, err := os.Stat(tmpPath)
+	if err != nil {
+		return "", err
+	}
+
+	blobPath := bs.blobPath(owner, sum)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return "", err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	blobInfo, err := os.Stat(blobPath)
+	if os.IsNotExist(err) {
+		// New content, the temporary file becomes the blob
+		if err := os.Link(tmpPath, blobPath); err != nil {
+			return "", err
+		}
+		return tmpPath, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if blobInfo.Size() != tmpInfo.Size() {
+		// Same content stored differently, e.g. before encryption was enabled. Files
+		// linked to the old blob keep it, new ones are linked to this one.
+		if err := os.Remove(blobPath); err != nil {
+			return "", err
+		}
+		if err := os.Link(tmpPath, blobPath); err != nil {
+			return "", err
+		}
+		return tmpPath, nil
+	}
+
+	// Known content, link the existing blob instead
+	linkPath := filepath.Join(filepath.Dir(tmpPath), uploadTempPrefix+"link-"+randomHex(8))
+	if err := os.Link(blobPath, linkPath); err != nil {
+		return "", err
+	}
+	os.Remove(tmpPath)
+
+	// The files of the blob are as recent as its latest copy, so that the new
+	// one doesn't seem older than it is
+	if tmpInfo.ModTime().After(blobInfo.ModTime()) {
+		os.Chtimes(linkPath, tmpInfo.ModTime(), tmpInfo.ModTime())
+	}
+	return linkPath, nil
+}
+
+// Stats returns the number and size of blobs without collecting anything
+func (bs *BlobStore) Stats() (BlobStats, error) {
+	return bs.scan(false)
+}
+
+// CollectGarbage removes the blobs that no file references anymore
+func (bs *BlobStore) CollectGarbage() (BlobStats, error) {
+	return bs.scan(true)
+}
+
+// scan walks the blobs, removing unreferenced ones when collect is true
+func (bs *BlobStore) scan(collect bool) (BlobStats, error) {
+	var stats BlobStats
+
+	err := filepath.WalkDir(bs.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		refs := linkCount(info) - 1
+
+		if refs == 0 && collect {
+			bs.mu.Lock()
+			// Check again, a reference may have been added meanwhile
+			if info, err := os.Stat(path); err == nil && linkCount(info) == 1 {
+				if os.Remove(path) == nil {
+					stats.Reclaimed++
+				}
+			}
+			bs.mu.Unlock()
+			return nil
+		}
+
+		stats.Blobs++
+		stats.Bytes += info.Size()
+		if refs > 0 {
+			stats.LogicalBytes += int64(refs) * info.Size()
+		}
+		return nil
+	})
+
+	return stats, err
+}
+
+// RunGC collects garbage once per interval, forever
+func (bs *BlobStore) RunGC(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stats, err := bs.CollectGarbage()
+		if err != nil {
+			log.Printf("Blob garbage collection failed: %v", err)
+			continue
+		}
+		if stats.Reclaimed > 0 {
+			log.Printf("Blob garbage collection removed %d unreferenced blobs", stats.Reclaimed)
+		}
+	}
+}
+
+// blobPath returns where owner's blob with hex SHA-256 sum is stored
+func (bs *BlobStore) blobPath(owner, sum string) string {
+	return filepath.Join(bs.dir, owner, sum[:2], sum)
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// HandleStorage reports blob store usage (GET) or collects garbage now (POST). Admin only.
+func (h *APIHandler) HandleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+	if username != "admin" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Admin only"})
+		return
+	}
+
+	if h.blobs == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "cas": false})
+		return
+	}
+
+	var stats BlobStats
+	if r.Method == http.MethodPost {
+		stats, err = h.blobs.CollectGarbage()
+	} else {
+		stats, err = h.blobs.Stats()
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error scanning blob store"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"cas":            true,
+		"stats":          stats,
+		"savedFormatted": formatSize(max(stats.LogicalBytes-stats.Bytes, 0)),
+	})
+}
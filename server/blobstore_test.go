@@ -0,0 +1,101 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBlobStore creates a file manager storing its files in a blob store
+func newTestBlobStore(t *testing.T, files ...string) (*FileManager, *BlobStore, string) {
+	t.Helper()
+	fm, baseDir := newTestFileManager(t, files...)
+	return fm, NewBlobStore(t.TempDir(), fm), baseDir
+}
+
+// saveBlobFile stores content at name in a user's directory
+func saveBlobFile(t *testing.T, fm *FileManager, username, name, content string) os.FileInfo {
+	t.Helper()
+	if _, _, err := fm.SaveFile(username, "", name, strings.NewReader(content), SaveOptions{}); err != nil {
+		t.Fatalf("save %s/%s: %v", username, name, err)
+	}
+	info, err := os.Stat(filepath.Join(fm.baseDir, username, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestBlobStoreDeduplicates(t *testing.T) {
+	fm, bs, baseDir := newTestBlobStore(t, "alice/.keep", "bob/.keep")
+
+	a := saveBlobFile(t, fm, "alice", "a.txt", "same content")
+	// Stored later, the copy is as recent as its upload
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(baseDir, "alice", "a.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	copied := saveBlobFile(t, fm, "alice", "copy.txt", "same content")
+	if !os.SameFile(a, copied) {
+		t.Error("alice's copy isn't linked to the same blob")
+	}
+	if copied.ModTime().Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("copy modified at %v, when the first file was", copied.ModTime())
+	}
+
+	// Other users don't share blobs, nor learn when the content was stored
+	b := saveBlobFile(t, fm, "bob", "b.txt", "same content")
+	if os.SameFile(a, b) {
+		t.Error("bob's file is linked to alice's blob")
+	}
+	if fileETag(b) == fileETag(copied) {
+		t.Error("bob's file has the ETag of alice's")
+	}
+
+	stats, err := bs.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 2 || stats.Bytes != 24 || stats.LogicalBytes != 36 {
+		t.Errorf("stats: got %+v, want 2 blobs of 24 bytes for 36", stats)
+	}
+}
+
+// The same content stored again at the same path is the file already there
+func TestBlobStoreSameContentAgain(t *testing.T) {
+	fm, bs, baseDir := newTestBlobStore(t, "alice/.keep")
+
+	saveBlobFile(t, fm, "alice", "a.txt", "same content")
+	saveBlobFile(t, fm, "alice", "a.txt", "same content")
+
+	entries, err := os.ReadDir(filepath.Join(baseDir, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), uploadTempPrefix) {
+			t.Errorf("%s left behind", entry.Name())
+		}
+	}
+	used, err := NewUsageTracker(baseDir).Usage("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("alice/.keep") + len("same content")); used != want {
+		t.Errorf("usage: got %d, want %d", used, want)
+	}
+
+	// Once the file is gone, its blob is reclaimed
+	if err := fm.DeleteItems("alice", "", []string{"a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := bs.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Reclaimed != 1 || stats.Blobs != 0 {
+		t.Errorf("collection: got %+v, want 1 blob reclaimed and none left", stats)
+	}
+}
@@ -0,0 +1,585 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrChecksumMismatch is returned when uploaded content doesn't match the digest sent by the client
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Checksum store settings
+const (
+	checksumSaveDelay     = 5 * time.Second
+	checksumQueueCapacity = 1024
+)
+
+// Digests holds the checksums a client expects its upload to match
+type Digests struct {
+	SHA256 []byte
+	MD5    []byte
+}
+
+// Empty reports whether no digest was given
+func (d Digests) Empty() bool {
+	return d.SHA256 == nil && d.MD5 == nil
+}
+
+// ParseDigests reads the Digest (RFC 3230) and Content-MD5 headers.
+// Digest algorithms other than SHA-256 and MD5 are ignored.
+func ParseDigests(header http.Header) (Digests, error) {
+	var d Digests
+
+	if value := header.Get("Content-MD5"); value != "" {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(sum) != md5.Size {
+			return d, errors.New("invalid Content-MD5 header")
+		}
+		d.MD5 = sum
+	}
+
+	for _, value := range header.Values("Digest") {
+		for _, field := range strings.Split(value, ",") {
+			algorithm, encoded, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return d, errors.New("invalid Digest header")
+			}
+
+			var size int
+			switch strings.ToLower(algorithm) {
+			case "sha-256":
+				size = sha256.Size
+			case "md5":
+				size = md5.Size
+			default:
+				continue
+			}
+
+			sum, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(sum) != size {
+				return d, errors.New("invalid Digest header")
+			}
+			if size == sha256.Size {
+				d.SHA256 = sum
+			} else if d.MD5 != nil && !bytes.Equal(d.MD5, sum) {
+				return d, errors.New("Digest and Content-MD5 headers disagree")
+			} else {
+				d.MD5 = sum
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// digestWriter hashes everything written to it
+type digestWriter struct {
+	sha256 hash.Hash
+	md5    hash.Hash // Only computed when an MD5 digest is expected
+}
+
+func newDigestWriter(expect Digests) *digestWriter {
+	dw := &digestWriter{sha256: sha256.New()}
+	if expect.MD5 != nil {
+		dw.md5 = md5.New()
+	}
+	return dw
+}
+
+func (dw *digestWriter) Write(p []byte) (int, error) {
+	dw.sha256.Write(p)
+	if dw.md5 != nil {
+		dw.md5.Write(p)
+	}
+	return len(p), nil
+}
+
+// Verify compares the content written so far with the expected digests
+func (dw *digestWriter) Verify(expect Digests) error {
+	if expect.SHA256 != nil && !bytes.Equal(dw.sha256.Sum(nil), expect.SHA256) {
+		return ErrChecksumMismatch
+	}
+	if expect.MD5 != nil && !bytes.Equal(dw.md5.Sum(nil), expect.MD5) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// SHA256 returns the hex SHA-256 of the content written so far
+func (dw *digestWriter) SHA256() string {
+	return hex.EncodeToString(dw.sha256.Sum(nil))
+}
+
+// checksumEntry is the recorded hash of a file. Size and ModTime tell whether
+// the file was legitimately replaced since.
+type checksumEntry struct {
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"modTime"`            // Unix nanoseconds
+	Verified string `json:"verified,omitempty"` // RFC 3339 time of the last successful check
+}
+
+// IntegrityMismatch is a file whose content no longer matches its recorded hash
+type IntegrityMismatch struct {
+	Path       string `json:"path"`
+	Expected   string `json:"expected"`
+	Actual     string `json:"actual"`
+	Error      string `json:"error,omitempty"` // Why the content couldn't be read, e.g. failed decryption
+	DetectedAt string `json:"detectedAt"`
+}
+
+// IntegrityReport summarizes the state of a user's files
+type IntegrityReport struct {
+	Files      int                 `json:"files"`
+	LastScrub  string              `json:"lastScrub,omitempty"`
+	Mismatches []IntegrityMismatch `json:"mismatches"`
+}
+
+// integrityRecord holds the hashes of one user's files
+type integrityRecord struct {
+	Files      map[string]*checksumEntry `json:"files"` // By path relative to user directory
+	Mismatches []IntegrityMismatch       `json:"mismatches"`
+	LastScrub  string                    `json:"lastScrub,omitempty"`
+	dirty      bool
+}
+
+// ChecksumStore records the SHA-256 of every stored file in a sidecar file per user,
+// and re-verifies them in the background to detect corruption.
+type ChecksumStore struct {
+	dir         string
+	fileManager *FileManager
+	users       map[string]*integrityRecord
+	events      chan FileEvent
+	saveTimer   *time.Timer
+	scrubbing   sync.Mutex // Only one scrub runs at a time
+	mu          sync.Mutex
+}
+
+// NewChecksumStore creates a checksum store in dir and subscribes it to fm's changes
+func NewChecksumStore(dir string, fm *FileManager) *ChecksumStore {
+	os.MkdirAll(dir, 0755)
+
+	cs := &ChecksumStore{
+		dir:         dir,
+		fileManager: fm,
+		users:       make(map[string]*integrityRecord),
+		events:      make(chan FileEvent, checksumQueueCapacity),
+	}
+
+	go cs.run()
+	fm.checksums = cs
+	fm.OnChange(func(event FileEvent) {
+		// Only files that still have to be hashed are left to the background
+		if event.SHA256 != "" || event.Type == EventDelete || event.Type == EventRename {
+			cs.apply(event)
+			return
+		}
+		select {
+		case cs.events <- event:
+		default:
+			// Files missed here are hashed by the next scrub
+		}
+	})
+
+	return cs
+}
+
+// run applies change events to the store
+func (cs *ChecksumStore) run() {
+	for event := range cs.events {
+		cs.apply(event)
+	}
+}
+
+// apply records, moves or forgets hashes after a change
+func (cs *ChecksumStore) apply(event FileEvent) {
+	switch event.Type {
+	case EventCreate, EventModify:
+		// Folder contents are committed, and reported, one file at a time
+		if !event.IsDir {
+			cs.record(event.Username, event.Path, event.SHA256)
+		}
+	case EventDelete:
+		cs.mu.Lock()
+		rec := cs.loadLocked(event.Username)
+		rec.forget(event.Path)
+		cs.scheduleSaveLocked()
+		cs.mu.Unlock()
+	case EventRename:
+		cs.mu.Lock()
+		rec := cs.loadLocked(event.Username)
+		rec.forget(event.Path)
+		moved := make(map[string]*checksumEntry)
+		for p, entry := range rec.Files {
+			if withinRel(event.OldPath, p) {
+				delete(rec.Files, p)
+				moved[event.Path+strings.TrimPrefix(p, event.OldPath)] = entry
+			}
+		}
+		for p, entry := range moved {
+			rec.Files[p] = entry
+		}
+		for i, m := range rec.Mismatches {
+			if withinRel(event.OldPath, m.Path) {
+				rec.Mismatches[i].Path = event.Path + strings.TrimPrefix(m.Path, event.OldPath)
+			}
+		}
+		rec.dirty = true
+		cs.scheduleSaveLocked()
+		cs.mu.Unlock()
+	}
+}
+
+// record stores the hash of a file, computing it when sum is empty
+func (cs *ChecksumStore) record(username, rel, sum string) {
+	fullPath, err := cs.fileManager.resolvePath(username, rel)
+	if err != nil {
+		return
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if sum == "" {
+		if sum, err = cs.fileManager.hashFile(fullPath); err != nil {
+			return
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	rec := cs.loadLocked(username)
+	rec.forgetMismatches(rel)
+	rec.Files[rel] = &checksumEntry{
+		SHA256:   sum,
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixNano(),
+		Verified: time.Now().UTC().Format(time.RFC3339),
+	}
+	rec.dirty = true
+	cs.scheduleSaveLocked()
+}
+
+// Lookup returns the recorded hash of a file, or an empty string if it is
+// unknown or the file changed since it was recorded
+func (cs *ChecksumStore) Lookup(username, rel string, info fs.FileInfo) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	entry := cs.loadLocked(username).Files[rel]
+	if entry == nil || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return ""
+	}
+	return entry.SHA256
+}
+
+// Report returns the integrity state of a user's files
+func (cs *ChecksumStore) Report(username string) IntegrityReport {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	rec := cs.loadLocked(username)
+	return IntegrityReport{
+		Files:      len(rec.Files),
+		LastScrub:  rec.LastScrub,
+		Mismatches: append([]IntegrityMismatch{}, rec.Mismatches...),
+	}
+}
+
+// Scrub re-hashes every file of a user and compares it with the recorded hash.
+// Files without a hash, or replaced since it was recorded, are hashed again;
+// files whose content changed without their size or date changing are reported.
+func (cs *ChecksumStore) Scrub(username string) (IntegrityReport, error) {
+	cs.scrubbing.Lock()
+	defer cs.scrubbing.Unlock()
+
+	userDir, err := filepath.Abs(cs.fileManager.GetUserDir(username))
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+
+	seen := make(map[string]bool)
+	err = filepath.WalkDir(userDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == userDir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			if d != nil && d.IsDir() && p != userDir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), uploadTempPrefix) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel := cs.fileManager.relPath(username, p)
+		seen[rel] = true
+		cs.verify(username, rel, p)
+		return nil
+	})
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+
+	cs.mu.Lock()
+	rec := cs.loadLocked(username)
+	for rel := range rec.Files {
+		if !seen[rel] {
+			delete(rec.Files, rel)
+		}
+	}
+	rec.LastScrub = time.Now().UTC().Format(time.RFC3339)
+	rec.dirty = true
+	cs.scheduleSaveLocked()
+	cs.mu.Unlock()
+
+	return cs.Report(username), nil
+}
+
+// verify checks one file against its recorded hash
+func (cs *ChecksumStore) verify(username, rel, fullPath string) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return
+	}
+
+	cs.mu.Lock()
+	entry := cs.loadLocked(username).Files[rel]
+	cs.mu.Unlock()
+
+	// Files replaced since they were recorded are hashed again, unless they can't be read
+	stale := entry == nil || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano()
+
+	sum, err := cs.fileManager.hashFile(fullPath)
+	if err != nil && !errors.Is(err, ErrDecrypt) {
+		return
+	}
+	if stale && err == nil {
+		cs.record(username, rel, sum)
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	rec := cs.loadLocked(username)
+	if rec.Files[rel] != entry {
+		// Replaced while it was being hashed
+		return
+	}
+
+	if entry != nil && sum == entry.SHA256 {
+		entry.Verified = time.Now().UTC().Format(time.RFC3339)
+		rec.forgetMismatches(rel)
+	} else if !rec.hasMismatch(rel) {
+		mismatch := IntegrityMismatch{
+			Path:       rel,
+			Actual:     sum,
+			DetectedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		if entry != nil {
+			mismatch.Expected = entry.SHA256
+		}
+		if err != nil {
+			mismatch.Error = err.Error()
+		}
+		log.Printf("Integrity check failed for %s/%s: expected sha256 %q, got %q (%v)", username, rel, mismatch.Expected, sum, err)
+		rec.Mismatches = append(rec.Mismatches, mismatch)
+	}
+	rec.dirty = true
+	cs.scheduleSaveLocked()
+}
+
+// RunScrubber verifies every user's files once per interval, forever
+func (cs *ChecksumStore) RunScrubber(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		entries, err := os.ReadDir(cs.fileManager.baseDir)
+		if err != nil {
+			log.Printf("Integrity scrub failed: %v", err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			report, err := cs.Scrub(entry.Name())
+			if err != nil {
+				log.Printf("Integrity scrub of %s failed: %v", entry.Name(), err)
+				continue
+			}
+			if len(report.Mismatches) > 0 {
+				log.Printf("Integrity scrub of %s: %d corrupted files", entry.Name(), len(report.Mismatches))
+			}
+		}
+	}
+}
+
+// loadLocked returns a user's record, reading it from disk the first time
+func (cs *ChecksumStore) loadLocked(username string) *integrityRecord {
+	if rec := cs.users[username]; rec != nil {
+		return rec
+	}
+
+	rec := &integrityRecord{}
+	if data, err := os.ReadFile(cs.recordPath(username)); err == nil {
+		if err := json.Unmarshal(data, rec); err != nil {
+			log.Printf("Discarding checksums of %s: %v", username, err)
+			rec = &integrityRecord{}
+		}
+	}
+	if rec.Files == nil {
+		rec.Files = make(map[string]*checksumEntry)
+	}
+
+	cs.users[username] = rec
+	return rec
+}
+
+// scheduleSaveLocked writes the modified records to disk after a short delay
+func (cs *ChecksumStore) scheduleSaveLocked() {
+	if cs.saveTimer == nil {
+		cs.saveTimer = time.AfterFunc(checksumSaveDelay, cs.save)
+	}
+}
+
+// save writes every modified record to disk
+func (cs *ChecksumStore) save() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.saveTimer = nil
+
+	for username, rec := range cs.users {
+		if !rec.dirty {
+			continue
+		}
+
+		data, err := json.Marshal(rec)
+		if err == nil {
+			err = writeFileAtomic(cs.recordPath(username), data)
+		}
+		if err != nil {
+			log.Printf("Failed to save checksums of %s: %v", username, err)
+			continue
+		}
+		rec.dirty = false
+	}
+}
+
+// recordPath returns the sidecar file holding a user's hashes
+func (cs *ChecksumStore) recordPath(username string) string {
+	return filepath.Join(cs.dir, username+".json")
+}
+
+// forget drops the hashes of a file, or of every file below a folder
+func (rec *integrityRecord) forget(rel string) {
+	for p := range rec.Files {
+		if withinRel(rel, p) {
+			delete(rec.Files, p)
+		}
+	}
+	rec.forgetMismatches(rel)
+	rec.dirty = true
+}
+
+// forgetMismatches drops the reported mismatches of a file or folder
+func (rec *integrityRecord) forgetMismatches(rel string) {
+	kept := rec.Mismatches[:0]
+	for _, m := range rec.Mismatches {
+		if !withinRel(rel, m.Path) {
+			kept = append(kept, m)
+		}
+	}
+	rec.Mismatches = kept
+}
+
+func (rec *integrityRecord) hasMismatch(rel string) bool {
+	for _, m := range rec.Mismatches {
+		if m.Path == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// digestHeader formats a hex SHA-256 as a Digest header value
+func digestHeader(sum string) string {
+	raw, _ := hex.DecodeString(sum)
+	return "sha-256=" + base64.StdEncoding.EncodeToString(raw)
+}
+
+// writeFileAtomic replaces path with data, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// HandleIntegrity reports corrupted files (GET) or verifies all the user's files now (POST)
+func (h *APIHandler) HandleIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	report := h.checksums.Report(username)
+	if r.Method == http.MethodPost {
+		if report, err = h.checksums.Scrub(username); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Error verifying files"})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"files":      report.Files,
+		"lastScrub":  report.LastScrub,
+		"mismatches": report.Mismatches,
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDigests(t *testing.T) {
+	sha := sha256.Sum256([]byte("content"))
+	sum := md5.Sum([]byte("content"))
+	other := md5.Sum([]byte("other"))
+	encode := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		ok     bool
+	}{
+		{"sha-256", map[string]string{"Digest": "SHA-256=" + encode(sha[:])}, true},
+		{"both headers", map[string]string{"Digest": "sha-256=" + encode(sha[:]) + ", md5=" + encode(sum[:]), "Content-MD5": encode(sum[:])}, true},
+		{"unknown algorithm", map[string]string{"Digest": "sha-512=AAAA"}, true},
+		{"headers disagree", map[string]string{"Digest": "md5=" + encode(sum[:]), "Content-MD5": encode(other[:])}, false},
+		{"wrong length", map[string]string{"Digest": "sha-256=" + encode(sum[:])}, false},
+		{"not base64", map[string]string{"Content-MD5": "not base64!"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.header {
+				header.Set(name, value)
+			}
+			if _, err := ParseDigests(header); (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestChecksumStore(t *testing.T) {
+	fm, baseDir := newTestFileManager(t, "alice/.keep")
+	cs := NewChecksumStore(t.TempDir(), fm)
+
+	// Uploads must match the digests they came with
+	sum := sha256.Sum256([]byte("good content"))
+	wrong := sha256.Sum256([]byte("bad content"))
+	if _, _, err := fm.SaveFile("alice", "", "bad.txt", strings.NewReader("good content"), SaveOptions{Expect: Digests{SHA256: wrong[:]}}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("wrong digest: got %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "alice", "bad.txt")); !os.IsNotExist(err) {
+		t.Errorf("file with the wrong digest stored: %v", err)
+	}
+	if _, _, err := fm.SaveFile("alice", "", "good.txt", strings.NewReader("good content"), SaveOptions{Expect: Digests{SHA256: sum[:]}}); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := fm.GetFileInfo("alice", "", "good.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("recorded hash: got %q", item.SHA256)
+	}
+	report, err := cs.Scrub("alice")
+	if err != nil || len(report.Mismatches) != 0 {
+		t.Fatalf("scrub of intact files: %+v (%v)", report, err)
+	}
+
+	// Content changed behind the server's back, keeping size and date, is reported
+	path := filepath.Join(baseDir, "alice", "good.txt")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("evil content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	report, err = cs.Scrub("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Path != "good.txt" || report.Mismatches[0].Expected != hex.EncodeToString(sum[:]) {
+		t.Errorf("scrub of a corrupted file: %+v", report)
+	}
+
+	// Replacing the file clears the report
+	if _, _, err := fm.SaveFile("alice", "", "good.txt", strings.NewReader("new content"), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if report := cs.Report("alice"); len(report.Mismatches) != 0 {
+		t.Errorf("report after replacing the file: %+v", report)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrPreconditionFailed is returned when an If-Match or If-None-Match
+// precondition doesn't hold for the current state of a file
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// fileETag returns a strong validator for a file. Its inode, modification time
+// and size change with every write, as files are always replaced by rename.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, inode(info), info.ModTime().UnixNano(), info.Size())
+}
+
+// contentETag returns a strong validator for a generated response body
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether header, an If-Match or If-None-Match value,
+// lists etag. "*" matches any existing item; weak tags never match.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || (tag == etag && etag != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match header values
+// against an item, info being nil when it doesn't exist. Folders have no
+// validator, so only "*" matches them.
+func checkPreconditions(info fs.FileInfo, ifMatch, ifNoneMatch string) error {
+	etag := ""
+	if info != nil && !info.IsDir() {
+		etag = fileETag(info)
+	}
+	if ifMatch != "" && (info == nil || !etagMatches(ifMatch, etag)) {
+		return ErrPreconditionFailed
+	}
+	if ifNoneMatch != "" && info != nil && etagMatches(ifNoneMatch, etag) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// notModified reports whether a client already holds the representation with
+// etag and lastModified, following the precedence rules of RFC 9110
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etagMatches(header, etag)
+	}
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return false
+		}
+		// HTTP dates have second precision
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// writePreconditionFailed sends the JSON error for a failed precondition
+func writePreconditionFailed(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(map[string]string{"error": "The item was changed by someone else"})
+}
+
+// checkItems verifies that every named item inside path matches ifMatch,
+// the If-Match header of a request changing them
+func (fm *FileManager) checkItems(username, path string, names []string, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	for _, name := range names {
+		itemPath, err := fm.resolveItem(username, path, name)
+		if err != nil {
+			continue // Rejected by the change itself
+		}
+		info, err := os.Stat(itemPath)
+		if err != nil {
+			info = nil
+		}
+		if err := checkPreconditions(info, ifMatch, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// conditionalRequest sends a request signed in as alice, with extra headers
+func conditionalRequest(t *testing.T, h *APIHandler, handler http.HandlerFunc, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := h.authManager.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestConditionalRequests(t *testing.T) {
+	h := newTestAPIHandler(t)
+	writeUserFile(t, h, "notes.txt", "first")
+
+	// Downloads are revalidated with their ETag or date
+	w := conditionalRequest(t, h, h.HandleDownload, http.MethodGet, "/api/files/download?path=&name=notes.txt", "", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("download: status %d, ETag %q", w.Code, etag)
+	}
+	for _, header := range []map[string]string{
+		{"If-None-Match": etag},
+		{"If-Modified-Since": w.Header().Get("Last-Modified")},
+	} {
+		if w := conditionalRequest(t, h, h.HandleDownload, http.MethodGet, "/api/files/download?path=&name=notes.txt", "", header); w.Code != http.StatusNotModified {
+			t.Errorf("download %v: status %d, want 304", header, w.Code)
+		}
+	}
+
+	// So are listings, until something in the folder changes
+	w = conditionalRequest(t, h, h.HandleFiles, http.MethodGet, "/api/files?path=", "", nil)
+	listing := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || listing == "" {
+		t.Fatalf("listing: status %d, ETag %q", w.Code, listing)
+	}
+	if w := conditionalRequest(t, h, h.HandleFiles, http.MethodGet, "/api/files?path=", "", map[string]string{"If-None-Match": listing}); w.Code != http.StatusNotModified {
+		t.Errorf("unchanged listing: status %d, want 304", w.Code)
+	}
+	writeUserFile(t, h, "other.txt", "other")
+	if w := conditionalRequest(t, h, h.HandleFiles, http.MethodGet, "/api/files?path=", "", map[string]string{"If-None-Match": listing}); w.Code != http.StatusOK {
+		t.Errorf("changed listing: status %d, want 200", w.Code)
+	}
+
+	// Changes to a file someone else changed since are refused
+	writeUserFile(t, h, "notes.txt", "second version")
+	body := `{"path": "", "names": ["notes.txt"]}`
+	if w := conditionalRequest(t, h, h.HandleFiles, http.MethodDelete, "/api/files", body, map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete of a changed file: status %d, want 412", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(h.fileManager.baseDir, "alice", "notes.txt")); err != nil {
+		t.Fatalf("changed file deleted: %v", err)
+	}
+
+	w = conditionalRequest(t, h, h.HandleDownload, http.MethodGet, "/api/files/download?path=&name=notes.txt", "", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK || w.Body.String() != "second version" {
+		t.Fatalf("download of the new version: status %d %q", w.Code, w.Body)
+	}
+	if w := conditionalRequest(t, h, h.HandleFiles, http.MethodDelete, "/api/files", body, map[string]string{"If-Match": w.Header().Get("ETag")}); w.Code != http.StatusOK {
+		t.Errorf("delete of the current version: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxEditableSize is the largest file that can be saved through the text editor
+const maxEditableSize = 10 << 20
+
+// sandboxPolicy keeps files opened inline from doing anything: no scripts,
+// no requests, and a unique origin without access to the session. It is sent
+// for every type, since browsers run scripts in more of them than any list
+// would hold.
+const sandboxPolicy = "sandbox; default-src 'none'; img-src data:; style-src 'unsafe-inline'"
+
+// editableTypes are the non text/* media types that are edited as text
+var editableTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/toml":       true,
+	"application/x-sh":       true,
+	"image/svg+xml":          true,
+}
+
+// isEditable reports whether files of mimeType can be edited as text
+func isEditable(mimeType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	return strings.HasPrefix(mediaType, "text/") || editableTypes[mediaType]
+}
+
+// HandleFileContent serves a file inline for previews (GET) or replaces the
+// content of a text file (PUT)
+func (h *APIHandler) HandleFileContent(w http.ResponseWriter, r *http.Request) {
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.handleGetContent(w, r, username)
+	case http.MethodPut:
+		h.handlePutContent(w, r, username)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGetContent sends a file to be displayed by the browser instead of downloaded
+func (h *APIHandler) handleGetContent(w http.ResponseWriter, r *http.Request, username string) {
+	query := r.URL.Query()
+	loc, name := h.locateItem(w, username, query.Get("path"), query.Get("name"))
+	if loc == nil {
+		return
+	}
+	fullPath, err := h.fileManager.resolveItem(loc.Owner, loc.Path, name)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	mimeType := h.fileManager.detectMimeType(fullPath)
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", sandboxPolicy)
+
+	h.serveFile(w, r, loc.Owner, fullPath, info, "inline; filename*=UTF-8''"+url.PathEscape(info.Name()))
+}
+
+// handlePutContent replaces the content of a text file, or creates it. The
+// request must carry If-Match with the ETag of the version being edited, or
+// If-None-Match: * for a new file, so concurrent edits are never lost.
+func (h *APIHandler) handlePutContent(w http.ResponseWriter, r *http.Request, username string) {
+	query := r.URL.Query()
+	name := query.Get("name")
+
+	loc := h.locate(w, username, query.Get("path"), AccessWrite)
+	if loc == nil {
+		return
+	}
+	fullPath, err := h.fileManager.resolveItem(loc.Owner, loc.Path, name)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	opts := SaveOptions{
+		IfMatch:     r.Header.Get("If-Match"),
+		IfNoneMatch: r.Header.Get("If-None-Match"),
+	}
+	if opts.IfMatch == "" && opts.IfNoneMatch == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(map[string]string{"error": "If-Match or If-None-Match required"})
+		return
+	}
+	if opts.Expect, err = ParseDigests(r.Header); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Only text is edited, whether the file exists or is named like one
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	info, err := os.Stat(fullPath)
+	if err == nil {
+		if info.IsDir() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "a folder with that name already exists"})
+			return
+		}
+		mimeType = h.fileManager.detectMimeType(fullPath)
+	}
+	if mimeType != "" && !isEditable(mimeType) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Only text files can be edited"})
+		return
+	}
+
+	if r.ContentLength > maxEditableSize {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]string{"error": "File too large to edit"})
+		return
+	}
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxEditableSize+1))
+	if err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+	if len(content) > maxEditableSize {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]string{"error": "File too large to edit"})
+		return
+	}
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Content is not UTF-8 text"})
+		return
+	}
+
+	_, _, err = h.fileManager.SaveFile(loc.Owner, loc.Path, name, bytes.NewReader(content), opts)
+	h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditUpload, Owner: loc.Owner, Path: auditPath(loc.Path, name)}, err)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrPreconditionFailed):
+			writePreconditionFailed(w)
+			return
+		case errors.Is(err, ErrQuotaExceeded):
+			status = http.StatusInsufficientStorage
+		case errors.Is(err, ErrChecksumMismatch):
+			status = http.StatusBadRequest
+		default:
+			log.Printf("Error saving %s: %v", fullPath, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	item, err := h.fileManager.GetFileInfo(loc.Owner, loc.Path, name)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	h.showItem(username, loc, item)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", item.ETag)
+	if info == nil {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"item":    item,
+	})
+}
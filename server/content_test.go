@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Files opened inline are sandboxed whatever their type
+func TestFileContentSandbox(t *testing.T) {
+	h := newTestAPIHandler(t)
+	token, err := h.authManager.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"page.html", "notes.txt", "drawing.svg", "report.pdf", "data.unknown"} {
+		writeUserFile(t, h, name, "<script>alert(1)</script>")
+		r := httptest.NewRequest(http.MethodGet, "/api/files/content?path=&name="+name, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.HandleFileContent(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", name, w.Code)
+		}
+		if csp := w.Header().Get("Content-Security-Policy"); !strings.HasPrefix(csp, "sandbox") {
+			t.Errorf("%s: Content-Security-Policy %q", name, csp)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline") {
+			t.Errorf("%s: Content-Disposition %q", name, w.Header().Get("Content-Disposition"))
+		}
+	}
+}
@@ -0,0 +1,751 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MasterKeyEnv is the environment variable holding master keys when no key file is given
+const MasterKeyEnv = "GOCLOUD_MASTER_KEY"
+
+// Encrypted file layout: a fixed size header followed by the content split in
+// chunks, each sealed with AES-GCM under the file's own data key. Chunks can be
+// decrypted independently, so any byte range can be read without the rest.
+const (
+	encMagic       = "GCSENC\x00\x01"
+	encKeyIDSize   = 8
+	encNonceSize   = 12
+	encKeySize     = 32
+	encWrappedSize = encKeySize + 16
+	encAADSize     = len(encMagic) + encKeyIDSize + 4 + 8
+	encHeaderSize  = encAADSize + encNonceSize + encWrappedSize
+	encChunkSize   = 64 << 10
+	encTagSize     = 16
+)
+
+// ErrDecrypt is returned when a file can't be decrypted, because its master key
+// is missing or its content was corrupted or tampered with
+var ErrDecrypt = errors.New("file cannot be decrypted")
+
+// KeyRing holds the master keys that wrap per-file data keys. New files use the
+// active key; the others are only used to read files written before a rotation.
+type KeyRing struct {
+	keys   map[string][]byte // By key ID
+	active string
+}
+
+// LoadKeyRing reads master keys from path, or from the MasterKeyEnv environment
+// variable when path is empty. It returns nil when neither holds any key.
+func LoadKeyRing(path string) (*KeyRing, error) {
+	text := os.Getenv(MasterKeyEnv)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return ParseKeyRing(text)
+}
+
+// ParseKeyRing parses base64 encoded 256-bit keys, one per line (or separated
+// by commas). The first key is the active one. Lines starting with # are ignored.
+func ParseKeyRing(text string) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[string][]byte)}
+
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(key) != encKeySize {
+			return nil, errors.New("master keys must be 32 bytes, base64 encoded")
+		}
+		id := keyID(key)
+		if kr.active == "" {
+			kr.active = id
+		}
+		kr.keys[id] = key
+	}
+
+	if kr.active == "" {
+		return nil, errors.New("no master key found")
+	}
+	return kr, nil
+}
+
+// GenerateKey returns a new random master key, base64 encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, encKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ActiveKeyID returns the ID of the key new files are encrypted with
+func (kr *KeyRing) ActiveKeyID() string {
+	return kr.active
+}
+
+// keyID identifies a master key without revealing it
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:encKeyIDSize])
+}
+
+// encHeader is the header of an encrypted file
+type encHeader struct {
+	keyID     [encKeyIDSize]byte
+	chunkSize uint32
+	plainSize uint64
+	nonce     [encNonceSize]byte
+	wrapped   [encWrappedSize]byte
+}
+
+func (h *encHeader) marshal() []byte {
+	buf := make([]byte, 0, encHeaderSize)
+	buf = append(buf, encMagic...)
+	buf = append(buf, h.keyID[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, h.chunkSize)
+	buf = binary.BigEndian.AppendUint64(buf, h.plainSize)
+	buf = append(buf, h.nonce[:]...)
+	return append(buf, h.wrapped[:]...)
+}
+
+// parseEncHeader reads a header, returning nil if buf isn't one
+func parseEncHeader(buf []byte) *encHeader {
+	if len(buf) < encHeaderSize || string(buf[:len(encMagic)]) != encMagic {
+		return nil
+	}
+
+	h := &encHeader{}
+	pos := len(encMagic)
+	pos += copy(h.keyID[:], buf[pos:])
+	h.chunkSize = binary.BigEndian.Uint32(buf[pos:])
+	h.plainSize = binary.BigEndian.Uint64(buf[pos+4:])
+	pos += 12
+	pos += copy(h.nonce[:], buf[pos:])
+	copy(h.wrapped[:], buf[pos:])
+
+	if h.chunkSize == 0 {
+		return nil
+	}
+	return h
+}
+
+// wrap seals the data key with the active master key. The rest of the header
+// is authenticated along with it.
+func (kr *KeyRing) wrap(h *encHeader, dek []byte) error {
+	raw, _ := hex.DecodeString(kr.active)
+	copy(h.keyID[:], raw)
+	if _, err := rand.Read(h.nonce[:]); err != nil {
+		return err
+	}
+
+	aead, err := newGCM(kr.keys[kr.active])
+	if err != nil {
+		return err
+	}
+	copy(h.wrapped[:], aead.Seal(nil, h.nonce[:], dek, h.marshal()[:encAADSize]))
+	return nil
+}
+
+// unwrap opens the data key of a header
+func (kr *KeyRing) unwrap(h *encHeader) ([]byte, error) {
+	master := kr.keys[hex.EncodeToString(h.keyID[:])]
+	if master == nil {
+		return nil, fmt.Errorf("%w: unknown master key %x", ErrDecrypt, h.keyID)
+	}
+
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := aead.Open(nil, h.nonce[:], h.wrapped[:], h.marshal()[:encAADSize])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dek, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce and chunkAAD bind each chunk to its position, and mark the last one
+// so that truncated files are detected
+func chunkNonce(index uint64) []byte {
+	nonce := make([]byte, encNonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+func chunkAAD(index uint64, final bool) []byte {
+	aad := binary.BigEndian.AppendUint64(nil, index)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// encryptWriter encrypts everything written to it into file, through w
+type encryptWriter struct {
+	file   *os.File  // Where the header is written once the size is known
+	w      io.Writer // Writes to file, e.g. to account for quota
+	keys   *KeyRing
+	aead   cipher.AEAD
+	header encHeader
+	dek    []byte
+	buf    []byte
+	index  uint64
+}
+
+// newEncryptWriter starts an encrypted file at the current position of file,
+// which must be its beginning
+func newEncryptWriter(file *os.File, w io.Writer, keys *KeyRing) (*encryptWriter, error) {
+	dek := make([]byte, encKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	ew := &encryptWriter{
+		file:   file,
+		w:      w,
+		keys:   keys,
+		aead:   aead,
+		header: encHeader{chunkSize: encChunkSize},
+		dek:    dek,
+		buf:    make([]byte, 0, encChunkSize),
+	}
+
+	// Reserve room for the header, written on Close
+	if _, err := w.Write(make([]byte, encHeaderSize)); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it isn't the last one
+		if len(ew.buf) == encChunkSize {
+			if err := ew.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):encChunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		ew.header.plainSize += uint64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) flush(final bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.index), ew.buf, chunkAAD(ew.index, final))
+	if _, err := ew.w.Write(sealed); err != nil {
+		return err
+	}
+	ew.index++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Close seals the last chunk and writes the header
+func (ew *encryptWriter) Close() error {
+	if err := ew.flush(true); err != nil {
+		return err
+	}
+	if err := ew.keys.wrap(&ew.header, ew.dek); err != nil {
+		return err
+	}
+	_, err := ew.file.WriteAt(ew.header.marshal(), 0)
+	return err
+}
+
+// storedFile is the content of a stored file, decrypted if needed
+type storedFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Size() int64
+}
+
+// plainFile is a file stored in the clear
+type plainFile struct {
+	*os.File
+	size int64
+}
+
+func (f *plainFile) Size() int64 {
+	return f.size
+}
+
+// encryptedFile decrypts an encrypted file, one chunk at a time
+type encryptedFile struct {
+	file   *os.File
+	aead   cipher.AEAD
+	header *encHeader
+	chunks uint64
+	pos    int64
+
+	mu    sync.Mutex
+	index uint64 // Chunk held in plain
+	plain []byte
+}
+
+func (f *encryptedFile) Size() int64 {
+	return int64(f.header.plainSize)
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	read := 0
+	for len(p) > 0 {
+		if off >= f.Size() {
+			return read, io.EOF
+		}
+
+		chunkSize := int64(f.header.chunkSize)
+		index := uint64(off / chunkSize)
+		if err := f.load(index); err != nil {
+			return read, err
+		}
+
+		n := copy(p, f.plain[off%chunkSize:])
+		read += n
+		off += int64(n)
+		p = p[n:]
+	}
+	return read, nil
+}
+
+// load decrypts a chunk, unless it is the one already held
+func (f *encryptedFile) load(index uint64) error {
+	if f.plain != nil && f.index == index {
+		return nil
+	}
+
+	chunkSize := uint64(f.header.chunkSize)
+	plainLen := min(chunkSize, f.header.plainSize-index*chunkSize)
+	sealed := make([]byte, plainLen+encTagSize)
+	offset := int64(encHeaderSize) + int64(index*(chunkSize+encTagSize))
+	if _, err := f.file.ReadAt(sealed, offset); err != nil {
+		if err == io.EOF {
+			return ErrDecrypt
+		}
+		return err
+	}
+
+	plain, err := f.aead.Open(f.plain[:0], chunkNonce(index), sealed, chunkAAD(index, index == f.chunks-1))
+	if err != nil {
+		f.plain = nil
+		return ErrDecrypt
+	}
+	f.index = index
+	f.plain = plain
+	return nil
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	if f.pos >= f.Size() {
+		return 0, io.EOF
+	}
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *encryptedFile) Close() error {
+	return f.file.Close()
+}
+
+// readEncHeader returns the header of an encrypted file, or nil for a plain file
+func readEncHeader(file *os.File) *encHeader {
+	buf := make([]byte, encHeaderSize)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return nil
+	}
+	return parseEncHeader(buf)
+}
+
+// UseEncryption makes fm encrypt new files with keys, and decrypt stored ones
+func (fm *FileManager) UseEncryption(keys *KeyRing) {
+	fm.keys = keys
+}
+
+// openFile opens a stored file for reading its content
+func (fm *FileManager) openFile(path string) (storedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := (*encHeader)(nil)
+	if fm.keys != nil && info.Mode().IsRegular() {
+		header = readEncHeader(file)
+	}
+	if header == nil {
+		return &plainFile{File: file, size: info.Size()}, nil
+	}
+
+	dek, err := fm.keys.unwrap(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	chunks := (header.plainSize + uint64(header.chunkSize) - 1) / uint64(header.chunkSize)
+	return &encryptedFile{file: file, aead: aead, header: header, chunks: max(chunks, 1)}, nil
+}
+
+// fileSize returns the size of a stored file's content, which for encrypted
+// files is smaller than the size on disk
+func (fm *FileManager) fileSize(path string, info fs.FileInfo) int64 {
+	if fm.keys == nil || !info.Mode().IsRegular() || info.Size() < int64(encHeaderSize) {
+		return info.Size()
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return info.Size()
+	}
+	defer file.Close()
+
+	if header := readEncHeader(file); header != nil {
+		return int64(header.plainSize)
+	}
+	return info.Size()
+}
+
+// isEncrypted reports whether a stored file is encrypted
+func isEncrypted(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return readEncHeader(file) != nil
+}
+
+// encryptTemp replaces a plain temporary file with its encrypted version,
+// reserving the extra space for username
+func (fm *FileManager) encryptTemp(username, tmpPath string) error {
+	if isEncrypted(tmpPath) {
+		return nil
+	}
+
+	encPath, err := fm.encryptCopy(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	oldInfo, err1 := os.Stat(tmpPath)
+	newInfo, err2 := os.Stat(encPath)
+	if err1 != nil || err2 != nil {
+		os.Remove(encPath)
+		return errors.New("error encrypting file")
+	}
+	if username != "" {
+		if err := fm.ReserveSpace(username, newInfo.Size()-oldInfo.Size()); err != nil {
+			os.Remove(encPath)
+			return err
+		}
+	}
+
+	if err := os.Rename(encPath, tmpPath); err != nil {
+		os.Remove(encPath)
+		if username != "" {
+			fm.ReleaseSpace(username, newInfo.Size()-oldInfo.Size())
+		}
+		return err
+	}
+	return nil
+}
+
+// encryptCopy writes an encrypted copy of a plain file next to it, with the
+// same permissions and modification time, and returns its path
+func (fm *FileManager) encryptCopy(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(path), uploadTempPrefix+"enc-*")
+	if err != nil {
+		return "", err
+	}
+	dstPath := dst.Name()
+
+	ew, err := newEncryptWriter(dst, dst, fm.keys)
+	if err == nil {
+		_, err = io.Copy(ew, src)
+	}
+	if err == nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = dst.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(dstPath)
+		return "", err
+	}
+	return dstPath, nil
+}
+
+// EncryptExisting encrypts every plain file in the user trees, except skip.
+// It is meant to run while the server is stopped, after enabling encryption.
+func (fm *FileManager) EncryptExisting(skip string) (int, error) {
+	count := 0
+	err := fm.walkStored(func(path string, info fs.FileInfo) error {
+		if path == skip || isEncrypted(path) {
+			return nil
+		}
+
+		encPath, err := fm.encryptCopy(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		// Identical files are linked to the same encrypted blob again
+		if fm.blobs != nil {
+			if sum, err := fm.hashFile(path); err == nil {
+				if linkPath, err := fm.blobs.Put(fm.ownerOf(path), encPath, sum); err == nil {
+					encPath = linkPath
+				}
+			}
+		}
+
+		if err := os.Rename(encPath, path); err != nil {
+			os.Remove(encPath)
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// RotateKeys wraps the data key of every encrypted file with the active master
+// key. File contents aren't rewritten, so rotation is fast; once it is done,
+// the previous master keys can be removed.
+func (fm *FileManager) RotateKeys() (int, error) {
+	count := 0
+	failed := 0
+	err := fm.walkStored(func(path string, info fs.FileInfo) error {
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer file.Close()
+
+		header := readEncHeader(file)
+		if header == nil || hex.EncodeToString(header.keyID[:]) == fm.keys.active {
+			return nil
+		}
+
+		dek, err := fm.keys.unwrap(header)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed++
+			return nil
+		}
+		if err := fm.keys.wrap(header, dek); err != nil {
+			return err
+		}
+
+		// The header fits in a single block, so it is replaced in place: this
+		// keeps hard links to deduplicated content intact
+		if _, err := file.WriteAt(header.marshal(), 0); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		count++
+		return nil
+	})
+
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d files could not be decrypted with the given keys", failed)
+	}
+	return count, err
+}
+
+// walkStored calls fn for every stored regular file, skipping uploads in progress
+func (fm *FileManager) walkStored(fn func(path string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(fm.baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), uploadTempPrefix) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// ownerOf returns the user or space whose directory holds a path found by walkStored
+func (fm *FileManager) ownerOf(path string) string {
+	rel, err := filepath.Rel(fm.baseDir, path)
+	if err != nil {
+		return ""
+	}
+	owner, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return owner
+}
+
+// hashFile returns the hex SHA-256 of a stored file's content
+func (fm *FileManager) hashFile(path string) (string, error) {
+	file, err := fm.openFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readFile returns the content of a stored file, up to limit bytes
+func (fm *FileManager) readFile(path string, limit int64) ([]byte, error) {
+	file, err := fm.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, io.LimitReader(file, limit))
+	return buf.Bytes(), err
+}
+
+// EncryptExistingFiles encrypts the files stored before encryption was enabled.
+// The server must not be running.
+func EncryptExistingFiles(cfg Config) (int, error) {
+	fm, err := maintenanceFileManager(cfg)
+	if err != nil {
+		return 0, err
+	}
+	// The credentials file is read directly by the server
+	return fm.EncryptExisting(credentialsPath(cfg.DataDir))
+}
+
+// RotateKeys re-wraps every file key with the active master key.
+// The server must not be running.
+func RotateKeys(cfg Config) (int, error) {
+	fm, err := maintenanceFileManager(cfg)
+	if err != nil {
+		return 0, err
+	}
+	return fm.RotateKeys()
+}
+
+// maintenanceFileManager returns a file manager for offline maintenance of the data directory
+func maintenanceFileManager(cfg Config) (*FileManager, error) {
+	if cfg.Keys == nil {
+		return nil, errors.New("no master key configured")
+	}
+
+	fm := NewFileManager(filepath.Join(cfg.DataDir, "files"), nil)
+	fm.UseEncryption(cfg.Keys)
+	if cfg.CAS {
+		NewBlobStore(filepath.Join(cfg.DataDir, "cas"), fm)
+	}
+	return fm, nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestKeyRing returns a key ring of new keys, the first one active
+func newTestKeyRing(t *testing.T, count int) (*KeyRing, []string) {
+	t.Helper()
+	var keys []string
+	for i := 0; i < count; i++ {
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return mustParseKeyRing(t, keys...), keys
+}
+
+// mustParseKeyRing parses keys, one per line
+func mustParseKeyRing(t *testing.T, keys ...string) *KeyRing {
+	t.Helper()
+	var text string
+	for _, key := range keys {
+		text += key + "\n"
+	}
+	kr, err := ParseKeyRing(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+// readStored returns the decrypted content of a stored file
+func readStored(fm *FileManager, path string) ([]byte, error) {
+	file, err := fm.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	fm, baseDir := newTestFileManager(t, "alice/.keep")
+	keys, _ := newTestKeyRing(t, 1)
+	fm.UseEncryption(keys)
+
+	// Spans several chunks, the last one partial
+	content := make([]byte, 2*encChunkSize+1000)
+	rand.Read(content)
+	if _, _, err := fm.SaveFile("alice", "", "data.bin", bytes.NewReader(content), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(baseDir, "alice", "data.bin")
+
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(path) || bytes.Contains(stored, content[:64]) {
+		t.Fatal("file stored in the clear")
+	}
+	info, _ := os.Stat(path)
+	if size := fm.fileSize(path, info); size != int64(len(content)) {
+		t.Errorf("size: got %d, want %d", size, len(content))
+	}
+
+	got, err := readStored(fm, path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("read: %d bytes (%v), want %d", len(got), err, len(content))
+	}
+
+	// Ranges across chunk boundaries are read without the rest of the file
+	file, err := fm.openFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, off := range []int64{0, encChunkSize - 10, 2*encChunkSize - 1, int64(len(content)) - 20} {
+		buf := make([]byte, 20)
+		if n, err := file.ReadAt(buf, off); n != len(buf) || (err != nil && err != io.EOF) {
+			t.Fatalf("range at %d: read %d (%v)", off, n, err)
+		}
+		if !bytes.Equal(buf, content[off:off+20]) {
+			t.Errorf("range at %d: wrong content", off)
+		}
+	}
+
+	// Tampered chunks are refused
+	stored[encHeaderSize+encChunkSize+encTagSize+5] ^= 1
+	if err := os.WriteFile(path, stored, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readStored(fm, path); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("tampered file: got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	fm, baseDir := newTestFileManager(t, "alice/.keep", "alice/plain.txt")
+	_, keys := newTestKeyRing(t, 2)
+	oldKey, newKey := keys[1], keys[0]
+
+	fm.UseEncryption(mustParseKeyRing(t, oldKey))
+	if _, _, err := fm.SaveFile("alice", "", "notes.txt", bytes.NewReader([]byte("secret notes")), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(baseDir, "alice", "notes.txt")
+
+	// The new key is active, the old one still reads files written before
+	fm.UseEncryption(mustParseKeyRing(t, newKey, oldKey))
+	count, err := fm.RotateKeys()
+	if err != nil || count != 1 {
+		t.Fatalf("rotate: %d files (%v), want 1", count, err)
+	}
+	if count, err := fm.RotateKeys(); err != nil || count != 0 {
+		t.Errorf("rotate again: %d files (%v), want 0", count, err)
+	}
+
+	fm.UseEncryption(mustParseKeyRing(t, newKey))
+	if got, err := readStored(fm, path); err != nil || string(got) != "secret notes" {
+		t.Errorf("read with the new key: %q (%v)", got, err)
+	}
+	if got, err := readStored(fm, filepath.Join(baseDir, "alice", "plain.txt")); err != nil || string(got) != "alice/plain.txt" {
+		t.Errorf("read plain file: %q (%v)", got, err)
+	}
+
+	fm.UseEncryption(mustParseKeyRing(t, oldKey))
+	if _, err := readStored(fm, path); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("read with the old key: got %v, want ErrDecrypt", err)
+	}
+
+	// Files the keys can't open are reported
+	other, _ := newTestKeyRing(t, 1)
+	fm.UseEncryption(other)
+	if _, err := fm.RotateKeys(); err == nil {
+		t.Error("rotation without the file's key succeeded")
+	}
+}
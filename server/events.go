@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event stream settings
+const (
+	eventBuffer    = 64               // Changes queued per client before it has to reload instead
+	eventHeartbeat = 25 * time.Second // Keeps proxies from closing idle streams, and signed out clients are dropped
+)
+
+// EventHub passes file changes on, as they happen, to the clients watching the
+// folders they happen in
+type EventHub struct {
+	subscribers map[*eventSubscriber]struct{}
+	mu          sync.Mutex
+}
+
+// eventSubscriber is a client watching a folder
+type eventSubscriber struct {
+	owner     string // User or space whose directory holds the folder
+	folder    string // Relative to the owner's directory, "" being the directory itself
+	recursive bool   // Whether changes deeper than the folder's direct children count
+	changes   chan Change
+	missed    atomic.Bool // Changes were dropped while the queue was full
+	replaced  atomic.Bool // The folder itself was deleted or moved
+}
+
+// NewEventHub creates an event hub publishing the changes of the file manager
+func NewEventHub(fm *FileManager) *EventHub {
+	hub := &EventHub{
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+	fm.OnChange(hub.publish)
+	return hub
+}
+
+// subscribe starts watching a folder of owner's directory
+func (hub *EventHub) subscribe(owner, folder string, recursive bool) *eventSubscriber {
+	sub := &eventSubscriber{
+		owner:     owner,
+		folder:    folder,
+		recursive: recursive,
+		changes:   make(chan Change, eventBuffer),
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe stops passing changes to a subscriber
+func (hub *EventHub) unsubscribe(sub *eventSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.subscribers, sub)
+}
+
+// publish queues a change for the subscribers watching where it happened. It
+// never blocks on slow clients, they are told to reload instead.
+func (hub *EventHub) publish(event FileEvent) {
+	change := Change{
+		Type:    event.Type,
+		Path:    event.Path,
+		OldPath: event.OldPath,
+		IsDir:   event.IsDir,
+		SHA256:  event.SHA256,
+		Time:    time.Now().UTC(),
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for sub := range hub.subscribers {
+		if sub.owner != event.Username {
+			continue
+		}
+		if folderReplaced(sub.folder, change) {
+			sub.replaced.Store(true)
+			sub.notify()
+			continue
+		}
+		c, ok := relativeChange(sub.folder, change, sub.recursive)
+		if !ok {
+			continue
+		}
+		select {
+		case sub.changes <- c:
+		default:
+			sub.missed.Store(true)
+		}
+	}
+}
+
+// notify wakes the subscriber up to look at its flags, unless changes are
+// queued already
+func (sub *eventSubscriber) notify() {
+	select {
+	case sub.changes <- Change{}:
+	default:
+	}
+}
+
+// HandleEvents streams the changes made to a folder as Server-Sent Events,
+// until the client disconnects or signs out
+func (h *APIHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	query := r.URL.Query()
+	folder := query.Get("path")
+	if folder == "" {
+		folder = "root"
+	}
+	recursive := query.Get("recursive") == "true"
+
+	loc, rel := h.locateFolder(w, username, folder)
+	if loc == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := h.events.subscribe(loc.Owner, rel, recursive)
+	defer h.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Nginx would hold the events back
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "event: ready\ndata: {}\n\n")
+	flusher.Flush()
+
+	// Access to shared folders may be withdrawn while watching
+	allowed := func() bool {
+		if loc.Owner == username {
+			return true
+		}
+		current, err := h.acls.Resolve(username, folder)
+		return err == nil && current.Owner == loc.Owner && current.Path == loc.Path && current.Allows(AccessRead)
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if _, err := h.getUsernameFromToken(r); err != nil || !allowed() {
+				return
+			}
+			fmt.Fprint(w, ": ping\n\n")
+
+		case change := <-sub.changes:
+			switch {
+			case sub.replaced.Load():
+				// The client has to find out where the folder went
+				fmt.Fprint(w, "event: gone\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			case !allowed():
+				return
+			case sub.missed.Swap(false):
+				// Too far behind to catch up change by change
+				fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+			case change.Type != "":
+				data, err := json.Marshal(change)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "event: change\ndata: %s\n\n", data)
+			}
+		}
+		flusher.Flush()
+	}
+}
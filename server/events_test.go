@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queuedChanges returns the changes waiting for a subscriber
+func queuedChanges(sub *eventSubscriber) []string {
+	var summary []string
+	for {
+		select {
+		case c := <-sub.changes:
+			summary = append(summary, changeSummary([]Change{c})...)
+		default:
+			return summary
+		}
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	fm, _ := newTestFileManager(t, "alice/docs/.keep", "bob/.keep")
+	hub := NewEventHub(fm)
+	direct := hub.subscribe("alice", "docs", false)
+	recursive := hub.subscribe("alice", "docs", true)
+
+	if err := fm.CreateFolder("alice", "docs", "sub"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"docs", "docs/sub", ""} {
+		if _, _, err := fm.SaveFile("alice", path, "a.txt", strings.NewReader("a"), SaveOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := fm.SaveFile("bob", "", "docs", strings.NewReader("b"), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(queuedChanges(direct), ","), EventCreate+" sub,"+EventCreate+" a.txt"; got != want {
+		t.Errorf("direct children: got %s, want %s", got, want)
+	}
+	if got, want := strings.Join(queuedChanges(recursive), ","), EventCreate+" sub,"+EventCreate+" a.txt,"+EventCreate+" sub/a.txt"; got != want {
+		t.Errorf("whole folder: got %s, want %s", got, want)
+	}
+
+	// Slow clients are told to reload rather than holding changes back
+	for i := 0; i <= eventBuffer; i++ {
+		if _, _, err := fm.SaveFile("alice", "docs", "a.txt", strings.NewReader("a"), SaveOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !direct.missed.Load() {
+		t.Error("full queue not reported")
+	}
+
+	hub.unsubscribe(direct)
+	queuedChanges(recursive)
+	if err := fm.RenameItem("alice", "", "docs", "papers"); err != nil {
+		t.Fatal(err)
+	}
+	if !recursive.replaced.Load() {
+		t.Error("moved folder not reported")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	h := newTestAPIHandler(t)
+	token, err := h.authManager.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(h.HandleEvents))
+	defer server.Close()
+
+	r, _ := http.NewRequest(http.MethodGet, server.URL+"/api/events?path=", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return ""
+	}
+
+	if line := next(); line != "event: ready" {
+		t.Fatalf("first event: %q", line)
+	}
+	next()
+	next()
+	if _, _, err := h.fileManager.SaveFile("alice", "", "notes.txt", strings.NewReader("notes"), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if line := next(); line != "event: change" {
+		t.Fatalf("change event: %q", line)
+	}
+	if line := next(); !strings.Contains(line, `"path":"notes.txt"`) || !strings.Contains(line, `"type":"`+EventCreate+`"`) {
+		t.Errorf("change data: %q", line)
+	}
+}
@@ -0,0 +1,539 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Conflict policies for files that already exist at the destination
+const (
+	ConflictFail      = "fail"      // Abort without extracting anything
+	ConflictSkip      = "skip"      // Keep the existing file
+	ConflictOverwrite = "overwrite" // Replace the existing file
+	ConflictRename    = "rename"    // Extract as "name (1).ext"
+)
+
+var (
+	// ErrExtractConflict is returned by the fail policy when a file already exists
+	ErrExtractConflict = errors.New("destination already contains files from the archive")
+	// ErrArchiveLimit is returned when an archive exceeds the extraction limits
+	ErrArchiveLimit = errors.New("archive exceeds extraction limits")
+	// ErrUnsafeArchive is returned for entries that would escape the destination
+	ErrUnsafeArchive = errors.New("archive contains an unsafe path")
+)
+
+// ExtractLimits bounds what a single extraction may produce (protection against zip bombs)
+type ExtractLimits struct {
+	MaxTotalSize int64 // Maximum uncompressed bytes
+	MaxFiles     int   // Maximum number of entries
+	MaxRatio     int64 // Maximum uncompressed to compressed size ratio
+}
+
+// DefaultExtractLimits are used when no limits are configured
+var DefaultExtractLimits = ExtractLimits{
+	MaxTotalSize: 10 << 30,
+	MaxFiles:     100000,
+	MaxRatio:     200,
+}
+
+// ratioGrace is the output size below which the compression ratio isn't checked
+const ratioGrace = 1 << 20
+
+// ExtractResult summarizes an extraction
+type ExtractResult struct {
+	Extracted int   `json:"extracted"`
+	Skipped   int   `json:"skipped"`
+	Renamed   int   `json:"renamed"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// DetectArchiveFormat guesses the archive format from a file name
+func DetectArchiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return FormatZip
+	case strings.HasSuffix(lower, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return FormatTarZst
+	}
+	return ""
+}
+
+// ExtractArchive unpacks the archive called name inside path into destPath (both relative
+// to user directory). Everything is first extracted to a hidden staging folder inside the
+// destination, counting towards the quota as it is written, and then moved into place
+// according to the conflict policy.
+func (fm *FileManager) ExtractArchive(username, path, name, destPath, format, conflict string, limits ExtractLimits) (result *ExtractResult, err error) {
+	if format == "" {
+		format = DetectArchiveFormat(name)
+	}
+	if conflict == "" {
+		conflict = ConflictFail
+	}
+	switch conflict {
+	case ConflictFail, ConflictSkip, ConflictOverwrite, ConflictRename:
+	default:
+		return nil, errors.New("invalid conflict policy")
+	}
+
+	archivePath, err := fm.resolveItem(username, path, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("not a file")
+	}
+
+	destDir, err := fm.resolvePath(username, destPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// A destination created here is removed again if nothing could be extracted
+	if _, err := os.Stat(destDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return nil, err
+		}
+		fm.emit(FileEvent{Type: EventCreate, Username: username, Path: fm.relPath(username, destDir), IsDir: true})
+		defer func() {
+			if result == nil && os.Remove(destDir) == nil {
+				fm.emit(FileEvent{Type: EventDelete, Username: username, Path: fm.relPath(username, destDir), IsDir: true})
+			}
+		}()
+	}
+
+	staging, err := os.MkdirTemp(destDir, uploadTempPrefix+"extract-")
+	if err != nil {
+		return nil, err
+	}
+	defer fm.removeStaging(username, staging)
+
+	ex := &extractor{
+		fm:          fm,
+		username:    username,
+		root:        staging,
+		limits:      limits,
+		archiveSize: fm.fileSize(archivePath, info),
+	}
+
+	switch format {
+	case FormatZip:
+		err = ex.extractZip(archivePath)
+	case FormatTar, FormatTarGz, FormatTarZst:
+		err = ex.extractTar(archivePath, format)
+	default:
+		return nil, errors.New("unsupported archive format")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &ExtractResult{Bytes: ex.written}
+	if err := fm.mergeStaging(username, staging, destDir, conflict, merged); err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
+
+// extractor writes archive entries below root while enforcing the limits
+type extractor struct {
+	fm          *FileManager
+	username    string
+	root        string
+	limits      ExtractLimits
+	archiveSize int64
+	files       int
+	written     int64
+}
+
+// extractZip extracts a ZIP archive
+func (ex *extractor) extractZip(archivePath string) error {
+	file, err := ex.fm.openFile(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zr, err := zip.NewReader(file, file.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range zr.File {
+		if entry.FileInfo().IsDir() {
+			if err := ex.addDir(entry.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = ex.addFile(entry.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractTar extracts a plain, gzip or zstd compressed tar archive
+func (ex *extractor) extractTar(archivePath, format string) error {
+	file, err := ex.fm.openFile(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var src io.Reader = file
+	switch format {
+	case FormatTarGz:
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		src = gr
+	case FormatTarZst:
+		zr, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(256<<20))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Links, devices and other special entries are never created
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = ex.addDir(header.Name)
+		case tar.TypeReg:
+			err = ex.addFile(header.Name, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// target validates an entry name and returns where it must be written
+func (ex *extractor) target(name string) (string, bool, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", false, ErrUnsafeArchive
+	}
+
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		switch {
+		case part == "" || part == ".":
+			continue
+		case part == "..":
+			return "", false, ErrUnsafeArchive
+		case strings.HasPrefix(part, uploadTempPrefix):
+			return "", false, nil
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", false, nil
+	}
+
+	fullPath := filepath.Join(append([]string{ex.root}, parts...)...)
+	if !isWithinDir(ex.root, fullPath) {
+		return "", false, ErrUnsafeArchive
+	}
+
+	return fullPath, true, nil
+}
+
+// count registers one more entry against the file limit
+func (ex *extractor) count() error {
+	ex.files++
+	if ex.limits.MaxFiles > 0 && ex.files > ex.limits.MaxFiles {
+		return ErrArchiveLimit
+	}
+	return nil
+}
+
+// addDir creates a folder entry
+func (ex *extractor) addDir(name string) error {
+	fullPath, ok, err := ex.target(name)
+	if err != nil || !ok {
+		return err
+	}
+	if err := ex.count(); err != nil {
+		return err
+	}
+
+	return os.MkdirAll(fullPath, 0755)
+}
+
+// addFile writes a file entry, checking size limits as data is decompressed
+func (ex *extractor) addFile(name string, content io.Reader) error {
+	fullPath, ok, err := ex.target(name)
+	if err != nil || !ok {
+		return err
+	}
+	if err := ex.count(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	// Archives may contain the same file twice, the last one wins
+	if info, err := os.Stat(fullPath); err == nil && info.Mode().IsRegular() {
+		ex.fm.ReleaseSpace(ex.username, info.Size())
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Data is accounted to the quota while it is written, and released with the staging folder on error
+	qw := &quotaWriter{fm: ex.fm, username: ex.username, w: file}
+	_, err = io.Copy(&limitedExtractWriter{ex: ex, w: qw}, content)
+	return err
+}
+
+// limitedExtractWriter fails once the extraction goes over its size or ratio limits
+type limitedExtractWriter struct {
+	ex *extractor
+	w  io.Writer
+}
+
+func (lw *limitedExtractWriter) Write(p []byte) (int, error) {
+	ex := lw.ex
+	total := ex.written + int64(len(p))
+
+	if ex.limits.MaxTotalSize > 0 && total > ex.limits.MaxTotalSize {
+		return 0, ErrArchiveLimit
+	}
+	if ex.limits.MaxRatio > 0 && total > ratioGrace && total > ex.limits.MaxRatio*ex.archiveSize {
+		return 0, ErrArchiveLimit
+	}
+
+	n, err := lw.w.Write(p)
+	ex.written += int64(n)
+	return n, err
+}
+
+// mergeStaging moves the extracted tree from staging into destDir
+func (fm *FileManager) mergeStaging(username, staging, destDir, conflict string, result *ExtractResult) error {
+	for _, name := range []string{SharedRoot, SpacesRoot} {
+		if _, err := os.Lstat(filepath.Join(staging, name)); err == nil && fm.reserved(username, filepath.Join(destDir, name)) {
+			return ErrReservedName
+		}
+	}
+
+	// With the fail policy nothing is moved if any file already exists
+	if conflict == ConflictFail {
+		err := filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(staging, path)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Lstat(filepath.Join(destDir, rel)); err == nil {
+				return ErrExtractConflict
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(destDir, rel)
+
+		if d.IsDir() {
+			// Folders are merged with existing ones
+			info, err := os.Stat(target)
+			if err == nil {
+				if !info.IsDir() {
+					return fmt.Errorf("%s already exists and is not a folder", filepath.ToSlash(rel))
+				}
+				return nil
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			fm.emit(FileEvent{Type: EventCreate, Username: username, Path: fm.relPath(username, target), IsDir: true})
+			return nil
+		}
+
+		if info, err := os.Lstat(target); err == nil {
+			switch {
+			case conflict == ConflictRename:
+				target = uniqueName(target)
+				result.Renamed++
+			case conflict == ConflictOverwrite && info.Mode().IsRegular():
+				// Replaced below by commitTemp
+			default:
+				result.Skipped++
+				return nil
+			}
+		}
+
+		if err := fm.commitTemp(username, path, target, ""); err != nil {
+			return err
+		}
+		result.Extracted++
+		return nil
+	})
+}
+
+// removeStaging deletes what is left of a staging folder and releases its space
+func (fm *FileManager) removeStaging(username, staging string) {
+	size, _ := dirSize(staging)
+	os.RemoveAll(staging)
+	remaining, _ := dirSize(staging)
+	fm.ReleaseSpace(username, size-remaining)
+}
+
+// uniqueName returns a variant of path ("name (1).ext", "name (2).ext", ...) that doesn't exist
+func uniqueName(path string) string {
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// HandleExtract unpacks an archive stored in the user's directory
+func (h *APIHandler) HandleExtract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	var req struct {
+		Path        string `json:"path"`
+		Name        string `json:"name"`
+		Destination string `json:"destination"`
+		Format      string `json:"format"`
+		Conflict    string `json:"conflict"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Archive name not specified"})
+		return
+	}
+
+	src, name := h.locateItem(w, username, req.Path, req.Name)
+	if src == nil {
+		return
+	}
+	dest := h.locate(w, username, req.Destination, AccessWrite)
+	if dest == nil {
+		return
+	}
+
+	// Archives are extracted within a tree, whose owner is charged for the files
+	if src.Owner != dest.Owner {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "The archive must be extracted in the tree it is stored in"})
+		return
+	}
+
+	result, err := h.fileManager.ExtractArchive(dest.Owner, src.Path, name, dest.Path, req.Format, req.Conflict, h.extractLimits)
+	h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: username, Action: AuditExtract, Owner: src.Owner, Path: auditPath(src.Path, name), Target: dest.Path}, err)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, ErrQuotaExceeded):
+			status = http.StatusInsufficientStorage
+		case errors.Is(err, ErrArchiveLimit):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, ErrExtractConflict), errors.Is(err, ErrReservedName):
+			status = http.StatusConflict
+		case os.IsNotExist(err):
+			status = http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"result":  result,
+	})
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a file of a test archive
+type archiveEntry struct {
+	name    string
+	content string
+}
+
+// writeTestZip stores a ZIP archive of entries at name in alice's directory
+func writeTestZip(t *testing.T, baseDir, name string, entries ...archiveEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, "alice", name), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// userEntries lists what is left in a folder of alice's directory
+func userEntries(t *testing.T, baseDir, path string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(baseDir, "alice", path))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	limits := ExtractLimits{MaxTotalSize: 4 << 20, MaxFiles: 3, MaxRatio: 200}
+	random := make([]byte, 5<<20)
+	rand.Read(random)
+
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		want    error
+	}{
+		{"within limits", []archiveEntry{{"a.txt", "a"}, {"docs/b.txt", "b"}}, nil},
+		{"too many files", []archiveEntry{{"a", "a"}, {"b", "b"}, {"c", "c"}, {"d", "d"}}, ErrArchiveLimit},
+		{"too large", []archiveEntry{{"big.bin", string(random)}}, ErrArchiveLimit},
+		// Highly compressed content is refused once past the grace size
+		{"compression ratio", []archiveEntry{{"bomb.bin", strings.Repeat("0", 3<<20)}}, ErrArchiveLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm, baseDir := newTestFileManager(t, "alice/.keep")
+			writeTestZip(t, baseDir, "archive.zip", tt.entries...)
+
+			result, err := fm.ExtractArchive("alice", "", "archive.zip", "out", "", "", limits)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if tt.want == nil {
+				if result.Extracted != len(tt.entries) {
+					t.Errorf("extracted %d files, want %d", result.Extracted, len(tt.entries))
+				}
+				assertExists(t, baseDir, "alice/out/docs/b.txt")
+				return
+			}
+
+			// Nothing is left behind, not even the destination created for the extraction
+			if names := userEntries(t, baseDir, ""); len(names) != 2 {
+				t.Errorf("alice's directory holds %v", names)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveUnsafePaths(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "docs/../../evil.txt", "/evil.txt", `..\evil.txt`} {
+		t.Run(name, func(t *testing.T) {
+			fm, baseDir := newTestFileManager(t, "alice/.keep")
+			writeTestZip(t, baseDir, "archive.zip", archiveEntry{"ok.txt", "ok"}, archiveEntry{name, "evil"})
+
+			if _, err := fm.ExtractArchive("alice", "", "archive.zip", "", "", "", DefaultExtractLimits); !errors.Is(err, ErrUnsafeArchive) {
+				t.Fatalf("got %v, want ErrUnsafeArchive", err)
+			}
+			if names := userEntries(t, baseDir, ""); len(names) != 2 {
+				t.Errorf("alice's directory holds %v", names)
+			}
+			if _, err := os.Stat(filepath.Join(baseDir, "evil.txt")); err == nil {
+				t.Error("entry written outside the user directory")
+			}
+		})
+	}
+}
+
+// Links in tar archives are never created
+func TestExtractArchiveSkipsLinks(t *testing.T) {
+	fm, baseDir := newTestFileManager(t, "alice/.keep", "bob/secret.txt")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../../bob/secret.txt"})
+	tw.WriteHeader(&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../../bob/secret.txt"})
+	tw.WriteHeader(&tar.Header{Name: "notes.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("notes"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, "alice", "archive.tar"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := fm.ExtractArchive("alice", "", "archive.tar", "out", "", "", DefaultExtractLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := userEntries(t, baseDir, "out"); len(names) != 1 || names[0] != "notes.txt" || result.Extracted != 1 {
+		t.Errorf("extracted %v (%+v), want notes.txt only", names, result)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package server
+
+import "io/fs"
+
+// linkCount returns the number of hard links to a file. It isn't known on this
+// platform, so blobs are never considered unreferenced.
+func linkCount(info fs.FileInfo) int {
+	return -1
+}
+
+// inode returns the inode number of a file, which isn't known on this platform
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -3,31 +3,88 @@ package server
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
+	"time"
+)
+
+// uploadTempPrefix marks files that are still being written
+const uploadTempPrefix = ".upload-"
+
+var (
+	// ErrInvalidPath is returned for folders outside of the user's directory
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrInvalidName is returned for item names that aren't a single path element
+	ErrInvalidName = errors.New("invalid name")
 )
 
 // FileItem represents a file or folder
 type FileItem struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Type     string `json:"type"` // "file" or "folder"
-	Size     string `json:"size,omitempty"`
-	Modified string `json:"modified"`
-	Path     string `json:"path,omitempty"`
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`           // "file" or "folder"
+	Size        string          `json:"size,omitempty"` // Human readable size
+	Modified    string          `json:"modified"`       // Human readable date
+	Path        string          `json:"path,omitempty"` // Path relative to user directory
+	Bytes       int64           `json:"bytes"`
+	ModifiedAt  string          `json:"modifiedAt"` // RFC 3339 modification time (with nanoseconds)
+	MimeType    string          `json:"mimeType,omitempty"`
+	SHA256      string          `json:"sha256,omitempty"` // Hex content hash, when known
+	ETag        string          `json:"etag,omitempty"`   // Validator for If-Match preconditions, files only
+	Owner       string          `json:"owner,omitempty"`  // User whose tree holds the item, when shared with the current user
+	Permissions ItemPermissions `json:"permissions"`
+}
+
+// ItemPermissions describes what can be done with a file or folder
+type ItemPermissions struct {
+	Read   bool `json:"read"`
+	Write  bool `json:"write"`
+	Delete bool `json:"delete"`
+	Rename bool `json:"rename"`
+}
+
+// File change event types
+const (
+	EventCreate = "create"
+	EventModify = "modify"
+	EventRename = "rename"
+	EventDelete = "delete"
+)
+
+// FileEvent describes a change made through the FileManager
+type FileEvent struct {
+	Type     string `json:"type"`
+	Username string `json:"-"`
+	Path     string `json:"path"`              // Relative to user directory
+	OldPath  string `json:"oldPath,omitempty"` // Previous path of renamed items
+	IsDir    bool   `json:"isDir"`
+	SHA256   string `json:"sha256,omitempty"` // Content hash of created or modified files, when already known
 }
 
 // FileManager manages file operations
 type FileManager struct {
-	baseDir string
+	baseDir   string
+	usage     *UsageTracker
+	quotaFor  func(username string) int64 // Returns a user's quota in bytes (0 = unlimited)
+	checksums *ChecksumStore              // Content hashes shown in FileItem (nil = none)
+	blobs     *BlobStore                  // Deduplicated content storage (nil = plain files)
+	keys      *KeyRing                    // Encrypts stored files (nil = stored in the clear)
+	listeners []func(FileEvent)
+	mu        sync.RWMutex
 }
 
 // NewFileManager creates a new file manager
-func NewFileManager(baseDir string) *FileManager {
+func NewFileManager(baseDir string, quotaFor func(username string) int64) *FileManager {
 	return &FileManager{
-		baseDir: baseDir,
+		baseDir:  baseDir,
+		usage:    NewUsageTracker(baseDir),
+		quotaFor: quotaFor,
 	}
 }
 
@@ -42,238 +99,609 @@ func (fm *FileManager) EnsureUserDir(username string) error {
 	return os.MkdirAll(userDir, 0755)
 }
 
-// ListFiles lists files in a folder (relative to user directory)
-func (fm *FileManager) ListFiles(username, path string) ([]FileItem, error) {
-	// Get user base directory
-	userDir := fm.GetUserDir(username)
+// OnChange registers a function called after every change made through the FileManager
+func (fm *FileManager) OnChange(listener func(FileEvent)) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.listeners = append(fm.listeners, listener)
+}
 
-	// Normalize path
-	if path == "" || path == "root" || path == "/" {
-		path = userDir
-	} else {
-		// Check if path is relative or absolute
-		if !filepath.IsAbs(path) {
-			path = filepath.Join(userDir, path)
-		}
-		// Check if path is within userDir (security)
-		absUserDir, _ := filepath.Abs(userDir)
-		absPath, _ := filepath.Abs(path)
-		if !strings.HasPrefix(absPath, absUserDir) {
-			return nil, errors.New("invalid path")
-		}
+// emit notifies the registered listeners of a change
+func (fm *FileManager) emit(event FileEvent) {
+	fm.mu.RLock()
+	listeners := fm.listeners
+	fm.mu.RUnlock()
+
+	for _, listener := range listeners {
+		listener(event)
 	}
+}
 
-	// Check if directory exists
-	info, err := os.Stat(path)
+// GetUsage returns the bytes used by a user and their quota (0 = unlimited)
+func (fm *FileManager) GetUsage(username string) (int64, int64, error) {
+	used, err := fm.usage.Usage(username)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-	if !info.IsDir() {
-		return nil, errors.New("not a directory")
+	return used, fm.quota(username), nil
+}
+
+// ReserveSpace accounts size bytes to the user, failing with ErrQuotaExceeded if they don't fit
+func (fm *FileManager) ReserveSpace(username string, size int64) error {
+	return fm.usage.Reserve(username, size, fm.quota(username))
+}
+
+// ReleaseSpace gives back size bytes previously accounted to the user
+func (fm *FileManager) ReleaseSpace(username string, size int64) {
+	fm.usage.Add(username, -size)
+}
+
+// quota returns the user's quota in bytes (0 = unlimited)
+func (fm *FileManager) quota(username string) int64 {
+	if fm.quotaFor == nil {
+		return 0
 	}
+	return fm.quotaFor(username)
+}
 
-	// Read directory
-	entries, err := os.ReadDir(path)
+// ListFiles lists files in a folder (relative to user directory)
+func (fm *FileManager) ListFiles(username, path string) ([]FileItem, error) {
+	page, err := fm.ListFilesPage(username, path, DefaultListOptions)
 	if err != nil {
 		return nil, err
 	}
+	return page.Items, nil
+}
+
+// CreateFolder creates a new folder (relative to user directory)
+func (fm *FileManager) CreateFolder(username, parentPath, folderName string) error {
+	newPath, err := fm.resolveItem(username, parentPath, folderName)
+	if err != nil {
+		return err
+	}
+	userDir, err := fm.resolvePath(username, "")
+	if err != nil {
+		return err
+	}
+
+	// Missing parents are created too, each one is reported
+	var created []string
+	for dir := newPath; dir != userDir && isWithinDir(userDir, dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+	}
+	if err := os.MkdirAll(newPath, 0755); err != nil {
+		return err
+	}
+
+	for i := len(created) - 1; i >= 0; i-- {
+		fm.emit(FileEvent{Type: EventCreate, Username: username, Path: fm.relPath(username, created[i]), IsDir: true})
+	}
+	return nil
+}
 
-	var items []FileItem
-	for _, entry := range entries {
-		item := FileItem{
-			ID:   entry.Name(),
-			Name: entry.Name(),
+// DeleteItems deletes files or folders (relative to user directory)
+func (fm *FileManager) DeleteItems(username, path string, names []string) error {
+	// Every name is checked before anything is deleted
+	itemPaths := make([]string, len(names))
+	for i, name := range names {
+		itemPath, err := fm.resolveItem(username, path, name)
+		if err != nil {
+			return err
 		}
+		itemPaths[i] = itemPath
+	}
 
-		entryPath := filepath.Join(path, entry.Name())
-		info, err := os.Stat(entryPath)
+	for _, itemPath := range itemPaths {
+		info, err := os.Stat(itemPath)
 		if err != nil {
 			continue
 		}
 
 		if info.IsDir() {
-			item.Type = "folder"
+			// Release only what was actually removed
+			size, _ := dirSize(itemPath)
+			os.RemoveAll(itemPath)
+			remaining, _ := dirSize(itemPath)
+			fm.ReleaseSpace(username, size-remaining)
 		} else {
-			item.Type = "file"
-			item.Size = formatSize(info.Size())
+			if os.Remove(itemPath) != nil {
+				continue
+			}
+			fm.ReleaseSpace(username, info.Size())
 		}
 
-		item.Modified = info.ModTime().Format("2006-01-02")
-		items = append(items, item)
+		fm.emit(FileEvent{Type: EventDelete, Username: username, Path: fm.relPath(username, itemPath), IsDir: info.IsDir()})
 	}
 
-	// Sort: folders first, then files, both by name
-	sort.Slice(items, func(i, j int) bool {
-		if items[i].Type != items[j].Type {
-			return items[i].Type == "folder"
-		}
-		return strings.ToLower(items[i].Name) < strings.ToLower(items[j].Name)
+	return nil
+}
+
+// RenameItem renames a file or folder (relative to user directory)
+func (fm *FileManager) RenameItem(username, path, oldName, newName string) error {
+	oldPath, err := fm.resolveItem(username, path, oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := fm.resolveItem(username, path, newName)
+	if err != nil {
+		return err
+	}
+
+	// A file replaced by the rename no longer counts towards the quota
+	var replaced int64
+	if info, err := os.Stat(newPath); err == nil && !info.IsDir() && oldPath != newPath {
+		replaced = info.Size()
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	fm.ReleaseSpace(username, replaced)
+
+	isDir := false
+	if info, err := os.Stat(newPath); err == nil {
+		isDir = info.IsDir()
+	}
+	fm.emit(FileEvent{
+		Type:     EventRename,
+		Username: username,
+		Path:     fm.relPath(username, newPath),
+		OldPath:  fm.relPath(username, oldPath),
+		IsDir:    isDir,
 	})
+	return nil
+}
+
+// MoveItem moves a file or folder to another folder of the user's tree, under
+// newName. A file already there is replaced, the destination folder must exist.
+func (fm *FileManager) MoveItem(username, path, name, newPath, newName string) error {
+	oldFull, err := fm.resolveItem(username, path, name)
+	if err != nil {
+		return err
+	}
+	newFull, err := fm.resolveItem(username, newPath, newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Dir(newFull)); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(oldFull)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && newFull != oldFull && isWithinDir(oldFull, newFull) {
+		return errors.New("a folder can't be moved into itself")
+	}
+
+	// A file replaced by the move no longer counts towards the quota
+	var replaced int64
+	if existing, err := os.Stat(newFull); err == nil && !existing.IsDir() && oldFull != newFull {
+		replaced = existing.Size()
+	}
 
-	return items, nil
+	if err := os.Rename(oldFull, newFull); err != nil {
+		return err
+	}
+
+	fm.ReleaseSpace(username, replaced)
+	fm.emit(FileEvent{
+		Type:     EventRename,
+		Username: username,
+		Path:     fm.relPath(username, newFull),
+		OldPath:  fm.relPath(username, oldFull),
+		IsDir:    info.IsDir(),
+	})
+	return nil
 }
 
-// CreateFolder creates a new folder (relative to user directory)
-func (fm *FileManager) CreateFolder(username, parentPath, folderName string) error {
-	// Get user base directory
-	userDir := fm.GetUserDir(username)
+// GetFileInfo gets information about a file (relative to user directory)
+func (fm *FileManager) GetFileInfo(username, path, name string) (*FileItem, error) {
+	filePath, err := fm.resolveItem(username, path, name)
+	if err != nil {
+		return nil, err
+	}
 
-	// Normalize path
-	if parentPath == "" || parentPath == "root" || parentPath == "/" {
-		parentPath = userDir
-	} else {
-		if !filepath.IsAbs(parentPath) {
-			parentPath = filepath.Join(userDir, parentPath)
-		}
-		// Check security
-		absUserDir, _ := filepath.Abs(userDir)
-		absPath, _ := filepath.Abs(parentPath)
-		if !strings.HasPrefix(absPath, absUserDir) {
-			return errors.New("invalid path")
-		}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
 	}
 
-	// Validate folder name
-	if folderName == "" || strings.ContainsAny(folderName, "/\\") {
-		return errors.New("invalid folder name")
+	parentWritable := false
+	if parentInfo, err := os.Stat(filepath.Dir(filePath)); err == nil {
+		parentWritable = parentInfo.Mode().Perm()&0200 != 0
 	}
 
-	newPath := filepath.Join(parentPath, folderName)
-	return os.MkdirAll(newPath, 0755)
+	item := fm.newFileItem(username, filePath, info, parentWritable)
+	return &item, nil
 }
 
-// DeleteItems deletes files or folders (relative to user directory)
-func (fm *FileManager) DeleteItems(username, path string, names []string) error {
-	// Get user base directory
-	userDir := fm.GetUserDir(username)
+// newFileItem builds the API representation of a file or folder
+func (fm *FileManager) newFileItem(username, fullPath string, info os.FileInfo, parentWritable bool) FileItem {
+	item := FileItem{
+		ID:         info.Name(),
+		Name:       info.Name(),
+		Modified:   info.ModTime().Format("2006-01-02"),
+		ModifiedAt: info.ModTime().Format(time.RFC3339Nano),
+		Permissions: ItemPermissions{
+			Read:   info.Mode().Perm()&0400 != 0,
+			Write:  info.Mode().Perm()&0200 != 0,
+			Delete: parentWritable,
+			Rename: parentWritable,
+		},
+	}
 
-	// Normalize path
-	if path == "" || path == "root" || path == "/" {
-		path = userDir
+	item.Path = fm.relPath(username, fullPath)
+
+	if info.IsDir() {
+		item.Type = "folder"
+		item.MimeType = "inode/directory"
 	} else {
-		if !filepath.IsAbs(path) {
-			path = filepath.Join(userDir, path)
-		}
-		// Check security
-		absUserDir, _ := filepath.Abs(userDir)
-		absPath, _ := filepath.Abs(path)
-		if !strings.HasPrefix(absPath, absUserDir) {
-			return errors.New("invalid path")
+		item.Type = "file"
+		item.ETag = fileETag(info)
+		size := fm.fileSize(fullPath, info)
+		item.Size = formatSize(size)
+		item.Bytes = size
+		item.MimeType = fm.detectMimeType(fullPath)
+		if fm.checksums != nil {
+			item.SHA256 = fm.checksums.Lookup(username, item.Path, info)
 		}
 	}
 
-	for _, name := range names {
-		itemPath := filepath.Join(path, name)
+	return item
+}
 
-		// Check security again
-		absUserDir, _ := filepath.Abs(userDir)
-		absItemPath, _ := filepath.Abs(itemPath)
-		if !strings.HasPrefix(absItemPath, absUserDir) {
-			continue
-		}
+// detectMimeType returns the MIME type of a file, from its extension or by sniffing its content
+func (fm *FileManager) detectMimeType(path string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(path)); mimeType != "" {
+		return mimeType
+	}
 
-		info, err := os.Stat(itemPath)
-		if err != nil {
-			continue
+	file, err := fm.openFile(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(file, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// SaveOptions are the conditions a file saved by SaveFile must meet
+type SaveOptions struct {
+	Expect      Digests // Digests the content must match
+	IfMatch     string  // The file being replaced must match one of these ETags
+	IfNoneMatch string  // The file being replaced must match none of these ETags, "*" if it must not exist
+}
+
+// check verifies the preconditions against the current file at dstPath
+func (opts SaveOptions) check(dstPath string) error {
+	if opts.IfMatch == "" && opts.IfNoneMatch == "" {
+		return nil
+	}
+	info, err := os.Stat(dstPath)
+	if err != nil {
+		info = nil
+	}
+	return checkPreconditions(info, opts.IfMatch, opts.IfNoneMatch)
+}
+
+// SaveFile streams src into a file inside path (relative to user directory).
+// Data is written to a temporary file in the same folder and renamed into place
+// once complete, so a failed or interrupted upload never leaves a partial file.
+// It returns the size and hex SHA-256 of the content. If it doesn't match the
+// digests in opts, the file is discarded and ErrChecksumMismatch returned.
+func (fm *FileManager) SaveFile(username, path, name string, src io.Reader, opts SaveOptions) (int64, string, error) {
+	dstPath, err := fm.resolveItem(username, path, name)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if info, err := os.Stat(dstPath); err == nil && info.IsDir() {
+		return 0, "", errors.New("a folder with that name already exists")
+	}
+
+	// Fail early, the preconditions are checked again before the file is replaced
+	if err := opts.check(dstPath); err != nil {
+		return 0, "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), uploadTempPrefix+"*")
+	if err != nil {
+		return 0, "", err
+	}
+	tmpPath := tmp.Name()
+
+	// CreateTemp uses 0600, keep the same permissions as regular files
+	tmp.Chmod(0644)
+
+	// Quota is reserved chunk by chunk as data arrives, the content is hashed on the way
+	qw := &quotaWriter{fm: fm, username: username, w: tmp}
+	var dst io.Writer = qw
+	var encrypter *encryptWriter
+	if fm.keys != nil {
+		if encrypter, err = newEncryptWriter(tmp, qw, fm.keys); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			fm.ReleaseSpace(username, qw.reserved)
+			return 0, "", err
 		}
+		dst = encrypter
+	}
 
-		if info.IsDir() {
-			os.RemoveAll(itemPath)
-		} else {
-			os.Remove(itemPath)
+	hashes := newDigestWriter(opts.Expect)
+	written, err := io.Copy(io.MultiWriter(dst, hashes), src)
+	if err == nil {
+		err = hashes.Verify(opts.Expect)
+	}
+	if err == nil && encrypter != nil {
+		err = encrypter.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		fm.ReleaseSpace(username, qw.reserved)
+		return 0, "", err
+	}
+
+	checksum := hashes.SHA256()
+	if err := opts.check(dstPath); err != nil {
+		os.Remove(tmpPath)
+		fm.ReleaseSpace(username, qw.reserved)
+		return 0, "", err
+	}
+	if err := fm.commitTemp(username, tmpPath, dstPath, checksum); err != nil {
+		os.Remove(tmpPath)
+		fm.ReleaseSpace(username, qw.reserved)
+		return 0, "", err
+	}
+
+	return written, checksum, nil
+}
+
+// AppendPartial writes src at offset into a partial upload file inside the user directory.
+// Anything after offset is discarded first, and at most limit bytes are accepted.
+// Every byte written is also passed to hash when it isn't nil.
+func (fm *FileManager) AppendPartial(username, partialPath string, offset, limit int64, src io.Reader, hash io.Writer) (int64, error) {
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := fm.truncatePartial(username, file, offset); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var w io.Writer = &quotaWriter{fm: fm, username: username, w: file}
+	if hash != nil {
+		w = io.MultiWriter(w, hash)
+	}
+
+	// Read one byte more than allowed to detect oversized bodies, which are discarded
+	written, err := io.Copy(w, io.LimitReader(src, limit+1))
+	if err == nil && written > limit {
+		fm.truncatePartial(username, file, offset)
+		return 0, errors.New("upload exceeds declared length")
+	}
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+
+	return written, err
+}
+
+// TruncatePartial cuts a partial upload file back to size bytes
+func (fm *FileManager) TruncatePartial(username, partialPath string, size int64) error {
+	file, err := os.OpenFile(partialPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return fm.truncatePartial(username, file, size)
+}
+
+// RemovePartial deletes a partial upload file and releases its space
+func (fm *FileManager) RemovePartial(username, partialPath string) error {
+	info, err := os.Stat(partialPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
+	}
+
+	if err := os.Remove(partialPath); err != nil {
+		return err
 	}
 
+	fm.ReleaseSpace(username, info.Size())
 	return nil
 }
 
-// RenameItem renames a file or folder (relative to user directory)
-func (fm *FileManager) RenameItem(username, path, oldName, newName string) error {
-	// Get user base directory
-	userDir := fm.GetUserDir(username)
+// CommitPartial moves a complete partial upload file to its final name inside path
+func (fm *FileManager) CommitPartial(username, partialPath, path, name string) error {
+	dstPath, err := fm.resolveItem(username, path, name)
+	if err != nil {
+		return err
+	}
 
-	// Normalize path
-	if path == "" || path == "root" || path == "/" {
-		path = userDir
-	} else {
-		if !filepath.IsAbs(path) {
-			path = filepath.Join(userDir, path)
-		}
-		// Check security
-		absUserDir, _ := filepath.Abs(userDir)
-		absPath, _ := filepath.Abs(path)
-		if !strings.HasPrefix(absPath, absUserDir) {
-			return errors.New("invalid path")
+	return fm.commitTemp(username, partialPath, dstPath, "")
+}
+
+// truncatePartial shrinks an open file to size, releasing the removed bytes
+func (fm *FileManager) truncatePartial(username string, file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= size {
+		return nil
+	}
+
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+
+	fm.ReleaseSpace(username, info.Size()-size)
+	return nil
+}
+
+// commitTemp moves a finished temporary file over dstPath. checksum is the
+// hex SHA-256 of its content when already known (empty otherwise). With a
+// blob store, the content is deduplicated on the way.
+func (fm *FileManager) commitTemp(username, tmpPath, dstPath, checksum string) error {
+	// An overwritten file frees its previous size
+	var replaced int64
+	eventType := EventCreate
+	if info, err := os.Stat(dstPath); err == nil {
+		if info.IsDir() {
+			return errors.New("a folder with that name already exists")
 		}
+		replaced = info.Size()
+		eventType = EventModify
 	}
 
-	// Validate new name
-	if newName == "" || strings.ContainsAny(newName, "/\\") {
-		return errors.New("invalid name")
+	// Files not encrypted while they were written, like resumable uploads, are encrypted now
+	if fm.keys != nil {
+		if checksum == "" {
+			checksum, _ = fm.hashFile(tmpPath)
+		}
+		if err := fm.encryptTemp(username, tmpPath); err != nil {
+			return err
+		}
 	}
 
-	oldPath := filepath.Join(path, oldName)
-	newPath := filepath.Join(path, newName)
+	src := tmpPath
+	if fm.blobs != nil {
+		if checksum == "" {
+			checksum, _ = fm.hashFile(tmpPath)
+		}
+		// Without a blob the file is simply stored as it is
+		if linkPath, err := fm.blobs.Put(username, tmpPath, checksum); err == nil {
+			src = linkPath
+		} else {
+			log.Printf("Storing %s without deduplication: %v", dstPath, err)
+		}
+	}
 
-	// Check security
-	absUserDir, _ := filepath.Abs(userDir)
-	absOldPath, _ := filepath.Abs(oldPath)
-	absNewPath, _ := filepath.Abs(newPath)
-	if !strings.HasPrefix(absOldPath, absUserDir) || !strings.HasPrefix(absNewPath, absUserDir) {
-		return errors.New("invalid path")
+	// The same content stored again at the same path is that file already:
+	// renaming a link over itself would do nothing and leave the link behind
+	if sameFile(src, dstPath) {
+		os.Remove(src)
+	} else if err := os.Rename(src, dstPath); err != nil {
+		if src != tmpPath {
+			os.Remove(src)
+		}
+		return err
 	}
 
-	return os.Rename(oldPath, newPath)
+	fm.ReleaseSpace(username, replaced)
+	fm.emit(FileEvent{Type: eventType, Username: username, Path: fm.relPath(username, dstPath), SHA256: checksum})
+	return nil
 }
 
-// GetFileInfo gets information about a file (relative to user directory)
-func (fm *FileManager) GetFileInfo(username, path, name string) (*FileItem, error) {
-	// Get user base directory
-	userDir := fm.GetUserDir(username)
+// resolvePath converts a folder path (relative to user directory) into an absolute path inside it
+func (fm *FileManager) resolvePath(username, path string) (string, error) {
+	userDir, err := filepath.Abs(fm.GetUserDir(username))
+	if err != nil {
+		return "", err
+	}
 
-	// Normalize path
 	if path == "" || path == "root" || path == "/" {
-		path = userDir
-	} else {
-		if !filepath.IsAbs(path) {
-			path = filepath.Join(userDir, path)
-		}
-		// Check security
-		absUserDir, _ := filepath.Abs(userDir)
-		absPath, _ := filepath.Abs(path)
-		if !strings.HasPrefix(absPath, absUserDir) {
-			return nil, errors.New("invalid path")
-		}
+		return userDir, nil
+	}
+
+	fullPath := filepath.Join(userDir, path)
+	if !isWithinDir(userDir, fullPath) {
+		return "", ErrInvalidPath
 	}
 
-	filePath := filepath.Join(path, name)
+	return fullPath, nil
+}
 
-	// Check security
-	absUserDir, _ := filepath.Abs(userDir)
-	absFilePath, _ := filepath.Abs(filePath)
-	if !strings.HasPrefix(absFilePath, absUserDir) {
-		return nil, errors.New("invalid path")
+// resolveItem resolves the absolute path of an item called name inside path
+func (fm *FileManager) resolveItem(username, path, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", ErrInvalidName
 	}
 
-	info, err := os.Stat(filePath)
+	dir, err := fm.resolvePath(username, path)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	item := &FileItem{
-		ID:       name,
-		Name:     name,
-		Modified: info.ModTime().Format("2006-01-02"),
+	fullPath := filepath.Join(dir, name)
+	if fm.reserved(username, fullPath) {
+		return "", ErrReservedName
 	}
+	return fullPath, nil
+}
 
-	if info.IsDir() {
-		item.Type = "folder"
-	} else {
-		item.Type = "file"
-		item.Size = formatSize(info.Size())
+// reserved reports whether a path would hide one of the virtual folders
+// at the top of the user's directory: shared items and team spaces
+func (fm *FileManager) reserved(username, fullPath string) bool {
+	userDir, err := filepath.Abs(fm.GetUserDir(username))
+	if err != nil {
+		return false
 	}
+	absPath, err := filepath.Abs(fullPath)
+	return err == nil && (absPath == filepath.Join(userDir, SharedRoot) || absPath == filepath.Join(userDir, SpacesRoot))
+}
+
+// freeName returns name, or a variant of it that doesn't exist yet inside path
+func (fm *FileManager) freeName(username, path, name string) (string, error) {
+	fullPath, err := fm.resolveItem(username, path, name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+		return name, nil
+	}
+	return filepath.Base(uniqueName(fullPath)), nil
+}
+
+// relPath returns the slash separated path of fullPath relative to the user directory
+func (fm *FileManager) relPath(username, fullPath string) string {
+	userDir, err := filepath.Abs(fm.GetUserDir(username))
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(userDir, fullPath)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// sameFile reports whether two paths are links to the same file
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	return err == nil && os.SameFile(aInfo, bInfo)
+}
 
-	return item, nil
+// isWithinDir reports whether path is dir itself or somewhere below it
+func isWithinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
 }
 
 // formatSize formats file size
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestFileManager creates a file manager over a temporary directory
+// holding the given files, relative to the files directory
+func newTestFileManager(t *testing.T, files ...string) (*FileManager, string) {
+	t.Helper()
+	baseDir := t.TempDir()
+	for _, file := range files {
+		path := filepath.Join(baseDir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewFileManager(baseDir, func(string) int64 { return 0 }), baseDir
+}
+
+// assertExists fails the test if a path of the files directory is gone
+func assertExists(t *testing.T, baseDir, path string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(baseDir, filepath.FromSlash(path))); err != nil {
+		t.Errorf("%s: %v", path, err)
+	}
+}
+
+func TestItemsStayInsideUserDirectory(t *testing.T) {
+	fm, baseDir := newTestFileManager(t,
+		"alice/Projects/plan.txt",
+		"alice/Private/secret.txt",
+		"alice2/data/notes.txt",
+	)
+
+	tests := []struct {
+		name string
+		op   func() error
+		want error
+	}{
+		{"rename from parent", func() error { return fm.RenameItem("alice", "Projects", "../Private", "stolen") }, ErrInvalidName},
+		{"rename to parent", func() error { return fm.RenameItem("alice", "Projects", "plan.txt", "../plan.txt") }, ErrInvalidName},
+		{"rename in sibling directory", func() error { return fm.RenameItem("alice", "../alice2", "data", "moved") }, ErrInvalidPath},
+		{"delete in parent", func() error { return fm.DeleteItems("alice", "Projects", []string{"../Private"}) }, ErrInvalidName},
+		{"delete in sibling directory", func() error { return fm.DeleteItems("alice", "", []string{"../alice2/data"}) }, ErrInvalidName},
+		{"delete from sibling path", func() error { return fm.DeleteItems("alice", "../alice2", []string{"data"}) }, ErrInvalidPath},
+		{"delete user directory", func() error { return fm.DeleteItems("alice", "", []string{"."}) }, ErrInvalidName},
+		{"delete after a valid name", func() error { return fm.DeleteItems("alice", "Projects", []string{"plan.txt", ".."}) }, ErrInvalidName},
+		{"create folder in parent", func() error { return fm.CreateFolder("alice", "", "../alice3") }, ErrInvalidName},
+		{"create folder in sibling directory", func() error { return fm.CreateFolder("alice", "../alice2", "new") }, ErrInvalidPath},
+		{"info of sibling file", func() error {
+			_, err := fm.GetFileInfo("alice", "", "../alice2/data/notes.txt")
+			return err
+		}, ErrInvalidName},
+		{"info from sibling path", func() error {
+			_, err := fm.GetFileInfo("alice", "../alice2/data", "notes.txt")
+			return err
+		}, ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Nothing was touched, not even the valid names of a rejected request
+	assertExists(t, baseDir, "alice/Projects/plan.txt")
+	assertExists(t, baseDir, "alice/Private/secret.txt")
+	assertExists(t, baseDir, "alice2/data/notes.txt")
+	for _, path := range []string{"alice/Projects/stolen", "alice/plan.txt", "alice3", "alice2/new"} {
+		if _, err := os.Stat(filepath.Join(baseDir, path)); err == nil {
+			t.Errorf("%s was created", path)
+		}
+	}
+}
+
+func TestItemsInsideUserDirectory(t *testing.T) {
+	fm, baseDir := newTestFileManager(t, "alice/Projects/plan.txt")
+
+	if err := fm.CreateFolder("alice", "Projects", "2024"); err != nil {
+		t.Fatalf("create folder: %v", err)
+	}
+	if err := fm.RenameItem("alice", "Projects", "plan.txt", "final.txt"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	item, err := fm.GetFileInfo("alice", "Projects", "final.txt")
+	if err != nil {
+		t.Fatalf("info: %v", err)
+	}
+	if item.Name != "final.txt" {
+		t.Errorf("info name: got %q", item.Name)
+	}
+	if err := fm.DeleteItems("alice", "root", []string{"Projects"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "alice", "Projects")); !os.IsNotExist(err) {
+		t.Errorf("Projects still exists: %v", err)
+	}
+}
+
+func TestFileItemMetadata(t *testing.T) {
+	fm, baseDir := newTestFileManager(t, "alice/docs/report.pdf", "alice/docs/notes")
+	modified := time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)
+	if err := os.Chtimes(filepath.Join(baseDir, "alice", "docs", "report.pdf"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := fm.GetFileInfo("alice", "docs", "report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Type != "file" || item.Path != "docs/report.pdf" || item.Bytes != int64(len("alice/docs/report.pdf")) {
+		t.Errorf("file: got %s %s of %d bytes", item.Type, item.Path, item.Bytes)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, item.ModifiedAt); err != nil || !at.Equal(modified) {
+		t.Errorf("modifiedAt: got %q, want %s", item.ModifiedAt, modified.Format(time.RFC3339Nano))
+	}
+	if item.MimeType != "application/pdf" || !item.Permissions.Read || !item.Permissions.Write || !item.Permissions.Rename {
+		t.Errorf("file: got %s %+v", item.MimeType, item.Permissions)
+	}
+
+	// Files without an extension are sniffed
+	item, err = fm.GetFileInfo("alice", "docs", "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.MimeType != "text/plain; charset=utf-8" {
+		t.Errorf("sniffed type: got %q", item.MimeType)
+	}
+
+	items, err := fm.ListFiles("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Type != "folder" || items[0].MimeType != "inode/directory" || items[0].Bytes != 0 {
+		t.Errorf("folder: got %+v", items)
+	}
+}
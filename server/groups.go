@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// HandleGroups lists the groups of the user (GET), or all of them for the
+// admin, who creates (POST), changes the quota of (PUT) and deletes (DELETE)
+// groups. Creating a group creates its space, which must be empty to delete it.
+func (h *APIHandler) HandleGroups(w http.ResponseWriter, r *http.Request) {
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		groups := h.authManager.ListGroups()
+		if username != "admin" {
+			groups = slices.DeleteFunc(groups, func(group Group) bool {
+				return !slices.Contains(group.Members, username)
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"groups":  groups,
+		})
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if username != "admin" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Admin only"})
+		return
+	}
+
+	var req struct {
+		Name  string `json:"name"`
+		Quota *int64 `json:"quota"` // Bytes (0 = server default, negative = unlimited)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		err = h.authManager.CreateGroup(req.Name)
+		if err == nil {
+			err = h.fileManager.EnsureUserDir(spaceOwner(req.Name))
+		}
+		if err == nil && req.Quota != nil {
+			err = h.authManager.SetGroupQuota(req.Name, *req.Quota)
+		}
+		status = http.StatusCreated
+	case http.MethodPut:
+		if req.Quota == nil {
+			err = errors.New("quota is required")
+		} else {
+			err = h.authManager.SetGroupQuota(req.Name, *req.Quota)
+		}
+	default:
+		err = h.removeSpace(req.Name)
+		if err == nil {
+			err = h.authManager.DeleteGroup(req.Name)
+		}
+	}
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// HandleGroupMembers adds (POST) or removes (DELETE) a member of a group. With
+// "admin", POST also makes the member one of the group's admins or a plain
+// member again. Only the admin and the group's admins manage its members.
+func (h *APIHandler) HandleGroupMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	var req struct {
+		Group    string `json:"group"`
+		Username string `json:"username"`
+		Admin    *bool  `json:"admin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	if username != "admin" && h.authManager.GroupRole(req.Group, username) != GroupAdmin {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Only the admins of the group can change its members"})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err = h.authManager.AddGroupMember(req.Group, req.Username)
+		if err == nil && req.Admin != nil {
+			err = h.authManager.SetGroupAdmin(req.Group, req.Username, *req.Admin)
+		}
+	} else {
+		err = h.authManager.RemoveGroupMember(req.Group, req.Username)
+	}
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// removeSpace removes the directory of a group's space, which must be empty
+func (h *APIHandler) removeSpace(group string) error {
+	if !h.authManager.GroupExists(group) {
+		return ErrGroupNotFound
+	}
+	dir := h.fileManager.GetUserDir(spaceOwner(group))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrSpaceNotEmpty
+	}
+	return os.Remove(dir)
+}
+
+// writeGroupError reports why a group couldn't be changed
+func writeGroupError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrGroupNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrGroupExists), errors.Is(err, ErrSpaceNotEmpty):
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
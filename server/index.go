@@ -0,0 +1,673 @@
+package server
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"html"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Content index limits
+const (
+	maxIndexFileSize   = 10 << 20 // Larger files are not indexed
+	minTermLength      = 2
+	maxTermLength      = 64
+	maxQueryTerms      = 16
+	defaultIndexLimit  = 50
+	maxIndexLimit      = 500
+	snippetRadius      = 80
+	indexSaveDelay     = 5 * time.Second
+	indexQueueCapacity = 1024
+)
+
+// BM25 ranking parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// indexedExtensions lists the text-like files whose content is indexed
+var indexedExtensions = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".rst": true, ".log": true,
+	".csv": true, ".tsv": true, ".json": true, ".xml": true, ".yaml": true,
+	".yml": true, ".toml": true, ".ini": true, ".conf": true, ".cfg": true,
+	".html": true, ".htm": true, ".css": true, ".js": true, ".ts": true,
+	".jsx": true, ".tsx": true, ".go": true, ".py": true, ".rb": true,
+	".java": true, ".kt": true, ".c": true, ".h": true, ".cpp": true,
+	".hpp": true, ".cs": true, ".rs": true, ".php": true, ".sh": true,
+	".sql": true, ".swift": true, ".lua": true, ".pl": true, ".r": true,
+	".tex": true,
+}
+
+// indexedDoc holds the term frequencies of one indexed file
+type indexedDoc struct {
+	Size    int64
+	ModTime int64
+	Length  int            // Number of terms in the file
+	Terms   map[string]int // Term frequencies
+}
+
+// userIndex is the inverted index of one user's files
+type userIndex struct {
+	Docs     map[string]*indexedDoc         // By path relative to user directory
+	postings map[string]map[string]struct{} // Term -> paths containing it
+	totalLen int64
+	dirty    bool
+}
+
+// ContentSearchResult is a file matching a content search
+type ContentSearchResult struct {
+	Item    FileItem `json:"item"`
+	Score   float64  `json:"score"`
+	Snippet string   `json:"snippet"` // HTML escaped, matches wrapped in <mark>
+}
+
+// ContentIndex maintains a full-text index of the text files in each user directory.
+// It is updated in the background from FileManager change events and persisted
+// to one file per user.
+type ContentIndex struct {
+	dir         string
+	fileManager *FileManager
+	users       map[string]*userIndex
+	events      chan FileEvent
+	saveTimer   *time.Timer
+	mu          sync.Mutex
+}
+
+// NewContentIndex creates a content index stored in dir and subscribes it to fm's changes
+func NewContentIndex(dir string, fm *FileManager) *ContentIndex {
+	os.MkdirAll(dir, 0755)
+
+	ci := &ContentIndex{
+		dir:         dir,
+		fileManager: fm,
+		users:       make(map[string]*userIndex),
+		events:      make(chan FileEvent, indexQueueCapacity),
+	}
+
+	go ci.run()
+	fm.OnChange(func(event FileEvent) {
+		select {
+		case ci.events <- event:
+		default:
+			// The queue is full, the next load reconciles the index with the disk
+			ci.mu.Lock()
+			delete(ci.users, event.Username)
+			ci.mu.Unlock()
+		}
+	})
+
+	return ci
+}
+
+// run applies change events to the index
+func (ci *ContentIndex) run() {
+	for event := range ci.events {
+		ci.apply(event)
+	}
+}
+
+// apply updates the index of the event's user, if it is loaded
+func (ci *ContentIndex) apply(event FileEvent) {
+	ci.mu.Lock()
+	idx := ci.users[event.Username]
+	ci.mu.Unlock()
+
+	// Indexes are loaded on first search, which picks up every change made until then
+	if idx == nil {
+		return
+	}
+
+	switch event.Type {
+	case EventCreate, EventModify:
+		if event.IsDir {
+			ci.indexTree(event.Username, idx, event.Path)
+		} else {
+			ci.indexFile(event.Username, idx, event.Path)
+		}
+	case EventDelete:
+		ci.mu.Lock()
+		idx.removePath(event.Path, event.IsDir)
+		ci.mu.Unlock()
+	case EventRename:
+		ci.mu.Lock()
+		idx.removePath(event.OldPath, event.IsDir)
+		ci.mu.Unlock()
+		if event.IsDir {
+			ci.indexTree(event.Username, idx, event.Path)
+		} else {
+			ci.indexFile(event.Username, idx, event.Path)
+		}
+	}
+
+	ci.scheduleSave()
+}
+
+// load returns a user's index, reading it from disk and reconciling it
+// with the user directory the first time
+func (ci *ContentIndex) load(username string) *userIndex {
+	ci.mu.Lock()
+	idx := ci.users[username]
+	if idx != nil {
+		ci.mu.Unlock()
+		return idx
+	}
+
+	idx = &userIndex{Docs: make(map[string]*indexedDoc)}
+	if file, err := os.Open(ci.indexPath(username)); err == nil {
+		if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&idx.Docs); err != nil {
+			log.Printf("Discarding content index of %s: %v", username, err)
+			idx.Docs = make(map[string]*indexedDoc)
+		}
+		file.Close()
+	}
+	idx.rebuild()
+
+	// Registered before reconciling so that no change event is missed meanwhile
+	ci.users[username] = idx
+	known := make([]string, 0, len(idx.Docs))
+	for rel := range idx.Docs {
+		known = append(known, rel)
+	}
+	ci.mu.Unlock()
+
+	// Files changed while the index wasn't loaded are indexed again
+	seen := make(map[string]bool, len(known))
+	ci.walk(username, "", func(rel string, info fs.FileInfo) {
+		seen[rel] = true
+		ci.mu.Lock()
+		doc := idx.Docs[rel]
+		ci.mu.Unlock()
+		if doc == nil || doc.Size != info.Size() || doc.ModTime != info.ModTime().UnixNano() {
+			ci.indexFile(username, idx, rel)
+		}
+	})
+	for _, rel := range known {
+		if !seen[rel] {
+			ci.indexFile(username, idx, rel)
+		}
+	}
+
+	ci.scheduleSave()
+	return idx
+}
+
+// walk calls fn for every indexable file below rel (relative to user directory)
+func (ci *ContentIndex) walk(username, rel string, fn func(rel string, info fs.FileInfo)) {
+	root, err := ci.fileManager.resolvePath(username, rel)
+	if err != nil {
+		return
+	}
+
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && p != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), uploadTempPrefix) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() || !isIndexable(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() > maxIndexFileSize {
+			return nil
+		}
+		fn(ci.fileManager.relPath(username, p), info)
+		return nil
+	})
+}
+
+// indexTree indexes every file below rel
+func (ci *ContentIndex) indexTree(username string, idx *userIndex, rel string) {
+	ci.walk(username, rel, func(fileRel string, info fs.FileInfo) {
+		ci.indexFile(username, idx, fileRel)
+	})
+}
+
+// indexFile (re)indexes a single file, or drops it if it can no longer be indexed
+func (ci *ContentIndex) indexFile(username string, idx *userIndex, rel string) {
+	doc := ci.readDoc(username, rel)
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	idx.remove(rel)
+	if doc != nil {
+		idx.add(rel, doc)
+	}
+}
+
+// readDoc tokenizes a file, returning nil for files that aren't indexable text
+func (ci *ContentIndex) readDoc(username, rel string) *indexedDoc {
+	if !isIndexable(rel) {
+		return nil
+	}
+	fullPath, err := ci.fileManager.resolvePath(username, rel)
+	if err != nil {
+		return nil
+	}
+
+	info, err := os.Lstat(fullPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > maxIndexFileSize {
+		return nil
+	}
+	content, err := ci.fileManager.readFile(fullPath, maxIndexFileSize)
+	if err != nil || !isText(content) {
+		return nil
+	}
+
+	doc := &indexedDoc{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Terms:   make(map[string]int),
+	}
+	for _, term := range tokenize(string(content)) {
+		doc.Terms[term]++
+		doc.Length++
+	}
+	return doc
+}
+
+// Search returns the files containing every term of query, best matches first.
+// Only files below path (relative to user directory) are considered.
+func (ci *ContentIndex) Search(username, query, path string, limit int) ([]ContentSearchResult, int, error) {
+	terms := uniqueTerms(tokenize(query))
+	if len(terms) == 0 {
+		return nil, 0, errors.New("query has no searchable terms")
+	}
+	if len(terms) > maxQueryTerms {
+		return nil, 0, errors.New("too many query terms")
+	}
+
+	root, err := ci.fileManager.resolvePath(username, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	prefix := ci.fileManager.relPath(username, root)
+
+	idx := ci.load(username)
+
+	type match struct {
+		path  string
+		score float64
+	}
+	var matches []match
+
+	ci.mu.Lock()
+	n := float64(len(idx.Docs))
+	avgLen := float64(idx.totalLen) / math.Max(n, 1)
+
+	// Start with the rarest term, every other term has to be present too
+	sort.Slice(terms, func(i, j int) bool {
+		return len(idx.postings[terms[i]]) < len(idx.postings[terms[j]])
+	})
+	for p := range idx.postings[terms[0]] {
+		if !withinRel(prefix, p) {
+			continue
+		}
+		doc := idx.Docs[p]
+		score := 0.0
+		for _, term := range terms {
+			tf := float64(doc.Terms[term])
+			if tf == 0 {
+				score = -1
+				break
+			}
+			df := float64(len(idx.postings[term]))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(doc.Length)/avgLen))
+		}
+		if score >= 0 {
+			matches = append(matches, match{p, score})
+		}
+	}
+	ci.mu.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].path < matches[j].path
+	})
+
+	results := make([]ContentSearchResult, 0, min(limit, len(matches)))
+	for _, m := range matches {
+		if len(results) >= limit {
+			break
+		}
+		fullPath, err := ci.fileManager.resolvePath(username, m.path)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+		parentWritable := false
+		if parentInfo, err := os.Stat(filepath.Dir(fullPath)); err == nil {
+			parentWritable = parentInfo.Mode().Perm()&0200 != 0
+		}
+
+		results = append(results, ContentSearchResult{
+			Item:    ci.fileManager.newFileItem(username, fullPath, info, parentWritable),
+			Score:   math.Round(m.score*1000) / 1000,
+			Snippet: ci.snippet(fullPath, terms),
+		})
+	}
+
+	return results, len(matches), nil
+}
+
+// scheduleSave writes the modified indexes to disk after a short delay
+func (ci *ContentIndex) scheduleSave() {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.scheduleSaveLocked()
+}
+
+func (ci *ContentIndex) scheduleSaveLocked() {
+	if ci.saveTimer == nil {
+		ci.saveTimer = time.AfterFunc(indexSaveDelay, ci.save)
+	}
+}
+
+// save writes every modified index to disk
+func (ci *ContentIndex) save() {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.saveTimer = nil
+
+	for username, idx := range ci.users {
+		if !idx.dirty {
+			continue
+		}
+		if err := ci.saveUserLocked(username, idx); err != nil {
+			log.Printf("Failed to save content index of %s: %v", username, err)
+			continue
+		}
+		idx.dirty = false
+	}
+}
+
+// saveUserLocked atomically replaces a user's index file
+func (ci *ContentIndex) saveUserLocked(username string, idx *userIndex) error {
+	tmp, err := os.CreateTemp(ci.dir, "."+username+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := gob.NewEncoder(w).Encode(idx.Docs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), ci.indexPath(username))
+}
+
+// indexPath returns the file a user's index is stored in
+func (ci *ContentIndex) indexPath(username string) string {
+	return filepath.Join(ci.dir, username+".gob")
+}
+
+// rebuild recreates the postings from the stored documents
+func (idx *userIndex) rebuild() {
+	idx.postings = make(map[string]map[string]struct{})
+	idx.totalLen = 0
+	for p, doc := range idx.Docs {
+		idx.link(p, doc)
+	}
+}
+
+// add indexes a document
+func (idx *userIndex) add(p string, doc *indexedDoc) {
+	idx.Docs[p] = doc
+	idx.link(p, doc)
+	idx.dirty = true
+}
+
+func (idx *userIndex) link(p string, doc *indexedDoc) {
+	for term := range doc.Terms {
+		paths := idx.postings[term]
+		if paths == nil {
+			paths = make(map[string]struct{})
+			idx.postings[term] = paths
+		}
+		paths[p] = struct{}{}
+	}
+	idx.totalLen += int64(doc.Length)
+}
+
+// remove drops a document from the index
+func (idx *userIndex) remove(p string) {
+	doc := idx.Docs[p]
+	if doc == nil {
+		return
+	}
+	for term := range doc.Terms {
+		delete(idx.postings[term], p)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLen -= int64(doc.Length)
+	delete(idx.Docs, p)
+	idx.dirty = true
+}
+
+// removePath drops a document, or every document below a folder
+func (idx *userIndex) removePath(prefix string, isDir bool) {
+	if !isDir {
+		idx.remove(prefix)
+		return
+	}
+	for p := range idx.Docs {
+		if withinRel(prefix, p) {
+			idx.remove(p)
+		}
+	}
+}
+
+// withinRel reports whether the relative path p is prefix itself or below it
+func withinRel(prefix, p string) bool {
+	if prefix == "" || prefix == "." {
+		return true
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// isIndexable reports whether a file name has a text extension
+func isIndexable(name string) bool {
+	return indexedExtensions[strings.ToLower(path.Ext(name))]
+}
+
+// isText reports whether content looks like text rather than binary data
+func isText(content []byte) bool {
+	sample := content[:min(len(content), 8192)]
+	for _, b := range sample {
+		if b == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenize splits text into lower case terms made of letters and digits
+func tokenize(text string) []string {
+	var terms []string
+	for _, field := range strings.FieldsFunc(text, isTermSeparator) {
+		n := utf8.RuneCountInString(field)
+		if n < minTermLength || n > maxTermLength {
+			continue
+		}
+		terms = append(terms, strings.ToLower(field))
+	}
+	return terms
+}
+
+func isTermSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// uniqueTerms removes duplicate terms, keeping their order
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]bool, len(terms))
+	unique := terms[:0]
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+// snippet returns the text around the first occurrence of a term, with the
+// terms highlighted
+func (ci *ContentIndex) snippet(fullPath string, terms []string) string {
+	content, err := ci.fileManager.readFile(fullPath, maxIndexFileSize)
+	if err != nil {
+		return ""
+	}
+	text := string(content)
+
+	// Term boundaries of the original text, so highlighting matches indexing
+	type span struct{ start, end int }
+	wanted := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		wanted[term] = true
+	}
+
+	var spans []span
+	start := -1
+	for i, r := range text + " " {
+		if isTermSeparator(r) {
+			if start >= 0 && wanted[strings.ToLower(text[start:i])] {
+				spans = append(spans, span{start, i})
+			}
+			start = -1
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if len(spans) == 0 {
+		return ""
+	}
+
+	from := max(spans[0].start-snippetRadius, 0)
+	to := min(spans[0].end+snippetRadius, len(text))
+	// Don't cut runes in half
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, s := range spans {
+		if s.start < from {
+			continue
+		}
+		if s.end > to {
+			break
+		}
+		b.WriteString(html.EscapeString(text[pos:s.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[s.start:s.end]))
+		b.WriteString("</mark>")
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(text[pos:to]))
+	if to < len(text) {
+		b.WriteString("…")
+	}
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// HandleContentSearch searches the content of the user's text files
+func (h *APIHandler) HandleContentSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	limit := defaultIndexLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid limit"})
+			return
+		}
+		limit = min(limit, maxIndexLimit)
+	}
+
+	loc := h.locate(w, username, r.URL.Query().Get("path"), AccessRead)
+	if loc == nil {
+		return
+	}
+
+	results, total, err := h.contentIndex.Search(loc.Owner, r.URL.Query().Get("q"), loc.Path, limit)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	for i := range results {
+		h.showItem(username, loc, &results[i].Item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"results": results,
+		"total":   total,
+	})
+}
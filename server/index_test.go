@@ -0,0 +1,91 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contentSearchPaths returns the paths of the files a content search finds, best first
+func contentSearchPaths(t *testing.T, ci *ContentIndex, query, path string) []string {
+	t.Helper()
+	results, _, err := ci.Search("alice", query, path, defaultIndexLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, result := range results {
+		paths = append(paths, result.Item.Path)
+	}
+	return paths
+}
+
+func TestContentIndex(t *testing.T) {
+	fm, baseDir := newTestFileManager(t, "bob/budget.txt")
+	for name, content := range map[string]string{
+		"budget.txt":      "budget budget budget for the quarterly report",
+		"notes/report.md": "The quarterly report is late, the budget isn't",
+		"notes/other.md":  "nothing to see here",
+		"notes/esc.txt":   "<script>quarterly budget</script>",
+		"image.png":       "budget",
+		".upload-123":     "budget",
+	} {
+		path := filepath.Join(baseDir, "alice", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ci := NewContentIndex(t.TempDir(), fm)
+
+	// Every term must be present, files using them more often come first
+	if got, want := contentSearchPaths(t, ci, "budget", ""), []string{"budget.txt", "notes/esc.txt", "notes/report.md"}; !slices.Equal(got, want) {
+		t.Errorf("one term: got %v, want %v", got, want)
+	}
+	if got, want := contentSearchPaths(t, ci, "Quarterly REPORT", ""), []string{"budget.txt", "notes/report.md"}; !slices.Equal(got, want) {
+		t.Errorf("two terms: got %v, want %v", got, want)
+	}
+	if got, want := contentSearchPaths(t, ci, "budget", "notes"), []string{"notes/esc.txt", "notes/report.md"}; !slices.Equal(got, want) {
+		t.Errorf("inside a folder: got %v, want %v", got, want)
+	}
+	if _, _, err := ci.Search("alice", "a", "", defaultIndexLimit); err == nil {
+		t.Error("query without searchable terms accepted")
+	}
+
+	// Snippets are escaped, only the matches are marked
+	results, _, err := ci.Search("alice", "quarterly", "notes", defaultIndexLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if strings.Contains(result.Snippet, "<script>") || !strings.Contains(result.Snippet, "<mark>") {
+			t.Errorf("%s snippet: %q", result.Item.Path, result.Snippet)
+		}
+	}
+
+	// Changes are picked up in the background
+	if err := fm.DeleteItems("alice", "", []string{"budget.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fm.SaveFile("alice", "notes", "new.md", strings.NewReader("budget"), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"notes/esc.txt", "notes/new.md", "notes/report.md"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := contentSearchPaths(t, ci, "budget", "")
+		slices.Sort(got)
+		if slices.Equal(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after changes: got %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change journal settings
+const (
+	journalKeep         = 10000 // Changes kept per user, older cursors have to start over
+	journalDefaultLimit = 1000  // Changes returned per request unless asked otherwise
+)
+
+// Change is an entry of the change journal, also sent to event streams.
+// Paths are relative to the user directory in the journal, and to the synced
+// or watched folder in responses.
+type Change struct {
+	Seq     int64     `json:"seq,omitempty"`     // Journal entries only
+	Type    string    `json:"type"`              // One of the Event* types
+	Path    string    `json:"path"`              // Item after the change
+	OldPath string    `json:"oldPath,omitempty"` // Item before a rename, omitted when moved in from outside the folder
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"` // Files only, when known
+	ETag    string    `json:"etag,omitempty"`   // Files only
+	Time    time.Time `json:"time"`
+}
+
+// journalHeader is the first line of a journal file
+type journalHeader struct {
+	ID string `json:"id"`
+}
+
+// userJournal holds the latest changes of one user's files
+type userJournal struct {
+	id      string // Changes when the journal starts over, invalidating cursors
+	next    int64  // Sequence number of the next change
+	changes []Change
+}
+
+// ChangeJournal records every change made through the FileManager in an
+// append-only file per user, so sync clients can ask what changed since
+// they last looked instead of listing everything again.
+type ChangeJournal struct {
+	dir         string
+	fileManager *FileManager
+	users       map[string]*userJournal
+	mu          sync.Mutex
+}
+
+// NewChangeJournal creates a change journal in dir and subscribes it to fm's changes
+func NewChangeJournal(dir string, fm *FileManager) *ChangeJournal {
+	os.MkdirAll(dir, 0755)
+
+	cj := &ChangeJournal{
+		dir:         dir,
+		fileManager: fm,
+		users:       make(map[string]*userJournal),
+	}
+	fm.OnChange(cj.record)
+	return cj
+}
+
+// journalPath returns the path of a user's journal file
+func (cj *ChangeJournal) journalPath(username string) string {
+	return filepath.Join(cj.dir, username+".jsonl")
+}
+
+// record appends a change event to the journal of its owner
+func (cj *ChangeJournal) record(event FileEvent) {
+	change := Change{
+		Type:    event.Type,
+		Path:    event.Path,
+		OldPath: event.OldPath,
+		IsDir:   event.IsDir,
+		SHA256:  event.SHA256,
+		Time:    time.Now().UTC(),
+	}
+	// The validator lets clients make their next change conditional
+	if !event.IsDir && event.Type != EventDelete {
+		if fullPath, err := cj.fileManager.resolvePath(event.Username, event.Path); err == nil {
+			if info, err := os.Stat(fullPath); err == nil && info.Mode().IsRegular() {
+				change.Size = info.Size()
+				change.ETag = fileETag(info)
+			}
+		}
+	}
+
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+
+	j := cj.loadLocked(event.Username)
+	change.Seq = j.next
+	j.next++
+	j.changes = append(j.changes, change)
+
+	if len(j.changes) >= 2*journalKeep {
+		j.changes = append([]Change(nil), j.changes[len(j.changes)-journalKeep:]...)
+		if err := cj.saveLocked(event.Username, j); err != nil {
+			log.Printf("Error compacting the change journal of %s: %v", event.Username, err)
+		}
+		return
+	}
+	if err := cj.appendLocked(event.Username, change); err != nil {
+		log.Printf("Error writing the change journal of %s: %v", event.Username, err)
+	}
+}
+
+// loadLocked returns the journal of a user, reading it from disk on first use.
+// A missing or unreadable journal starts over with a new ID.
+func (cj *ChangeJournal) loadLocked(username string) *userJournal {
+	if j := cj.users[username]; j != nil {
+		return j
+	}
+
+	j := &userJournal{next: 1}
+	if data, err := os.ReadFile(cj.journalPath(username)); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, 1<<20)
+		var header journalHeader
+		if scanner.Scan() && json.Unmarshal(scanner.Bytes(), &header) == nil && header.ID != "" {
+			j.id = header.ID
+			for scanner.Scan() {
+				var change Change
+				// A line cut short by a crash is the last one
+				if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+					break
+				}
+				j.changes = append(j.changes, change)
+			}
+			if n := len(j.changes); n > 0 {
+				j.next = j.changes[n-1].Seq + 1
+			}
+		}
+	}
+	if j.id == "" {
+		j.id = randomHex(8)
+		if err := cj.saveLocked(username, j); err != nil {
+			log.Printf("Error creating the change journal of %s: %v", username, err)
+		}
+	}
+
+	cj.users[username] = j
+	return j
+}
+
+// saveLocked rewrites the journal file of a user
+func (cj *ChangeJournal) saveLocked(username string, j *userJournal) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(journalHeader{ID: j.id})
+	for _, change := range j.changes {
+		enc.Encode(change)
+	}
+	return writeFileAtomic(cj.journalPath(username), buf.Bytes())
+}
+
+// appendLocked adds a change at the end of the journal file of a user
+func (cj *ChangeJournal) appendLocked(username string, change Change) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(cj.journalPath(username), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ChangePage is a batch of changes below a folder
+type ChangePage struct {
+	Changes []Change
+	Cursor  string // Where the next request starts
+	HasMore bool   // More changes are waiting after Cursor
+	Reset   bool   // The changes since cursor are unknown, the folder has to be listed again
+}
+
+// Changes returns up to limit changes made below folder (relative to the user
+// directory) since cursor, with paths relative to folder. An empty cursor,
+// one from before the oldest change kept, or a change replacing the folder
+// itself, makes the page a reset: the client lists the folder again and
+// continues from the returned cursor.
+func (cj *ChangeJournal) Changes(username, folder, cursor string, limit int) (*ChangePage, error) {
+	cj.mu.Lock()
+	j := cj.loadLocked(username)
+	current := j.next - 1
+
+	page := &ChangePage{Changes: []Change{}}
+	reset := func() (*ChangePage, error) {
+		cj.mu.Unlock()
+		return &ChangePage{Changes: []Change{}, Cursor: formatCursor(j.id, current), Reset: true}, nil
+	}
+
+	if cursor == "" {
+		return reset()
+	}
+	id, seqText, ok := strings.Cut(cursor, ".")
+	seq, err := strconv.ParseInt(seqText, 10, 64)
+	if !ok || err != nil || seq < 0 {
+		cj.mu.Unlock()
+		return nil, ErrInvalidCursor
+	}
+	if id != j.id || seq > current {
+		return reset()
+	}
+	if len(j.changes) > 0 && seq < j.changes[0].Seq-1 {
+		// Changes were dropped since
+		return reset()
+	}
+
+	// Sequence numbers follow each other, so the first change after the cursor is found directly
+	start := 0
+	if len(j.changes) > 0 {
+		start = int(seq - j.changes[0].Seq + 1)
+	}
+	last := seq
+	for _, change := range j.changes[start:] {
+		if len(page.Changes) == limit {
+			page.HasMore = true
+			break
+		}
+		last = change.Seq
+
+		if folderReplaced(folder, change) {
+			return reset()
+		}
+		if c, ok := relativeChange(folder, change, true); ok {
+			page.Changes = append(page.Changes, c)
+		}
+	}
+	if !page.HasMore {
+		last = current
+	}
+	page.Cursor = formatCursor(j.id, last)
+	cj.mu.Unlock()
+
+	cj.fillHashes(username, folder, page.Changes)
+	return page, nil
+}
+
+// folderReplaced reports whether a change deletes, moves or replaces folder
+// itself, or one of its parents
+func folderReplaced(folder string, change Change) bool {
+	switch change.Type {
+	case EventDelete:
+		return withinRel(change.Path, folder)
+	case EventRename:
+		return withinRel(change.OldPath, folder) || withinRel(change.Path, folder)
+	}
+	return false
+}
+
+// relativeChange rewrites a change relative to folder, telling whether it
+// concerns it at all. Renames across the folder's boundary become deletions
+// when the item left, and renames without an old path when it came in. Unless
+// recursive, only changes to the folder's direct children count.
+func relativeChange(folder string, change Change, recursive bool) (Change, bool) {
+	within := func(p string) bool {
+		if p == folder || !withinRel(folder, p) {
+			return false
+		}
+		return recursive || !strings.Contains(relTo(folder, p), "/")
+	}
+	in := within(change.Path)
+	oldIn := change.OldPath != "" && within(change.OldPath)
+
+	switch {
+	case change.Type == EventRename && !in && oldIn:
+		return Change{Seq: change.Seq, Type: EventDelete, Path: relTo(folder, change.OldPath), IsDir: change.IsDir, Time: change.Time}, true
+	case !in:
+		return Change{}, false
+	}
+
+	change.Path = relTo(folder, change.Path)
+	if oldIn {
+		change.OldPath = relTo(folder, change.OldPath)
+	} else {
+		change.OldPath = ""
+	}
+	return change, true
+}
+
+// relTo returns p, somewhere below folder, relative to it
+func relTo(folder, p string) string {
+	if folder == "" {
+		return p
+	}
+	return strings.TrimPrefix(p, folder+"/")
+}
+
+// formatCursor encodes a position in a user's journal
+func formatCursor(id string, seq int64) string {
+	return fmt.Sprintf("%s.%d", id, seq)
+}
+
+// fillHashes adds the hashes of files that weren't known when they changed,
+// for those still in the state the change left them in
+func (cj *ChangeJournal) fillHashes(username, folder string, changes []Change) {
+	checksums := cj.fileManager.checksums
+	for i := range changes {
+		c := &changes[i]
+		if c.IsDir || c.SHA256 != "" || c.ETag == "" || c.Type == EventDelete {
+			continue
+		}
+		rel := c.Path
+		if folder != "" {
+			rel = folder + "/" + c.Path
+		}
+		fullPath, err := cj.fileManager.resolvePath(username, rel)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil || fileETag(info) != c.ETag {
+			continue
+		}
+		if checksums != nil {
+			c.SHA256 = checksums.Lookup(username, rel, info)
+		}
+		if c.SHA256 == "" {
+			if c.SHA256, err = cj.fileManager.hashFile(fullPath); err != nil {
+				c.SHA256 = ""
+				continue
+			}
+			if checksums != nil {
+				checksums.record(username, rel, c.SHA256)
+			}
+		}
+		cj.rememberHash(username, c.Seq, c.SHA256)
+	}
+}
+
+// rememberHash stores the hash of the file a change left, once computed
+func (cj *ChangeJournal) rememberHash(username string, seq int64, sum string) {
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+
+	j := cj.users[username]
+	if j == nil || len(j.changes) == 0 {
+		return
+	}
+	if i := int(seq - j.changes[0].Seq); i >= 0 && i < len(j.changes) && j.changes[i].Seq == seq {
+		j.changes[i].SHA256 = sum
+	}
+}
+
+// HandleSyncChanges lists the changes made below a folder since a cursor.
+// Without a cursor, or when the changes since are no longer known, the
+// response is a reset with the current cursor: the client lists the folder
+// and asks for the changes since that cursor from then on.
+func (h *APIHandler) HandleSyncChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	query := r.URL.Query()
+	folder := query.Get("path")
+	if folder == "" {
+		folder = "root"
+	}
+	limit := journalDefaultLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	// Clients tell a folder that is gone from one that didn't change
+	loc, rel := h.locateFolder(w, username, folder)
+	if loc == nil {
+		return
+	}
+
+	page, err := h.journal.Changes(loc.Owner, rel, query.Get("cursor"), limit)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"changes": page.Changes,
+		"cursor":  page.Cursor,
+		"hasMore": page.HasMore,
+		"reset":   page.Reset,
+	})
+}
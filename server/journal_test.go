@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// changeSummary describes changes as "type path [oldPath]" for comparisons
+func changeSummary(changes []Change) []string {
+	var summary []string
+	for _, c := range changes {
+		summary = append(summary, strings.TrimSpace(c.Type+" "+c.Path+" "+c.OldPath))
+	}
+	return summary
+}
+
+func TestChangeJournal(t *testing.T) {
+	fm, _ := newTestFileManager(t, "alice/.keep")
+	dir := t.TempDir()
+	cj := NewChangeJournal(dir, fm)
+
+	if err := fm.CreateFolder("alice", "", "docs"); err != nil {
+		t.Fatal(err)
+	}
+	page, err := cj.Changes("alice", "docs", "", 100)
+	if err != nil || !page.Reset || len(page.Changes) != 0 {
+		t.Fatalf("first page: %+v (%v), want a reset", page, err)
+	}
+	cursor := page.Cursor
+
+	if _, _, err := fm.SaveFile("alice", "docs", "a.txt", strings.NewReader("a"), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fm.SaveFile("alice", "", "outside.txt", strings.NewReader("b"), SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.RenameItem("alice", "docs", "a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.MoveItem("alice", "docs", "b.txt", "", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths are relative to the folder, and items moved out of it are gone
+	want := []string{EventCreate + " a.txt", EventRename + " b.txt a.txt", EventDelete + " b.txt"}
+	page, err = cj.Changes("alice", "docs", cursor, 100)
+	if err != nil || page.Reset || page.HasMore {
+		t.Fatalf("changes: %+v (%v)", page, err)
+	}
+	if got := changeSummary(page.Changes); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("changes: got %v, want %v", got, want)
+	}
+	if page.Changes[0].ETag == "" || page.Changes[0].Size != 1 {
+		t.Errorf("created file: %+v", page.Changes[0])
+	}
+
+	// The journal survives restarts, and is read a page at a time
+	cj = NewChangeJournal(dir, fm)
+	var got []string
+	for next := cursor; ; {
+		page, err := cj.Changes("alice", "docs", next, 1)
+		if err != nil || page.Reset {
+			t.Fatalf("paged changes: %+v (%v)", page, err)
+		}
+		got = append(got, changeSummary(page.Changes)...)
+		next = page.Cursor
+		if !page.HasMore {
+			break
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("paged changes: got %v, want %v", got, want)
+	}
+
+	// A folder moved away has to be listed again
+	if err := fm.RenameItem("alice", "", "docs", "papers"); err != nil {
+		t.Fatal(err)
+	}
+	if page, err := cj.Changes("alice", "docs", cursor, 100); err != nil || !page.Reset {
+		t.Errorf("changes of a moved folder: %+v (%v), want a reset", page, err)
+	}
+	if _, err := cj.Changes("alice", "docs", "garbage", 100); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("bad cursor: got %v, want ErrInvalidCursor", err)
+	}
+}
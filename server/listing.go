@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort orders for directory listings
+const (
+	SortName     = "name"
+	SortSize     = "size"
+	SortModified = "modified"
+	SortType     = "type"
+)
+
+var (
+	// ErrInvalidCursor is returned for cursors that don't belong to the requested listing
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidListOptions is returned for unknown sort orders, types or bad patterns
+	ErrInvalidListOptions = errors.New("invalid listing options")
+)
+
+// ListOptions controls sorting, filtering and pagination of a directory listing
+type ListOptions struct {
+	Sort         string // SortName, SortSize, SortModified or SortType
+	Desc         bool   // Reverse the sort order
+	FoldersFirst bool   // Keep folders before files regardless of the order
+	Type         string // Only list "file" or "folder" items (empty = both)
+	Pattern      string // Glob matched against item names (case insensitive)
+	Limit        int    // Maximum items per page (0 = all)
+	Cursor       string // Position returned by the previous page
+}
+
+// DefaultListOptions lists everything, folders first, by name
+var DefaultListOptions = ListOptions{
+	Sort:         SortName,
+	FoldersFirst: true,
+}
+
+// ListPage is one page of a directory listing
+type ListPage struct {
+	Items        []FileItem `json:"items"`
+	Total        int        `json:"total"`                // Matching items in the whole folder
+	NextCursor   string     `json:"nextCursor,omitempty"` // Empty on the last page
+	LastModified time.Time  `json:"-"`                    // Latest change to the folder or an item of the page
+}
+
+// listEntry holds what is needed to sort a directory entry without building its FileItem
+type listEntry struct {
+	name     string
+	isDir    bool
+	size     int64
+	modified int64 // Unix nanoseconds
+}
+
+// listCursor is the decoded form of ListOptions.Cursor: the last entry of the previous
+// page together with the order it was listed in
+type listCursor struct {
+	Sort         string `json:"s"`
+	Desc         bool   `json:"d"`
+	FoldersFirst bool   `json:"f"`
+	Name         string `json:"n"`
+	IsDir        bool   `json:"t"`
+	Size         int64  `json:"z"`
+	Modified     int64  `json:"m"`
+}
+
+// ListFilesPage lists a folder (relative to user directory) with sorting, filtering and
+// cursor based pagination. Only the entries of the returned page are fully inspected,
+// the rest are sorted from the directory entry alone (plus a stat when sorting by size
+// or date), so large folders stay cheap to browse.
+func (fm *FileManager) ListFilesPage(username, path string, opts ListOptions) (*ListPage, error) {
+	if opts.Sort == "" {
+		opts.Sort = SortName
+	}
+	switch opts.Sort {
+	case SortName, SortSize, SortModified, SortType:
+	default:
+		return nil, fmt.Errorf("%w: unknown sort %q", ErrInvalidListOptions, opts.Sort)
+	}
+	if opts.Type != "" && opts.Type != "file" && opts.Type != "folder" {
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidListOptions, opts.Type)
+	}
+	pattern := strings.ToLower(opts.Pattern)
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%w: bad pattern", ErrInvalidListOptions)
+	}
+
+	dir, err := fm.resolvePath(username, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if directory exists
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	needInfo := opts.Sort == SortSize || opts.Sort == SortModified
+	entries := make([]listEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		// Skip uploads still in progress
+		if strings.HasPrefix(d.Name(), uploadTempPrefix) {
+			continue
+		}
+
+		entry := listEntry{name: d.Name(), isDir: d.IsDir()}
+
+		// Symlinks are listed as what they point to
+		if needInfo || d.Type()&os.ModeSymlink != 0 {
+			info, err := os.Stat(filepath.Join(dir, d.Name()))
+			if err != nil {
+				continue
+			}
+			entry.isDir = info.IsDir()
+			entry.size = fm.fileSize(filepath.Join(dir, d.Name()), info)
+			entry.modified = info.ModTime().UnixNano()
+		}
+
+		if opts.Type == "folder" && !entry.isDir || opts.Type == "file" && entry.isDir {
+			continue
+		}
+		if pattern != "" {
+			if matched, _ := filepath.Match(pattern, strings.ToLower(entry.name)); !matched {
+				continue
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return opts.less(&entries[i], &entries[j])
+	})
+
+	// Skip everything up to and including the cursor
+	start := 0
+	if opts.Cursor != "" {
+		cursor, err := decodeListCursor(opts.Cursor)
+		if err != nil || cursor.Sort != opts.Sort || cursor.Desc != opts.Desc || cursor.FoldersFirst != opts.FoldersFirst {
+			return nil, ErrInvalidCursor
+		}
+		last := listEntry{name: cursor.Name, isDir: cursor.IsDir, size: cursor.Size, modified: cursor.Modified}
+		start = sort.Search(len(entries), func(i int) bool {
+			return opts.less(&last, &entries[i])
+		})
+	}
+
+	end := len(entries)
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+	}
+
+	// Items can be deleted or renamed when their folder is writable
+	parentWritable := info.Mode().Perm()&0200 != 0
+
+	page := &ListPage{
+		Items:        make([]FileItem, 0, end-start),
+		Total:        len(entries),
+		LastModified: info.ModTime(),
+	}
+	for _, entry := range entries[start:end] {
+		entryPath := filepath.Join(dir, entry.name)
+		info, err := os.Stat(entryPath)
+		if err != nil {
+			continue
+		}
+		page.Items = append(page.Items, fm.newFileItem(username, entryPath, info, parentWritable))
+		if info.ModTime().After(page.LastModified) {
+			page.LastModified = info.ModTime()
+		}
+	}
+
+	if end < len(entries) {
+		last := entries[end-1]
+		page.NextCursor = encodeListCursor(listCursor{
+			Sort:         opts.Sort,
+			Desc:         opts.Desc,
+			FoldersFirst: opts.FoldersFirst,
+			Name:         last.name,
+			IsDir:        last.isDir,
+			Size:         last.size,
+			Modified:     last.modified,
+		})
+	}
+
+	return page, nil
+}
+
+// less reports whether a is listed before b
+func (opts ListOptions) less(a, b *listEntry) bool {
+	// Folders first is independent of the direction
+	if opts.FoldersFirst && a.isDir != b.isDir {
+		return a.isDir
+	}
+
+	c := 0
+	switch opts.Sort {
+	case SortSize:
+		c = compareInt64(a.size, b.size)
+	case SortModified:
+		c = compareInt64(a.modified, b.modified)
+	case SortType:
+		c = strings.Compare(listType(a), listType(b))
+	}
+	if c == 0 {
+		c = strings.Compare(strings.ToLower(a.name), strings.ToLower(b.name))
+	}
+	if c == 0 {
+		c = strings.Compare(a.name, b.name)
+	}
+
+	if opts.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// listType is the key used when sorting by type: folders, then files by extension
+func listType(entry *listEntry) string {
+	if entry.isDir {
+		return ""
+	}
+	return "." + strings.ToLower(filepath.Ext(entry.name))
+}
+
+// compareInt64 returns -1, 0 or 1 like strings.Compare
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// encodeListCursor turns a cursor into an opaque string
+func encodeListCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeListCursor parses a string created by encodeListCursor
+func decodeListCursor(value string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
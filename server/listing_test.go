@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// listAll follows the cursors of a listing and returns the item names of every page
+func listAll(t *testing.T, fm *FileManager, opts ListOptions) ([]string, int) {
+	t.Helper()
+	var names []string
+	pages := 0
+	for {
+		page, err := fm.ListFilesPage("alice", "", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.Limit > 0 && len(page.Items) > opts.Limit {
+			t.Fatalf("page of %d items, limit %d", len(page.Items), opts.Limit)
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		pages++
+		if page.NextCursor == "" {
+			return names, pages
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func TestListFilesPage(t *testing.T) {
+	fm, baseDir := newTestFileManager(t,
+		"alice/b.txt",
+		"alice/A.md",
+		"alice/c.jpg",
+		"alice/big.bin",
+		"alice/Docs/x",
+		"alice/archive/y",
+	)
+	if err := os.WriteFile(filepath.Join(baseDir, "alice", "big.bin"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"b.txt", "A.md", "c.jpg", "big.bin"} {
+		at := time.Now().Add(time.Duration(i-10) * time.Hour)
+		if err := os.Chtimes(filepath.Join(baseDir, "alice", name), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []string
+	}{
+		{"folders first by name", DefaultListOptions, []string{"archive", "Docs", "A.md", "b.txt", "big.bin", "c.jpg"}},
+		// Equal sizes are ordered by name, in the same direction
+		{"by size descending", ListOptions{Sort: SortSize, Desc: true, Type: "file"}, []string{"big.bin", "c.jpg", "b.txt", "A.md"}},
+		{"by date", ListOptions{Sort: SortModified, Type: "file"}, []string{"b.txt", "A.md", "c.jpg", "big.bin"}},
+		{"by type", ListOptions{Sort: SortType, Type: "file"}, []string{"big.bin", "c.jpg", "A.md", "b.txt"}},
+		{"folders only", ListOptions{Type: "folder", Desc: true}, []string{"Docs", "archive"}},
+		{"pattern", ListOptions{Pattern: "B*"}, []string{"b.txt", "big.bin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, _ := listAll(t, fm, tt.opts)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("got %v, want %v", names, tt.want)
+			}
+
+			// Pages add up to the whole listing
+			paged := tt.opts
+			paged.Limit = 1
+			names, pages := listAll(t, fm, paged)
+			if !slices.Equal(names, tt.want) || pages != len(tt.want) {
+				t.Errorf("paged: got %v in %d pages, want %v", names, pages, tt.want)
+			}
+		})
+	}
+
+	page, err := fm.ListFilesPage("alice", "", ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 6 {
+		t.Errorf("total: got %d, want 6", page.Total)
+	}
+
+	// A cursor only continues the listing order it came from
+	if _, err := fm.ListFilesPage("alice", "", ListOptions{Sort: SortSize, Cursor: page.NextCursor}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("cursor of another order: got %v, want ErrInvalidCursor", err)
+	}
+	if _, err := fm.ListFilesPage("alice", "", ListOptions{Cursor: "garbage"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("bad cursor: got %v, want ErrInvalidCursor", err)
+	}
+	if _, err := fm.ListFilesPage("alice", "", ListOptions{Sort: "color"}); !errors.Is(err, ErrInvalidListOptions) {
+		t.Errorf("unknown sort: got %v, want ErrInvalidListOptions", err)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned when a write would exceed the user's quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// UsageTracker keeps the storage usage of each user in memory.
+// A user's directory is only walked the first time their usage is needed,
+// after that the value is updated incrementally by the file operations.
+type UsageTracker struct {
+	baseDir string
+	usage   map[string]int64
+	mu      sync.Mutex
+}
+
+// NewUsageTracker creates a new usage tracker
+func NewUsageTracker(baseDir string) *UsageTracker {
+	return &UsageTracker{
+		baseDir: baseDir,
+		usage:   make(map[string]int64),
+	}
+}
+
+// Usage returns the number of bytes used by a user
+func (ut *UsageTracker) Usage(username string) (int64, error) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	return ut.loadLocked(username)
+}
+
+// Reserve adds size bytes to the user's usage if they fit in the quota (0 = unlimited)
+func (ut *UsageTracker) Reserve(username string, size, quota int64) error {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	used, err := ut.loadLocked(username)
+	if err != nil {
+		return err
+	}
+
+	if quota > 0 && used+size > quota {
+		return ErrQuotaExceeded
+	}
+
+	ut.usage[username] = used + size
+	return nil
+}
+
+// Add adjusts the user's usage by delta bytes (negative to release space)
+func (ut *UsageTracker) Add(username string, delta int64) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	// Users not loaded yet will be scanned on first use
+	used, exists := ut.usage[username]
+	if !exists {
+		return
+	}
+
+	used += delta
+	if used < 0 {
+		used = 0
+	}
+	ut.usage[username] = used
+}
+
+// Forget drops the user's cached usage, to scan their directory again on next
+// use after it changed outside of the file operations
+func (ut *UsageTracker) Forget(username string) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	delete(ut.usage, username)
+}
+
+// loadLocked returns the cached usage, scanning the user directory if needed (caller must hold ut.mu)
+func (ut *UsageTracker) loadLocked(username string) (int64, error) {
+	if used, exists := ut.usage[username]; exists {
+		return used, nil
+	}
+
+	used, err := dirSize(filepath.Join(ut.baseDir, username))
+	if err != nil {
+		return 0, err
+	}
+
+	ut.usage[username] = used
+	return used, nil
+}
+
+// dirSize returns the total size of the regular files inside a directory
+func dirSize(path string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// quotaWriter reserves quota for every chunk before passing it to the underlying writer
+type quotaWriter struct {
+	fm       *FileManager
+	username string
+	w        io.Writer
+	reserved int64 // Bytes reserved so far
+}
+
+// Write reserves len(p) bytes and writes them, failing with ErrQuotaExceeded when full
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	if err := qw.fm.ReserveSpace(qw.username, int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	n, err := qw.w.Write(p)
+	qw.reserved += int64(n)
+
+	// Give back what was not written
+	if n < len(p) {
+		qw.fm.ReleaseSpace(qw.username, int64(len(p)-n))
+	}
+
+	return n, err
+}
@@ -0,0 +1,766 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3Namespace is the XML namespace of S3 responses
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	// s3TimeFormat is how S3 writes dates in XML
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	// s3MaxKeys is the most objects a listing returns at once
+	s3MaxKeys = 1000
+	// s3EmptyETag is the ETag S3 gives empty objects, the MD5 of nothing
+	s3EmptyETag = `"d41d8cd98f00b204e9800998ecf8427e"`
+)
+
+// s3Error is an error answered in the XML format of S3
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string { return e.message }
+
+// s3ErrorOf returns an S3 error
+func s3ErrorOf(status int, code, message string) *s3Error {
+	return &s3Error{status: status, code: code, message: message}
+}
+
+var (
+	errS3AccessDenied          = s3ErrorOf(http.StatusForbidden, "AccessDenied", "Access Denied")
+	errS3SignatureDoesNotMatch = s3ErrorOf(http.StatusForbidden, "SignatureDoesNotMatch", "The chunk signature we calculated does not match the signature you provided")
+	errS3ContentSHA256Mismatch = s3ErrorOf(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed")
+	errS3IncompleteBody        = s3ErrorOf(http.StatusBadRequest, "IncompleteBody", "The request body is malformed or incomplete")
+	errS3NoSuchBucket          = s3ErrorOf(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	errS3NoSuchKey             = s3ErrorOf(http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+	errS3NoSuchUpload          = s3ErrorOf(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+	errS3InvalidKey            = s3ErrorOf(http.StatusBadRequest, "InvalidArgument", "Keys are paths of files: they can't have empty, . or .. elements")
+	errS3MalformedXML          = s3ErrorOf(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+	errS3NotImplemented        = s3ErrorOf(http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented")
+	errS3MethodNotAllowed      = s3ErrorOf(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource")
+	errS3EntityTooLarge        = s3ErrorOf(http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size")
+	errS3QuotaExceeded         = s3ErrorOf(http.StatusForbidden, "QuotaExceeded", "Storage quota exceeded")
+)
+
+// writeS3Error answers a request with the S3 error matching err
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.Is(err, ErrQuotaExceeded):
+		s3Err = errS3QuotaExceeded
+	case errors.Is(err, ErrChecksumMismatch):
+		s3Err = s3ErrorOf(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+	case errors.Is(err, ErrPreconditionFailed):
+		s3Err = s3ErrorOf(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold")
+	case errors.Is(err, ErrReservedName):
+		s3Err = errS3InvalidKey
+	default:
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			s3Err = errS3EntityTooLarge
+			break
+		}
+		log.Printf("S3 %s %s: %v", r.Method, r.URL.Path, err)
+		s3Err = s3ErrorOf(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+	}
+
+	body := struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string   `xml:"Code"`
+		Message  string   `xml:"Message"`
+		Resource string   `xml:"Resource"`
+	}{Code: s3Err.code, Message: s3Err.message, Resource: r.URL.Path}
+	writeS3XML(w, s3Err.status, body)
+}
+
+// writeS3XML answers with an XML document
+func writeS3XML(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(body)
+}
+
+// readS3XML decodes an XML request body, read in full so that its signed hash is checked
+func readS3XML(body io.Reader, v interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(body, 2<<20))
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return errS3MalformedXML
+	}
+	return nil
+}
+
+// HandleS3 serves the S3 API with path-style addressing: the top-level
+// folders of the user's own tree are buckets, and object keys are the paths
+// of the files below them. Requests are signed with SigV4, using one of the
+// user's S3 access keys.
+func (h *APIHandler) HandleS3(w http.ResponseWriter, r *http.Request) {
+	auth, err := h.s3Authenticate(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeS3Error(w, r, errS3MethodNotAllowed)
+			return
+		}
+		h.s3ListBuckets(w, r, auth.username)
+		return
+	}
+
+	if key == "" && r.Method == http.MethodPut {
+		h.s3CreateBucket(w, r, auth.username, bucket)
+		return
+	}
+	if err := h.s3CheckBucket(auth.username, bucket); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && query.Has("location"):
+			writeS3XML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		case r.Method == http.MethodGet && (query.Has("uploads") || query.Has("versioning") || query.Has("policy") || query.Has("acl")):
+			writeS3Error(w, r, errS3NotImplemented)
+		case r.Method == http.MethodGet:
+			h.s3ListObjects(w, r, auth.username, bucket)
+		case r.Method == http.MethodPost && query.Has("delete"):
+			h.s3DeleteObjects(w, r, auth, bucket)
+		case r.Method == http.MethodDelete:
+			h.s3DeleteBucket(w, r, auth.username, bucket)
+		default:
+			writeS3Error(w, r, errS3MethodNotAllowed)
+		}
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		h.s3UploadPart(w, r, auth, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		writeS3Error(w, r, errS3NotImplemented)
+	case r.Method == http.MethodPut:
+		h.s3PutObject(w, r, auth, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		h.s3CreateMultipartUpload(w, r, auth.username, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		h.s3CompleteMultipartUpload(w, r, auth, bucket, key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		h.s3AbortMultipartUpload(w, r, auth.username, bucket, key)
+	case r.Method == http.MethodDelete:
+		if err := h.s3DeleteObject(auth.username, bucket, key); err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && query.Has("uploadId"):
+		writeS3Error(w, r, errS3NotImplemented)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		h.s3GetObject(w, r, auth.username, bucket, key)
+	default:
+		writeS3Error(w, r, errS3MethodNotAllowed)
+	}
+}
+
+// s3CheckBucket checks a bucket is a top-level folder of the user
+func (h *APIHandler) s3CheckBucket(username, bucket string) error {
+	if !validS3Bucket(bucket) {
+		return errS3NoSuchBucket
+	}
+	dir, err := h.fileManager.resolveItem(username, "", bucket)
+	if err != nil {
+		return errS3NoSuchBucket
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return errS3NoSuchBucket
+	}
+	return nil
+}
+
+// validS3Bucket reports whether a bucket name can be a top-level folder
+func validS3Bucket(bucket string) bool {
+	return bucket != "." && bucket != ".." && !strings.ContainsAny(bucket, "\\") && !strings.HasPrefix(bucket, uploadTempPrefix)
+}
+
+// s3Location returns the folder, relative to the user directory, and the
+// name of the item a key points to. Keys ending in a slash point to folders.
+func s3Location(bucket, key string) (dir, name string, err error) {
+	parts := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, "\\") || strings.HasPrefix(part, uploadTempPrefix) {
+			return "", "", errS3InvalidKey
+		}
+	}
+	return path.Join(append([]string{bucket}, parts[:len(parts)-1]...)...), parts[len(parts)-1], nil
+}
+
+// s3MakeFolders creates a folder, relative to the user directory, and the
+// folders above it that don't exist yet, as keys imply them
+func (h *APIHandler) s3MakeFolders(username, dir string) error {
+	parent := ""
+	for _, name := range strings.Split(dir, "/") {
+		fullPath, err := h.fileManager.resolveItem(username, parent, name)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(fullPath)
+		switch {
+		case os.IsNotExist(err):
+			if err := h.fileManager.CreateFolder(username, parent, name); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return s3ErrorOf(http.StatusConflict, "InvalidArgument", "A file is in the way of the key: "+path.Join(parent, name))
+		}
+		parent = path.Join(parent, name)
+	}
+	return nil
+}
+
+// s3ListBuckets lists the top-level folders of the user
+func (h *APIHandler) s3ListBuckets(w http.ResponseWriter, r *http.Request, username string) {
+	opts := DefaultListOptions
+	opts.Limit = 0
+	opts.Type = "folder"
+	page, err := h.fileManager.ListFilesPage(username, "", opts)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	type bucketEntry struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+	result := struct {
+		XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Owner   s3Owner       `xml:"Owner"`
+		Buckets []bucketEntry `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: s3Owner{ID: username, DisplayName: username}}
+	for _, item := range page.Items {
+		result.Buckets = append(result.Buckets, bucketEntry{Name: item.Name, CreationDate: s3Time(item.ModifiedAt)})
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
+
+// s3CreateBucket creates a top-level folder
+func (h *APIHandler) s3CreateBucket(w http.ResponseWriter, r *http.Request, username, bucket string) {
+	if !validS3Bucket(bucket) {
+		writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"))
+		return
+	}
+	if h.s3CheckBucket(username, bucket) == nil {
+		writeS3Error(w, r, s3ErrorOf(http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it"))
+		return
+	}
+	err := h.fileManager.CreateFolder(username, "", bucket)
+	h.audit.Record(AuditEntry{Protocol: AuditS3, User: username, Action: AuditMkdir, Owner: username, Path: bucket}, err)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidBucketName", err.Error()))
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+// s3DeleteBucket deletes an empty top-level folder
+func (h *APIHandler) s3DeleteBucket(w http.ResponseWriter, r *http.Request, username, bucket string) {
+	page, err := h.fileManager.ListFilesPage(username, bucket, ListOptions{Limit: 1})
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if page.Total > 0 {
+		writeS3Error(w, r, s3ErrorOf(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"))
+		return
+	}
+	err = h.fileManager.DeleteItems(username, "", []string{bucket})
+	h.audit.Record(AuditEntry{Protocol: AuditS3, User: username, Action: AuditDelete, Owner: username, Path: bucket}, err)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3Owner is the owner of buckets and objects in listings
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// s3Object is an object or a common prefix of a listing
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+	prefix       bool
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3ListObjects lists the objects of a bucket, in version 2 of the API when
+// list-type=2 and in version 1 otherwise
+func (h *APIHandler) s3ListObjects(w http.ResponseWriter, r *http.Request, username, bucket string) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	urlEncoded := query.Get("encoding-type") == "url"
+
+	maxKeys := s3MaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidArgument", "max-keys must be a positive number"))
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	// Objects after start are listed: the continuation token (v2) or
+	// marker (v1) carries on from the end of the previous page
+	start := query.Get("marker")
+	if v2 {
+		start = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"))
+				return
+			}
+			start = string(decoded)
+		}
+	}
+
+	objects, err := h.s3Objects(username, bucket, prefix, delimiter)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	first := sort.Search(len(objects), func(i int) bool { return objects[i].Key > start })
+	objects = objects[first:]
+	truncated := len(objects) > maxKeys
+	if truncated {
+		objects = objects[:maxKeys]
+	}
+
+	encode := func(s string) string {
+		if urlEncoded {
+			return s3Escape(s, true)
+		}
+		return s
+	}
+	var contents []s3Object
+	var prefixes []s3Prefix
+	for _, object := range objects {
+		if object.prefix {
+			prefixes = append(prefixes, s3Prefix{Prefix: encode(object.Key)})
+			continue
+		}
+		object.Key = encode(object.Key)
+		contents = append(contents, object)
+	}
+
+	last := ""
+	if truncated && len(objects) > 0 {
+		last = objects[len(objects)-1].Key
+	}
+
+	if v2 {
+		result := struct {
+			XMLName               xml.Name   `xml:"ListBucketResult"`
+			Xmlns                 string     `xml:"xmlns,attr"`
+			Name                  string     `xml:"Name"`
+			Prefix                string     `xml:"Prefix"`
+			Delimiter             string     `xml:"Delimiter,omitempty"`
+			MaxKeys               int        `xml:"MaxKeys"`
+			KeyCount              int        `xml:"KeyCount"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+			NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+			StartAfter            string     `xml:"StartAfter,omitempty"`
+			EncodingType          string     `xml:"EncodingType,omitempty"`
+			Contents              []s3Object `xml:"Contents"`
+			CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+		}{
+			Xmlns:             s3Namespace,
+			Name:              bucket,
+			Prefix:            encode(prefix),
+			Delimiter:         encode(delimiter),
+			MaxKeys:           maxKeys,
+			KeyCount:          len(objects),
+			IsTruncated:       truncated,
+			ContinuationToken: query.Get("continuation-token"),
+			StartAfter:        encode(query.Get("start-after")),
+			EncodingType:      query.Get("encoding-type"),
+			Contents:          contents,
+			CommonPrefixes:    prefixes,
+		}
+		if last != "" {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+		writeS3XML(w, http.StatusOK, result)
+		return
+	}
+
+	result := struct {
+		XMLName        xml.Name   `xml:"ListBucketResult"`
+		Xmlns          string     `xml:"xmlns,attr"`
+		Name           string     `xml:"Name"`
+		Prefix         string     `xml:"Prefix"`
+		Marker         string     `xml:"Marker"`
+		NextMarker     string     `xml:"NextMarker,omitempty"`
+		Delimiter      string     `xml:"Delimiter,omitempty"`
+		MaxKeys        int        `xml:"MaxKeys"`
+		IsTruncated    bool       `xml:"IsTruncated"`
+		EncodingType   string     `xml:"EncodingType,omitempty"`
+		Contents       []s3Object `xml:"Contents"`
+		CommonPrefixes []s3Prefix `xml:"CommonPrefixes"`
+	}{
+		Xmlns:          s3Namespace,
+		Name:           bucket,
+		Prefix:         encode(prefix),
+		Marker:         encode(query.Get("marker")),
+		NextMarker:     encode(last),
+		Delimiter:      encode(delimiter),
+		MaxKeys:        maxKeys,
+		IsTruncated:    truncated,
+		EncodingType:   query.Get("encoding-type"),
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
+
+// s3Objects returns the objects of a bucket whose keys start with prefix,
+// sorted by key. Keys that hold delimiter after the prefix are rolled up into
+// common prefixes. Only the folder the prefix is in is walked, and only its
+// own entries when the delimiter is a slash.
+func (h *APIHandler) s3Objects(username, bucket, prefix, delimiter string) ([]s3Object, error) {
+	folder := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		folder = prefix[:i]
+		if _, _, err := s3Location(bucket, folder); err != nil {
+			// No file has such a key
+			return nil, nil
+		}
+	}
+
+	var objects []s3Object
+	var walk func(folder string) error
+	walk = func(folder string) error {
+		opts := DefaultListOptions
+		opts.Limit = 0
+		page, err := h.fileManager.ListFilesPage(username, path.Join(bucket, folder), opts)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, item := range page.Items {
+			key := path.Join(folder, item.Name)
+			if item.Type == "folder" {
+				if !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+					continue
+				}
+				if delimiter == "/" {
+					if strings.HasPrefix(key+"/", prefix) {
+						objects = append(objects, s3Object{Key: key + "/", prefix: true})
+					}
+					continue
+				}
+				if err := walk(key); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					objects = append(objects, s3Object{Key: key[:len(prefix)+i+len(delimiter)], prefix: true})
+					continue
+				}
+			}
+			objects = append(objects, s3Object{
+				Key:          key,
+				LastModified: s3Time(item.ModifiedAt),
+				ETag:         item.ETag,
+				Size:         item.Bytes,
+				StorageClass: "STANDARD",
+			})
+		}
+		return nil
+	}
+	if err := walk(folder); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	// Common prefixes are listed once
+	unique := objects[:0]
+	for i, object := range objects {
+		if i > 0 && object.prefix && object.Key == objects[i-1].Key {
+			continue
+		}
+		unique = append(unique, object)
+	}
+	return unique, nil
+}
+
+// s3Time converts an RFC 3339 time of a FileItem to the format of S3 listings
+func s3Time(modifiedAt string) string {
+	t, _ := time.Parse(time.RFC3339Nano, modifiedAt)
+	return t.UTC().Format(s3TimeFormat)
+}
+
+// s3GetObject sends an object, or only its headers for HEAD requests.
+// Ranges and conditional requests are answered by ServeContent.
+func (h *APIHandler) s3GetObject(w http.ResponseWriter, r *http.Request, username, bucket, key string) {
+	dir, name, err := s3Location(bucket, key)
+	if err != nil {
+		writeS3Error(w, r, errS3NoSuchKey)
+		return
+	}
+	fullPath, err := h.fileManager.resolveItem(username, dir, name)
+	if err != nil {
+		writeS3Error(w, r, errS3NoSuchKey)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() != strings.HasSuffix(key, "/") {
+		writeS3Error(w, r, errS3NoSuchKey)
+		return
+	}
+
+	// Folders are empty objects whose keys end with a slash
+	if info.IsDir() {
+		w.Header().Set("Content-Type", "application/x-directory")
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("ETag", s3EmptyETag)
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	file, err := h.fileManager.openFile(fullPath)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	defer file.Close()
+	if r.Method == http.MethodGet {
+		h.audit.Record(AuditEntry{Protocol: AuditS3, User: username, Action: AuditDownload, Owner: username, Path: auditPath(dir, name)}, nil)
+	}
+
+	query := r.URL.Query()
+	contentType := query.Get("response-content-type")
+	if contentType == "" {
+		contentType = h.fileManager.detectMimeType(fullPath)
+	}
+	w.Header().Set("Content-Type", contentType)
+	if disposition := query.Get("response-content-disposition"); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// s3PutObject stores an object, creating the folders its key implies. An
+// empty object whose key ends with a slash creates a folder.
+func (h *APIHandler) s3PutObject(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket, key string) {
+	dir, name, err := s3Location(bucket, key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	body, err := h.s3Body(w, r, auth, auth.username)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	if strings.HasSuffix(key, "/") {
+		if n, _ := io.Copy(io.Discard, io.LimitReader(body, 1)); n > 0 {
+			writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidArgument", "Keys ending with a slash are folders, they can't have content"))
+			return
+		}
+		err := h.s3MakeFolders(auth.username, path.Join(dir, name))
+		h.audit.Record(AuditEntry{Protocol: AuditS3, User: auth.username, Action: AuditMkdir, Owner: auth.username, Path: auditPath(dir, name)}, err)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", s3EmptyETag)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	digests, err := ParseDigests(r.Header)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was invalid"))
+		return
+	}
+	if err := h.s3MakeFolders(auth.username, dir); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	_, _, err = h.fileManager.SaveFile(auth.username, dir, name, body, SaveOptions{
+		Expect:      digests,
+		IfMatch:     r.Header.Get("If-Match"),
+		IfNoneMatch: r.Header.Get("If-None-Match"),
+	})
+	h.audit.Record(AuditEntry{Protocol: AuditS3, User: auth.username, Action: AuditUpload, Owner: auth.username, Path: auditPath(dir, name)}, err)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	if fullPath, err := h.fileManager.resolveItem(auth.username, dir, name); err == nil {
+		if info, err := os.Stat(fullPath); err == nil {
+			w.Header().Set("ETag", fileETag(info))
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// s3Body returns the verified body of an upload, after checking it fits in
+// the maximum upload size and in the quota of owner
+func (h *APIHandler) s3Body(w http.ResponseWriter, r *http.Request, auth *s3Auth, owner string) (io.Reader, error) {
+	length := r.ContentLength
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		length, _ = strconv.ParseInt(decoded, 10, 64)
+	}
+	if h.maxUploadSize > 0 {
+		if length > h.maxUploadSize {
+			return nil, errS3EntityTooLarge
+		}
+		// aws-chunked framing takes a little more than the content
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize+h.maxUploadSize/64+4096)
+	}
+	if length > 0 {
+		used, quota, err := h.fileManager.GetUsage(owner)
+		if err == nil && quota > 0 && used+length > quota {
+			return nil, errS3QuotaExceeded
+		}
+	}
+	return auth.body(r)
+}
+
+// s3DeleteObject deletes the file a key points to. Deleting what doesn't
+// exist succeeds, as in S3; folders are only deleted once empty.
+func (h *APIHandler) s3DeleteObject(username, bucket, key string) error {
+	dir, name, err := s3Location(bucket, key)
+	if err != nil {
+		return nil
+	}
+	fullPath, err := h.fileManager.resolveItem(username, dir, name)
+	if err != nil {
+		return nil
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() != strings.HasSuffix(key, "/") {
+		return nil
+	}
+	if info.IsDir() {
+		page, err := h.fileManager.ListFilesPage(username, path.Join(dir, name), ListOptions{Limit: 1})
+		if err != nil || page.Total > 0 {
+			return err
+		}
+	}
+	err = h.fileManager.DeleteItems(username, dir, []string{name})
+	h.audit.Record(AuditEntry{Protocol: AuditS3, User: username, Action: AuditDelete, Owner: username, Path: auditPath(dir, name)}, err)
+	return err
+}
+
+// s3DeleteObjects deletes up to 1000 objects at once
+func (h *APIHandler) s3DeleteObjects(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket string) {
+	body, err := auth.body(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := readS3XML(body, &req); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if len(req.Objects) > s3MaxKeys {
+		writeS3Error(w, r, errS3MalformedXML)
+		return
+	}
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	type deleteError struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	result := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{Xmlns: s3Namespace}
+	for _, object := range req.Objects {
+		if err := h.s3DeleteObject(auth.username, bucket, object.Key); err != nil {
+			log.Printf("S3 delete of %s/%s by %s failed: %v", bucket, object.Key, auth.username, err)
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: "InternalError", Message: "The object could not be deleted"})
+			continue
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: object.Key})
+		}
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// newTestS3Gateway serves the S3 gateway of a new server with one user, and
+// returns a client signing as them. Over TLS, minio-go signs the payload's
+// hash in the headers; over plain HTTP it streams aws-chunked payloads, each
+// chunk signed. The payload hashes of uploads are recorded in payloads.
+func newTestS3Gateway(t *testing.T, tls bool, payloads *[]string) *minio.Core {
+	t.Helper()
+	h := newTestAPIHandler(t)
+	key, err := h.authManager.CreateS3Key("alice", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			*payloads = append(*payloads, r.Header.Get("X-Amz-Content-Sha256"))
+		}
+		h.HandleS3(w, r)
+	})
+	var ts *httptest.Server
+	if tls {
+		ts = httptest.NewTLSServer(handler)
+	} else {
+		ts = httptest.NewServer(handler)
+	}
+	t.Cleanup(ts.Close)
+
+	endpoint, _ := url.Parse(ts.URL)
+	client, err := minio.NewCore(endpoint.Host, &minio.Options{
+		Creds:     credentials.NewStaticV4(key.AccessKeyID, key.Secret, ""),
+		Secure:    tls,
+		Region:    "us-east-1",
+		Transport: ts.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// putObject uploads an object, with its hash signed when the client doesn't stream
+func putObject(t *testing.T, client *minio.Core, bucket, key, content string) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	_, err := client.PutObject(context.Background(), bucket, key, strings.NewReader(content), int64(len(content)), "", hex.EncodeToString(sum[:]), minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+}
+
+// getObject downloads an object
+func getObject(t *testing.T, client *minio.Core, bucket, key string) string {
+	t.Helper()
+	body, _, _, err := client.GetObject(context.Background(), bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	return string(data)
+}
+
+func TestS3Gateway(t *testing.T) {
+	for _, signing := range []struct {
+		name string
+		tls  bool
+	}{
+		{"signed payload", true},
+		{"aws-chunked", false},
+	} {
+		t.Run(signing.name, func(t *testing.T) {
+			var payloads []string
+			client := newTestS3Gateway(t, signing.tls, &payloads)
+			testS3Buckets(t, client)
+			testS3Objects(t, client)
+			testS3ListObjects(t, client)
+			testS3Multipart(t, client)
+
+			// Both ways of signing were really used
+			streamed, hashed := 0, 0
+			for _, payload := range payloads {
+				switch {
+				case payload == streamingSignedPayload:
+					streamed++
+				case len(payload) == 64:
+					hashed++
+				}
+			}
+			if signing.tls && (hashed == 0 || streamed > 0) {
+				t.Errorf("signed payload uploads: %d hashed, %d streamed", hashed, streamed)
+			}
+			if !signing.tls && streamed == 0 {
+				t.Errorf("no aws-chunked uploads among %v", payloads)
+			}
+		})
+	}
+}
+
+func testS3Buckets(t *testing.T, client *minio.Core) {
+	ctx := context.Background()
+	for _, bucket := range []string{"photos", "docs"} {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			t.Fatalf("make bucket %s: %v", bucket, err)
+		}
+	}
+
+	buckets, err := client.ListBuckets(ctx)
+	if err != nil {
+		t.Fatalf("list buckets: %v", err)
+	}
+	var names []string
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "docs,photos" {
+		t.Errorf("buckets: got %v", names)
+	}
+
+	if exists, err := client.BucketExists(ctx, "missing"); err != nil || exists {
+		t.Errorf("missing bucket exists: %v, %v", exists, err)
+	}
+}
+
+func testS3Objects(t *testing.T, client *minio.Core) {
+	ctx := context.Background()
+	putObject(t, client, "docs", "notes/today.txt", "hello from S3")
+
+	if got := getObject(t, client, "docs", "notes/today.txt"); got != "hello from S3" {
+		t.Errorf("get: got %q", got)
+	}
+
+	info, err := client.StatObject(ctx, "docs", "notes/today.txt", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatalf("head: %v", err)
+	}
+	if info.Size != int64(len("hello from S3")) || info.ETag == "" {
+		t.Errorf("head: size %d, etag %q", info.Size, info.ETag)
+	}
+
+	// Overwriting replaces the content
+	putObject(t, client, "docs", "notes/today.txt", "changed")
+	if got := getObject(t, client, "docs", "notes/today.txt"); got != "changed" {
+		t.Errorf("get after overwrite: got %q", got)
+	}
+
+	if err := client.RemoveObject(ctx, "docs", "notes/today.txt", minio.RemoveObjectOptions{}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, err = client.StatObject(ctx, "docs", "notes/today.txt", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Errorf("head after delete: got %v, want NoSuchKey", err)
+	}
+}
+
+func testS3ListObjects(t *testing.T, client *minio.Core) {
+	keys := []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "dir/one.txt", "dir/two.txt", "dir/sub/three.txt"}
+	for _, key := range keys {
+		putObject(t, client, "photos", key, key)
+	}
+
+	// Two keys per page, following the continuation tokens
+	var listed []string
+	token := ""
+	pages := 0
+	for {
+		result, err := client.ListObjectsV2("photos", "", "", token, "", 2)
+		if err != nil {
+			t.Fatalf("list page %d: %v", pages, err)
+		}
+		pages++
+		if len(result.Contents) > 2 {
+			t.Errorf("page %d has %d keys", pages, len(result.Contents))
+		}
+		for _, object := range result.Contents {
+			listed = append(listed, object.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		if result.NextContinuationToken == "" {
+			t.Fatal("truncated page without a continuation token")
+		}
+		token = result.NextContinuationToken
+	}
+	want := append([]string(nil), keys...)
+	sort.Strings(want)
+	if strings.Join(listed, ",") != strings.Join(want, ",") {
+		t.Errorf("paginated listing:\n got %v\nwant %v", listed, want)
+	}
+	if pages != 4 {
+		t.Errorf("pages: got %d, want 4", pages)
+	}
+
+	// The delimiter groups what is below a folder
+	result, err := client.ListObjectsV2("photos", "", "", "", "/", 1000)
+	if err != nil {
+		t.Fatalf("list with delimiter: %v", err)
+	}
+	var top, prefixes []string
+	for _, object := range result.Contents {
+		top = append(top, object.Key)
+	}
+	for _, prefix := range result.CommonPrefixes {
+		prefixes = append(prefixes, prefix.Prefix)
+	}
+	if strings.Join(top, ",") != "a.txt,b.txt,c.txt,d.txt,e.txt" || strings.Join(prefixes, ",") != "dir/" {
+		t.Errorf("delimiter listing: keys %v, prefixes %v", top, prefixes)
+	}
+
+	result, err = client.ListObjectsV2("photos", "dir/", "", "", "/", 1000)
+	if err != nil {
+		t.Fatalf("list prefix with delimiter: %v", err)
+	}
+	top, prefixes = nil, nil
+	for _, object := range result.Contents {
+		top = append(top, object.Key)
+	}
+	for _, prefix := range result.CommonPrefixes {
+		prefixes = append(prefixes, prefix.Prefix)
+	}
+	if strings.Join(top, ",") != "dir/one.txt,dir/two.txt" || strings.Join(prefixes, ",") != "dir/sub/" {
+		t.Errorf("prefix listing: keys %v, prefixes %v", top, prefixes)
+	}
+}
+
+func testS3Multipart(t *testing.T, client *minio.Core) {
+	ctx := context.Background()
+	parts := [][]byte{
+		bytes.Repeat([]byte("first part "), 1000),
+		bytes.Repeat([]byte("second part "), 1000),
+		[]byte("last"),
+	}
+
+	uploadID, err := client.NewMultipartUpload(ctx, "docs", "big/file.bin", minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatalf("create multipart upload: %v", err)
+	}
+
+	var completed []minio.CompletePart
+	for i, data := range parts {
+		sum := sha256.Sum256(data)
+		part, err := client.PutObjectPart(ctx, "docs", "big/file.bin", uploadID, i+1, bytes.NewReader(data), int64(len(data)), minio.PutObjectPartOptions{
+			Sha256Hex: hex.EncodeToString(sum[:]),
+		})
+		if err != nil {
+			t.Fatalf("upload part %d: %v", i+1, err)
+		}
+		completed = append(completed, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	if _, err := client.CompleteMultipartUpload(ctx, "docs", "big/file.bin", uploadID, completed, minio.PutObjectOptions{}); err != nil {
+		t.Fatalf("complete multipart upload: %v", err)
+	}
+	if got := getObject(t, client, "docs", "big/file.bin"); got != string(bytes.Join(parts, nil)) {
+		t.Errorf("assembled object: got %d bytes, want %d", len(got), len(bytes.Join(parts, nil)))
+	}
+
+	// A part that doesn't match its Content-MD5 is refused, and leaves the one
+	// it would have replaced
+	uploadID, err = client.NewMultipartUpload(ctx, "docs", "big/checked.bin", minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatalf("create multipart upload: %v", err)
+	}
+	part, err := client.PutObjectPart(ctx, "docs", "big/checked.bin", uploadID, 1, strings.NewReader("good"), 4, minio.PutObjectPartOptions{})
+	if err != nil {
+		t.Fatalf("upload part: %v", err)
+	}
+	wrong := md5.Sum([]byte("something else"))
+	_, err = client.PutObjectPart(ctx, "docs", "big/checked.bin", uploadID, 1, strings.NewReader("evil"), 4, minio.PutObjectPartOptions{
+		Md5Base64: base64.StdEncoding.EncodeToString(wrong[:]),
+	})
+	if code := minio.ToErrorResponse(err).Code; code != "BadDigest" {
+		t.Errorf("part with a wrong Content-MD5: got %v, want BadDigest", err)
+	}
+	if _, err := client.CompleteMultipartUpload(ctx, "docs", "big/checked.bin", uploadID, []minio.CompletePart{{PartNumber: 1, ETag: part.ETag}}, minio.PutObjectOptions{}); err != nil {
+		t.Fatalf("complete after a refused part: %v", err)
+	}
+	if got := getObject(t, client, "docs", "big/checked.bin"); got != "good" {
+		t.Errorf("object after a refused part: got %q", got)
+	}
+
+	// An aborted upload leaves nothing behind
+	uploadID, err = client.NewMultipartUpload(ctx, "docs", "big/aborted.bin", minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatalf("create multipart upload: %v", err)
+	}
+	if _, err := client.PutObjectPart(ctx, "docs", "big/aborted.bin", uploadID, 1, strings.NewReader("part"), 4, minio.PutObjectPartOptions{}); err != nil {
+		t.Fatalf("upload part: %v", err)
+	}
+	if err := client.AbortMultipartUpload(ctx, "docs", "big/aborted.bin", uploadID); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	_, err = client.StatObject(ctx, "docs", "big/aborted.bin", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Errorf("aborted object: got %v, want NoSuchKey", err)
+	}
+}
+
+// Multipart uploads that receive no part for a while are removed with their parts
+func TestS3MultipartExpiration(t *testing.T) {
+	h := newTestAPIHandler(t)
+	upload, err := h.s3Uploads.Create("alice", "docs", "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.s3Uploads.PutPart(upload, 1, strings.NewReader("first"), 100, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if swept, err := h.s3Uploads.Sweep(); err != nil || swept != 0 {
+		t.Errorf("sweep of an active upload: %d, %v", swept, err)
+	}
+
+	upload, err = h.s3Uploads.Get("alice", upload.ID, "docs", "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload.Updated = time.Now().Add(-s3UploadTTL - time.Minute)
+	if err := h.s3Uploads.save(upload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.s3Uploads.Get("alice", upload.ID, "docs", "big.bin"); err != errS3NoSuchUpload {
+		t.Errorf("get of an expired upload: got %v", err)
+	}
+
+	if swept, err := h.s3Uploads.Sweep(); err != nil || swept != 1 {
+		t.Fatalf("sweep: %d, %v", swept, err)
+	}
+	parts, _ := filepath.Glob(filepath.Join(h.fileManager.baseDir, "alice", partPrefix(upload)+"*"))
+	if len(parts) > 0 {
+		t.Errorf("parts left: %v", parts)
+	}
+	if used, _ := h.fileManager.usage.Usage("alice"); used != 0 {
+		t.Errorf("usage after the sweep: %d", used)
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrS3KeyNotFound is returned for unknown S3 access keys
+var ErrS3KeyNotFound = errors.New("access key not found")
+
+// S3Key is an access key pair S3 clients sign their requests with. Unlike API
+// keys, the secret is kept: checking a signature takes the secret itself.
+type S3Key struct {
+	AccessKeyID string    `json:"accessKeyId"`
+	Secret      string    `json:"secret,omitempty"`
+	Username    string    `json:"username"`
+	Name        string    `json:"name"`
+	Created     time.Time `json:"created"`
+}
+
+// CreateS3Key creates an access key pair for a user, returned with its secret
+func (am *AuthManager) CreateS3Key(username, name string) (*S3Key, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("the key needs a name")
+	}
+
+	secret := make([]byte, 30)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.users[username]; !exists {
+		return nil, errors.New("user not found")
+	}
+	s3Key := &S3Key{
+		AccessKeyID: "GC" + strings.ToUpper(randomHex(9)),
+		Secret:      base64.StdEncoding.EncodeToString(secret),
+		Username:    username,
+		Name:        name,
+		Created:     time.Now(),
+	}
+	am.s3Keys[s3Key.AccessKeyID] = s3Key
+	if err := am.saveS3KeysLocked(); err != nil {
+		delete(am.s3Keys, s3Key.AccessKeyID)
+		return nil, err
+	}
+
+	copied := *s3Key
+	return &copied, nil
+}
+
+// ListS3Keys returns the access keys of a user, oldest first, without their secrets
+func (am *AuthManager) ListS3Keys(username string) []S3Key {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	keys := []S3Key{}
+	for _, s3Key := range am.s3Keys {
+		if s3Key.Username == username {
+			copied := *s3Key
+			copied.Secret = ""
+			keys = append(keys, copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// DeleteS3Key revokes one of a user's access keys
+func (am *AuthManager) DeleteS3Key(username, accessKeyID string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	s3Key, exists := am.s3Keys[accessKeyID]
+	if !exists || s3Key.Username != username {
+		return ErrS3KeyNotFound
+	}
+	delete(am.s3Keys, accessKeyID)
+	return am.saveS3KeysLocked()
+}
+
+// LookupS3Key returns the user and secret of an access key
+func (am *AuthManager) LookupS3Key(accessKeyID string) (username, secret string, found bool) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	s3Key, exists := am.s3Keys[accessKeyID]
+	if !exists {
+		return "", "", false
+	}
+	if _, exists := am.users[s3Key.Username]; !exists {
+		return "", "", false
+	}
+	return s3Key.Username, s3Key.Secret, true
+}
+
+// loadS3Keys reads the S3 keys file, if it exists
+func (am *AuthManager) loadS3Keys() error {
+	if am.s3KeysFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(am.s3KeysFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var keys []*S3Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, s3Key := range keys {
+		am.s3Keys[s3Key.AccessKeyID] = s3Key
+	}
+	return nil
+}
+
+// saveS3KeysLocked writes the S3 keys to the JSON file (caller must hold am.mu).
+// writeFileAtomic creates it readable by the server only, as it holds the secrets.
+func (am *AuthManager) saveS3KeysLocked() error {
+	if am.s3KeysFile == "" {
+		return nil
+	}
+
+	keys := make([]*S3Key, 0, len(am.s3Keys))
+	for _, s3Key := range am.s3Keys {
+		keys = append(keys, s3Key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(am.s3KeysFile), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(am.s3KeysFile, data)
+}
+
+// HandleS3Keys lists (GET), creates (POST) and revokes (DELETE) the access
+// keys of the user for the S3 gateway
+func (h *APIHandler) HandleS3Keys(w http.ResponseWriter, r *http.Request) {
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"keys":    h.authManager.ListS3Keys(username),
+		})
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		AccessKeyID string `json:"accessKeyId"`
+		Name        string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := h.authManager.DeleteS3Key(username, req.AccessKeyID); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+
+	s3Key, err := h.authManager.CreateS3Key(username, req.Name)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"s3Key":   s3Key,
+	})
+}
@@ -0,0 +1,489 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// s3MaxParts is the highest part number of a multipart upload
+	s3MaxParts = 10000
+	// s3MaxPartSize bounds parts when the server has no maximum upload size
+	s3MaxPartSize = 5 << 30
+)
+
+// Multipart uploads expire once they received no part for s3UploadTTL, they
+// are looked for every s3SweepInterval
+const (
+	s3UploadTTL     = 24 * time.Hour
+	s3SweepInterval = time.Hour
+)
+
+// S3Upload is a multipart upload in progress
+type S3Upload struct {
+	ID       string         `json:"id"`
+	Username string         `json:"username"`
+	Bucket   string         `json:"bucket"`
+	Key      string         `json:"key"`
+	Parts    map[int]S3Part `json:"parts"`
+	Created  time.Time      `json:"created"`
+	Updated  time.Time      `json:"updated,omitempty"` // A part was last received
+}
+
+// expires returns when the upload expires unless it receives a part
+func (u *S3Upload) expires() time.Time {
+	if u.Updated.IsZero() {
+		return u.Created.Add(s3UploadTTL)
+	}
+	return u.Updated.Add(s3UploadTTL)
+}
+
+// S3Part is a received part of a multipart upload
+type S3Part struct {
+	ETag string `json:"etag"` // Quoted hex MD5 of the part
+	Size int64  `json:"size"`
+}
+
+// S3UploadStore keeps multipart uploads. Their descriptions are JSON files in
+// its directory; the parts are hidden partial files in the user directory,
+// so they count towards the quota like any other upload.
+type S3UploadStore struct {
+	dir         string
+	fileManager *FileManager
+	receiving   map[string]int // Parts being received, by upload
+	mu          sync.Mutex     // Serializes changes to upload descriptions
+}
+
+// NewS3UploadStore creates a new multipart upload store
+func NewS3UploadStore(dir string, fileManager *FileManager) *S3UploadStore {
+	return &S3UploadStore{dir: dir, fileManager: fileManager, receiving: make(map[string]int)}
+}
+
+// Create starts a multipart upload of username to a key of a bucket
+func (us *S3UploadStore) Create(username, bucket, key string) (*S3Upload, error) {
+	upload := &S3Upload{
+		ID:       randomHex(16),
+		Username: username,
+		Bucket:   bucket,
+		Key:      key,
+		Parts:    make(map[int]S3Part),
+		Created:  time.Now(),
+	}
+	if err := us.save(upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Get loads an upload of username to a key of a bucket. Expired uploads don't
+// exist anymore, even before they are swept.
+func (us *S3UploadStore) Get(username, id, bucket, key string) (*S3Upload, error) {
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return nil, errS3NoSuchUpload
+	}
+
+	upload, err := us.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Other users' uploads don't exist as far as this user is concerned
+	if upload.Username != username || upload.Bucket != bucket || upload.Key != key || time.Now().After(upload.expires()) {
+		return nil, errS3NoSuchUpload
+	}
+	return upload, nil
+}
+
+// partPrefix is what the names of the partial files of an upload start with
+func partPrefix(upload *S3Upload) string {
+	return uploadTempPrefix + "s3-" + upload.ID + "-"
+}
+
+// partPath returns where a part of an upload is kept
+func (us *S3UploadStore) partPath(upload *S3Upload, number int) (string, error) {
+	return us.fileManager.resolveItem(upload.Username, "", partPrefix(upload)+strconv.Itoa(number))
+}
+
+// PutPart stores a part of an upload, replacing any previous one with the same
+// number. Parts that don't match expectMD5, when given, fail with
+// ErrChecksumMismatch and leave the upload as it was.
+func (us *S3UploadStore) PutPart(upload *S3Upload, number int, src io.Reader, limit int64, expectMD5 []byte) (S3Part, error) {
+	partPath, err := us.partPath(upload, number)
+	if err != nil {
+		return S3Part{}, err
+	}
+	receivedPath, err := us.fileManager.resolveItem(upload.Username, "", partPrefix(upload)+strconv.Itoa(number)+"-"+randomHex(4))
+	if err != nil {
+		return S3Part{}, err
+	}
+
+	us.mu.Lock()
+	us.receiving[upload.ID]++
+	us.mu.Unlock()
+	defer func() {
+		us.mu.Lock()
+		us.receiving[upload.ID]--
+		if us.receiving[upload.ID] <= 0 {
+			delete(us.receiving, upload.ID)
+		}
+		us.mu.Unlock()
+	}()
+
+	// Received apart from the part it replaces, which stays until this one is verified
+	hash := md5.New()
+	size, err := us.fileManager.AppendPartial(upload.Username, receivedPath, 0, limit, src, hash)
+	if err == nil && expectMD5 != nil && !bytes.Equal(hash.Sum(nil), expectMD5) {
+		err = ErrChecksumMismatch
+	}
+	if err != nil {
+		us.fileManager.RemovePartial(upload.Username, receivedPath)
+		return S3Part{}, err
+	}
+	part := S3Part{ETag: `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, Size: size}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	// Reload, as other parts may have been added meanwhile
+	current, err := us.Get(upload.Username, upload.ID, upload.Bucket, upload.Key)
+	if err == nil {
+		err = us.fileManager.RemovePartial(upload.Username, partPath)
+	}
+	if err == nil {
+		err = os.Rename(receivedPath, partPath)
+	}
+	if err != nil {
+		us.fileManager.RemovePartial(upload.Username, receivedPath)
+		return S3Part{}, err
+	}
+	current.Parts[number] = part
+	current.Updated = time.Now()
+	if err := us.save(current); err != nil {
+		return S3Part{}, err
+	}
+	return part, nil
+}
+
+// Assemble joins the given parts of an upload, in order, into the partial file
+// of the first one and returns its path. The upload can't be used afterwards,
+// whether it succeeds or not.
+func (us *S3UploadStore) Assemble(upload *S3Upload, numbers []int) (string, error) {
+	assembled, err := us.partPath(upload, numbers[0])
+	if err != nil {
+		return "", err
+	}
+	offset := upload.Parts[numbers[0]].Size
+
+	for _, number := range numbers[1:] {
+		partPath, err := us.partPath(upload, number)
+		if err != nil {
+			return "", err
+		}
+		part, err := os.Open(partPath)
+		if err != nil {
+			return "", err
+		}
+		written, err := us.fileManager.AppendPartial(upload.Username, assembled, offset, upload.Parts[number].Size, part, nil)
+		part.Close()
+		if err != nil {
+			return "", err
+		}
+		offset += written
+
+		// The part is now in the assembled file
+		if err := us.fileManager.RemovePartial(upload.Username, partPath); err != nil {
+			return "", err
+		}
+	}
+	return assembled, nil
+}
+
+// Forget removes the description of an upload and the parts left
+func (us *S3UploadStore) Forget(upload *S3Upload) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	return us.forgetLocked(upload)
+}
+
+// forgetLocked removes the description of an upload and all of its partial
+// files, those of parts that were never recorded included (caller must hold us.mu)
+func (us *S3UploadStore) forgetLocked(upload *S3Upload) error {
+	userDir, err := us.fileManager.resolvePath(upload.Username, "")
+	if err != nil {
+		return err
+	}
+	partPaths, err := filepath.Glob(filepath.Join(userDir, partPrefix(upload)+"*"))
+	if err != nil {
+		return err
+	}
+	for _, partPath := range partPaths {
+		if err := us.fileManager.RemovePartial(upload.Username, partPath); err != nil {
+			return err
+		}
+	}
+	return os.Remove(filepath.Join(us.dir, upload.ID+".json"))
+}
+
+// Sweep removes the uploads that expired, returning how many. Uploads
+// receiving a part are left alone.
+func (us *S3UploadStore) Sweep() (int, error) {
+	entries, err := os.ReadDir(us.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	swept := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || us.receiving[id] > 0 {
+			continue
+		}
+		upload, err := us.load(id)
+		if err == nil && time.Now().After(upload.expires()) {
+			if err = us.forgetLocked(upload); err == nil {
+				swept++
+			}
+		}
+		if err != nil && !errors.Is(err, errS3NoSuchUpload) {
+			log.Printf("Error expiring multipart upload %s: %v", id, err)
+		}
+	}
+	return swept, nil
+}
+
+// RunSweeper removes expired uploads once per interval, forever
+func (us *S3UploadStore) RunSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		swept, err := us.Sweep()
+		if err != nil {
+			log.Printf("Expiring multipart uploads failed: %v", err)
+			continue
+		}
+		if swept > 0 {
+			log.Printf("Removed %d expired multipart uploads", swept)
+		}
+	}
+}
+
+// load reads an upload description from disk
+func (us *S3UploadStore) load(id string) (*S3Upload, error) {
+	data, err := os.ReadFile(filepath.Join(us.dir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errS3NoSuchUpload
+		}
+		return nil, err
+	}
+
+	var upload S3Upload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// save writes the upload description to disk
+func (us *S3UploadStore) save(upload *S3Upload) error {
+	if err := os.MkdirAll(us.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(us.dir, upload.ID+".json"), data)
+}
+
+// s3CreateMultipartUpload starts a multipart upload
+func (h *APIHandler) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, username, bucket, key string) {
+	if _, _, err := s3Location(bucket, key); err != nil || strings.HasSuffix(key, "/") {
+		writeS3Error(w, r, errS3InvalidKey)
+		return
+	}
+
+	upload, err := h.s3Uploads.Create(username, bucket, key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: upload.ID})
+}
+
+// s3UploadPart stores a part of a multipart upload
+func (h *APIHandler) s3UploadPart(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket, key string) {
+	query := r.URL.Query()
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > s3MaxParts {
+		writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000"))
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3Error(w, r, errS3NotImplemented)
+		return
+	}
+
+	upload, err := h.s3Uploads.Get(auth.username, query.Get("uploadId"), bucket, key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	body, err := h.s3Body(w, r, auth, auth.username)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	digests, err := ParseDigests(r.Header)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was invalid"))
+		return
+	}
+
+	limit := int64(s3MaxPartSize)
+	if h.maxUploadSize > 0 {
+		limit = h.maxUploadSize
+	}
+	part, err := h.s3Uploads.PutPart(upload, number, body, limit, digests.MD5)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", part.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// s3CompleteMultipartUpload joins the parts listed by the client into the object
+func (h *APIHandler) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, auth *s3Auth, bucket, key string) {
+	upload, err := h.s3Uploads.Get(auth.username, r.URL.Query().Get("uploadId"), bucket, key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	body, err := auth.body(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := readS3XML(body, &req); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if len(req.Parts) == 0 {
+		writeS3Error(w, r, errS3MalformedXML)
+		return
+	}
+
+	// Parts must be listed in order, as they were received
+	numbers := make([]int, len(req.Parts))
+	for i, listed := range req.Parts {
+		if i > 0 && listed.PartNumber <= numbers[i-1] {
+			writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"))
+			return
+		}
+		part, found := upload.Parts[listed.PartNumber]
+		if !found || strings.Trim(listed.ETag, `"`) != strings.Trim(part.ETag, `"`) {
+			writeS3Error(w, r, s3ErrorOf(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"))
+			return
+		}
+		numbers[i] = listed.PartNumber
+	}
+
+	dir, name, err := s3Location(bucket, key)
+	if err == nil {
+		err = h.s3MakeFolders(auth.username, dir)
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	assembled, err := h.s3Uploads.Assemble(upload, numbers)
+	if err == nil {
+		err = h.fileManager.CommitPartial(auth.username, assembled, dir, name)
+	}
+	h.audit.Record(AuditEntry{Protocol: AuditS3, User: auth.username, Action: AuditUpload, Owner: auth.username, Path: auditPath(dir, name)}, err)
+	// The parts are gone or partly joined either way: when this fails, the
+	// client has to start over
+	h.s3Uploads.Forget(upload)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	etag := ""
+	if fullPath, err := h.fileManager.resolveItem(auth.username, dir, name); err == nil {
+		if info, err := os.Stat(fullPath); err == nil {
+			etag = fileETag(info)
+		}
+	}
+
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{
+		Xmlns:    s3Namespace,
+		Location: "/" + path.Join(bucket, key),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag,
+	})
+}
+
+// s3AbortMultipartUpload discards a multipart upload and its parts
+func (h *APIHandler) s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, username, bucket, key string) {
+	upload, err := h.s3Uploads.Get(username, r.URL.Query().Get("uploadId"), bucket, key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if err := h.s3Uploads.Forget(upload); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
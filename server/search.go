@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name matching modes for searches
+const (
+	MatchSubstring = "substring"
+	MatchGlob      = "glob"
+	MatchRegex     = "regex"
+)
+
+// Search result limits
+const (
+	defaultSearchLimit = 1000
+	maxSearchLimit     = 10000
+	maxSearchPattern   = 512
+)
+
+// errSearchLimit stops the walk once enough results were found
+var errSearchLimit = errors.New("search limit reached")
+
+// SearchQuery describes what to look for in a user's tree
+type SearchQuery struct {
+	Path           string    // Folder to search in (relative to user directory)
+	Pattern        string    // Name to match (empty = any name)
+	Match          string    // MatchSubstring, MatchGlob or MatchRegex
+	Type           string    // Only "file" or "folder" items (empty = both)
+	MinSize        int64     // Minimum file size in bytes (0 = no minimum)
+	MaxSize        int64     // Maximum file size in bytes (0 = no maximum)
+	ModifiedAfter  time.Time // Zero = no lower bound
+	ModifiedBefore time.Time // Zero = no upper bound
+	Limit          int       // Maximum number of results
+}
+
+// Search walks the user's tree below q.Path and calls found for every matching item,
+// as soon as it is found. It stops when ctx is cancelled or q.Limit results were
+// found, in which case truncated is true.
+func (fm *FileManager) Search(ctx context.Context, username string, q SearchQuery, found func(FileItem) error) (count int, truncated bool, err error) {
+	matchName, err := q.nameMatcher()
+	if err != nil {
+		return 0, false, err
+	}
+	if q.Type != "" && q.Type != "file" && q.Type != "folder" {
+		return 0, false, errors.New("invalid type filter")
+	}
+
+	root, err := fm.resolvePath(username, q.Path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Folder permissions are needed for every item's flags, remember them per folder
+	writable := make(map[string]bool)
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			// Unreadable folders are skipped, not fatal
+			if d != nil && d.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), uploadTempPrefix) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Symlinks are never followed
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		if q.Type == "folder" && !d.IsDir() || q.Type == "file" && d.IsDir() {
+			return nil
+		}
+		if !matchName(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if !q.matchInfo(info, fm.fileSize(path, info)) {
+			return nil
+		}
+
+		parent := filepath.Dir(path)
+		parentWritable, known := writable[parent]
+		if !known {
+			if parentInfo, err := os.Stat(parent); err == nil {
+				parentWritable = parentInfo.Mode().Perm()&0200 != 0
+			}
+			writable[parent] = parentWritable
+		}
+
+		if count >= q.Limit {
+			truncated = true
+			return errSearchLimit
+		}
+		count++
+		return found(fm.newFileItem(username, path, info, parentWritable))
+	})
+
+	if errors.Is(err, errSearchLimit) {
+		err = nil
+	}
+	return count, truncated, err
+}
+
+// nameMatcher builds the function used to match item names
+func (q *SearchQuery) nameMatcher() (func(string) bool, error) {
+	if len(q.Pattern) > maxSearchPattern {
+		return nil, errors.New("search pattern too long")
+	}
+	if q.Pattern == "" {
+		return func(string) bool { return true }, nil
+	}
+
+	switch q.Match {
+	case "", MatchSubstring:
+		needle := strings.ToLower(q.Pattern)
+		return func(name string) bool {
+			return strings.Contains(strings.ToLower(name), needle)
+		}, nil
+	case MatchGlob:
+		pattern := strings.ToLower(q.Pattern)
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.New("invalid glob pattern")
+		}
+		return func(name string) bool {
+			matched, _ := filepath.Match(pattern, strings.ToLower(name))
+			return matched
+		}, nil
+	case MatchRegex:
+		re, err := regexp.Compile("(?i)" + q.Pattern)
+		if err != nil {
+			return nil, errors.New("invalid regular expression")
+		}
+		return re.MatchString, nil
+	}
+
+	return nil, errors.New("invalid match mode")
+}
+
+// matchInfo checks the size and date filters, size being the size of the file's content
+func (q *SearchQuery) matchInfo(info fs.FileInfo, size int64) bool {
+	// Size filters only apply to files
+	if !info.IsDir() {
+		if q.MinSize > 0 && size < q.MinSize {
+			return false
+		}
+		if q.MaxSize > 0 && size > q.MaxSize {
+			return false
+		}
+	} else if q.MinSize > 0 || q.MaxSize > 0 {
+		return false
+	}
+
+	if !q.ModifiedAfter.IsZero() && info.ModTime().Before(q.ModifiedAfter) {
+		return false
+	}
+	if !q.ModifiedBefore.IsZero() && info.ModTime().After(q.ModifiedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// HandleSearch searches the user's whole tree, streaming results as
+// newline delimited JSON while they are found
+func (h *APIHandler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Validate the query before the response starts
+	if _, err := q.nameMatcher(); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	loc := h.locate(w, username, q.Path, AccessRead)
+	if loc == nil {
+		return
+	}
+	q.Path = loc.Path
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	// The walk stops as soon as the client goes away
+	count, truncated, err := h.fileManager.Search(r.Context(), loc.Owner, q, func(item FileItem) error {
+		h.showItem(username, loc, &item)
+		if err := encoder.Encode(map[string]interface{}{"item": item}); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if r.Context().Err() != nil {
+		return
+	}
+
+	summary := map[string]interface{}{
+		"done":      true,
+		"count":     count,
+		"truncated": truncated,
+	}
+	if err != nil {
+		summary["error"] = err.Error()
+	}
+	encoder.Encode(summary)
+}
+
+// parseSearchQuery reads the search parameters of a request
+func parseSearchQuery(r *http.Request) (SearchQuery, error) {
+	query := r.URL.Query()
+	q := SearchQuery{
+		Path:    query.Get("path"),
+		Pattern: query.Get("q"),
+		Match:   query.Get("match"),
+		Type:    query.Get("type"),
+		Limit:   defaultSearchLimit,
+	}
+
+	var err error
+	if value := query.Get("minSize"); value != "" {
+		if q.MinSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return q, errors.New("invalid minSize")
+		}
+	}
+	if value := query.Get("maxSize"); value != "" {
+		if q.MaxSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return q, errors.New("invalid maxSize")
+		}
+	}
+	if value := query.Get("after"); value != "" {
+		if q.ModifiedAfter, err = parseSearchTime(value); err != nil {
+			return q, errors.New("invalid after date")
+		}
+	}
+	if value := query.Get("before"); value != "" {
+		if q.ModifiedBefore, err = parseSearchTime(value); err != nil {
+			return q, errors.New("invalid before date")
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = min(limit, maxSearchLimit)
+	}
+
+	return q, nil
+}
+
+// parseSearchTime accepts RFC 3339 timestamps or plain dates
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
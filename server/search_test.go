@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	fm, baseDir := newTestFileManager(t,
+		"alice/Report.pdf",
+		"alice/docs/report-2024.txt",
+		"alice/docs/reports/summary.txt",
+		"alice/docs/.upload-123/report.txt",
+		"bob/report.txt",
+	)
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(baseDir, "alice", "Report.pdf"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    SearchQuery
+		want []string
+	}{
+		{"substring", SearchQuery{Pattern: "REPORT"}, []string{"Report.pdf", "docs/report-2024.txt", "docs/reports"}},
+		{"glob", SearchQuery{Pattern: "*.txt", Match: MatchGlob}, []string{"docs/report-2024.txt", "docs/reports/summary.txt"}},
+		{"regex", SearchQuery{Pattern: `^report-\d+`, Match: MatchRegex}, []string{"docs/report-2024.txt"}},
+		{"folders", SearchQuery{Type: "folder"}, []string{"docs", "docs/reports"}},
+		{"inside a folder", SearchQuery{Path: "docs/reports"}, []string{"docs/reports/summary.txt"}},
+		{"size", SearchQuery{MinSize: int64(len("alice/docs/report-2024.txt"))}, []string{"docs/report-2024.txt", "docs/reports/summary.txt"}},
+		{"date", SearchQuery{Pattern: "report", ModifiedBefore: time.Now().Add(-time.Hour)}, []string{"Report.pdf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.q.Limit = defaultSearchLimit
+			var paths []string
+			_, truncated, err := fm.Search(context.Background(), "alice", tt.q, func(item FileItem) error {
+				paths = append(paths, item.Path)
+				return nil
+			})
+			if err != nil || truncated {
+				t.Fatalf("search: truncated %v (%v)", truncated, err)
+			}
+			slices.Sort(paths)
+			if !slices.Equal(paths, tt.want) {
+				t.Errorf("got %v, want %v", paths, tt.want)
+			}
+		})
+	}
+
+	count, truncated, err := fm.Search(context.Background(), "alice", SearchQuery{Limit: 2}, func(FileItem) error { return nil })
+	if err != nil || count != 2 || !truncated {
+		t.Errorf("limited search: %d results, truncated %v (%v)", count, truncated, err)
+	}
+	if _, _, err := fm.Search(context.Background(), "alice", SearchQuery{Pattern: "(", Match: MatchRegex, Limit: 1}, func(FileItem) error { return nil }); err == nil {
+		t.Error("invalid regular expression accepted")
+	}
+}
@@ -2,35 +2,52 @@ package server
 
 import (
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+// Config holds the server configuration
+type Config struct {
+	Port          string
+	SFTPPort      string // Port of the SFTP server ("" = disabled)
+	S3Port        string // Port of the S3 gateway ("" = disabled)
+	WebDir        string
+	DataDir       string
+	DefaultQuota  int64         // Default per-user quota in bytes (0 = unlimited)
+	MaxUploadSize int64         // Maximum upload request size in bytes (0 = unlimited)
+	ScrubInterval time.Duration // How often stored files are re-verified (0 = never)
+	CAS           bool          // Store file contents once, deduplicated by hash
+	Watch         bool          // Report changes made to the files directory outside of the server
+	Keys          *KeyRing      // Master keys for encryption at rest (nil = files stored in the clear)
+}
+
 // StartServer starts the HTTP server
-func StartServer(port string, webDir string, dataDir string) error {
+func StartServer(cfg Config) error {
 	// Check if web directory exists
-	if _, err := os.Stat(webDir); os.IsNotExist(err) {
+	if _, err := os.Stat(cfg.WebDir); os.IsNotExist(err) {
 		return err
 	}
 
 	// Create data directory if it doesn't exist
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
 		return err
 	}
 
 	// Create files directory if it doesn't exist
-	filesDir := filepath.Join(dataDir, "files")
+	filesDir := filepath.Join(cfg.DataDir, "files")
 	if err := os.MkdirAll(filesDir, 0755); err != nil {
 		return err
 	}
 
 	// Serve static files
-	fs := http.FileServer(http.Dir(webDir))
+	fs := http.FileServer(http.Dir(cfg.WebDir))
 	http.Handle("/", fs)
 
 	// API routes
-	apiHandler := NewAPIHandler(dataDir)
+	apiHandler := NewAPIHandler(cfg)
 	http.HandleFunc("/api/login", apiHandler.HandleLogin)
 	http.HandleFunc("/api/register", apiHandler.HandleRegister)
 	http.HandleFunc("/api/logout", apiHandler.HandleLogout)
@@ -39,10 +56,69 @@ func StartServer(port string, webDir string, dataDir string) error {
 	http.HandleFunc("/api/files/folder", apiHandler.HandleCreateFolder)
 	http.HandleFunc("/api/files/download", apiHandler.HandleDownload)
 	http.HandleFunc("/api/files/rename", apiHandler.HandleRename)
+	http.HandleFunc("/api/files/extract", apiHandler.HandleExtract)
+	http.HandleFunc("/api/files/search", apiHandler.HandleSearch)
+	http.HandleFunc("/api/files/integrity", apiHandler.HandleIntegrity)
+	http.HandleFunc("/api/files/thumbnail", apiHandler.HandleThumbnail)
+	http.HandleFunc("/api/files/content", apiHandler.HandleFileContent)
+	http.HandleFunc("/api/search", apiHandler.HandleContentSearch)
+	http.HandleFunc("/api/sync/changes", apiHandler.HandleSyncChanges)
+	http.HandleFunc("/api/events", apiHandler.HandleEvents)
+	http.HandleFunc("/api/account/usage", apiHandler.HandleUsage)
+	http.HandleFunc("/api/admin/quota", apiHandler.HandleQuota)
+	http.HandleFunc("/api/admin/storage", apiHandler.HandleStorage)
+	http.HandleFunc("/api/tus/", apiHandler.HandleTus)
+	http.HandleFunc("/api/shares", apiHandler.HandleShares)
+	http.HandleFunc("/api/files/acl", apiHandler.HandleACL)
+	http.HandleFunc("/api/groups", apiHandler.HandleGroups)
+	http.HandleFunc("/api/groups/members", apiHandler.HandleGroupMembers)
+	http.HandleFunc("/api/spaces", apiHandler.HandleSpaces)
+	http.HandleFunc("/api/account/keys", apiHandler.HandleAPIKeys)
+	http.HandleFunc("/api/account/sshkeys", apiHandler.HandleSSHKeys)
+	http.HandleFunc("/api/account/s3keys", apiHandler.HandleS3Keys)
+
+	// WebDAV, to mount the user's files as a network drive
+	http.HandleFunc("/dav", apiHandler.HandleDAV)
+	http.HandleFunc("/dav/", apiHandler.HandleDAV)
+
+	// Public share links, used without an account
+	http.HandleFunc("/s/", apiHandler.HandleShareLink)
+
+	// SFTP, on its own port
+	if cfg.SFTPPort != "" {
+		sftpConfig, err := apiHandler.sftpConfig()
+		if err != nil {
+			return err
+		}
+		sftpListener, err := net.Listen("tcp", ":"+cfg.SFTPPort)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := apiHandler.serveSFTP(sftpListener, sftpConfig); err != nil {
+				log.Printf("SFTP server stopped: %v", err)
+			}
+		}()
+		log.Printf("SFTP server started on port %s", cfg.SFTPPort)
+	}
+
+	// S3, on its own port since buckets are at the root of its URLs
+	if cfg.S3Port != "" {
+		s3Listener, err := net.Listen("tcp", ":"+cfg.S3Port)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := http.Serve(s3Listener, http.HandlerFunc(apiHandler.HandleS3)); err != nil {
+				log.Printf("S3 gateway stopped: %v", err)
+			}
+		}()
+		log.Printf("S3 gateway started on port %s", cfg.S3Port)
+	}
 
-	log.Printf("Server started on port %s", port)
-	log.Printf("Web interface available at http://localhost:%s", port)
-	log.Printf("Data directory: %s", dataDir)
+	log.Printf("Server started on port %s", cfg.Port)
+	log.Printf("Web interface available at http://localhost:%s", cfg.Port)
+	log.Printf("Data directory: %s", cfg.DataDir)
 
-	return http.ListenAndServe(":"+port, nil)
+	return http.ListenAndServe(":"+cfg.Port, nil)
 }
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sftpHostKeyFile is the SSH host key of the SFTP server, in the data directory
+	sftpHostKeyFile = "ssh_host_ed25519_key"
+	// sftpHandshakeTimeout bounds the time clients have to sign in
+	sftpHandshakeTimeout = 30 * time.Second
+	// sftpMaxPending bounds the data of an upload held back while waiting for
+	// the writes before it, which clients may send in any order
+	sftpMaxPending = 64 << 20
+)
+
+// sftpConfig returns the SSH configuration of the SFTP server. Users sign in
+// with their password, one of their API keys as password, or one of their
+// SSH public keys.
+func (h *APIHandler) sftpConfig() (*ssh.ServerConfig, error) {
+	hostKey, err := loadHostKey(filepath.Join(h.dataDir, sftpHostKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if h.authManager.AuthenticateSecret(conn.User(), string(password)) {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if h.authManager.AuthenticateSSHKey(conn.User(), key) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		},
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			switch {
+			case method == "none":
+			case err != nil:
+				log.Printf("SFTP: failed %s sign in as %s from %s", method, conn.User(), conn.RemoteAddr())
+			default:
+				log.Printf("SFTP: %s signed in with %s from %s", conn.User(), method, conn.RemoteAddr())
+			}
+		},
+		ServerVersion: "SSH-2.0-GoCloud",
+	}
+	config.AddHostKey(hostKey)
+	return config, nil
+}
+
+// loadHostKey reads the SSH host key, generating it on first run
+func loadHostKey(keyFile string) (ssh.Signer, error) {
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Generated SFTP host key %s", ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer, nil
+}
+
+// serveSFTP accepts SSH connections until the listener is closed
+func (h *APIHandler) serveSFTP(ln net.Listener, config *ssh.ServerConfig) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go h.serveSSHConn(conn, config)
+	}
+}
+
+// serveSSHConn signs a client in and serves the SFTP sessions it opens
+func (h *APIHandler) serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	conn.SetDeadline(time.Now().Add(sftpHandshakeTimeout))
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go h.serveSFTPSession(sshConn.User(), channel, requests)
+	}
+}
+
+// serveSFTPSession serves the sftp subsystem on a session, and nothing else
+func (h *APIHandler) serveSFTPSession(username string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	started := false
+	for req := range requests {
+		isSFTP := !started && req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(isSFTP, nil)
+		if !isSFTP {
+			continue
+		}
+		started = true
+
+		go func() {
+			handler := &sftpHandler{fs: &davFS{h: h, username: username, protocol: AuditSFTP}}
+			server := sftp.NewRequestServer(channel, sftp.Handlers{
+				FileGet:  handler,
+				FilePut:  handler,
+				FileCmd:  handler,
+				FileList: handler,
+			})
+			if err := server.Serve(); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				log.Printf("SFTP session of %s ended: %v", username, err)
+			}
+			server.Close()
+			channel.Close()
+		}()
+	}
+}
+
+// sftpHandler serves a user's tree to SFTP clients. It is the tree WebDAV
+// clients see, so the same access rules and quotas apply, and the user can't
+// leave it.
+type sftpHandler struct {
+	fs *davFS
+}
+
+// Fileread opens a file for reading
+func (s *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	file, err := s.fs.OpenFile(r.Context(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	opened, isFile := file.(*davFile)
+	if !isFile {
+		file.Close()
+		return nil, errors.New("is a folder")
+	}
+	s.fs.auditRead(r.Filepath)
+	return opened.file, nil
+}
+
+// Filewrite opens a file for writing. Files are replaced as a whole once they
+// are closed, so uploads can't append to or patch existing files.
+func (s *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if r.Pflags().Append {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	file, err := s.fs.OpenFile(r.Context(), r.Filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return &sftpWriter{file: file.(*davWriter), pending: make(map[int64][]byte)}, nil
+}
+
+// Filecmd changes the tree
+func (s *sftpHandler) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		// Modes and times aren't kept, only check the item exists
+		_, err := s.fs.Stat(ctx, r.Filepath)
+		return sftpError(err)
+	case "Rename":
+		if _, err := s.fs.Stat(ctx, r.Target); err == nil {
+			return os.ErrExist
+		}
+		return sftpError(s.fs.Rename(ctx, r.Filepath, r.Target))
+	case "Mkdir":
+		return sftpError(s.fs.Mkdir(ctx, r.Filepath, 0755))
+	case "Rmdir", "Remove":
+		info, err := s.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return sftpError(err)
+		}
+		if r.Method == "Remove" && info.IsDir() {
+			return errors.New("is a folder")
+		}
+		if r.Method == "Rmdir" {
+			if !info.IsDir() {
+				return errors.New("not a folder")
+			}
+			entries, err := s.sftpList(ctx, r.Filepath)
+			if err != nil {
+				return sftpError(err)
+			}
+			if len(entries) > 0 {
+				return errors.New("folder is not empty")
+			}
+		}
+		return sftpError(s.fs.RemoveAll(ctx, r.Filepath))
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename moves an item, replacing the one at the target
+func (s *sftpHandler) PosixRename(r *sftp.Request) error {
+	return sftpError(s.fs.Rename(r.Context(), r.Filepath, r.Target))
+}
+
+// Filelist lists folders and describes items
+func (s *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := s.sftpList(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpLister(entries), nil
+	case "Stat":
+		info, err := s.fs.Stat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpLister{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpList returns the entries of a folder
+func (s *sftpHandler) sftpList(ctx context.Context, name string) ([]os.FileInfo, error) {
+	file, err := s.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dir, isDir := file.(*davDir)
+	if !isDir {
+		return nil, errors.New("not a folder")
+	}
+	return dir.entries, nil
+}
+
+// sftpError reports refused operations as such rather than as failures
+func sftpError(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+// sftpLister serves a list of items to the sftp package
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(entries, l[offset:])
+	if n < len(entries) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpWriter passes the writes of an upload to a davWriter in order. Clients
+// send several writes at once, which may arrive out of order, so writes past
+// the end of what has been written so far are held back until it reaches them.
+type sftpWriter struct {
+	mu       sync.Mutex
+	file     *davWriter
+	next     int64            // Offset of the next byte to pass on
+	pending  map[int64][]byte // Writes held back, by offset
+	buffered int64            // Bytes held back
+	err      error
+}
+
+func (w *sftpWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	switch {
+	case off < w.next:
+		w.err = errors.New("files can only be written from start to end")
+		return 0, w.err
+	case off > w.next:
+		if w.buffered+int64(len(p)) > sftpMaxPending {
+			w.err = errors.New("too many writes out of order")
+			return 0, w.err
+		}
+		w.pending[off] = append([]byte(nil), p...)
+		w.buffered += int64(len(p))
+		return len(p), nil
+	}
+
+	if err := w.write(p); err != nil {
+		return 0, err
+	}
+	for len(w.pending) > 0 {
+		chunk, found := w.pending[w.next]
+		if !found {
+			break
+		}
+		delete(w.pending, w.next)
+		w.buffered -= int64(len(chunk))
+		if err := w.write(chunk); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// write passes data on (caller must hold w.mu)
+func (w *sftpWriter) write(p []byte) error {
+	n, err := w.file.Write(p)
+	w.next += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// TransferError notes the connection was lost, so the upload is discarded
+func (w *sftpWriter) TransferError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Close saves the file, unless the upload failed or left gaps
+func (w *sftpWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil && len(w.pending) > 0 {
+		w.err = errors.New("the file was written with gaps")
+	}
+	if w.err != nil && w.file.failed == nil {
+		w.file.failed = w.err
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,1079 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share permissions
+const (
+	ShareRead   = "read"   // Visitors can browse and download
+	ShareUpload = "upload" // Visitors can also upload into a shared folder
+	ShareDrop   = "drop"   // Visitors can only upload into a shared folder, without seeing it
+)
+
+// maxUploaderName is the longest uploader name added to files sent to a share
+const maxUploaderName = 64
+
+// shareGrantTTL is how long a share stays unlocked after its password was given
+const shareGrantTTL = time.Hour
+
+// Wrong passwords are limited per share: after shareUnlockAttempts of them, a
+// share can't be unlocked until shareUnlockWindow passed since the first one
+const (
+	shareUnlockAttempts = 5
+	shareUnlockWindow   = 15 * time.Minute
+)
+
+// maxSharePassword is the longest password bcrypt hashes, in bytes
+const maxSharePassword = 72
+
+var (
+	// ErrShareNotFound is returned for unknown or revoked shares
+	ErrShareNotFound = errors.New("share not found")
+	// ErrShareExpired is returned for shares past their expiry date
+	ErrShareExpired = errors.New("share expired")
+	// ErrShareExhausted is returned for shares that reached their download limit
+	ErrShareExhausted = errors.New("download limit reached")
+	// ErrSharePassword is returned when a share needs a password that wasn't given
+	ErrSharePassword = errors.New("password required")
+	// ErrShareForbidden is returned for actions the share's permission doesn't allow
+	ErrShareForbidden = errors.New("not allowed by this share")
+	// ErrShareFull is returned for shares that received all the data they accept
+	ErrShareFull = errors.New("upload limit reached")
+	// ErrShareLocked is returned for shares given too many wrong passwords recently
+	ErrShareLocked = errors.New("too many wrong passwords, try again later")
+)
+
+// Share is a public link to a file or folder of a user
+type Share struct {
+	ID           string     `json:"id"`
+	Username     string     `json:"username"`
+	Path         string     `json:"path"` // Shared item, relative to the owner's directory
+	IsDir        bool       `json:"isDir"`
+	Permission   string     `json:"permission"`
+	PasswordHash string     `json:"passwordHash,omitempty"` // bcrypt
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"` // 0 = unlimited
+	Downloads    int        `json:"downloads"`
+	MaxFileSize  int64      `json:"maxFileSize,omitempty"` // Largest file visitors may upload (0 = unlimited)
+	MaxBytes     int64      `json:"maxBytes,omitempty"`    // Total bytes visitors may upload (0 = unlimited)
+	Uploaded     int64      `json:"uploaded,omitempty"`    // Bytes uploaded by visitors
+	Uploads      int        `json:"uploads,omitempty"`     // Files uploaded by visitors
+	Created      time.Time  `json:"created"`
+}
+
+// ShareOptions are the rules of a new share
+type ShareOptions struct {
+	Permission   string     // ShareRead (default), ShareUpload or ShareDrop
+	Password     string     // Empty for no password
+	ExpiresAt    *time.Time // nil for no expiry
+	MaxDownloads int        // 0 = unlimited
+	MaxFileSize  int64      // Largest uploaded file, upload and drop shares only (0 = unlimited)
+	MaxBytes     int64      // Total uploaded bytes, upload and drop shares only (0 = unlimited)
+}
+
+// ShareInfo is the API representation of a share for its owner
+type ShareInfo struct {
+	ID           string     `json:"id"`
+	URL          string     `json:"url"`
+	Path         string     `json:"path"`
+	Name         string     `json:"name"`
+	Type         string     `json:"type"` // "file" or "folder"
+	Permission   string     `json:"permission"`
+	HasPassword  bool       `json:"hasPassword"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	MaxFileSize  int64      `json:"maxFileSize,omitempty"`
+	MaxBytes     int64      `json:"maxBytes,omitempty"`
+	Uploaded     int64      `json:"uploaded"`
+	Uploads      int        `json:"uploads"`
+	Created      time.Time  `json:"created"`
+	Status       string     `json:"status"` // "active", "expired", "exhausted" or "full"
+}
+
+// shareGrant remembers that a visitor gave the password of a share
+type shareGrant struct {
+	shareID   string
+	expiresAt time.Time
+}
+
+// unlockFailures counts the wrong passwords given for a share
+type unlockFailures struct {
+	count int
+	since time.Time // First of them
+}
+
+// ShareStore keeps the public links of all users in a single JSON file.
+// Shares follow their item when it is renamed and disappear when it is deleted.
+type ShareStore struct {
+	file        string
+	fileManager *FileManager
+	shares      map[string]*Share
+	grants      map[string]*shareGrant     // Unlocked password protected shares by grant token
+	failures    map[string]*unlockFailures // Recent wrong passwords by share
+	reserved    map[string]int64           // Bytes set aside for uploads in progress, by share
+	mu          sync.Mutex
+}
+
+// NewShareStore loads the shares kept in file and subscribes the store to fm's changes
+func NewShareStore(file string, fm *FileManager) *ShareStore {
+	ss := &ShareStore{
+		file:        file,
+		fileManager: fm,
+		shares:      make(map[string]*Share),
+		grants:      make(map[string]*shareGrant),
+		failures:    make(map[string]*unlockFailures),
+		reserved:    make(map[string]int64),
+	}
+
+	if data, err := os.ReadFile(file); err == nil {
+		var shares []*Share
+		if err := json.Unmarshal(data, &shares); err != nil {
+			log.Printf("Error loading shares: %v", err)
+		}
+		for _, share := range shares {
+			ss.shares[share.ID] = share
+		}
+	}
+
+	fm.OnChange(ss.apply)
+	return ss
+}
+
+// apply moves or removes the shares of an item after a change
+func (ss *ShareStore) apply(event FileEvent) {
+	if event.Type != EventRename && event.Type != EventDelete {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	changed := false
+	for id, share := range ss.shares {
+		if share.Username != event.Username {
+			continue
+		}
+		switch {
+		case event.Type == EventDelete && withinRel(event.Path, share.Path):
+			delete(ss.shares, id)
+			changed = true
+		case event.Type == EventRename && withinRel(event.OldPath, share.Path):
+			share.Path = event.Path + strings.TrimPrefix(share.Path, event.OldPath)
+			changed = true
+		case event.Type == EventRename && withinRel(event.Path, share.Path):
+			// The item was replaced by the rename
+			delete(ss.shares, id)
+			changed = true
+		}
+	}
+	if changed {
+		if err := ss.saveLocked(); err != nil {
+			log.Printf("Error saving shares: %v", err)
+		}
+	}
+}
+
+// Create shares the item called name inside path (relative to the user directory)
+func (ss *ShareStore) Create(username, path, name string, opts ShareOptions) (*Share, error) {
+	fullPath, err := ss.fileManager.resolveItem(username, path, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Permission {
+	case "":
+		opts.Permission = ShareRead
+	case ShareRead:
+	case ShareUpload, ShareDrop:
+		if !info.IsDir() {
+			return nil, errors.New("only folders can be shared for upload")
+		}
+	default:
+		return nil, errors.New("invalid permission")
+	}
+	if opts.MaxFileSize < 0 || opts.MaxBytes < 0 {
+		return nil, errors.New("invalid size limit")
+	}
+	if opts.Permission == ShareRead && (opts.MaxFileSize > 0 || opts.MaxBytes > 0) {
+		return nil, errors.New("size limits only apply to upload links")
+	}
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return nil, errors.New("expiry date is in the past")
+	}
+	if opts.MaxDownloads < 0 {
+		return nil, errors.New("invalid download limit")
+	}
+	if len(opts.Password) > maxSharePassword {
+		return nil, errors.New("password is too long")
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	share := &Share{
+		ID:           base64.RawURLEncoding.EncodeToString(idBytes),
+		Username:     username,
+		Path:         ss.fileManager.relPath(username, fullPath),
+		IsDir:        info.IsDir(),
+		Permission:   opts.Permission,
+		ExpiresAt:    opts.ExpiresAt,
+		MaxDownloads: opts.MaxDownloads,
+		MaxFileSize:  opts.MaxFileSize,
+		MaxBytes:     opts.MaxBytes,
+		Created:      time.Now(),
+	}
+	if opts.Password != "" {
+		if share.PasswordHash, err = hashSharePassword(opts.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.shares[share.ID] = share
+	if err := ss.saveLocked(); err != nil {
+		delete(ss.shares, share.ID)
+		return nil, err
+	}
+
+	copied := *share
+	return &copied, nil
+}
+
+// List returns the shares of a user, newest first
+func (ss *ShareStore) List(username string) []Share {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	shares := []Share{}
+	for _, share := range ss.shares {
+		if share.Username == username {
+			shares = append(shares, *share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.After(shares[j].Created)
+	})
+	return shares
+}
+
+// Revoke deletes a share of a user
+func (ss *ShareStore) Revoke(username, id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	share, exists := ss.shares[id]
+	if !exists || share.Username != username {
+		return ErrShareNotFound
+	}
+
+	delete(ss.shares, id)
+	delete(ss.failures, id)
+	delete(ss.reserved, id)
+	for token, grant := range ss.grants {
+		if grant.shareID == id {
+			delete(ss.grants, token)
+		}
+	}
+	return ss.saveLocked()
+}
+
+// Open returns a share a visitor may use. Password protected shares also
+// need the token returned by Unlock.
+func (ss *ShareStore) Open(id, grantToken string) (*Share, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	share, err := ss.usableLocked(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if share.PasswordHash != "" {
+		grant, exists := ss.grants[grantToken]
+		if exists && time.Now().After(grant.expiresAt) {
+			delete(ss.grants, grantToken)
+			exists = false
+		}
+		if !exists || grant.shareID != id {
+			return nil, ErrSharePassword
+		}
+	}
+
+	copied := *share
+	return &copied, nil
+}
+
+// Unlock checks the password of a share and returns a grant token for Open.
+// Shares given too many wrong passwords fail with ErrShareLocked for a while.
+func (ss *ShareStore) Unlock(id, password string) (string, error) {
+	ss.mu.Lock()
+	share, err := ss.usableLocked(id)
+	if err != nil || share.PasswordHash == "" {
+		ss.mu.Unlock()
+		return "", err
+	}
+
+	// Every attempt counts as failed until the password was checked, so that
+	// concurrent ones can't get past the limit
+	now := time.Now()
+	for shareID, f := range ss.failures {
+		if now.Sub(f.since) > shareUnlockWindow {
+			delete(ss.failures, shareID)
+		}
+	}
+	failures := ss.failures[id]
+	if failures == nil {
+		failures = &unlockFailures{since: now}
+		ss.failures[id] = failures
+	}
+	if failures.count >= shareUnlockAttempts {
+		ss.mu.Unlock()
+		return "", ErrShareLocked
+	}
+	failures.count++
+	hash := share.PasswordHash
+	ss.mu.Unlock()
+
+	// bcrypt is slow on purpose, the store isn't held up meanwhile
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", ErrSharePassword
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.failures[id] == failures {
+		delete(ss.failures, id)
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	// Drop grants nobody can use anymore while adding one
+	now = time.Now()
+	for t, grant := range ss.grants {
+		if now.After(grant.expiresAt) {
+			delete(ss.grants, t)
+		}
+	}
+	ss.grants[token] = &shareGrant{shareID: id, expiresAt: now.Add(shareGrantTTL)}
+
+	return token, nil
+}
+
+// CountDownload uses up one download of a share, failing with
+// ErrShareExhausted when none are left
+func (ss *ShareStore) CountDownload(id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	share, err := ss.usableLocked(id)
+	if err != nil {
+		return err
+	}
+	if share.exhausted() {
+		return ErrShareExhausted
+	}
+
+	share.Downloads++
+	return ss.saveLocked()
+}
+
+// ReserveUpload sets aside up to size bytes of what a share accepts for an
+// upload about to start, all of what is left if size is unknown (0 or less),
+// so that concurrent uploads can't go over its limit together. It returns how
+// many bytes the upload may store, 0 for shares without limit, and fails with
+// ErrShareFull when nothing is left. SettleUpload must follow.
+func (ss *ShareStore) ReserveUpload(id string, size int64) (int64, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	share, err := ss.usableLocked(id)
+	if err != nil {
+		return 0, err
+	}
+	if share.MaxBytes == 0 {
+		return 0, nil
+	}
+
+	left := share.MaxBytes - share.Uploaded - ss.reserved[id]
+	if left <= 0 {
+		return 0, ErrShareFull
+	}
+	if size <= 0 || size > left {
+		size = left
+	}
+	ss.reserved[id] += size
+	return size, nil
+}
+
+// SettleUpload releases the bytes reserved for an upload, and adds the files
+// it stored to the totals of the share
+func (ss *ShareStore) SettleUpload(id string, reserved, bytes int64, files int) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.reserved[id] -= reserved
+	if ss.reserved[id] <= 0 {
+		delete(ss.reserved, id)
+	}
+	if files == 0 {
+		return nil
+	}
+
+	share, exists := ss.shares[id]
+	if !exists {
+		return ErrShareNotFound
+	}
+
+	share.Uploaded += bytes
+	share.Uploads += files
+	return ss.saveLocked()
+}
+
+// usableLocked returns a share that exists and hasn't expired (caller must
+// hold ss.mu). Download and upload limits only apply to their own action.
+func (ss *ShareStore) usableLocked(id string) (*Share, error) {
+	share, exists := ss.shares[id]
+	if !exists {
+		return nil, ErrShareNotFound
+	}
+	if share.expired() {
+		return nil, ErrShareExpired
+	}
+	return share, nil
+}
+
+// saveLocked writes all shares to the store file (caller must hold ss.mu)
+func (ss *ShareStore) saveLocked() error {
+	shares := make([]*Share, 0, len(ss.shares))
+	for _, share := range ss.shares {
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.Before(shares[j].Created)
+	})
+
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ss.file), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(ss.file, data)
+}
+
+// status reports whether a share can still be used
+func (s *Share) status() string {
+	switch {
+	case s.expired():
+		return "expired"
+	case s.exhausted():
+		return "exhausted"
+	case s.full():
+		return "full"
+	}
+	return "active"
+}
+
+// expired reports whether a share is past its expiry date
+func (s *Share) expired() bool {
+	return s.ExpiresAt != nil && time.Now().After(*s.ExpiresAt)
+}
+
+// exhausted reports whether a share has no downloads left
+func (s *Share) exhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// full reports whether a share received all the data it accepts
+func (s *Share) full() bool {
+	return s.MaxBytes > 0 && s.Uploaded >= s.MaxBytes
+}
+
+// info returns the representation of a share for its owner
+func (s *Share) info() ShareInfo {
+	info := ShareInfo{
+		ID:           s.ID,
+		URL:          "/s/" + s.ID,
+		Path:         s.Path,
+		Name:         path.Base(s.Path),
+		Type:         "file",
+		Permission:   s.Permission,
+		HasPassword:  s.PasswordHash != "",
+		ExpiresAt:    s.ExpiresAt,
+		MaxDownloads: s.MaxDownloads,
+		Downloads:    s.Downloads,
+		MaxFileSize:  s.MaxFileSize,
+		MaxBytes:     s.MaxBytes,
+		Uploaded:     s.Uploaded,
+		Uploads:      s.Uploads,
+		Created:      s.Created,
+		Status:       s.status(),
+	}
+	if s.IsDir {
+		info.Type = "folder"
+	}
+	return info
+}
+
+// resolve returns the folder sub (relative to a shared folder) relative to the owner's directory.
+// Paths can't leave the shared folder, and a shared file has no sub folders.
+func (s *Share) resolve(sub string) (string, error) {
+	if strings.Contains(sub, "\\") {
+		return "", errors.New("invalid path")
+	}
+	sub = path.Clean("/" + sub)
+	if sub == "/" {
+		return s.Path, nil
+	}
+	if !s.IsDir {
+		return "", ErrShareNotFound
+	}
+	return path.Join(s.Path, sub), nil
+}
+
+// uploaderPrefix turns the name a visitor gave into a prefix for the files they upload
+func uploaderPrefix(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '/' || r == '\\' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxUploaderName {
+		name = strings.TrimSpace(string(runes[:maxUploaderName]))
+	}
+	if name == "" || name == "." || name == ".." {
+		return ""
+	}
+	return name + " - "
+}
+
+// readsFromStart reports whether a GET of a file of size bytes sends its first
+// byte, following http.ServeContent: without a range, when If-Range no longer
+// matches, or when one of the ranges covers offset 0. Ranges that can't be
+// parsed count too.
+func readsFromStart(r *http.Request, info os.FileInfo, size int64) bool {
+	ranges, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok {
+		return true
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != fileETag(info) {
+		since, err := http.ParseTime(ifRange)
+		if err != nil || !info.ModTime().Truncate(time.Second).Equal(since) {
+			return true
+		}
+	}
+
+	for _, spec := range strings.Split(ranges, ",") {
+		start, end, _ := strings.Cut(strings.TrimSpace(spec), "-")
+		if start == "" {
+			// The last end bytes
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n >= size {
+				return true
+			}
+			continue
+		}
+		if n, err := strconv.ParseInt(start, 10, 64); err != nil || n == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hashSharePassword hashes a share password with bcrypt
+func hashSharePassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// HandleShares lists (GET), creates (POST) or revokes (DELETE) the user's share links
+func (h *APIHandler) HandleShares(w http.ResponseWriter, r *http.Request) {
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		shares := h.shares.List(username)
+		infos := make([]ShareInfo, 0, len(shares))
+		for _, share := range shares {
+			infos = append(infos, share.info())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"shares":  infos,
+		})
+	case http.MethodPost:
+		h.handleCreateShare(w, r, username)
+	case http.MethodDelete:
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Error processing request", http.StatusBadRequest)
+			return
+		}
+		if err := h.shares.Revoke(username, req.ID); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrShareNotFound) {
+				status = http.StatusNotFound
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCreateShare creates a share link for a file or folder
+func (h *APIHandler) handleCreateShare(w http.ResponseWriter, r *http.Request, username string) {
+	var req struct {
+		Path         string     `json:"path"`
+		Name         string     `json:"name"`
+		Permission   string     `json:"permission"`
+		Password     string     `json:"password"`
+		ExpiresAt    *time.Time `json:"expiresAt"`
+		MaxDownloads int        `json:"maxDownloads"`
+		MaxFileSize  int64      `json:"maxFileSize"`
+		MaxBytes     int64      `json:"maxBytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	// Links are only created for the user's own items
+	loc := h.locate(w, username, req.Path, AccessManage)
+	if loc == nil {
+		return
+	}
+	if loc.Owner != username {
+		writeAccessError(w, ErrAccessDenied)
+		return
+	}
+
+	share, err := h.shares.Create(username, req.Path, req.Name, ShareOptions{
+		Permission:   req.Permission,
+		Password:     req.Password,
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+		MaxFileSize:  req.MaxFileSize,
+		MaxBytes:     req.MaxBytes,
+	})
+	if err != nil {
+		status := http.StatusBadRequest
+		if os.IsNotExist(err) {
+			status = http.StatusNotFound
+			err = errors.New("item not found")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"share":   share.info(),
+	})
+}
+
+// HandleShareLink serves the public side of share links under /s/{id}. It
+// doesn't use getUsernameFromToken: visitors are only bound by the rules of
+// the share, and only ever reach the shared item and what's inside it.
+//
+//	GET  /s/{id}           Page of the share
+//	GET  /s/{id}/info      What is shared
+//	POST /s/{id}/unlock    Exchanges the password for a token
+//	GET  /s/{id}/files     Lists a folder of a shared folder
+//	GET  /s/{id}/download  Downloads the shared file, or items of a shared folder
+//	POST /s/{id}/upload    Uploads into a shared folder
+func (h *APIHandler) HandleShareLink(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Shares must not be indexed, cached by proxies or framed elsewhere
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(h.webDir, "share.html"))
+		return
+	case "unlock":
+		h.handleShareUnlock(w, r, id)
+		return
+	}
+
+	grant := r.Header.Get("X-Share-Token")
+	if grant == "" {
+		grant = r.URL.Query().Get("token")
+	}
+	share, err := h.shares.Open(id, grant)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	switch action {
+	case "info":
+		h.handleShareInfo(w, r, share)
+	case "files":
+		h.handleShareFiles(w, r, share)
+	case "download":
+		h.handleShareDownload(w, r, share)
+	case "upload":
+		h.handleShareUpload(w, r, share)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeShareError sends the JSON error for a share that can't be used
+func writeShareError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrShareNotFound), os.IsNotExist(err):
+		status = http.StatusNotFound
+		err = ErrShareNotFound
+	case errors.Is(err, ErrShareExpired), errors.Is(err, ErrShareExhausted), errors.Is(err, ErrShareFull):
+		status = http.StatusGone
+	case errors.Is(err, ErrSharePassword):
+		status = http.StatusUnauthorized
+	case errors.Is(err, ErrShareForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrShareLocked):
+		status = http.StatusTooManyRequests
+	default:
+		log.Printf("Error serving share: %v", err)
+	}
+
+	response := map[string]interface{}{"error": err.Error()}
+	if status == http.StatusUnauthorized {
+		response["passwordRequired"] = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleShareUnlock exchanges the password of a share for a grant token
+func (h *APIHandler) handleShareUnlock(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	token, err := h.shares.Unlock(id, req.Password)
+	if err != nil {
+		if errors.Is(err, ErrSharePassword) {
+			err = errors.New("wrong password")
+		}
+		writeShareError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"token":   token,
+	})
+}
+
+// handleShareInfo describes a share to a visitor, without revealing where it is in the owner's tree
+func (h *APIHandler) handleShareInfo(w http.ResponseWriter, r *http.Request, share *Share) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fullPath, err := h.fileManager.resolvePath(share.Username, share.Path)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() != share.IsDir {
+		writeShareError(w, ErrShareNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"name":       info.Name(),
+		"type":       "file",
+		"permission": share.Permission,
+	}
+	if share.ExpiresAt != nil {
+		response["expiresAt"] = share.ExpiresAt
+	}
+	if share.Permission != ShareRead {
+		if share.MaxFileSize > 0 {
+			response["maxFileSize"] = share.MaxFileSize
+		}
+		if share.MaxBytes > 0 {
+			response["bytesLeft"] = share.MaxBytes - share.Uploaded
+		}
+	}
+
+	// Drops only tell visitors where their files go
+	if share.Permission == ShareDrop {
+		response["type"] = "folder"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response["modifiedAt"] = info.ModTime().Format(time.RFC3339Nano)
+	if share.IsDir {
+		response["type"] = "folder"
+	} else {
+		size := h.fileManager.fileSize(fullPath, info)
+		response["bytes"] = size
+		response["size"] = formatSize(size)
+		response["mimeType"] = h.fileManager.detectMimeType(fullPath)
+	}
+	if share.MaxDownloads > 0 {
+		response["downloadsLeft"] = share.MaxDownloads - share.Downloads
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleShareFiles lists a folder inside a shared folder
+func (h *APIHandler) handleShareFiles(w http.ResponseWriter, r *http.Request, share *Share) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !share.IsDir || share.Permission == ShareDrop {
+		writeShareError(w, ErrShareForbidden)
+		return
+	}
+
+	rel, err := share.resolve(r.URL.Query().Get("path"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	page, err := h.fileManager.ListFilesPage(share.Username, rel, DefaultListOptions)
+	if err != nil {
+		writeShareError(w, ErrShareNotFound)
+		return
+	}
+
+	// Paths are relative to the shared folder, and visitors can't change anything
+	for i := range page.Items {
+		item := &page.Items[i]
+		item.Path = strings.TrimPrefix(strings.TrimPrefix(item.Path, share.Path), "/")
+		item.Permissions = ItemPermissions{Read: item.Permissions.Read}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"items":   page.Items,
+		"total":   page.Total,
+	})
+}
+
+// handleShareDownload sends the shared file, or items of a shared folder. Every
+// archive and every download that sends the first byte of a file counts
+// towards the download limit, resuming one doesn't.
+func (h *APIHandler) handleShareDownload(w http.ResponseWriter, r *http.Request, share *Share) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if share.Permission == ShareDrop {
+		writeShareError(w, ErrShareForbidden)
+		return
+	}
+	// Resuming a download needs downloads left too
+	if share.exhausted() {
+		writeShareError(w, ErrShareExhausted)
+		return
+	}
+
+	query := r.URL.Query()
+	names := query["name"]
+	format := query.Get("format")
+
+	rel, err := share.resolve(query.Get("path"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	// Without names, the shared item itself is downloaded
+	if len(names) == 0 || !share.IsDir {
+		if rel != share.Path {
+			writeShareError(w, ErrShareNotFound)
+			return
+		}
+		rel, names = path.Dir(share.Path), []string{path.Base(share.Path)}
+		if rel == "." {
+			rel = ""
+		}
+	}
+
+	fullPath, err := h.fileManager.resolveItem(share.Username, rel, names[0])
+	if err != nil {
+		writeShareError(w, ErrShareNotFound)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		writeShareError(w, ErrShareNotFound)
+		return
+	}
+
+	// Archives are always sent whole
+	archive := len(names) > 1 || info.IsDir() || format != ""
+	if r.Method == http.MethodGet && (archive || readsFromStart(r, info, h.fileManager.fileSize(fullPath, info))) {
+		if err := h.shares.CountDownload(share.ID); err != nil {
+			writeShareError(w, err)
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		for _, name := range names {
+			h.audit.Record(AuditEntry{Protocol: AuditShare, Share: share.ID, Action: AuditDownload, Owner: share.Username, Path: auditPath(rel, name)}, nil)
+		}
+	}
+
+	if archive {
+		h.serveArchive(w, share.Username, rel, names, format)
+		return
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()})
+	h.serveFile(w, r, share.Username, fullPath, info, disposition)
+}
+
+// handleShareUpload stores files sent to a shared folder, through the same
+// streaming path as HandleUpload. Existing files are never replaced, and drops
+// don't tell visitors which names were already taken. Files can be tagged with
+// the name of the uploader, given in the uploader query parameter.
+func (h *APIHandler) handleShareUpload(w http.ResponseWriter, r *http.Request, share *Share) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if share.Permission != ShareUpload && share.Permission != ShareDrop {
+		writeShareError(w, ErrShareForbidden)
+		return
+	}
+
+	// Drops only receive files in the shared folder itself
+	sub := r.URL.Query().Get("path")
+	if share.Permission == ShareDrop && strings.Trim(sub, "/") != "" {
+		writeShareError(w, ErrShareForbidden)
+		return
+	}
+	rel, err := share.resolve(sub)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	dir, err := h.fileManager.resolvePath(share.Username, rel)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		writeShareError(w, ErrShareNotFound)
+		return
+	}
+
+	opts := uploadOptions{
+		keepExisting: true,
+		hideNames:    share.Permission == ShareDrop,
+		namePrefix:   uploaderPrefix(r.URL.Query().Get("uploader")),
+		maxFileSize:  share.MaxFileSize,
+		audit:        AuditEntry{Protocol: AuditShare, Share: share.ID},
+	}
+
+	// The request holds more than its files, so its length covers them
+	reserved, err := h.shares.ReserveUpload(share.ID, r.ContentLength)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	opts.maxBytes = reserved
+
+	bytes, files := h.receiveUpload(w, r, share.Username, rel, opts)
+	if err := h.shares.SettleUpload(share.ID, reserved, bytes, files); err != nil {
+		log.Printf("Error recording upload to share %s: %v", share.ID, err)
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shareRequest sends a request to a share link
+func shareRequest(h *APIHandler, method, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.HandleShareLink(w, r)
+	return w
+}
+
+// shareDownloads returns how many downloads a share counted
+func shareDownloads(t *testing.T, h *APIHandler, id string) int {
+	t.Helper()
+	for _, share := range h.shares.List("alice") {
+		if share.ID == id {
+			return share.Downloads
+		}
+	}
+	t.Fatalf("share %s not found", id)
+	return 0
+}
+
+func TestShareDownloadCounting(t *testing.T) {
+	h := newTestAPIHandler(t)
+	writeUserFile(t, h, "Docs/report.txt", "0123456789")
+	writeUserFile(t, h, "Docs/notes.txt", "notes")
+
+	file, err := h.shares.Create("alice", "Docs", "report.txt", ShareOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(h.fileManager.baseDir, "alice", "Docs", "report.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		counts bool
+	}{
+		{"whole file", http.MethodGet, nil, true},
+		{"head", http.MethodHead, nil, false},
+		{"range from start", http.MethodGet, map[string]string{"Range": "bytes=0-4"}, true},
+		{"resumed", http.MethodGet, map[string]string{"Range": "bytes=5-"}, false},
+		{"start among ranges", http.MethodGet, map[string]string{"Range": "bytes=5-,0-4"}, true},
+		{"suffix of whole file", http.MethodGet, map[string]string{"Range": "bytes=-10"}, true},
+		{"suffix", http.MethodGet, map[string]string{"Range": "bytes=-3"}, false},
+		{"resumed if unchanged", http.MethodGet, map[string]string{"Range": "bytes=5-", "If-Range": fileETag(info)}, false},
+		{"resumed after a change", http.MethodGet, map[string]string{"Range": "bytes=5-", "If-Range": `"stale"`}, true},
+		{"unreadable range", http.MethodGet, map[string]string{"Range": "bytes=x-"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := shareDownloads(t, h, file.ID)
+			shareRequest(h, tt.method, "/s/"+file.ID+"/download", tt.header)
+			want := 0
+			if tt.counts {
+				want = 1
+			}
+			if counted := shareDownloads(t, h, file.ID) - before; counted != want {
+				t.Errorf("counted %d downloads, want %d", counted, want)
+			}
+		})
+	}
+
+	// Archives ignore ranges, they always count
+	folder, err := h.shares.Create("alice", "", "Docs", ShareOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := shareRequest(h, http.MethodGet, "/s/"+folder.ID+"/download?name=report.txt&name=notes.txt", map[string]string{"Range": "bytes=100-"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("archive: status %d", w.Code)
+	}
+	if got := shareDownloads(t, h, folder.ID); got != 1 {
+		t.Errorf("archive: counted %d downloads", got)
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	h := newTestAPIHandler(t)
+	writeUserFile(t, h, "report.txt", "report")
+
+	share, err := h.shares.Create("alice", "", "report.txt", ShareOptions{Password: "open sesame"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(share.PasswordHash, "$2") {
+		t.Errorf("password stored as %q, want a bcrypt hash", share.PasswordHash)
+	}
+	if _, err := h.shares.Unlock(share.ID, "open sesame"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	// Wrong passwords lock the share, even for the right one
+	for i := 0; i < shareUnlockAttempts; i++ {
+		if _, err := h.shares.Unlock(share.ID, "guess"); !errors.Is(err, ErrSharePassword) {
+			t.Fatalf("guess %d: got %v", i+1, err)
+		}
+	}
+	r := httptest.NewRequest(http.MethodPost, "/s/"+share.ID+"/unlock", strings.NewReader(`{"password": "open sesame"}`))
+	w := httptest.NewRecorder()
+	h.HandleShareLink(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("unlock after guesses: status %d, want 429", w.Code)
+	}
+
+	// Until the window passed
+	h.shares.mu.Lock()
+	h.shares.failures[share.ID].since = time.Now().Add(-shareUnlockWindow - time.Second)
+	h.shares.mu.Unlock()
+	if _, err := h.shares.Unlock(share.ID, "open sesame"); err != nil {
+		t.Errorf("unlock after the window: %v", err)
+	}
+
+	// Other shares aren't locked by guesses on this one
+	other, err := h.shares.Create("alice", "", "report.txt", ShareOptions{Password: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < shareUnlockAttempts; i++ {
+		h.shares.Unlock(share.ID, "guess")
+	}
+	if _, err := h.shares.Unlock(other.ID, "other"); err != nil {
+		t.Errorf("unlock other share: %v", err)
+	}
+}
+
+// Uploads in progress hold their part of a share's limit, so that
+// concurrent ones can't go over it together
+func TestShareUploadReservation(t *testing.T) {
+	h := newTestAPIHandler(t)
+	if err := h.fileManager.CreateFolder("alice", "", "Inbox"); err != nil {
+		t.Fatal(err)
+	}
+	share, err := h.shares.Create("alice", "", "Inbox", ShareOptions{Permission: ShareDrop, MaxBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := h.shares.ReserveUpload(share.ID, 80)
+	if err != nil || first != 80 {
+		t.Fatalf("first reservation: %d, %v", first, err)
+	}
+	second, err := h.shares.ReserveUpload(share.ID, 50)
+	if err != nil || second != 20 {
+		t.Fatalf("second reservation: %d, %v", second, err)
+	}
+	if _, err := h.shares.ReserveUpload(share.ID, 10); !errors.Is(err, ErrShareFull) {
+		t.Errorf("reservation past the limit: got %v", err)
+	}
+
+	// What the first upload didn't use is released
+	if err := h.shares.SettleUpload(share.ID, first, 30, 1); err != nil {
+		t.Fatal(err)
+	}
+	if unknown, err := h.shares.ReserveUpload(share.ID, 0); err != nil || unknown != 50 {
+		t.Errorf("reservation of unknown size: %d, %v", unknown, err)
+	}
+
+	// Unlimited shares reserve nothing
+	open, err := h.shares.Create("alice", "", "Inbox", ShareOptions{Permission: ShareDrop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved, err := h.shares.ReserveUpload(open.ID, 1000); err != nil || reserved != 0 {
+		t.Errorf("unlimited reservation: %d, %v", reserved, err)
+	}
+}
+
+func TestShareUploadLimit(t *testing.T) {
+	h := newTestAPIHandler(t)
+	if err := h.fileManager.CreateFolder("alice", "", "Inbox"); err != nil {
+		t.Fatal(err)
+	}
+	share, err := h.shares.Create("alice", "", "Inbox", ShareOptions{Permission: ShareDrop, MaxBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(name, content string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("files", name)
+		part.Write([]byte(content))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/s/"+share.ID+"/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.HandleShareLink(w, r)
+		return w.Code
+	}
+
+	if code := upload("a.txt", "123456"); code != http.StatusOK {
+		t.Fatalf("first upload: status %d", code)
+	}
+	if code := upload("b.txt", "123456"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload past the limit: status %d, want 413", code)
+	}
+	if code := upload("c.txt", "1234"); code != http.StatusOK {
+		t.Errorf("upload of what is left: status %d", code)
+	}
+	if code := upload("d.txt", "1"); code != http.StatusGone {
+		t.Errorf("upload to a full share: status %d, want 410", code)
+	}
+
+	h.shares.mu.Lock()
+	uploaded, reserved := h.shares.shares[share.ID].Uploaded, h.shares.reserved[share.ID]
+	h.shares.mu.Unlock()
+	if uploaded != 10 || reserved != 0 {
+		t.Errorf("uploaded %d, reserved %d", uploaded, reserved)
+	}
+}
+
+// A full share still serves downloads, and an exhausted one still takes uploads
+func TestShareLimitsPerAction(t *testing.T) {
+	h := newTestAPIHandler(t)
+	writeUserFile(t, h, "Inbox/report.txt", "report")
+	share, err := h.shares.Create("alice", "", "Inbox", ShareOptions{Permission: ShareUpload, MaxBytes: 10, MaxDownloads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "/s/" + share.ID
+
+	upload := func(name, content string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("files", name)
+		part.Write([]byte(content))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, base+"/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.HandleShareLink(w, r)
+		return w.Code
+	}
+
+	if code := upload("a.txt", "0123456789"); code != http.StatusOK {
+		t.Fatalf("upload: status %d", code)
+	}
+	if code := upload("b.txt", "1"); code != http.StatusGone {
+		t.Errorf("upload to a full share: status %d, want 410", code)
+	}
+	for _, action := range []string{"/info", "/files"} {
+		if w := shareRequest(h, http.MethodGet, base+action, nil); w.Code != http.StatusOK {
+			t.Errorf("%s of a full share: status %d", action, w.Code)
+		}
+	}
+	if w := shareRequest(h, http.MethodGet, base+"/download?name=report.txt", nil); w.Code != http.StatusOK {
+		t.Fatalf("download from a full share: status %d", w.Code)
+	}
+
+	// The download used up the limit, resuming it included
+	if w := shareRequest(h, http.MethodGet, base+"/download?name=report.txt", nil); w.Code != http.StatusGone {
+		t.Errorf("download from an exhausted share: status %d, want 410", w.Code)
+	}
+	if w := shareRequest(h, http.MethodGet, base+"/download?name=report.txt", map[string]string{"Range": "bytes=2-"}); w.Code != http.StatusGone {
+		t.Errorf("resumed download from an exhausted share: status %d, want 410", w.Code)
+	}
+	if w := shareRequest(h, http.MethodGet, base+"/files", nil); w.Code != http.StatusOK {
+		t.Errorf("files of an exhausted share: status %d", w.Code)
+	}
+	h.shares.mu.Lock()
+	h.shares.shares[share.ID].MaxBytes = 20
+	h.shares.mu.Unlock()
+	if code := upload("c.txt", "1"); code != http.StatusOK {
+		t.Errorf("upload to an exhausted share: status %d", code)
+	}
+}
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 (https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html)
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4MaxSkew    = 15 * time.Minute
+	sigV4MaxExpires = 7 * 24 * time.Hour
+
+	// Values of x-amz-content-sha256 other than the hex SHA-256 of the body
+	unsignedPayload                 = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedPayloadTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// awsChunkMaxSize bounds the chunks of aws-chunked bodies, held in memory until verified
+	awsChunkMaxSize = 16 << 20
+)
+
+// emptySHA256 is the hex SHA-256 of nothing
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Auth is the verified signature of an S3 request
+type s3Auth struct {
+	username   string
+	signingKey []byte
+	amzDate    string // Request time, as signed
+	scope      string // date/region/service/aws4_request
+	signature  string // Seeds the signatures of the chunks of streamed bodies
+	payload    string // x-amz-content-sha256
+}
+
+// s3Authenticate checks the SigV4 signature of a request, sent in the
+// Authorization header or in the query string of a presigned URL
+func (h *APIHandler) s3Authenticate(r *http.Request) (*s3Auth, error) {
+	query := r.URL.Query()
+	header := r.Header.Get("Authorization")
+
+	var credential, signedHeaders, signature, amzDate string
+	presigned := false
+	switch {
+	case strings.HasPrefix(header, sigV4Algorithm+" "):
+		for _, field := range strings.Split(strings.TrimPrefix(header, sigV4Algorithm+" "), ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+	case query.Get("X-Amz-Algorithm") == sigV4Algorithm:
+		presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+	case header != "" || query.Get("X-Amz-Algorithm") != "":
+		return nil, s3ErrorOf(http.StatusBadRequest, "InvalidRequest", "Only AWS Signature Version 4 is supported")
+	default:
+		return nil, errS3AccessDenied
+	}
+
+	// Credential is <access key>/<date>/<region>/<service>/aws4_request
+	scopeParts := strings.Split(credential, "/")
+	if len(scopeParts) != 5 || scopeParts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return nil, s3ErrorOf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed")
+	}
+	headers := strings.Split(signedHeaders, ";")
+	if !slices.Contains(headers, "host") {
+		return nil, s3ErrorOf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The host header must be signed")
+	}
+
+	signedAt, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil || scopeParts[1] != signedAt.Format("20060102") {
+		return nil, s3ErrorOf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The request date is missing or doesn't match the credential")
+	}
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || time.Duration(expires)*time.Second > sigV4MaxExpires {
+			return nil, s3ErrorOf(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 second and 7 days")
+		}
+		if time.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+			return nil, s3ErrorOf(http.StatusForbidden, "AccessDenied", "Request has expired")
+		}
+	} else if skew := time.Since(signedAt); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return nil, s3ErrorOf(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+	}
+
+	username, secret, found := h.authManager.LookupS3Key(scopeParts[0])
+	if !found {
+		return nil, s3ErrorOf(http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist")
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		if !presigned {
+			return nil, s3ErrorOf(http.StatusBadRequest, "InvalidRequest", "Missing x-amz-content-sha256 header")
+		}
+		payload = unsignedPayload
+	}
+
+	auth := &s3Auth{
+		username:   username,
+		signingKey: sigV4SigningKey(secret, scopeParts[1], scopeParts[2], scopeParts[3]),
+		amzDate:    amzDate,
+		scope:      strings.Join(scopeParts[1:], "/"),
+		signature:  signature,
+		payload:    payload,
+	}
+	canonical := sigV4CanonicalRequest(r, headers, payload, presigned)
+	expected := auth.sign(sigV4Algorithm, hexSHA256([]byte(canonical)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, s3ErrorOf(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+	}
+	return auth, nil
+}
+
+// sign returns the hex signature of a string to sign made of the algorithm,
+// the request time, the scope and the given lines
+func (a *s3Auth) sign(algorithm string, lines ...string) string {
+	toSign := strings.Join(append([]string{algorithm, a.amzDate, a.scope}, lines...), "\n")
+	return hex.EncodeToString(hmacSHA256(a.signingKey, toSign))
+}
+
+// body returns the request body, checked against the payload hash it was
+// signed with, and decoded if it was streamed in aws-chunked encoding
+func (a *s3Auth) body(r *http.Request) (io.Reader, error) {
+	switch a.payload {
+	case unsignedPayload:
+		return r.Body, nil
+	case streamingSignedPayload, streamingSignedPayloadTrailer:
+		return &awsChunkedReader{r: bufio.NewReader(r.Body), auth: a, prevSig: a.signature}, nil
+	case streamingUnsignedPayloadTrailer:
+		return &awsChunkedReader{r: bufio.NewReader(r.Body)}, nil
+	}
+
+	sum, err := hex.DecodeString(a.payload)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, s3ErrorOf(http.StatusBadRequest, "InvalidArgument", "Invalid x-amz-content-sha256 header")
+	}
+	return &sha256Reader{r: r.Body, expect: sum, hash: sha256.New()}, nil
+}
+
+// sigV4CanonicalRequest builds the canonical form of a request that is signed
+func sigV4CanonicalRequest(r *http.Request, signedHeaders []string, payload string, presigned bool) string {
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = r.Header.Get("Content-Length")
+			if value == "" && r.ContentLength >= 0 {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		case "transfer-encoding":
+			value = strings.Join(r.TransferEncoding, ",")
+		default:
+			var values []string
+			for _, v := range r.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	// Parameters are sorted by encoded name, then value
+	var params [][2]string
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		name, _ = url.PathUnescape(name)
+		value, _ = url.PathUnescape(value)
+		if presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		params = append(params, [2]string{s3Escape(name, false), s3Escape(value, false)})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	query := make([]string, len(params))
+	for i, param := range params {
+		query[i] = param[0] + "=" + param[1]
+	}
+
+	uri := s3Escape(r.URL.Path, true)
+	if uri == "" {
+		uri = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		uri,
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+// sigV4SigningKey derives the key requests of a day, region and service are signed with
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and slashes
+// when keepSlash is set, as signatures and url encoded listings require
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+// sha256Reader fails at the end of a body that doesn't match its signed hash
+type sha256Reader struct {
+	r      io.Reader
+	expect []byte
+	hash   hash.Hash
+}
+
+func (sr *sha256Reader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(sr.hash.Sum(nil), sr.expect) {
+		return n, errS3ContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes a body streamed in aws-chunked encoding, checking
+// the signature of every chunk, and of the trailer, when auth is set
+type awsChunkedReader struct {
+	r       *bufio.Reader
+	auth    *s3Auth // nil for unsigned chunks
+	prevSig string  // Signature of the previous chunk
+	chunk   []byte  // Rest of the current chunk
+	done    bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads a chunk, <hex size>[;chunk-signature=<signature>]\r\n<data>\r\n.
+// The last one is empty and followed by the trailer, if any, and \r\n.
+func (c *awsChunkedReader) next() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > awsChunkMaxSize {
+		return errS3IncompleteBody
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errS3IncompleteBody
+	}
+	if size > 0 {
+		if line, err := c.readLine(); err != nil || line != "" {
+			return errS3IncompleteBody
+		}
+	}
+
+	if c.auth != nil {
+		signature, found := strings.CutPrefix(extension, "chunk-signature=")
+		if !found || !hmac.Equal([]byte(signature), []byte(c.auth.sign(sigV4Algorithm+"-PAYLOAD", c.prevSig, emptySHA256, hexSHA256(data)))) {
+			return errS3SignatureDoesNotMatch
+		}
+		c.prevSig = signature
+	}
+
+	if size == 0 {
+		c.done = true
+		return c.readTrailer()
+	}
+	c.chunk = data
+	return nil
+}
+
+// readTrailer reads the trailing headers after the last chunk, checking their
+// signature for signed bodies. Checksums they carry aren't verified.
+func (c *awsChunkedReader) readTrailer() error {
+	var trailer strings.Builder
+	var signature string
+	for {
+		line, err := c.readLine()
+		if err == io.EOF && trailer.Len() == 0 && signature == "" {
+			// The final \r\n is left out by some clients when there is no trailer
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-amz-trailer-signature" {
+			signature = strings.TrimSpace(value)
+			continue
+		}
+		trailer.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	if c.auth == nil || c.auth.payload != streamingSignedPayloadTrailer {
+		return nil
+	}
+	if !hmac.Equal([]byte(signature), []byte(c.auth.sign(sigV4Algorithm+"-TRAILER", c.prevSig, hexSHA256([]byte(trailer.String()))))) {
+		return errS3SignatureDoesNotMatch
+	}
+	return nil
+}
+
+// readLine reads a line ending in \r\n, without it
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return "", io.EOF
+		}
+		return "", errS3IncompleteBody
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// SpacesRoot is the virtual folder at the top of every user's tree holding
+// the spaces of their groups, as SpacesRoot/<group>
+const SpacesRoot = "Team spaces"
+
+// ErrSpaceNotEmpty is returned when deleting a group whose space still has files
+var ErrSpaceNotEmpty = errors.New("the group's space is not empty")
+
+// spacePrefix starts the directory names of spaces in the files directory.
+// User names can't contain it, so spaces never clash with users.
+const spacePrefix = "@"
+
+// spaceOwner returns the owner of a group's space: the name of its directory
+// next to the users' ones, used wherever FileManager takes a username
+func spaceOwner(group string) string {
+	return spacePrefix + group
+}
+
+// spaceGroup returns the group owning a space, and whether owner is a space at all
+func spaceGroup(owner string) (string, bool) {
+	return strings.CutPrefix(owner, spacePrefix)
+}
+
+// Space is a group's space as one of its members sees it
+type Space struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Access string `json:"access"`
+	Admin  bool   `json:"admin"`
+	Used   int64  `json:"used"`
+	Quota  int64  `json:"quota"`
+}
+
+// spaceAccess returns what a user may do anywhere in the space of owner:
+// members write and group admins manage ("" if owner isn't a space of their groups)
+func (as *ACLStore) spaceAccess(username, owner string) string {
+	group, isSpace := spaceGroup(owner)
+	if !isSpace {
+		return ""
+	}
+	switch as.groupRole(group, username) {
+	case GroupAdmin:
+		return AccessManage
+	case GroupMember:
+		return AccessWrite
+	}
+	return ""
+}
+
+// resolveSpace is Resolve for the elements of a path below SpacesRoot
+func (as *ACLStore) resolveSpace(username string, parts []string) (*Location, error) {
+	if len(parts) == 0 {
+		return &Location{Path: SpacesRoot, Access: AccessRead, view: SpacesRoot}, nil
+	}
+
+	owner := spaceOwner(parts[0])
+	if as.spaceAccess(username, owner) == "" {
+		return nil, os.ErrNotExist
+	}
+	rel := path.Join(parts[1:]...)
+	return &Location{
+		Owner:  owner,
+		Path:   rel,
+		Access: as.Access(username, owner, rel),
+		view:   SpacesRoot + "/" + parts[0],
+	}, nil
+}
+
+// spaces returns the spaces of the groups a user is in, by name
+func (h *APIHandler) spaces(username string) []Space {
+	spaces := []Space{}
+	for _, group := range h.authManager.GroupsOf(username) {
+		owner := spaceOwner(group)
+		access := h.acls.Access(username, owner, "")
+		used, quota, _ := h.fileManager.GetUsage(owner)
+		spaces = append(spaces, Space{
+			Name:   group,
+			Path:   SpacesRoot + "/" + group,
+			Access: access,
+			Admin:  access == AccessManage,
+			Used:   used,
+			Quota:  quota,
+		})
+	}
+	return spaces
+}
+
+// listSpaces lists SpacesRoot: a folder per space of the user's groups
+func (h *APIHandler) listSpaces(username string, opts ListOptions) (*ListPage, error) {
+	var items []FileItem
+	for _, space := range h.spaces(username) {
+		var modified time.Time
+		if info, err := os.Stat(h.fileManager.GetUserDir(spaceOwner(space.Name))); err == nil {
+			modified = info.ModTime()
+		}
+		item := virtualFolder(space.Name, space.Path, modified)
+		item.Owner = spaceOwner(space.Name)
+		item.Permissions.Write = allows(space.Access, AccessWrite)
+		items = append(items, item)
+	}
+	return virtualPage(items, opts)
+}
+
+// spacesRootItem returns the item of SpacesRoot listed in the user's home
+// folder, nil while they aren't in any group
+func (h *APIHandler) spacesRootItem(username string) *FileItem {
+	groups := h.authManager.GroupsOf(username)
+	if len(groups) == 0 {
+		return nil
+	}
+
+	var latest time.Time
+	for _, group := range groups {
+		if info, err := os.Stat(h.fileManager.GetUserDir(spaceOwner(group))); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	item := virtualFolder(SpacesRoot, SpacesRoot, latest)
+	return &item
+}
+
+// HandleSpaces lists the spaces of the user's groups, with their usage and quota
+func (h *APIHandler) HandleSpaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"spaces":  h.spaces(username),
+	})
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Space directories sit next to each other, and one space's name can be the
+// start of another's: members of @team must not reach into @team2
+func TestItemsStayInsideSpace(t *testing.T) {
+	team, team2 := spaceOwner("team"), spaceOwner("team2")
+	fm, baseDir := newTestFileManager(t,
+		team+"/docs/plan.txt",
+		team2+"/budget/2024.xlsx",
+	)
+
+	tests := []struct {
+		name string
+		op   func() error
+		want error
+	}{
+		{"delete in other space", func() error { return fm.DeleteItems(team, "", []string{"../" + team2 + "/budget"}) }, ErrInvalidName},
+		{"delete from other space path", func() error { return fm.DeleteItems(team, "../"+team2, []string{"budget"}) }, ErrInvalidPath},
+		{"rename into other space", func() error { return fm.RenameItem(team, "", "docs", "../"+team2+"/docs") }, ErrInvalidName},
+		{"rename out of other space", func() error { return fm.RenameItem(team, "", "../"+team2+"/budget", "budget") }, ErrInvalidName},
+		{"move from other space", func() error { return fm.MoveItem(team, "../"+team2, "budget", "", "budget") }, ErrInvalidPath},
+		{"move into other space", func() error { return fm.MoveItem(team, "", "docs", "../"+team2, "docs") }, ErrInvalidPath},
+		{"create folder in other space", func() error { return fm.CreateFolder(team, "../"+team2, "new") }, ErrInvalidPath},
+		{"info of other space", func() error {
+			_, err := fm.GetFileInfo(team, "../"+team2+"/budget", "2024.xlsx")
+			return err
+		}, ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	assertExists(t, baseDir, team+"/docs/plan.txt")
+	assertExists(t, baseDir, team2+"/budget/2024.xlsx")
+	for _, path := range []string{team + "/budget", team2 + "/docs", team2 + "/new"} {
+		if _, err := os.Stat(filepath.Join(baseDir, path)); err == nil {
+			t.Errorf("%s was created", path)
+		}
+	}
+
+	// The other space's usage wasn't released by anything above
+	used, err := fm.usage.Usage(team2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(team2 + "/budget/2024.xlsx")); used != want {
+		t.Errorf("%s usage: got %d, want %d", team2, used, want)
+	}
+}
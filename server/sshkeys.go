@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrSSHKeyNotFound is returned for unknown SSH keys
+	ErrSSHKeyNotFound = errors.New("SSH key not found")
+	// ErrSSHKeyExists is returned when adding a public key that is already in use
+	ErrSSHKeyExists = errors.New("this SSH key is already in use")
+)
+
+// SSHKey is a public key a user signs in to the SFTP server with
+type SSHKey struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	Name        string    `json:"name"`
+	Key         string    `json:"key"` // In authorized_keys format, without comment
+	Fingerprint string    `json:"fingerprint"`
+	Created     time.Time `json:"created"`
+}
+
+// AddSSHKey adds a public key, in authorized_keys format, to a user
+func (am *AuthManager) AddSSHKey(username, name, authorizedKey string) (*SSHKey, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, errors.New("invalid SSH public key")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = comment
+	}
+	if name == "" {
+		return nil, errors.New("the key needs a name")
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.users[username]; !exists {
+		return nil, errors.New("user not found")
+	}
+	fingerprint := ssh.FingerprintSHA256(pub)
+	for _, sshKey := range am.sshKeys {
+		if sshKey.Fingerprint == fingerprint {
+			return nil, ErrSSHKeyExists
+		}
+	}
+
+	sshKey := &SSHKey{
+		ID:          randomHex(8),
+		Username:    username,
+		Name:        name,
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		Fingerprint: fingerprint,
+		Created:     time.Now(),
+	}
+	am.sshKeys[sshKey.ID] = sshKey
+	if err := am.saveSSHKeysLocked(); err != nil {
+		delete(am.sshKeys, sshKey.ID)
+		return nil, err
+	}
+
+	copied := *sshKey
+	return &copied, nil
+}
+
+// ListSSHKeys returns the public keys of a user, oldest first
+func (am *AuthManager) ListSSHKeys(username string) []SSHKey {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	keys := []SSHKey{}
+	for _, sshKey := range am.sshKeys {
+		if sshKey.Username == username {
+			keys = append(keys, *sshKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// DeleteSSHKey removes one of a user's public keys
+func (am *AuthManager) DeleteSSHKey(username, id string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	sshKey, exists := am.sshKeys[id]
+	if !exists || sshKey.Username != username {
+		return ErrSSHKeyNotFound
+	}
+	delete(am.sshKeys, id)
+	return am.saveSSHKeysLocked()
+}
+
+// AuthenticateSSHKey reports whether a public key is one of a user's
+func (am *AuthManager) AuthenticateSSHKey(username string, pub ssh.PublicKey) bool {
+	wire := pub.Marshal()
+
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	if _, exists := am.users[username]; !exists {
+		return false
+	}
+	for _, sshKey := range am.sshKeys {
+		if sshKey.Username != username {
+			continue
+		}
+		known, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sshKey.Key))
+		if err == nil && bytes.Equal(known.Marshal(), wire) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSSHKeys reads the SSH keys file, if it exists
+func (am *AuthManager) loadSSHKeys() error {
+	if am.sshKeysFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(am.sshKeysFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var keys []*SSHKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, sshKey := range keys {
+		am.sshKeys[sshKey.ID] = sshKey
+	}
+	return nil
+}
+
+// saveSSHKeysLocked writes the SSH keys to the JSON file (caller must hold am.mu)
+func (am *AuthManager) saveSSHKeysLocked() error {
+	if am.sshKeysFile == "" {
+		return nil
+	}
+
+	keys := make([]*SSHKey, 0, len(am.sshKeys))
+	for _, sshKey := range am.sshKeys {
+		keys = append(keys, sshKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(am.sshKeysFile), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(am.sshKeysFile, data)
+}
+
+// HandleSSHKeys lists (GET), adds (POST) and removes (DELETE) the public keys
+// the user signs in to the SFTP server with
+func (h *APIHandler) HandleSSHKeys(w http.ResponseWriter, r *http.Request) {
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"keys":    h.authManager.ListSSHKeys(username),
+		})
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error processing request", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := h.authManager.DeleteSSHKey(username, req.ID); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+
+	sshKey, err := h.authManager.AddSSHKey(username, req.Name, req.Key)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrSSHKeyExists) {
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"sshKey":  sshKey,
+	})
+}
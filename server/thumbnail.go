@@ -0,0 +1,359 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnail limits
+const (
+	maxThumbnailSource = 50 << 20   // Bigger files aren't decoded
+	maxThumbnailPixels = 40_000_000 // Decoded images may use up to 4 bytes per pixel
+)
+
+// thumbnailSizes maps the supported sizes to the longest side of the thumbnail in pixels
+var thumbnailSizes = map[string]int{
+	"small":  64,
+	"medium": 256,
+	"large":  1024,
+}
+
+var (
+	// ErrNotAnImage is returned for files without a supported image format
+	ErrNotAnImage = errors.New("unsupported image format")
+	// ErrImageTooLarge is returned for images too big to be decoded safely
+	ErrImageTooLarge = errors.New("image too large for a thumbnail")
+)
+
+// isThumbnailable reports whether a file name has a supported image extension
+func isThumbnailable(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// ThumbnailService generates thumbnails on demand and caches them in dir, in a
+// tree mirroring the user trees: the thumbnails of a file are stored in a
+// folder named after it, so deleting or renaming a file or folder is applied
+// to its cached thumbnails the same way. Cached files are named after the ETag
+// of the image, so a thumbnail of an older version is never served.
+type ThumbnailService struct {
+	dir         string
+	fileManager *FileManager
+	workers     chan struct{} // Limits how many images are decoded at once
+
+	mu       sync.Mutex
+	inflight map[string]*thumbnailJob // Generations in progress by cache path
+}
+
+// thumbnailJob is a thumbnail being generated, shared by concurrent requests for it
+type thumbnailJob struct {
+	done chan struct{}
+	err  error
+}
+
+// NewThumbnailService creates a thumbnail service caching in dir
+func NewThumbnailService(dir string, fm *FileManager) *ThumbnailService {
+	os.MkdirAll(dir, 0755)
+
+	ts := &ThumbnailService{
+		dir:         dir,
+		fileManager: fm,
+		workers:     make(chan struct{}, runtime.NumCPU()),
+		inflight:    make(map[string]*thumbnailJob),
+	}
+
+	fm.OnChange(ts.invalidate)
+	return ts
+}
+
+// invalidate applies a change to the cached thumbnails
+func (ts *ThumbnailService) invalidate(event FileEvent) {
+	switch event.Type {
+	case EventModify, EventDelete:
+		os.RemoveAll(ts.cacheDir(event.Username, event.Path))
+	case EventRename:
+		// Thumbnails stay valid, the ETag of a file doesn't change when it moves
+		dst := ts.cacheDir(event.Username, event.Path)
+		os.RemoveAll(dst)
+		os.MkdirAll(filepath.Dir(dst), 0755)
+		os.Rename(ts.cacheDir(event.Username, event.OldPath), dst)
+	}
+}
+
+// cacheDir returns the folder holding the thumbnails of a file, or of everything inside a folder
+func (ts *ThumbnailService) cacheDir(username, rel string) string {
+	return filepath.Join(ts.dir, username, filepath.FromSlash(rel))
+}
+
+// Thumbnail returns the path of the cached thumbnail of the image at fullPath,
+// generating it first if needed
+func (ts *ThumbnailService) Thumbnail(ctx context.Context, username, fullPath string, info os.FileInfo, size string) (string, error) {
+	if !isThumbnailable(fullPath) {
+		return "", ErrNotAnImage
+	}
+	if info.Size() > maxThumbnailSource {
+		return "", ErrImageTooLarge
+	}
+
+	etag := strings.Trim(fileETag(info), `"`)
+	dir := ts.cacheDir(username, ts.fileManager.relPath(username, fullPath))
+	cachePath := filepath.Join(dir, size+"-"+etag)
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	// Wait for a generation already in progress instead of repeating it
+	ts.mu.Lock()
+	job := ts.inflight[cachePath]
+	if job == nil {
+		job = &thumbnailJob{done: make(chan struct{})}
+		ts.inflight[cachePath] = job
+		go func() {
+			job.err = ts.generate(fullPath, dir, size, cachePath)
+			ts.mu.Lock()
+			delete(ts.inflight, cachePath)
+			ts.mu.Unlock()
+			close(job.done)
+		}()
+	}
+	ts.mu.Unlock()
+
+	select {
+	case <-job.done:
+		return cachePath, job.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// generate decodes an image and stores its thumbnail at cachePath,
+// removing older versions of that size
+func (ts *ThumbnailService) generate(fullPath, dir, size, cachePath string) error {
+	ts.workers <- struct{}{}
+	defer func() { <-ts.workers }()
+
+	file, err := ts.fileManager.openFile(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Check the dimensions before decoding, a small file can declare a huge image
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return ErrNotAnImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return ErrNotAnImage
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return ErrImageTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return ErrNotAnImage
+	}
+
+	thumb := scaleImage(src, thumbnailSizes[size])
+
+	var buf bytes.Buffer
+	if isOpaque(thumb) {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ts.writeCached(cachePath, buf.Bytes()); err != nil {
+		return err
+	}
+
+	// Older versions of this size are never used again
+	stale, _ := filepath.Glob(filepath.Join(dir, size+"-*"))
+	for _, path := range stale {
+		if path != cachePath {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// writeCached writes a thumbnail atomically, encrypted like user files when
+// encryption at rest is enabled
+func (ts *ThumbnailService) writeCached(path string, data []byte) error {
+	fm := ts.fileManager
+	if fm.keys == nil {
+		return writeFileAtomic(path, data)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), uploadTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	ew, err := newEncryptWriter(tmp, tmp, fm.keys)
+	if err == nil {
+		_, err = ew.Write(data)
+	}
+	if err == nil {
+		err = ew.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// scaleImage shrinks img so its longest side is at most maxSide pixels
+func scaleImage(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return img
+	}
+
+	if width >= height {
+		height = max(height*maxSide/width, 1)
+		width = maxSide
+	} else {
+		width = max(width*maxSide/height, 1)
+		height = maxSide
+	}
+
+	var dst draw.Image
+	if isOpaque(img) {
+		dst = image.NewRGBA(image.Rect(0, 0, width, height))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, width, height))
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// isOpaque reports whether an image has no transparent pixels
+func isOpaque(img image.Image) bool {
+	opaque, ok := img.(interface{ Opaque() bool })
+	return ok && opaque.Opaque()
+}
+
+// HandleThumbnail serves the thumbnail of an image
+func (h *APIHandler) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+		return
+	}
+
+	query := r.URL.Query()
+	size := query.Get("size")
+	if size == "" {
+		size = "medium"
+	}
+	if _, ok := thumbnailSizes[size]; !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid size"})
+		return
+	}
+
+	loc, name := h.locateItem(w, username, query.Get("path"), query.Get("name"))
+	if loc == nil {
+		return
+	}
+	fullPath, err := h.fileManager.resolveItem(loc.Owner, loc.Path, name)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "File not found"})
+		return
+	}
+
+	// The thumbnail changes exactly when the image does
+	etag := strings.TrimSuffix(fileETag(info), `"`) + "-" + size + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Vary", "Authorization")
+	if notModified(r, etag, info.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	cachePath, err := h.thumbnails.Thumbnail(r.Context(), loc.Owner, fullPath, info, size)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrNotAnImage):
+			status = http.StatusUnsupportedMediaType
+		case errors.Is(err, ErrImageTooLarge):
+			status = http.StatusUnprocessableEntity
+		case r.Context().Err() != nil:
+			return
+		default:
+			log.Printf("Error generating thumbnail of %s: %v", fullPath, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	file, err := h.fileManager.openFile(cachePath)
+	if err != nil {
+		http.Error(w, "Error reading thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Thumbnails are either JPEG or PNG, ServeContent sniffs which
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// writeTestImage stores a PNG image of the given size in alice's directory
+func writeTestImage(t *testing.T, h *APIHandler, name string, width, height int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, height/2, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	writeUserFile(t, h, name, buf.String())
+}
+
+func TestThumbnail(t *testing.T) {
+	h := newTestAPIHandler(t)
+	writeTestImage(t, h, "photo.png", 400, 200)
+	writeUserFile(t, h, "notes.txt", "not an image")
+
+	w := apiRequest(t, h, h.HandleThumbnail, "alice", http.MethodGet, "/api/files/thumbnail?path=&name=photo.png&size=small", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("thumbnail: status %d %s", w.Code, w.Body)
+	}
+	thumb, _, err := image.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := thumb.Bounds(); bounds.Dx() != 64 || bounds.Dy() != 32 {
+		t.Errorf("thumbnail of %v, want 64x32", bounds.Size())
+	}
+	etag := w.Header().Get("ETag")
+
+	// A new version of the image gets a new thumbnail
+	writeTestImage(t, h, "photo.png", 100, 300)
+	w = apiRequest(t, h, h.HandleThumbnail, "alice", http.MethodGet, "/api/files/thumbnail?path=&name=photo.png&size=small", "")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("new version: status %d, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	if thumb, _, err = image.Decode(w.Body); err != nil {
+		t.Fatal(err)
+	}
+	if bounds := thumb.Bounds(); bounds.Dx() != 21 || bounds.Dy() != 64 {
+		t.Errorf("thumbnail of the new version of %v, want 21x64", bounds.Size())
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"name=notes.txt", http.StatusUnsupportedMediaType},
+		{"name=photo.png&size=huge", http.StatusBadRequest},
+		{"name=missing.png", http.StatusNotFound},
+	} {
+		if w := apiRequest(t, h, h.HandleThumbnail, "alice", http.MethodGet, "/api/files/thumbnail?path=&"+tt.query, ""); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.query, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,607 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tus protocol constants (https://tus.io/protocols/resumable-upload)
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+	tusAlgorithms = "sha1,md5,sha256,sha512"
+
+	// statusChecksumMismatch is the tus specific status for a failed checksum
+	statusChecksumMismatch = 460
+)
+
+// Unfinished uploads expire once they received no data for tusUploadTTL,
+// they are looked for every tusSweepInterval
+const (
+	tusUploadTTL     = 24 * time.Hour
+	tusSweepInterval = time.Hour
+)
+
+// TusUpload describes a resumable upload in progress
+type TusUpload struct {
+	ID       string            `json:"id"`
+	Username string            `json:"username"`
+	Owner    string            `json:"owner,omitempty"` // User whose tree receives the file, when not Username
+	Path     string            `json:"path"`            // Destination folder (relative to the owner's directory)
+	Name     string            `json:"name"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Created  time.Time         `json:"created"`
+	Updated  time.Time         `json:"updated,omitempty"` // Data was last received
+}
+
+// TusStore persists resumable upload state so uploads survive server restarts.
+// Upload descriptions are kept as JSON files in its directory, while the data
+// itself is written to a hidden partial file in the destination folder, so it
+// counts towards the user's quota like any other upload.
+type TusStore struct {
+	dir         string
+	fileManager *FileManager
+	active      map[string]bool // Uploads currently receiving data
+	mu          sync.Mutex
+}
+
+// NewTusStore creates a new tus upload store
+func NewTusStore(dir string, fileManager *FileManager) *TusStore {
+	return &TusStore{
+		dir:         dir,
+		fileManager: fileManager,
+		active:      make(map[string]bool),
+	}
+}
+
+// expires returns when the upload expires unless it receives data
+func (u *TusUpload) expires() time.Time {
+	if u.Updated.IsZero() {
+		return u.Created.Add(tusUploadTTL)
+	}
+	return u.Updated.Add(tusUploadTTL)
+}
+
+// owner returns the user whose tree receives the upload
+func (u *TusUpload) owner() string {
+	if u.Owner != "" {
+		return u.Owner
+	}
+	return u.Username
+}
+
+// Create registers a new upload of username into path of owner's tree and
+// creates its empty partial file
+func (ts *TusStore) Create(username, owner, path, name string, length int64, metadata map[string]string) (*TusUpload, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	upload := &TusUpload{
+		ID:       hex.EncodeToString(idBytes),
+		Username: username,
+		Path:     path,
+		Name:     name,
+		Length:   length,
+		Metadata: metadata,
+		Created:  time.Now(),
+	}
+
+	if owner != username {
+		upload.Owner = owner
+	}
+
+	// Validate destination before accepting the upload
+	if _, err := ts.fileManager.resolveItem(owner, path, name); err != nil {
+		return nil, err
+	}
+
+	partialPath, err := ts.PartialPath(upload)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	if err := ts.save(upload); err != nil {
+		os.Remove(partialPath)
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// Get loads an upload owned by username. Expired uploads don't exist anymore,
+// even before they are swept.
+func (ts *TusStore) Get(username, id string) (*TusUpload, error) {
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return nil, os.ErrNotExist
+	}
+
+	upload, err := ts.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Other users' uploads don't exist as far as this user is concerned
+	if upload.Username != username || time.Now().After(upload.expires()) {
+		return nil, os.ErrNotExist
+	}
+
+	return upload, nil
+}
+
+// Touch records that an upload received data, which pushes its expiry back
+func (ts *TusStore) Touch(upload *TusUpload) error {
+	upload.Updated = time.Now()
+	return ts.save(upload)
+}
+
+// Offset returns how many bytes of the upload have been received
+func (ts *TusStore) Offset(upload *TusUpload) (int64, error) {
+	partialPath, err := ts.PartialPath(upload)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(partialPath)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// PartialPath returns where the data of an upload is being written
+func (ts *TusStore) PartialPath(upload *TusUpload) (string, error) {
+	return ts.fileManager.resolveItem(upload.owner(), upload.Path, uploadTempPrefix+"tus-"+upload.ID)
+}
+
+// Finish moves a complete upload to its destination and forgets it
+func (ts *TusStore) Finish(upload *TusUpload) error {
+	partialPath, err := ts.PartialPath(upload)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.fileManager.CommitPartial(upload.owner(), partialPath, upload.Path, upload.Name); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(ts.dir, upload.ID+".json"))
+}
+
+// Terminate discards an upload and its received data
+func (ts *TusStore) Terminate(upload *TusUpload) error {
+	if partialPath, err := ts.PartialPath(upload); err == nil {
+		if err := ts.fileManager.RemovePartial(upload.owner(), partialPath); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(filepath.Join(ts.dir, upload.ID+".json"))
+}
+
+// Sweep terminates the uploads that expired, returning how many. Uploads
+// receiving data are left alone.
+func (ts *TusStore) Sweep() (int, error) {
+	entries, err := os.ReadDir(ts.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	swept := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !ts.Lock(id) {
+			continue
+		}
+
+		// Loaded once locked, data may have arrived since the directory was read
+		upload, err := ts.load(id)
+		if err == nil && time.Now().After(upload.expires()) {
+			if err = ts.Terminate(upload); err == nil {
+				swept++
+			}
+		}
+		ts.Unlock(id)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error expiring upload %s: %v", id, err)
+		}
+	}
+	return swept, nil
+}
+
+// RunSweeper terminates expired uploads once per interval, forever
+func (ts *TusStore) RunSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		swept, err := ts.Sweep()
+		if err != nil {
+			log.Printf("Expiring resumable uploads failed: %v", err)
+			continue
+		}
+		if swept > 0 {
+			log.Printf("Removed %d expired resumable uploads", swept)
+		}
+	}
+}
+
+// Lock marks an upload as busy, returning false if it already is
+func (ts *TusStore) Lock(id string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.active[id] {
+		return false
+	}
+	ts.active[id] = true
+	return true
+}
+
+// Unlock releases an upload locked with Lock
+func (ts *TusStore) Unlock(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.active, id)
+}
+
+// load reads an upload description from disk
+func (ts *TusStore) load(id string) (*TusUpload, error) {
+	data, err := os.ReadFile(filepath.Join(ts.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var upload TusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// save writes the upload description to disk
+func (ts *TusStore) save(upload *TusUpload) error {
+	if err := os.MkdirAll(ts.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(ts.dir, upload.ID+".json"), data, 0600)
+}
+
+// HandleTus implements the tus 1.0 core protocol with the creation,
+// termination, checksum and expiration extensions under /api/tus/
+func (h *APIHandler) HandleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	// Allow clients that can't send PATCH or DELETE
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		r.Method = override
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Checksum-Algorithm", tusAlgorithms)
+		if h.maxUploadSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Verify authentication and get username
+	username, err := h.getUsernameFromToken(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tus"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.handleTusCreate(w, r, username)
+		return
+	}
+
+	upload, err := h.tusStore.Get(username, id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		h.handleTusHead(w, upload)
+	case http.MethodPatch:
+		h.handleTusPatch(w, r, upload)
+	case http.MethodDelete:
+		h.handleTusDelete(w, upload)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTusCreate creates a new upload (creation extension)
+func (h *APIHandler) handleTusCreate(w http.ResponseWriter, r *http.Request, username string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if h.maxUploadSize > 0 && length > h.maxUploadSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	name := metadata["filename"]
+	if name == "" {
+		name = metadata["name"]
+	}
+	path := metadata["path"]
+	if path == "" {
+		path = "root"
+	}
+
+	loc := h.locate(w, username, path, AccessWrite)
+	if loc == nil {
+		return
+	}
+
+	// Refuse uploads that can't fit before anything is written
+	used, quota, err := h.fileManager.GetUsage(loc.Owner)
+	if err == nil && quota > 0 && used+length > quota {
+		http.Error(w, ErrQuotaExceeded.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	upload, err := h.tusStore.Create(username, loc.Owner, loc.Path, name, length, metadata)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Empty files are complete as soon as they are created
+	if length == 0 {
+		if err := h.finishTusUpload(upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/api/tus/"+upload.ID)
+	w.Header().Set("Upload-Offset", "0")
+	if length > 0 {
+		w.Header().Set("Upload-Expires", upload.expires().UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// finishTusUpload moves a complete upload to its destination, and records it in the audit log
+func (h *APIHandler) finishTusUpload(upload *TusUpload) error {
+	err := h.tusStore.Finish(upload)
+	h.audit.Record(AuditEntry{Protocol: AuditHTTP, User: upload.Username, Action: AuditUpload, Owner: upload.owner(), Path: auditPath(upload.Path, upload.Name)}, err)
+	return err
+}
+
+// handleTusHead reports the current offset of an upload
+func (h *APIHandler) handleTusHead(w http.ResponseWriter, upload *TusUpload) {
+	offset, err := h.tusStore.Offset(upload)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.expires().UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTusPatch appends data to an upload
+func (h *APIHandler) handleTusPatch(w http.ResponseWriter, r *http.Request, upload *TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	var checksum hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		checksum, expected, err = parseTusChecksum(header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Access to a shared folder can be revoked while its uploads are in progress
+	if !allows(h.acls.Access(upload.Username, upload.owner(), upload.Path), AccessWrite) {
+		http.Error(w, ErrAccessDenied.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !h.tusStore.Lock(upload.ID) {
+		http.Error(w, "Upload is already in progress", http.StatusLocked)
+		return
+	}
+	defer h.tusStore.Unlock(upload.ID)
+
+	current, err := h.tusStore.Offset(upload)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if offset != current {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	partialPath, err := h.tusStore.PartialPath(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	written, err := h.fileManager.AppendPartial(upload.owner(), partialPath, offset, upload.Length-offset, r.Body, checksum)
+	if written > 0 {
+		if err := h.tusStore.Touch(upload); err != nil {
+			log.Printf("Error saving upload %s: %v", upload.ID, err)
+		}
+	}
+	if err != nil {
+		// Data already received is kept so the client can resume, unless it must be verified
+		if checksum != nil {
+			h.fileManager.TruncatePartial(upload.owner(), partialPath, offset)
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if checksum != nil && !bytes.Equal(checksum.Sum(nil), expected) {
+		h.fileManager.TruncatePartial(upload.owner(), partialPath, offset)
+		http.Error(w, "Checksum mismatch", statusChecksumMismatch)
+		return
+	}
+
+	offset += written
+	if offset == upload.Length {
+		if err := h.finishTusUpload(upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		w.Header().Set("Upload-Expires", upload.expires().UTC().Format(http.TimeFormat))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTusDelete terminates an upload (termination extension)
+func (h *APIHandler) handleTusDelete(w http.ResponseWriter, upload *TusUpload) {
+	if !h.tusStore.Lock(upload.ID) {
+		http.Error(w, "Upload is already in progress", http.StatusLocked)
+		return
+	}
+	defer h.tusStore.Unlock(upload.ID)
+
+	if err := h.tusStore.Terminate(upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header ("key base64value,key2 base64value2")
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, errors.New("invalid metadata pair")
+		}
+
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+
+	return metadata, nil
+}
+
+// parseTusChecksum decodes an Upload-Checksum header ("algorithm base64digest")
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("invalid Upload-Checksum")
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.New("invalid Upload-Checksum")
+	}
+
+	switch parts[0] {
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "md5":
+		return md5.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	case "sha512":
+		return sha512.New(), expected, nil
+	}
+
+	return nil, nil, errors.New("unsupported checksum algorithm")
+}
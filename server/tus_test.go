@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tusRequest sends a tus request signed in as alice
+func tusRequest(t *testing.T, h *APIHandler, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := h.authManager.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.HandleTus(w, r)
+	return w
+}
+
+func TestTusExpiration(t *testing.T) {
+	h := newTestAPIHandler(t)
+
+	w := tusRequest(t, h, http.MethodOptions, "/api/tus/", nil, "")
+	if !strings.Contains(w.Header().Get("Tus-Extension"), "expiration") {
+		t.Errorf("Tus-Extension: %q", w.Header().Get("Tus-Extension"))
+	}
+
+	// Metadata "filename big.bin"
+	w = tusRequest(t, h, http.MethodPost, "/api/tus/", map[string]string{"Upload-Length": "10", "Upload-Metadata": "filename YmlnLmJpbg=="}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+	created, err := http.ParseTime(w.Header().Get("Upload-Expires"))
+	if err != nil || created.Before(time.Now().Add(tusUploadTTL-time.Minute)) {
+		t.Errorf("Upload-Expires of creation: %q", w.Header().Get("Upload-Expires"))
+	}
+
+	w = tusRequest(t, h, http.MethodPatch, location, map[string]string{"Upload-Offset": "0", "Content-Type": "application/offset+octet-stream"}, "01234")
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("patch: status %d, Upload-Expires %q", w.Code, w.Header().Get("Upload-Expires"))
+	}
+
+	upload, err := h.tusStore.Get("alice", strings.TrimPrefix(location, "/api/tus/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partialPath, err := h.tusStore.PartialPath(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := h.fileManager.usage.Usage("alice")
+	if err != nil || used != 5 {
+		t.Fatalf("usage while uploading: %d, %v", used, err)
+	}
+
+	// Uploads that received data recently stay
+	if swept, err := h.tusStore.Sweep(); err != nil || swept != 0 {
+		t.Errorf("sweep of an active upload: %d, %v", swept, err)
+	}
+
+	// Idle uploads expire, and are no more found even before they are swept
+	upload.Updated = time.Now().Add(-tusUploadTTL - time.Minute)
+	if err := h.tusStore.save(upload); err != nil {
+		t.Fatal(err)
+	}
+	if w := tusRequest(t, h, http.MethodHead, location, nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("head of an expired upload: status %d", w.Code)
+	}
+
+	// Uploads receiving data are left to finish
+	if !h.tusStore.Lock(upload.ID) {
+		t.Fatal("upload locked")
+	}
+	if swept, _ := h.tusStore.Sweep(); swept != 0 {
+		t.Errorf("swept a busy upload")
+	}
+	h.tusStore.Unlock(upload.ID)
+
+	if swept, err := h.tusStore.Sweep(); err != nil || swept != 1 {
+		t.Fatalf("sweep: %d, %v", swept, err)
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Errorf("partial file left: %v", err)
+	}
+	if used, _ := h.fileManager.usage.Usage("alice"); used != 0 {
+		t.Errorf("usage after the sweep: %d", used)
+	}
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// File watcher settings
+const (
+	watchSettle   = 500 * time.Millisecond // A changed path is looked at once it stayed quiet that long
+	watchRemember = 30 * time.Second       // How long the server's own changes are told apart from outside ones
+)
+
+// What the server's own changes leave for folders: files leave their ETag and
+// deleted items nothing
+const (
+	watchedDir   = "dir"   // Created
+	watchedMoved = "moved" // Moved there with their contents
+)
+
+// Watcher notices the changes made to the files directory behind the server's
+// back, such as files copied in by an administrator, and reports them as
+// FileManager events so that the listeners stay right.
+//
+// Folders are only watched once they settled: fsnotify drops the watch of a
+// moved folder on its own, which would race with watching its new path.
+type Watcher struct {
+	fileManager *FileManager
+	baseDir     string
+	watcher     *fsnotify.Watcher
+	dirs        map[string]bool         // Folders being watched
+	pending     map[string]*pendingPath // Changed paths waiting to settle
+	recent      map[string]recentChange // What the server's own changes left, by path
+	warned      bool                    // Failing to watch was logged already
+	mu          sync.Mutex
+}
+
+// pendingPath is a path that changed recently
+type pendingPath struct {
+	created bool // Appeared, or was moved there
+	last    time.Time
+}
+
+// recentChange is what a change made by the server left at a path
+type recentChange struct {
+	state string // ETag of a file, watchedDir or watchedMoved, or "" once deleted
+	at    time.Time
+}
+
+// watchEntry is an item found in a folder that started being watched
+type watchEntry struct {
+	path  string
+	isDir bool
+}
+
+// NewWatcher creates a watcher for the files directory of the file manager,
+// it watches once Run is called
+func NewWatcher(fm *FileManager) (*Watcher, error) {
+	baseDir, err := filepath.Abs(fm.baseDir)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		fileManager: fm,
+		baseDir:     baseDir,
+		watcher:     watcher,
+		dirs:        make(map[string]bool),
+		pending:     make(map[string]*pendingPath),
+		recent:      make(map[string]recentChange),
+	}
+	fm.OnChange(w.remember)
+	return w, nil
+}
+
+// Run watches the files directory, it only returns if watching fails
+func (w *Watcher) Run() {
+	w.addTree(w.baseDir)
+
+	settle := time.NewTicker(watchSettle / 2)
+	defer settle.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.note(event)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events lost to an overflow can't be told, later ones still are
+			log.Printf("File watcher: %v", err)
+
+		case <-settle.C:
+			w.flush()
+		}
+	}
+}
+
+// note queues a path that changed, to look at once it settled
+func (w *Watcher) note(event fsnotify.Event) {
+	if event.Op == fsnotify.Chmod || w.ignored(event.Name) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending := w.pending[event.Name]
+	if pending == nil {
+		pending = &pendingPath{}
+		w.pending[event.Name] = pending
+	}
+	if event.Has(fsnotify.Create) {
+		pending.created = true
+	}
+	pending.last = time.Now()
+}
+
+// flush reports the pending paths that settled. Removals go first so that
+// moved folders stop being watched at their old path before their new one.
+func (w *Watcher) flush() {
+	now := time.Now()
+	var gone, present []string
+	created := make(map[string]bool)
+
+	w.mu.Lock()
+	for p, pending := range w.pending {
+		if now.Sub(pending.last) < watchSettle {
+			continue
+		}
+		delete(w.pending, p)
+		created[p] = pending.created
+		if _, err := os.Lstat(p); err != nil {
+			gone = append(gone, p)
+		} else {
+			present = append(present, p)
+		}
+	}
+	for p, change := range w.recent {
+		if now.Sub(change.at) > watchRemember {
+			delete(w.recent, p)
+		}
+	}
+	w.mu.Unlock()
+
+	sort.Strings(gone)
+	sort.Strings(present)
+	for _, p := range gone {
+		w.removed(p, created[p])
+	}
+	for _, p := range present {
+		w.changed(p, created[p])
+	}
+}
+
+// removed reports an item that is gone, unless it only showed up briefly or
+// went with a deleted folder
+func (w *Watcher) removed(p string, created bool) {
+	w.mu.Lock()
+	isDir := w.dirs[p]
+	deleted := w.deletedLocked(p)
+	w.mu.Unlock()
+
+	if isDir {
+		w.unwatchTree(p)
+	}
+	if created || deleted {
+		return
+	}
+	w.report(p, FileEvent{Type: EventDelete, IsDir: isDir})
+}
+
+// changed reports an item that was created or modified, unless the server did
+func (w *Watcher) changed(p string, created bool) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		// Gone again, the removal is pending already
+		return
+	}
+
+	switch {
+	case info.IsDir():
+		w.mu.Lock()
+		watched := w.dirs[p]
+		change := w.recent[p]
+		w.mu.Unlock()
+		if watched {
+			return
+		}
+
+		// Changes made inside before it was watched went unseen
+		entries := w.addTree(p)
+		if change.state == watchedMoved {
+			return
+		}
+		if change.state != watchedDir {
+			w.report(p, FileEvent{Type: EventCreate, IsDir: true})
+		}
+		w.reportEntries(p, entries)
+
+	case info.Mode().IsRegular():
+		w.mu.Lock()
+		made := w.madeLocked(p, fileETag(info))
+		w.mu.Unlock()
+		if made {
+			return
+		}
+		event := FileEvent{Type: EventModify}
+		if created {
+			event.Type = EventCreate
+		}
+		w.report(p, event)
+	}
+}
+
+// reportEntries reports the items found in a folder that started being
+// watched, but for those the server made or moved there itself, and the items
+// the server made there that are gone already
+func (w *Watcher) reportEntries(dir string, entries []watchEntry) {
+	found := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		found[entry.path] = true
+	}
+	var gone []watchEntry
+	w.mu.Lock()
+	for p, change := range w.recent {
+		if p != dir && isWithinDir(dir, p) && change.state != "" && !found[p] {
+			gone = append(gone, watchEntry{path: p, isDir: change.state == watchedDir || change.state == watchedMoved})
+		}
+	}
+	w.mu.Unlock()
+	sort.Slice(gone, func(i, j int) bool { return gone[i].path < gone[j].path })
+	for _, entry := range gone {
+		// Made after the walk, or went with a folder reported already
+		if _, err := os.Lstat(entry.path); err == nil {
+			continue
+		}
+		w.mu.Lock()
+		deleted := w.deletedLocked(entry.path)
+		w.mu.Unlock()
+		if !deleted {
+			w.report(entry.path, FileEvent{Type: EventDelete, IsDir: entry.isDir})
+		}
+	}
+
+	var moved []string
+	for _, entry := range entries {
+		if len(moved) > 0 && isWithinDir(moved[len(moved)-1], entry.path) {
+			continue
+		}
+
+		w.mu.Lock()
+		change, known := w.recent[entry.path]
+		w.mu.Unlock()
+
+		event := FileEvent{Type: EventCreate, IsDir: entry.isDir}
+		if entry.isDir {
+			if change.state == watchedMoved {
+				moved = append(moved, entry.path)
+				continue
+			}
+			if change.state == watchedDir {
+				continue
+			}
+		} else {
+			info, err := os.Lstat(entry.path)
+			if err != nil || change.state == fileETag(info) {
+				continue
+			}
+			if known && change.state != "" {
+				event.Type = EventModify
+			}
+		}
+		w.report(entry.path, event)
+	}
+}
+
+// report emits the event of an item changed outside of the server
+func (w *Watcher) report(p string, event FileEvent) {
+	rel, err := filepath.Rel(w.baseDir, p)
+	if err != nil {
+		return
+	}
+	owner, itemPath, found := strings.Cut(filepath.ToSlash(rel), "/")
+	if !found {
+		// User directories themselves aren't items
+		return
+	}
+
+	event.Username = owner
+	event.Path = itemPath
+	w.fileManager.emit(event)
+	w.fileManager.usage.Forget(owner)
+}
+
+// remember records what the server's own changes left, so that watching
+// doesn't report them again
+func (w *Watcher) remember(event FileEvent) {
+	full := filepath.Join(w.baseDir, event.Username, filepath.FromSlash(event.Path))
+	now := time.Now()
+
+	if event.Type == EventRename {
+		old := filepath.Join(w.baseDir, event.Username, filepath.FromSlash(event.OldPath))
+		if event.IsDir {
+			w.unwatchTree(old)
+		}
+		w.mu.Lock()
+		w.recent[old] = recentChange{at: now}
+		w.mu.Unlock()
+	}
+
+	var state string
+	switch {
+	case event.Type == EventDelete:
+		if event.IsDir {
+			w.unwatchTree(full)
+		}
+	case event.IsDir && event.Type == EventRename:
+		state = watchedMoved
+	case event.IsDir:
+		state = watchedDir
+	default:
+		info, err := os.Stat(full)
+		if err != nil {
+			return
+		}
+		state = fileETag(info)
+	}
+
+	w.mu.Lock()
+	w.recent[full] = recentChange{state: state, at: now}
+	w.mu.Unlock()
+}
+
+// madeLocked reports whether the server itself left path in state (caller must hold w.mu)
+func (w *Watcher) madeLocked(p, state string) bool {
+	change, ok := w.recent[p]
+	return ok && change.state == state
+}
+
+// deletedLocked reports whether path or one of its parents was deleted
+// recently, so that the items inside deleted folders aren't reported one by
+// one (caller must hold w.mu)
+func (w *Watcher) deletedLocked(p string) bool {
+	for ; isWithinDir(w.baseDir, p) && p != w.baseDir; p = filepath.Dir(p) {
+		if change, ok := w.recent[p]; ok && change.state == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// addTree watches a folder and the folders below it, returning the items found below it
+func (w *Watcher) addTree(root string) []watchEntry {
+	var entries []watchEntry
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Gone in the meantime or unreadable, there's nothing to watch
+			return nil
+		}
+		if p != w.baseDir && w.ignored(p) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			if err := w.watcher.Add(p); err != nil {
+				w.mu.Lock()
+				if !w.warned {
+					log.Printf("File watcher: can't watch %s, changes made outside of the server may be missed: %v", p, err)
+					w.warned = true
+				}
+				w.mu.Unlock()
+			} else {
+				w.mu.Lock()
+				w.dirs[p] = true
+				w.mu.Unlock()
+			}
+		}
+		if p != root && (d.IsDir() || d.Type().IsRegular()) {
+			entries = append(entries, watchEntry{path: p, isDir: d.IsDir()})
+		}
+		return nil
+	})
+	return entries
+}
+
+// unwatchTree stops watching a folder and the folders below it
+func (w *Watcher) unwatchTree(root string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for p := range w.dirs {
+		if isWithinDir(root, p) {
+			delete(w.dirs, p)
+			// Deleted folders aren't watched anymore already
+			w.watcher.Remove(p)
+		}
+	}
+}
+
+// ignored reports whether a path is outside of the user directories or
+// belongs to the server's temporary files
+func (w *Watcher) ignored(p string) bool {
+	rel, err := filepath.Rel(w.baseDir, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return true
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(name, uploadTempPrefix) {
+			return true
+		}
+	}
+	return false
+}
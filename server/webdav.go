@@ -0,0 +1,550 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davPrefix is where the WebDAV tree of the signed in user is served
+const davPrefix = "/dav"
+
+// HandleDAV serves the user's tree over WebDAV (class 1 and 2) under /dav/.
+// Clients sign in with Basic auth, using their password or one of their API
+// keys as password, or send an API key as bearer token.
+func (h *APIHandler) HandleDAV(w http.ResponseWriter, r *http.Request) {
+	username, ok := h.davUser(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="GoCloud", charset="UTF-8"`)
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	fs := &davFS{h: h, username: username, protocol: AuditWebDAV}
+	if status := fs.precheck(r); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: fs,
+		LockSystem: h.davLockSystem(username),
+	}
+	resp := &davResponse{ResponseWriter: w, fs: fs}
+	handler.ServeHTTP(resp, r)
+
+	// Files are opened to describe them as well, so downloads are only told
+	// apart once they were answered
+	if r.Method == http.MethodGet && resp.status >= 200 && resp.status < 300 {
+		fs.auditRead(strings.TrimPrefix(r.URL.Path, davPrefix))
+	}
+}
+
+// davResponse answers 507 rather than the 405 the webdav package sends when
+// an upload of unknown size runs out of quota on the way, and keeps the status
+// it answered with
+type davResponse struct {
+	http.ResponseWriter
+	fs     *davFS
+	status int
+}
+
+func (w *davResponse) WriteHeader(status int) {
+	if status == http.StatusMethodNotAllowed && w.fs.quotaExceeded {
+		status = http.StatusInsufficientStorage
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *davResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// davUser returns the user a WebDAV request is signed in as
+func (h *APIHandler) davUser(r *http.Request) (string, bool) {
+	if username, password, ok := r.BasicAuth(); ok {
+		return username, h.authManager.AuthenticateSecret(username, password)
+	}
+	if key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return h.authManager.AuthenticateKey(key)
+	}
+	return "", false
+}
+
+// davLockSystem returns the WebDAV locks of a user. Every user has their own,
+// since the same path leads to different items for different users.
+func (h *APIHandler) davLockSystem(username string) webdav.LockSystem {
+	ls, _ := h.davLocks.LoadOrStore(username, webdav.NewMemLS())
+	return ls.(webdav.LockSystem)
+}
+
+// davFS is a user's tree as WebDAV clients see it: their own files, with the
+// folders shared with them and their team spaces in the same virtual folders
+// as in the dashboard. Everything goes through the ACLs and FileManager like
+// the HTTP API, so the same path checks, access rules and quotas apply.
+type davFS struct {
+	h             *APIHandler
+	username      string
+	protocol      string // AuditWebDAV or AuditSFTP, for the audit log
+	quotaExceeded bool   // An upload of the request didn't fit in the quota
+}
+
+// davNode is the item a WebDAV path points to
+type davNode struct {
+	loc  *Location // Folder holding the item, or the item itself when name is ""
+	name string
+}
+
+// writable reports whether the item may be created, replaced, moved or
+// deleted. Home folders, virtual folders, shared folders and spaces can't.
+func (n *davNode) writable() bool {
+	return n.name != "" && n.loc.Allows(AccessWrite)
+}
+
+// node resolves a WebDAV path of the user
+func (fs *davFS) node(name string) (*davNode, error) {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	loc, err := fs.h.acls.Resolve(fs.username, p)
+	if errors.Is(err, ErrAccessDenied) {
+		return nil, os.ErrPermission
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p == "" || loc.Owner == "" || loc.view != "" && loc.Path == loc.root {
+		return &davNode{loc: loc}, nil
+	}
+
+	parent := *loc
+	parent.Path = path.Dir(loc.Path)
+	if parent.Path == "." {
+		parent.Path = ""
+	}
+	parent.Access = fs.h.acls.Access(fs.username, loc.Owner, parent.Path)
+	return &davNode{loc: &parent, name: path.Base(loc.Path)}, nil
+}
+
+// audit records an operation on a node in the audit log
+func (fs *davFS) audit(action string, n *davNode, target string, err error) {
+	fs.h.audit.Record(AuditEntry{
+		Protocol: fs.protocol,
+		User:     fs.username,
+		Action:   action,
+		Owner:    n.loc.Owner,
+		Path:     auditPath(n.loc.Path, n.name),
+		Target:   target,
+	}, err)
+}
+
+// auditRead records the download of the file at a path of the user
+func (fs *davFS) auditRead(name string) {
+	n, err := fs.node(name)
+	if err != nil || n.loc.Owner == "" {
+		return
+	}
+	fs.audit(AuditDownload, n, "", nil)
+}
+
+// fullPath returns where a node of a real folder is stored
+func (fs *davFS) fullPath(n *davNode) (string, error) {
+	if n.name == "" {
+		return fs.h.fileManager.resolvePath(n.loc.Owner, n.loc.Path)
+	}
+	return fs.h.fileManager.resolveItem(n.loc.Owner, n.loc.Path, n.name)
+}
+
+// precheck refuses writes the user's access doesn't allow, and uploads that
+// don't fit in the quota, before anything is written. It returns the status
+// to answer with, 0 to go on. The webdav package would report most refused
+// writes as missing resources.
+func (fs *davFS) precheck(r *http.Request) int {
+	var targets []string
+	switch r.Method {
+	case http.MethodPut, "MKCOL", http.MethodDelete:
+		targets = []string{r.URL.Path}
+	case "MOVE", "COPY":
+		if r.Method == "MOVE" {
+			targets = append(targets, r.URL.Path)
+		}
+		if u, err := url.Parse(r.Header.Get("Destination")); err == nil {
+			targets = append(targets, u.Path)
+		}
+	}
+
+	for _, target := range targets {
+		name, found := strings.CutPrefix(target, davPrefix)
+		if !found {
+			continue
+		}
+		n, err := fs.node(name)
+		switch {
+		case errors.Is(err, os.ErrPermission):
+			return http.StatusForbidden
+		case err != nil:
+			// Reported by the webdav package
+			continue
+		case !n.writable():
+			return http.StatusForbidden
+		}
+
+		if r.Method == http.MethodPut && r.ContentLength > 0 {
+			used, quota, err := fs.h.fileManager.GetUsage(n.loc.Owner)
+			if err == nil && quota > 0 && used+r.ContentLength > quota {
+				return http.StatusInsufficientStorage
+			}
+		}
+	}
+	return 0
+}
+
+// Mkdir creates a folder, in an existing folder
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	n, err := fs.node(name)
+	if err != nil {
+		return err
+	}
+	if !n.writable() {
+		return os.ErrPermission
+	}
+	fullPath, err := fs.fullPath(n)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(fullPath); err == nil {
+		return os.ErrExist
+	}
+	if _, err := os.Stat(filepath.Dir(fullPath)); err != nil {
+		return err
+	}
+	err = fs.h.fileManager.CreateFolder(n.loc.Owner, n.loc.Path, n.name)
+	fs.audit(AuditMkdir, n, "", err)
+	return err
+}
+
+// OpenFile opens a file or folder for reading, or a file for writing: its
+// content is then replaced with what is written, once the file is closed
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	n, err := fs.node(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return fs.create(n)
+	}
+
+	if n.loc.Owner == "" {
+		entries, err := fs.readDir(n.loc)
+		if err != nil {
+			return nil, err
+		}
+		return &davDir{info: virtualInfo(n.loc.Path), entries: entries}, nil
+	}
+
+	fullPath, err := fs.fullPath(n)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		folder := *n.loc
+		if n.name != "" {
+			folder.Path = path.Join(n.loc.Path, n.name)
+		}
+		entries, err := fs.readDir(&folder)
+		if err != nil {
+			return nil, err
+		}
+		return &davDir{info: fs.info(fullPath, info), entries: entries}, nil
+	}
+
+	file, err := fs.h.fileManager.openFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{file: file, info: fs.info(fullPath, info)}, nil
+}
+
+// create starts replacing the content of a file with SaveFile, which reads
+// what is written to the returned file
+func (fs *davFS) create(n *davNode) (webdav.File, error) {
+	if !n.writable() {
+		return nil, os.ErrPermission
+	}
+	fullPath, err := fs.fullPath(n)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+		return nil, errors.New("a folder with that name already exists")
+	}
+	if _, err := os.Stat(filepath.Dir(fullPath)); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	w := &davWriter{pw: pw, done: make(chan error, 1), info: &davInfo{name: n.name, modTime: time.Now()}}
+	go func() {
+		_, _, err := fs.h.fileManager.SaveFile(n.loc.Owner, n.loc.Path, n.name, pr, SaveOptions{})
+		fs.audit(AuditUpload, n, "", err)
+		pr.CloseWithError(err)
+		if errors.Is(err, ErrQuotaExceeded) {
+			fs.quotaExceeded = true
+		}
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// RemoveAll deletes a file or folder
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	n, err := fs.node(name)
+	if err != nil {
+		return err
+	}
+	if !n.writable() {
+		return os.ErrPermission
+	}
+	fullPath, err := fs.fullPath(n)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(fullPath); err != nil {
+		return err
+	}
+	err = fs.h.fileManager.DeleteItems(n.loc.Owner, n.loc.Path, []string{n.name})
+	fs.audit(AuditDelete, n, "", err)
+	return err
+}
+
+// Rename moves a file or folder, within the tree that holds it
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	src, err := fs.node(oldName)
+	if err != nil {
+		return err
+	}
+	dst, err := fs.node(newName)
+	if err != nil {
+		return err
+	}
+	if !src.writable() || !dst.writable() {
+		return os.ErrPermission
+	}
+	if src.loc.Owner != dst.loc.Owner {
+		return errors.New("items can only be moved within the tree that holds them")
+	}
+	err = fs.h.fileManager.MoveItem(src.loc.Owner, src.loc.Path, src.name, dst.loc.Path, dst.name)
+	fs.audit(AuditMove, src, auditPath(dst.loc.Path, dst.name), err)
+	return err
+}
+
+// Stat describes a file or folder
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fs.node(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.loc.Owner == "" {
+		return virtualInfo(n.loc.Path), nil
+	}
+
+	fullPath, err := fs.fullPath(n)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return fs.info(fullPath, info), nil
+}
+
+// info describes a stored item, with the size of its content
+func (fs *davFS) info(fullPath string, info os.FileInfo) *davInfo {
+	return &davInfo{
+		name:    info.Name(),
+		size:    fs.h.fileManager.fileSize(fullPath, info),
+		modTime: info.ModTime(),
+		dir:     info.IsDir(),
+	}
+}
+
+// readDir lists a folder the way the dashboard does, virtual folders included
+func (fs *davFS) readDir(loc *Location) ([]os.FileInfo, error) {
+	opts := DefaultListOptions
+	opts.Limit = 0
+
+	var page *ListPage
+	var err error
+	switch {
+	case loc.view == SpacesRoot:
+		page, err = fs.h.listSpaces(fs.username, opts)
+	case loc.Owner == "":
+		page, err = fs.h.listShared(fs.username, loc, opts)
+	default:
+		page, err = fs.h.fileManager.ListFilesPage(loc.Owner, loc.Path, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := page.Items
+	if loc.Owner == fs.username && loc.Path == "" {
+		for _, item := range []*FileItem{fs.h.sharedRootItem(fs.username), fs.h.spacesRootItem(fs.username)} {
+			if item != nil {
+				items = append(items, *item)
+			}
+		}
+	}
+
+	infos := make([]os.FileInfo, 0, len(items))
+	for _, item := range items {
+		modTime, _ := time.Parse(time.RFC3339Nano, item.ModifiedAt)
+		infos = append(infos, &davInfo{
+			name:    item.Name,
+			size:    item.Bytes,
+			modTime: modTime,
+			dir:     item.Type == "folder",
+		})
+	}
+	return infos, nil
+}
+
+// virtualInfo describes a virtual folder
+func virtualInfo(folder string) *davInfo {
+	return &davInfo{name: path.Base(folder), modTime: time.Now(), dir: true}
+}
+
+// davInfo describes an item to WebDAV clients, files with the size of their
+// content rather than the size they take on disk
+type davInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *davInfo) Name() string       { return fi.name }
+func (fi *davInfo) Size() int64        { return fi.size }
+func (fi *davInfo) ModTime() time.Time { return fi.modTime }
+func (fi *davInfo) IsDir() bool        { return fi.dir }
+func (fi *davInfo) Sys() interface{}   { return nil }
+
+func (fi *davInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// davFile is a file opened for reading
+type davFile struct {
+	file storedFile
+	info *davInfo
+}
+
+func (f *davFile) Read(p []byte) (int, error) { return f.file.Read(p) }
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+func (f *davFile) Close() error                             { return f.file.Close() }
+func (f *davFile) Stat() (os.FileInfo, error)               { return f.info, nil }
+func (f *davFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) { return nil, errors.New("not a folder") }
+
+// davDir is a folder opened for listing
+type davDir struct {
+	info    *davInfo
+	entries []os.FileInfo
+	pos     int
+}
+
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, errors.New("is a folder") }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, errors.New("is a folder") }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+// Readdir returns the next count entries, or all the remaining ones if count <= 0
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.entries[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	d.pos += n
+	return rest[:n], nil
+}
+
+// davWriter is a file opened for writing, whose content SaveFile reads.
+// Nothing is saved unless everything was copied in.
+type davWriter struct {
+	pw     *io.PipeWriter
+	done   chan error // Result of SaveFile
+	info   *davInfo
+	failed error // Error reading what was being copied in
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.info.size += int64(n)
+	return n, err
+}
+
+// ReadFrom copies src in, noting whether reading it failed. io.Copy uses it
+// for the request bodies of uploads and the files being copied.
+func (w *davWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(writerOnly{w}, src)
+	if err != nil && w.failed == nil {
+		w.failed = err
+	}
+	return n, err
+}
+
+// Close saves the file, or discards it if copying it in failed
+func (w *davWriter) Close() error {
+	if w.failed != nil {
+		w.pw.CloseWithError(w.failed)
+		<-w.done
+		return w.failed
+	}
+	w.pw.Close()
+	return <-w.done
+}
+
+func (w *davWriter) Read(p []byte) (int, error) { return 0, errors.New("file is open for writing") }
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("file is open for writing")
+}
+func (w *davWriter) Stat() (os.FileInfo, error) { return w.info, nil }
+func (w *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a folder")
+}
+
+// writerOnly hides the ReadFrom method of a writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// davRequest sends a WebDAV request signed in as alice
+func davRequest(h *APIHandler, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.SetBasicAuth("alice", "alicepass1")
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.HandleDAV(w, r)
+	return w
+}
+
+func TestWebDAV(t *testing.T) {
+	h := newTestAPIHandler(t)
+	sharedRootURL := (&url.URL{Path: SharedRoot}).EscapedPath()
+
+	r := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	r.SetBasicAuth("alice", "wrong password")
+	w := httptest.NewRecorder()
+	h.HandleDAV(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("wrong password: status %d", w.Code)
+	}
+
+	for _, step := range []struct {
+		method, target string
+		header         map[string]string
+		body           string
+		want           int
+	}{
+		{"MKCOL", "/dav/docs", nil, "", http.StatusCreated},
+		{"PUT", "/dav/docs/plan.txt", nil, "the plan", http.StatusCreated},
+		// Parents are never created implicitly
+		{"PUT", "/dav/missing/plan.txt", nil, "the plan", http.StatusConflict},
+		{"MOVE", "/dav/docs/plan.txt", map[string]string{"Destination": "/dav/plan.txt"}, "", http.StatusCreated},
+		{"COPY", "/dav/plan.txt", map[string]string{"Destination": "/dav/docs/copy.txt"}, "", http.StatusCreated},
+		// Paths can't leave the user's tree
+		{"PUT", "/dav/../escaped.txt", nil, "x", http.StatusCreated},
+		// Nor can items be written in the virtual folders
+		{"PUT", "/dav/" + sharedRootURL, nil, "x", http.StatusForbidden},
+		{"DELETE", "/dav/" + sharedRootURL, nil, "", http.StatusForbidden},
+		{"DELETE", "/dav/docs", nil, "", http.StatusNoContent},
+	} {
+		if w := davRequest(h, step.method, step.target, step.header, step.body); w.Code != step.want {
+			t.Fatalf("%s %s: got %d, want %d", step.method, step.target, w.Code, step.want)
+		}
+	}
+
+	aliceDir := filepath.Join(h.fileManager.baseDir, "alice")
+	if content, err := os.ReadFile(filepath.Join(aliceDir, "plan.txt")); err != nil || string(content) != "the plan" {
+		t.Errorf("moved file: %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(aliceDir, "escaped.txt")); err != nil {
+		t.Errorf("file written at the top of the tree: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(aliceDir, "docs")); !os.IsNotExist(err) {
+		t.Errorf("deleted folder: %v", err)
+	}
+
+	w = davRequest(h, "PROPFIND", "/dav/", map[string]string{"Depth": "1"}, "")
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "/dav/plan.txt") {
+		t.Errorf("listing: status %d %s", w.Code, w.Body)
+	}
+	if w := davRequest(h, "GET", "/dav/plan.txt", nil, ""); w.Code != http.StatusOK || w.Body.String() != "the plan" {
+		t.Errorf("download: status %d %q", w.Code, w.Body)
+	}
+
+	// Uploads that don't fit are refused before they are written
+	if err := h.authManager.SetQuota("alice", 40); err != nil {
+		t.Fatal(err)
+	}
+	if w := davRequest(h, "PUT", "/dav/big.txt", nil, strings.Repeat("x", 100)); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload over the quota: status %d, want 507", w.Code)
+	}
+}
@@ -1,8 +1,16 @@
 document.addEventListener('DOMContentLoaded', function() {
     let currentPath = 'root';
+    let spaces = [];
     let selectedItems = new Set();
     let searchQuery = '';
+    let sortField = 'name';
+    let sortOrder = 'asc';
+    let nextCursor = '';
+    let searchMode = false;
+    let searchController = null;
+    const PAGE_SIZE = 200;
     let allFolders = new Set();
+    let itemETags = new Map();
     
     const token = localStorage.getItem('authToken');
     const username = localStorage.getItem('username');
@@ -48,7 +56,7 @@ document.addEventListener('DOMContentLoaded', function() {
             }
         };
         
-        const response = await fetch(endpoint, { ...defaultOptions, ...options });
+        const response = await fetch(endpoint, { ...options, headers: defaultOptions.headers });
         return response;
     }
 
@@ -83,20 +91,136 @@ document.addEventListener('DOMContentLoaded', function() {
     }
 
     function handleItemClick(item) {
-        if (item.type === 'folder') {
-            currentPath = item.name;
-            selectedItems.clear();
-            updateSelectionCount();
-            loadFiles();
-            updateBreadcrumb();
-            updateSidebar();
+        // Search results open the folder that contains them
+        if (searchMode && item.type === 'file') {
+            const parent = (item.path || '').split('/').slice(0, -1).join('/');
+            exitSearchMode();
+            currentPath = parent || 'root';
+        } else if (item.type === 'folder') {
+            exitSearchMode();
+            currentPath = item.path || item.name;
+        } else {
+            openPreview(item);
+            return;
+        }
+        selectedItems.clear();
+        updateSelectionCount();
+        loadFiles();
+        updateBreadcrumb();
+        updateSidebar();
+    }
+
+    function exitSearchMode() {
+        if (searchController) {
+            searchController.abort();
+            searchController = null;
+        }
+        searchMode = false;
+    }
+
+    async function searchEverywhere(query) {
+        exitSearchMode();
+        searchMode = true;
+        searchController = new AbortController();
+        const signal = searchController.signal;
+
+        document.getElementById('fileGrid').innerHTML = '';
+        document.getElementById('loadMoreBtn').style.display = 'none';
+
+        try {
+            const response = await fetch(`/api/files/search?q=${encodeURIComponent(query)}`, {
+                headers: { 'Authorization': `Bearer ${token}` },
+                signal: signal
+            });
+            if (!response.ok) {
+                const data = await response.json();
+                showToast('Error', data.error || 'Error searching files', 'destructive');
+                return;
+            }
+
+            // Results are newline delimited JSON, rendered as they arrive
+            const reader = response.body.getReader();
+            const decoder = new TextDecoder();
+            let buffer = '';
+            let found = 0;
+            let summary = null;
+            while (true) {
+                const { done, value } = await reader.read();
+                if (done) break;
+
+                buffer += decoder.decode(value, { stream: true });
+                const lines = buffer.split('\n');
+                buffer = lines.pop();
+
+                const messages = lines.filter(line => line.trim()).map(line => JSON.parse(line));
+                const items = messages.filter(message => message.item).map(message => message.item);
+                summary = messages.find(message => message.done) || summary;
+                if (items.length > 0) {
+                    renderFilesList(items, found > 0);
+                    found += items.length;
+                }
+            }
+
+            if (found === 0) {
+                renderFilesList([], false);
+            }
+            if (summary && summary.truncated) {
+                showToast('Search', `Showing the first ${summary.count} results`);
+            }
+        } catch (error) {
+            if (error.name !== 'AbortError') {
+                showToast('Error', 'Error searching files', 'destructive');
+            }
+        }
+    }
+
+    async function searchContents(query) {
+        exitSearchMode();
+        searchMode = true;
+        document.getElementById('loadMoreBtn').style.display = 'none';
+
+        try {
+            const response = await fetch(`/api/search?q=${encodeURIComponent(query)}`, {
+                headers: { 'Authorization': `Bearer ${token}` }
+            });
+            const data = await response.json();
+            if (!data.success) {
+                showToast('Error', data.error || 'Error searching file contents', 'destructive');
+                return;
+            }
+
+            // Snippets are escaped by the server, only the highlighting is markup
+            const items = data.results.map(result => ({ ...result.item, snippet: result.snippet }));
+            renderFilesList(items, false);
+            if (data.total > items.length) {
+                showToast('Search', `Showing the best ${items.length} of ${data.total} results`);
+            }
+        } catch (error) {
+            showToast('Error', 'Error searching file contents', 'destructive');
         }
     }
 
-    async function loadFiles() {
+    async function loadFiles(append = false) {
+        if (!append) {
+            watchFolder();
+        }
         try {
             const pathParam = currentPath === 'root' ? '' : currentPath;
-            const response = await apiCall(`/api/files?path=${encodeURIComponent(pathParam)}`);
+            const params = new URLSearchParams({
+                path: pathParam,
+                limit: PAGE_SIZE,
+                sort: sortField,
+                order: sortOrder
+            });
+            if (searchQuery) {
+                // Escape glob characters so the query is matched literally
+                params.set('pattern', `*${searchQuery.replace(/[\\*?[\]]/g, '\\$&')}*`);
+            }
+            if (append && nextCursor) {
+                params.set('cursor', nextCursor);
+            }
+
+            const response = await apiCall(`/api/files?${params}`);
             
             if (!response.ok) {
                 if (response.status === 401) {
@@ -108,14 +232,99 @@ document.addEventListener('DOMContentLoaded', function() {
             
             const data = await response.json();
             if (data.success && data.items) {
-                renderFilesList(data.items);
+                renderFilesList(data.items, append);
+                nextCursor = data.nextCursor || '';
+                document.getElementById('loadMoreBtn').style.display = nextCursor ? 'block' : 'none';
             }
+            loadUsage();
         } catch (error) {
             showToast('Error', 'Error loading files', 'destructive');
             console.error(error);
         }
     }
 
+    async function loadUsage() {
+        try {
+            const response = await apiCall('/api/account/usage');
+            if (!response.ok) return;
+
+            const data = await response.json();
+            if (!data.success) return;
+
+            const usageText = document.getElementById('usageText');
+            const usageBarFill = document.getElementById('usageBarFill');
+
+            if (data.quota > 0) {
+                const percent = Math.min(100, (data.used / data.quota) * 100);
+                usageText.textContent = `${data.usedFormatted} / ${data.quotaFormatted}`;
+                usageBarFill.style.width = `${percent}%`;
+                usageBarFill.classList.toggle('full', percent >= 90);
+            } else {
+                usageText.textContent = `${data.usedFormatted} used`;
+                usageBarFill.style.width = '0';
+                usageBarFill.classList.remove('full');
+            }
+        } catch (error) {
+            console.error(error);
+        }
+    }
+
+    // Changes made to the open folder elsewhere, by other people or on other
+    // devices, are streamed by the server and reload the listing
+    let folderEvents = null;
+    let watchedPath = null;
+    let reloadTimer = null;
+
+    function watchFolder() {
+        if (folderEvents && watchedPath === currentPath) return;
+        if (folderEvents) folderEvents.close();
+
+        watchedPath = currentPath;
+        const params = new URLSearchParams({
+            path: currentPath === 'root' ? '' : currentPath,
+            token: token
+        });
+        folderEvents = new EventSource(`/api/events?${params}`);
+
+        let connected = false;
+        folderEvents.addEventListener('ready', () => {
+            // Changes made while reconnecting were missed
+            if (connected) scheduleReload();
+            connected = true;
+        });
+        folderEvents.addEventListener('change', (e) => {
+            const change = JSON.parse(e.data);
+            if (change.type === 'delete') {
+                selectedItems.delete(change.path);
+            } else if (change.type === 'rename' && change.oldPath && selectedItems.delete(change.oldPath)) {
+                selectedItems.add(change.path);
+            }
+            scheduleReload();
+        });
+        folderEvents.addEventListener('reset', scheduleReload);
+        folderEvents.addEventListener('gone', () => {
+            folderEvents.close();
+            folderEvents = null;
+            showToast('Folder removed', 'The folder was moved or deleted elsewhere');
+            currentPath = 'root';
+            selectedItems.clear();
+            updateSelectionCount();
+            loadFiles();
+            updateBreadcrumb();
+            updateSidebar();
+        });
+    }
+
+    function scheduleReload() {
+        clearTimeout(reloadTimer);
+        reloadTimer = setTimeout(() => {
+            // Search results aren't the folder's listing, they stay as they are
+            if (searchMode) return;
+            updateSelectionCount();
+            loadFiles();
+        }, 300);
+    }
+
     function updateBreadcrumb() {
         const breadcrumb = document.getElementById('breadcrumb');
         const pathParts = currentPath === 'root' ? ['Home'] : ['Home', currentPath];
@@ -170,10 +379,8 @@ document.addEventListener('DOMContentLoaded', function() {
             const button = document.createElement('button');
             button.className = `sidebar-button ${currentPath === folderName ? 'active' : ''}`;
             button.setAttribute('data-path', folderName);
-            button.innerHTML = `
-                <img src="gopher-logo.jpg" alt="" class="sidebar-icon">
-                ${folderName}
-            `;
+            button.innerHTML = '<img src="gopher-logo.jpg" alt="" class="sidebar-icon">';
+            button.append(folderName);
             button.onclick = () => {
                 currentPath = folderName;
                 selectedItems.clear();
@@ -184,24 +391,74 @@ document.addEventListener('DOMContentLoaded', function() {
             };
             sidebarFolders.appendChild(button);
         });
+
+        document.getElementById('sidebarSpaces').style.display = spaces.length ? '' : 'none';
+        const sidebarSpaces = document.getElementById('sidebarSpacesList');
+        sidebarSpaces.innerHTML = '';
+
+        spaces.forEach(space => {
+            const inSpace = currentPath === space.path || currentPath.startsWith(space.path + '/');
+            const button = document.createElement('button');
+            button.className = `sidebar-button ${inSpace ? 'active' : ''}`;
+            button.setAttribute('data-path', space.path);
+            button.title = space.quota > 0
+                ? `${formatBytes(space.used)} of ${formatBytes(space.quota)} used`
+                : `${formatBytes(space.used)} used`;
+            button.innerHTML = `
+                <svg class="sidebar-icon" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round">
+                    <path d="M17 21v-2a4 4 0 0 0-4-4H5a4 4 0 0 0-4 4v2"></path>
+                    <circle cx="9" cy="7" r="4"></circle>
+                    <path d="M23 21v-2a4 4 0 0 0-3-3.87"></path>
+                    <path d="M16 3.13a4 4 0 0 1 0 7.75"></path>
+                </svg>
+            `;
+            button.append(space.name);
+            button.onclick = () => {
+                currentPath = space.path;
+                selectedItems.clear();
+                updateSelectionCount();
+                loadFiles();
+                updateBreadcrumb();
+                updateSidebar();
+            };
+            sidebarSpaces.appendChild(button);
+        });
     }
 
-    function renderFilesList(items) {
+    // The spaces of the user's groups are listed below their folders
+    async function loadSpaces() {
+        try {
+            const response = await apiCall('/api/spaces');
+            if (!response.ok) return;
+
+            const data = await response.json();
+            if (!data.success) return;
+
+            spaces = data.spaces;
+            updateSidebar();
+        } catch (error) {
+            console.error(error);
+        }
+    }
+
+    function renderFilesList(items, append = false) {
         const fileGrid = document.getElementById('fileGrid');
         const emptyState = document.getElementById('emptyState');
         
+        if (!append) {
+            itemETags.clear();
+        }
         items.forEach(item => {
             if (item.type === 'folder') {
                 allFolders.add(item.name);
             }
+            if (item.etag) {
+                itemETags.set(item.name, item.etag);
+            }
         });
         updateSidebar();
-        
-        const filteredItems = items.filter(item =>
-            item.name.toLowerCase().includes(searchQuery.toLowerCase())
-        );
 
-        if (filteredItems.length === 0) {
+        if (!append && items.length === 0) {
             fileGrid.style.display = 'none';
             emptyState.style.display = 'block';
             return;
@@ -209,48 +466,90 @@ document.addEventListener('DOMContentLoaded', function() {
 
         fileGrid.style.display = 'grid';
         emptyState.style.display = 'none';
-        fileGrid.innerHTML = '';
+        if (!append) {
+            fileGrid.innerHTML = '';
+        }
 
-        filteredItems.forEach(item => {
+        items.forEach(item => {
             const fileItem = document.createElement('div');
             const isSelected = selectedItems.has(item.name);
             fileItem.className = `file-item ${isSelected ? 'selected' : ''}`;
+            if (item.modifiedAt) {
+                fileItem.title = `Modified ${new Date(item.modifiedAt).toLocaleString()}`;
+            }
             fileItem.onclick = (e) => {
                 if (!e.target.closest('.file-item-menu') && !e.target.closest('.dropdown-menu')) {
                     handleItemClick(item);
                 }
             };
 
-            fileItem.innerHTML = `
-                <div class="file-item-content">
-                    <button class="file-item-menu" onclick="event.stopPropagation(); showDropdown(event, '${item.id}', '${item.name}', '${item.type}')">
-                        <svg class="btn-icon icon-more-vertical" viewBox="0 0 24 24">
-                            <circle cx="12" cy="12" r="1"></circle>
-                            <circle cx="12" cy="5" r="1"></circle>
-                            <circle cx="12" cy="19" r="1"></circle>
-                        </svg>
-                    </button>
-                    ${item.type === 'folder' 
-                        ? `<img src="gopher-logo.jpg" alt="Folder" class="file-icon">`
-                        : `<svg class="file-icon-svg icon-file" viewBox="0 0 24 24">
-                            <path d="M13 2H6a2 2 0 0 0-2 2v16a2 2 0 0 0 2 2h12a2 2 0 0 0 2-2V9z"></path>
-                            <polyline points="13 2 13 9 20 9"></polyline>
-                        </svg>`
-                    }
-                    <div class="text-center w-100">
-                        <p class="file-name">${item.name}</p>
-                        <p class="file-meta">${item.size || item.modified}</p>
-                    </div>
-                </div>
-            `;
+            // Names come from other users too, so they only ever go in as text
+            const content = document.createElement('div');
+            content.className = 'file-item-content';
+            if (!searchMode) {
+                const menuButton = document.createElement('button');
+                menuButton.className = 'file-item-menu';
+                menuButton.innerHTML = `<svg class="btn-icon icon-more-vertical" viewBox="0 0 24 24">
+                        <circle cx="12" cy="12" r="1"></circle>
+                        <circle cx="12" cy="5" r="1"></circle>
+                        <circle cx="12" cy="19" r="1"></circle>
+                    </svg>`;
+                menuButton.onclick = (e) => {
+                    e.stopPropagation();
+                    showDropdown(e, item.id, item.name, item.type);
+                };
+                content.appendChild(menuButton);
+            }
+
+            if (item.type === 'folder') {
+                content.insertAdjacentHTML('beforeend', '<img src="gopher-logo.jpg" alt="Folder" class="file-icon">');
+            } else {
+                content.insertAdjacentHTML('beforeend', `<svg class="file-icon-svg icon-file" viewBox="0 0 24 24">
+                        <path d="M13 2H6a2 2 0 0 0-2 2v16a2 2 0 0 0 2 2h12a2 2 0 0 0 2-2V9z"></path>
+                        <polyline points="13 2 13 9 20 9"></polyline>
+                    </svg>`);
+                if (isImage(item.name)) {
+                    const icon = content.lastElementChild;
+                    const thumbnail = document.createElement('img');
+                    thumbnail.className = 'file-thumbnail';
+                    thumbnail.alt = '';
+                    thumbnail.loading = 'lazy';
+                    thumbnail.src = thumbnailUrl(item);
+                    thumbnail.onerror = () => {
+                        icon.style.display = '';
+                        thumbnail.remove();
+                    };
+                    icon.style.display = 'none';
+                    icon.before(thumbnail);
+                }
+            }
+
+            const text = document.createElement('div');
+            text.className = 'text-center w-100';
+            const name = document.createElement('p');
+            name.className = 'file-name';
+            name.textContent = item.name;
+            const meta = document.createElement('p');
+            meta.className = 'file-meta';
+            meta.textContent = searchMode ? (item.path || item.name) : (item.size || item.modified);
+            text.append(name, meta);
+            if (item.snippet) {
+                // Escaped by the server, only the matches are marked up
+                const snippet = document.createElement('p');
+                snippet.className = 'file-snippet';
+                snippet.innerHTML = item.snippet;
+                text.appendChild(snippet);
+            }
+            content.appendChild(text);
 
+            fileItem.appendChild(content);
             fileGrid.appendChild(fileItem);
         });
     }
 
     let currentDropdownItem = null;
     
-    window.showDropdown = function(event, itemId, itemName, itemType) {
+    function showDropdown(event, itemId, itemName, itemType) {
         event.stopPropagation();
         const dropdown = document.getElementById('dropdownMenu');
         
@@ -258,6 +557,9 @@ document.addEventListener('DOMContentLoaded', function() {
         const isSelected = selectedItems.has(itemName);
         
         document.getElementById('dropdownSelect').textContent = isSelected ? 'Deselect' : 'Select';
+        document.getElementById('dropdownExtract').style.display =
+            itemType === 'file' && isArchive(itemName) ? 'block' : 'none';
+        document.getElementById('dropdownAccess').style.display = itemType === 'folder' ? 'block' : 'none';
         
         dropdown.style.display = 'block';
         dropdown.style.left = event.pageX + 'px';
@@ -266,7 +568,7 @@ document.addEventListener('DOMContentLoaded', function() {
         setTimeout(() => {
             document.addEventListener('click', closeDropdown);
         }, 0);
-    };
+    }
 
     function closeDropdown() {
         document.getElementById('dropdownMenu').style.display = 'none';
@@ -296,8 +598,11 @@ document.addEventListener('DOMContentLoaded', function() {
         }
         
         try {
+            // Refuse to rename a file another tab changed meanwhile
+            const etag = itemETags.get(currentDropdownItem.name);
             const response = await apiCall('/api/files/rename', {
                 method: 'POST',
+                headers: etag ? { 'If-Match': etag } : {},
                 body: JSON.stringify({
                     path: currentPath === 'root' ? '' : currentPath,
                     oldName: currentDropdownItem.name,
@@ -308,6 +613,9 @@ document.addEventListener('DOMContentLoaded', function() {
             if (response.ok) {
                 showToast('Renamed', `Renamed to ${newName}`);
                 loadFiles();
+            } else if (response.status === 412) {
+                showToast('Changed', 'The file was changed elsewhere, please check it again', 'destructive');
+                loadFiles();
             } else {
                 const data = await response.json();
                 showToast('Error', data.error || 'Error renaming', 'destructive');
@@ -318,6 +626,508 @@ document.addEventListener('DOMContentLoaded', function() {
         closeDropdown();
     };
 
+    function isImage(name) {
+        return /\.(jpe?g|png|gif|webp)$/i.test(name);
+    }
+
+    // URL of a file endpoint for item, the ETag makes the browser fetch new versions
+    function fileUrl(endpoint, item, extra = {}) {
+        const itemPath = item.path || item.name;
+        const folder = itemPath.includes('/') ? itemPath.slice(0, itemPath.lastIndexOf('/')) : '';
+        const params = new URLSearchParams({ path: folder, name: item.name, token: token, ...extra });
+        if (item.etag) {
+            params.set('v', item.etag);
+        }
+        return `${endpoint}?${params}`;
+    }
+
+    function thumbnailUrl(item) {
+        return fileUrl('/api/files/thumbnail', item, { size: 'medium' });
+    }
+
+    const MAX_EDITABLE_SIZE = 10 * 1024 * 1024;
+    let previewItem = null;
+    let previewETag = '';
+    let previewDirty = false;
+
+    function isEditableType(mimeType) {
+        const type = (mimeType || '').split(';')[0].trim();
+        return type.startsWith('text/') || [
+            'application/json', 'application/javascript', 'application/xml',
+            'application/x-yaml', 'application/yaml', 'application/toml',
+            'application/x-sh', 'image/svg+xml'
+        ].includes(type);
+    }
+
+    // Images and PDFs are shown by the browser, text files open in an editor
+    async function openPreview(item) {
+        const mimeType = (item.mimeType || '').split(';')[0].trim();
+        const body = document.getElementById('previewBody');
+        const saveBtn = document.getElementById('previewSave');
+        body.innerHTML = '';
+        saveBtn.style.display = 'none';
+        previewItem = item;
+        previewDirty = false;
+        document.getElementById('previewTitle').textContent = item.name;
+
+        if (mimeType.startsWith('image/')) {
+            const img = document.createElement('img');
+            img.src = fileUrl('/api/files/content', item);
+            img.alt = item.name;
+            body.appendChild(img);
+        } else if (mimeType === 'application/pdf') {
+            const frame = document.createElement('iframe');
+            frame.src = fileUrl('/api/files/content', item);
+            frame.title = item.name;
+            body.appendChild(frame);
+        } else if (isEditableType(mimeType) && item.bytes <= MAX_EDITABLE_SIZE) {
+            try {
+                const response = await apiCall(fileUrl('/api/files/content', item), { cache: 'no-store' });
+                if (!response.ok) {
+                    throw new Error('Error loading file');
+                }
+                previewETag = response.headers.get('ETag') || '';
+
+                const editor = document.createElement('textarea');
+                editor.className = 'preview-editor';
+                editor.spellcheck = false;
+                editor.value = await response.text();
+                editor.oninput = () => { previewDirty = true; };
+                body.appendChild(editor);
+                saveBtn.style.display = '';
+            } catch (error) {
+                showToast('Error', 'Error loading file', 'destructive');
+                return;
+            }
+        } else {
+            downloadItem(item);
+            return;
+        }
+
+        document.getElementById('previewOverlay').style.display = 'flex';
+    }
+
+    function closePreview() {
+        if (previewDirty && !confirm('Discard unsaved changes?')) {
+            return;
+        }
+        document.getElementById('previewOverlay').style.display = 'none';
+        document.getElementById('previewBody').innerHTML = '';
+        previewItem = null;
+        previewDirty = false;
+    }
+
+    // Saving only succeeds if nobody changed the file since it was opened
+    async function savePreview() {
+        const editor = document.querySelector('#previewBody .preview-editor');
+        if (!previewItem || !editor) return;
+
+        try {
+            const response = await apiCall(fileUrl('/api/files/content', previewItem), {
+                method: 'PUT',
+                headers: { 'Content-Type': 'text/plain; charset=utf-8', 'If-Match': previewETag },
+                body: editor.value
+            });
+
+            if (response.ok) {
+                previewETag = response.headers.get('ETag') || '';
+                previewDirty = false;
+                showToast('Saved', `Saved ${previewItem.name}`);
+                loadFiles();
+            } else if (response.status === 412) {
+                showToast('Changed', 'The file was changed elsewhere, reopen it to see the latest version', 'destructive');
+            } else {
+                const data = await response.json();
+                showToast('Error', data.error || 'Error saving', 'destructive');
+            }
+        } catch (error) {
+            showToast('Error', 'Error saving', 'destructive');
+        }
+    }
+
+    function downloadItem(item) {
+        const itemPath = item.path || item.name;
+        const folder = itemPath.includes('/') ? itemPath.slice(0, itemPath.lastIndexOf('/')) : '';
+        const url = `/api/files/download?path=${encodeURIComponent(folder)}&name=${encodeURIComponent(item.name)}&token=${encodeURIComponent(token)}`;
+        window.open(url, '_blank');
+    }
+
+    document.getElementById('previewClose').onclick = closePreview;
+    document.getElementById('previewSave').onclick = savePreview;
+    document.getElementById('previewDownload').onclick = function() {
+        if (previewItem) downloadItem(previewItem);
+    };
+    document.getElementById('previewOverlay').onclick = function(e) {
+        if (e.target === this) closePreview();
+    };
+    document.addEventListener('keydown', function(e) {
+        if (!previewItem) return;
+        if (e.key === 'Escape') {
+            closePreview();
+        } else if (e.key === 's' && (e.ctrlKey || e.metaKey)) {
+            e.preventDefault();
+            savePreview();
+        }
+    });
+
+    function isArchive(name) {
+        return /\.(zip|tar|tar\.gz|tgz|tar\.zst|tzst)$/i.test(name);
+    }
+
+    document.getElementById('dropdownExtract').onclick = async function(e) {
+        e.stopPropagation();
+        if (!currentDropdownItem) {
+            closeDropdown();
+            return;
+        }
+
+        const archiveName = currentDropdownItem.name;
+        const pathParam = currentPath === 'root' ? '' : currentPath;
+        const folderName = archiveName.replace(/\.(zip|tar|tar\.gz|tgz|tar\.zst|tzst)$/i, '');
+        closeDropdown();
+
+        const destination = prompt('Extract to folder:', pathParam ? `${pathParam}/${folderName}` : folderName);
+        if (destination === null) return;
+
+        try {
+            const response = await apiCall('/api/files/extract', {
+                method: 'POST',
+                body: JSON.stringify({
+                    path: pathParam,
+                    name: archiveName,
+                    destination: destination,
+                    conflict: 'rename'
+                })
+            });
+
+            const data = await response.json();
+            if (response.ok && data.success) {
+                showToast('Extracted', `${data.result.extracted} file(s) extracted from ${archiveName}`);
+                loadFiles();
+            } else {
+                showToast('Error', data.error || 'Error extracting archive', 'destructive');
+            }
+        } catch (error) {
+            showToast('Error', 'Error extracting archive', 'destructive');
+        }
+    };
+
+    let shareItem = null;
+
+    document.getElementById('dropdownShare').onclick = function(e) {
+        e.stopPropagation();
+        if (currentDropdownItem) {
+            openShareDialog(currentDropdownItem);
+        }
+        closeDropdown();
+    };
+
+    function openShareDialog(item) {
+        shareItem = { name: item.name, type: item.type, path: currentPath === 'root' ? '' : currentPath };
+        document.getElementById('shareForm').reset();
+        document.getElementById('shareTitle').textContent = `Share ${item.name}`;
+        // Only folders can receive uploads
+        document.getElementById('sharePermissionField').style.display = item.type === 'folder' ? '' : 'none';
+        updateShareFields();
+        document.getElementById('shareResult').style.display = 'none';
+        document.getElementById('shareCreate').style.display = '';
+        document.getElementById('shareOverlay').style.display = 'flex';
+    }
+
+    // Size limits only apply to links that accept uploads, drops have nothing to download
+    function updateShareFields() {
+        const permission = shareItem && shareItem.type === 'folder' ? document.getElementById('sharePermission').value : 'read';
+        document.querySelectorAll('.share-upload-field').forEach(field => {
+            field.style.display = permission === 'read' ? 'none' : '';
+        });
+        document.getElementById('shareMaxDownloadsField').style.display = permission === 'drop' ? 'none' : '';
+    }
+
+    document.getElementById('sharePermission').onchange = updateShareFields;
+
+    function closeShareDialog() {
+        document.getElementById('shareOverlay').style.display = 'none';
+        shareItem = null;
+    }
+
+    document.getElementById('shareForm').onsubmit = async function(e) {
+        e.preventDefault();
+        if (!shareItem) return;
+
+        const expires = document.getElementById('shareExpires').value;
+        const maxDownloads = parseInt(document.getElementById('shareMaxDownloads').value, 10);
+        const maxFileSize = parseFloat(document.getElementById('shareMaxFileSize').value);
+        const maxBytes = parseFloat(document.getElementById('shareMaxBytes').value);
+        const request = {
+            path: shareItem.path,
+            name: shareItem.name,
+            permission: shareItem.type === 'folder' ? document.getElementById('sharePermission').value : 'read',
+            password: document.getElementById('sharePassword').value
+        };
+        if (expires) {
+            request.expiresAt = new Date(expires).toISOString();
+        }
+        if (maxDownloads > 0 && request.permission !== 'drop') {
+            request.maxDownloads = maxDownloads;
+        }
+        if (request.permission !== 'read') {
+            if (maxFileSize > 0) request.maxFileSize = Math.round(maxFileSize * 1024 * 1024);
+            if (maxBytes > 0) request.maxBytes = Math.round(maxBytes * 1024 * 1024);
+        }
+
+        try {
+            const response = await apiCall('/api/shares', {
+                method: 'POST',
+                body: JSON.stringify(request)
+            });
+
+            const data = await response.json();
+            if (response.ok && data.success) {
+                document.getElementById('shareUrl').value = window.location.origin + data.share.url;
+                document.getElementById('shareResult').style.display = 'flex';
+                document.getElementById('shareCreate').style.display = 'none';
+            } else {
+                showToast('Error', data.error || 'Error creating link', 'destructive');
+            }
+        } catch (error) {
+            showToast('Error', 'Error creating link', 'destructive');
+        }
+    };
+
+    document.getElementById('shareCopy').onclick = async function() {
+        const url = document.getElementById('shareUrl');
+        try {
+            await navigator.clipboard.writeText(url.value);
+        } catch (error) {
+            url.select();
+            document.execCommand('copy');
+        }
+        showToast('Copied', 'Link copied to the clipboard');
+    };
+
+    document.getElementById('shareClose').onclick = closeShareDialog;
+    document.getElementById('shareOverlay').onclick = function(e) {
+        if (e.target === this) closeShareDialog();
+    };
+
+    async function loadShares() {
+        try {
+            const response = await apiCall('/api/shares', { cache: 'no-store' });
+            if (!response.ok) {
+                if (response.status === 401) {
+                    window.location.href = 'login.html';
+                    return;
+                }
+                throw new Error('Error loading links');
+            }
+
+            const data = await response.json();
+            const list = document.getElementById('sharesList');
+            list.innerHTML = '';
+            document.getElementById('sharesTable').style.display = data.shares.length ? '' : 'none';
+            document.getElementById('sharesEmpty').style.display = data.shares.length ? 'none' : 'block';
+
+            data.shares.forEach(share => {
+                const row = document.createElement('tr');
+                const access = { read: 'Read', upload: 'Upload', drop: 'File drop' }[share.permission] || share.permission;
+                const transfers = share.permission === 'drop'
+                    ? `${share.uploads} file(s), ${formatBytes(share.uploaded)}` + (share.maxBytes ? ` / ${formatBytes(share.maxBytes)}` : '')
+                    : share.maxDownloads ? `${share.downloads} / ${share.maxDownloads}` : String(share.downloads);
+                const cells = [
+                    share.path,
+                    access + (share.hasPassword ? ', password' : ''),
+                    share.expiresAt ? new Date(share.expiresAt).toLocaleString() : 'Never',
+                    transfers,
+                    share.status
+                ];
+                cells.forEach((text, index) => {
+                    const cell = document.createElement('td');
+                    cell.textContent = text;
+                    if (index === cells.length - 1 && share.status !== 'active') {
+                        cell.className = 'share-inactive';
+                    }
+                    row.appendChild(cell);
+                });
+
+                const actions = document.createElement('td');
+                const copy = document.createElement('button');
+                copy.className = 'btn-toolbar btn-toolbar-ghost';
+                copy.textContent = 'Copy';
+                copy.onclick = async () => {
+                    await navigator.clipboard.writeText(window.location.origin + share.url);
+                    showToast('Copied', 'Link copied to the clipboard');
+                };
+                const revoke = document.createElement('button');
+                revoke.className = 'btn-toolbar btn-toolbar-destructive';
+                revoke.textContent = 'Revoke';
+                revoke.onclick = () => revokeShare(share);
+                actions.append(copy, revoke);
+                row.appendChild(actions);
+
+                list.appendChild(row);
+            });
+        } catch (error) {
+            showToast('Error', 'Error loading links', 'destructive');
+        }
+    }
+
+    function formatBytes(bytes) {
+        const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+        let value = bytes;
+        let unit = 0;
+        while (value >= 1024 && unit < units.length - 1) {
+            value /= 1024;
+            unit++;
+        }
+        return unit === 0 ? `${value} ${units[0]}` : `${value.toFixed(1)} ${units[unit]}`;
+    }
+
+    async function revokeShare(share) {
+        if (!confirm(`Revoke the link to ${share.name}? It will stop working right away.`)) return;
+
+        try {
+            const response = await apiCall('/api/shares', {
+                method: 'DELETE',
+                body: JSON.stringify({ id: share.id })
+            });
+
+            if (response.ok) {
+                showToast('Revoked', `Link to ${share.name} revoked`);
+            } else {
+                const data = await response.json();
+                showToast('Error', data.error || 'Error revoking link', 'destructive');
+            }
+        } catch (error) {
+            showToast('Error', 'Error revoking link', 'destructive');
+        }
+        loadShares();
+    }
+
+    let accessItem = null;
+    let accessEntries = [];
+    const accessLabels = { read: 'Can view', write: 'Can edit', manage: 'Can edit and share' };
+
+    document.getElementById('dropdownAccess').onclick = function(e) {
+        e.stopPropagation();
+        if (currentDropdownItem) {
+            openAccessDialog(currentDropdownItem);
+        }
+        closeDropdown();
+    };
+
+    async function openAccessDialog(item) {
+        accessItem = { path: currentPath === 'root' ? '' : currentPath, name: item.name };
+        document.getElementById('accessForm').reset();
+        document.getElementById('accessTitle').textContent = `Share ${item.name} with people`;
+
+        try {
+            const response = await apiCall(`/api/files/acl?${new URLSearchParams(accessItem)}`, { cache: 'no-store' });
+            const data = await response.json();
+            if (!response.ok) {
+                showToast('Error', data.error || 'Error loading access', 'destructive');
+                return;
+            }
+            accessEntries = data.entries || [];
+            renderAccess();
+            document.getElementById('accessOverlay').style.display = 'flex';
+        } catch (error) {
+            showToast('Error', 'Error loading access', 'destructive');
+        }
+    }
+
+    function renderAccess() {
+        const list = document.getElementById('accessList');
+        list.innerHTML = '';
+        document.getElementById('accessEmpty').style.display = accessEntries.length ? 'none' : '';
+
+        accessEntries.forEach((entry, index) => {
+            const row = document.createElement('tr');
+
+            const who = document.createElement('td');
+            who.textContent = entry.user || `Group ${entry.group}`;
+            row.appendChild(who);
+
+            const access = document.createElement('td');
+            const select = document.createElement('select');
+            select.className = 'sort-select';
+            Object.entries(accessLabels).forEach(([value, label]) => {
+                const option = document.createElement('option');
+                option.value = value;
+                option.textContent = label;
+                select.appendChild(option);
+            });
+            select.value = entry.access;
+            select.onchange = () => saveAccess(accessEntries.map((e, i) => i === index ? { ...e, access: select.value } : e));
+            access.appendChild(select);
+            row.appendChild(access);
+
+            const actions = document.createElement('td');
+            const remove = document.createElement('button');
+            remove.className = 'btn-toolbar btn-toolbar-destructive';
+            remove.textContent = 'Remove';
+            remove.onclick = () => saveAccess(accessEntries.filter((e, i) => i !== index));
+            actions.appendChild(remove);
+            row.appendChild(actions);
+
+            list.appendChild(row);
+        });
+    }
+
+    // Every change replaces the whole list, so the dialog always shows what the server stored
+    async function saveAccess(entries) {
+        if (!accessItem) return false;
+
+        try {
+            const response = await apiCall(`/api/files/acl?${new URLSearchParams(accessItem)}`, {
+                method: 'PUT',
+                body: JSON.stringify({ entries })
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                showToast('Error', data.error || 'Error updating access', 'destructive');
+                renderAccess();
+                return false;
+            }
+            accessEntries = data.entries || [];
+            renderAccess();
+            return true;
+        } catch (error) {
+            showToast('Error', 'Error updating access', 'destructive');
+            renderAccess();
+            return false;
+        }
+    }
+
+    document.getElementById('accessForm').onsubmit = async function(e) {
+        e.preventDefault();
+        const entry = { access: document.getElementById('accessLevel').value };
+        entry[document.getElementById('accessKind').value] = document.getElementById('accessName').value.trim();
+        if (await saveAccess([...accessEntries, entry])) {
+            document.getElementById('accessName').value = '';
+        }
+    };
+
+    function closeAccessDialog() {
+        document.getElementById('accessOverlay').style.display = 'none';
+        accessItem = null;
+    }
+
+    document.getElementById('accessClose').onclick = closeAccessDialog;
+    document.getElementById('accessOverlay').onclick = function(e) {
+        if (e.target === this) closeAccessDialog();
+    };
+
+    document.getElementById('sharesButton').onclick = function() {
+        document.getElementById('sharesOverlay').style.display = 'flex';
+        loadShares();
+    };
+    document.getElementById('sharesClose').onclick = function() {
+        document.getElementById('sharesOverlay').style.display = 'none';
+    };
+    document.getElementById('sharesOverlay').onclick = function(e) {
+        if (e.target === this) this.style.display = 'none';
+    };
+
     document.getElementById('dropdownDelete').onclick = function(e) {
         e.stopPropagation();
         if (currentDropdownItem) {
@@ -351,39 +1161,154 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     };
 
+    // Files bigger than this are sent with the resumable tus protocol
+    const TUS_THRESHOLD = 20 * 1024 * 1024;
+    const TUS_CHUNK_SIZE = 5 * 1024 * 1024;
+    const TUS_MAX_RETRIES = 10;
+
+    function toBase64(value) {
+        const bytes = value instanceof ArrayBuffer ? new Uint8Array(value) : new TextEncoder().encode(value);
+        let binary = '';
+        bytes.forEach(byte => binary += String.fromCharCode(byte));
+        return btoa(binary);
+    }
+
+    function tusHeaders(extra = {}) {
+        return {
+            'Authorization': `Bearer ${token}`,
+            'Tus-Resumable': '1.0.0',
+            ...extra
+        };
+    }
+
+    async function tusOffset(location) {
+        const response = await fetch(location, { method: 'HEAD', headers: tusHeaders() });
+        if (!response.ok) {
+            return null;
+        }
+        return parseInt(response.headers.get('Upload-Offset'), 10);
+    }
+
+    async function uploadResumable(file, pathParam) {
+        // Remember the upload URL so it can be resumed after a reload
+        const storageKey = `tus:${username}:${pathParam}:${file.name}:${file.size}:${file.lastModified}`;
+        let location = localStorage.getItem(storageKey);
+        let offset = location ? await tusOffset(location) : null;
+
+        if (offset === null) {
+            const response = await fetch('/api/tus/', {
+                method: 'POST',
+                headers: tusHeaders({
+                    'Upload-Length': String(file.size),
+                    'Upload-Metadata': `filename ${toBase64(file.name)},path ${toBase64(pathParam)}`
+                })
+            });
+            if (!response.ok) {
+                throw new Error(response.status === 507 ? 'storage quota exceeded' : await response.text());
+            }
+            location = response.headers.get('Location');
+            localStorage.setItem(storageKey, location);
+            offset = 0;
+        }
+
+        let retries = 0;
+        while (offset < file.size) {
+            const chunk = await file.slice(offset, offset + TUS_CHUNK_SIZE).arrayBuffer();
+            const headers = tusHeaders({
+                'Upload-Offset': String(offset),
+                'Content-Type': 'application/offset+octet-stream'
+            });
+            if (window.crypto && crypto.subtle) {
+                headers['Upload-Checksum'] = `sha256 ${toBase64(await crypto.subtle.digest('SHA-256', chunk))}`;
+            }
+
+            let response;
+            try {
+                response = await fetch(location, { method: 'PATCH', headers: headers, body: chunk });
+            } catch (error) {
+                // Network failure: wait and resume from what the server has
+                if (++retries > TUS_MAX_RETRIES) throw error;
+                await new Promise(resolve => setTimeout(resolve, 1000 * retries));
+                const current = await tusOffset(location).catch(() => null);
+                if (current !== null) offset = current;
+                continue;
+            }
+
+            if (response.status === 409 || response.status === 460) {
+                if (++retries > TUS_MAX_RETRIES) throw new Error('Upload could not be resumed');
+                const current = await tusOffset(location);
+                if (current === null) throw new Error('Upload expired');
+                offset = current;
+                continue;
+            }
+            if (!response.ok) {
+                localStorage.removeItem(storageKey);
+                throw new Error(response.status === 507 ? 'storage quota exceeded' : await response.text());
+            }
+
+            offset = parseInt(response.headers.get('Upload-Offset'), 10);
+            retries = 0;
+        }
+
+        localStorage.removeItem(storageKey);
+    }
+
+    async function uploadMultipart(files, pathParam) {
+        const formData = new FormData();
+        files.forEach(file => formData.append('files', file));
+
+        const response = await fetch(`/api/files/upload?path=${encodeURIComponent(pathParam)}`, {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${token}`
+            },
+            body: formData
+        });
+
+        const data = await response.json();
+        if (!response.ok || !data.success) {
+            const failed = (data.files || []).filter(file => !file.success);
+            const details = failed.map(file => `${file.name}: ${file.error}`).join(', ');
+            showToast('Error', data.error || details || 'Error uploading files', 'destructive');
+        }
+        return data.uploaded || 0;
+    }
+
     document.getElementById('uploadBtn').onclick = function() {
         const input = document.createElement('input');
         input.type = 'file';
         input.multiple = true;
         input.onchange = async function(e) {
-            const files = e.target.files;
+            const files = Array.from(e.target.files);
             if (files.length === 0) return;
-            
-            const formData = new FormData();
-            for (let i = 0; i < files.length; i++) {
-                formData.append('files', files[i]);
-            }
-            
+
+            const pathParam = currentPath === 'root' ? '' : currentPath;
+            const smallFiles = files.filter(file => file.size <= TUS_THRESHOLD);
+            const largeFiles = files.filter(file => file.size > TUS_THRESHOLD);
+            let uploaded = 0;
+
             try {
-                const pathParam = currentPath === 'root' ? '' : currentPath;
-                const response = await fetch(`/api/files/upload?path=${encodeURIComponent(pathParam)}`, {
-                    method: 'POST',
-                    headers: {
-                        'Authorization': `Bearer ${token}`
-                    },
-                    body: formData
-                });
-                
-                const data = await response.json();
-                if (response.ok && data.success) {
-                    showToast('Upload Successful', `${data.uploaded} file(s) uploaded`);
-                    loadFiles();
-                } else {
-                    showToast('Error', data.error || 'Error uploading files', 'destructive');
+                if (smallFiles.length > 0) {
+                    uploaded += await uploadMultipart(smallFiles, pathParam);
                 }
             } catch (error) {
                 showToast('Error', 'Error uploading files', 'destructive');
             }
+
+            for (const file of largeFiles) {
+                showToast('Uploading', `${file.name} (resumable upload)`);
+                try {
+                    await uploadResumable(file, pathParam);
+                    uploaded++;
+                } catch (error) {
+                    showToast('Error', `${file.name}: ${error.message || 'Error uploading file'}`, 'destructive');
+                }
+            }
+
+            if (uploaded > 0) {
+                showToast('Upload Successful', `${uploaded} file(s) uploaded`);
+                loadFiles();
+            }
         };
         input.click();
     };
@@ -394,11 +1319,11 @@ document.addEventListener('DOMContentLoaded', function() {
             return;
         }
         
-        for (const fileName of selectedItems) {
-            const pathParam = currentPath === 'root' ? '' : currentPath;
-            const url = `/api/files/download?path=${encodeURIComponent(pathParam)}&name=${encodeURIComponent(fileName)}&token=${encodeURIComponent(token)}`;
-            window.open(url, '_blank');
-        }
+        // Folders and multiple selections are downloaded as a single ZIP archive
+        const pathParam = currentPath === 'root' ? '' : currentPath;
+        const names = Array.from(selectedItems).map(name => `name=${encodeURIComponent(name)}`).join('&');
+        const url = `/api/files/download?path=${encodeURIComponent(pathParam)}&${names}&token=${encodeURIComponent(token)}`;
+        window.open(url, '_blank');
         
         showToast('Download', `Downloading ${selectedItems.size} item(s)`);
     };
@@ -414,8 +1339,11 @@ document.addEventListener('DOMContentLoaded', function() {
         }
         
         try {
+            // Files must still be the versions shown, folders have no ETag to compare
+            const etags = itemNames.map(name => itemETags.get(name));
             const response = await apiCall('/api/files', {
                 method: 'DELETE',
+                headers: etags.every(Boolean) ? { 'If-Match': etags.join(', ') } : {},
                 body: JSON.stringify({
                     path: currentPath === 'root' ? '' : currentPath,
                     names: itemNames
@@ -427,6 +1355,9 @@ document.addEventListener('DOMContentLoaded', function() {
                 itemNames.forEach(name => selectedItems.delete(name));
                 updateSelectionCount();
                 loadFiles();
+            } else if (response.status === 412) {
+                showToast('Changed', 'Some files were changed elsewhere, nothing was deleted', 'destructive');
+                loadFiles();
             } else {
                 const data = await response.json();
                 showToast('Error', data.error || 'Error deleting', 'destructive');
@@ -457,10 +1388,32 @@ document.addEventListener('DOMContentLoaded', function() {
 
     document.getElementById('searchInput').addEventListener('input', function(e) {
         searchQuery = e.target.value;
+        exitSearchMode();
         loadFiles();
     });
 
+    // Enter searches the whole tree instead of the current folder, Shift+Enter searches file contents
+    document.getElementById('searchInput').addEventListener('keydown', function(e) {
+        if (e.key === 'Enter' && searchQuery.trim()) {
+            if (e.shiftKey) {
+                searchContents(searchQuery.trim());
+            } else {
+                searchEverywhere(searchQuery.trim());
+            }
+        }
+    });
+
+    document.getElementById('sortSelect').addEventListener('change', function(e) {
+        [sortField, sortOrder] = e.target.value.split(':');
+        loadFiles();
+    });
+
+    document.getElementById('loadMoreBtn').onclick = function() {
+        loadFiles(true);
+    };
+
     updateBreadcrumb();
     loadFiles();
+    loadSpaces();
     updateSelectionCount();
 });
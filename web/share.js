@@ -0,0 +1,308 @@
+document.addEventListener('DOMContentLoaded', function() {
+    // The page is served at /s/{id}, every request goes below it
+    const shareId = window.location.pathname.split('/')[2];
+    const base = `/s/${encodeURIComponent(shareId)}`;
+    const storageKey = `share:${shareId}`;
+    let grant = sessionStorage.getItem(storageKey) || '';
+    let share = null;
+    let currentPath = '';
+
+    function showToast(title, description, variant = 'default') {
+        const toastContainer = document.getElementById('toastContainer');
+        const toast = document.createElement('div');
+        toast.className = `toast ${variant === 'destructive' ? 'destructive' : ''}`;
+
+        const titleEl = document.createElement('div');
+        titleEl.style.fontWeight = '600';
+        titleEl.style.marginBottom = '0.25rem';
+        titleEl.textContent = title;
+
+        const descEl = document.createElement('div');
+        descEl.style.fontSize = '0.875rem';
+        descEl.style.color = 'hsl(var(--muted-foreground))';
+        descEl.textContent = description;
+
+        toast.appendChild(titleEl);
+        toast.appendChild(descEl);
+        toastContainer.appendChild(toast);
+
+        setTimeout(() => {
+            toast.style.animation = 'slide-in 0.3s ease-out reverse';
+            setTimeout(() => toast.remove(), 300);
+        }, 3000);
+    }
+
+    function showMessage(text) {
+        document.getElementById('shareContent').style.display = 'none';
+        document.getElementById('unlockForm').style.display = 'none';
+        document.getElementById('dropForm').style.display = 'none';
+        const message = document.getElementById('shareMessage');
+        message.textContent = text;
+        message.style.display = 'block';
+    }
+
+    async function shareCall(action, options = {}) {
+        const headers = { ...options.headers };
+        if (grant) {
+            headers['X-Share-Token'] = grant;
+        }
+        return fetch(`${base}/${action}`, { ...options, headers: headers });
+    }
+
+    // Handles errors that make the whole share unusable, returns true if there was one
+    async function handleShareError(response) {
+        if (response.ok) return false;
+
+        const data = await response.json().catch(() => ({}));
+        if (response.status === 401 && data.passwordRequired) {
+            grant = '';
+            sessionStorage.removeItem(storageKey);
+            document.getElementById('shareContent').style.display = 'none';
+            document.getElementById('unlockForm').style.display = 'flex';
+        } else if (response.status === 410) {
+            showMessage({
+                'share expired': 'This link has expired.',
+                'upload limit reached': 'This link does not accept more files.'
+            }[data.error] || 'This link has reached its download limit.');
+        } else if (response.status === 404) {
+            showMessage('This link does not exist or was revoked.');
+        } else {
+            showToast('Error', data.error || 'Something went wrong', 'destructive');
+        }
+        return true;
+    }
+
+    function formatBytes(bytes) {
+        const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+        let value = bytes;
+        let unit = 0;
+        while (value >= 1024 && unit < units.length - 1) {
+            value /= 1024;
+            unit++;
+        }
+        return unit === 0 ? `${value} ${units[0]}` : `${value.toFixed(1)} ${units[unit]}`;
+    }
+
+    function downloadUrl(params) {
+        const query = new URLSearchParams(params);
+        if (grant) {
+            query.set('token', grant);
+        }
+        return `${base}/download?${query}`;
+    }
+
+    async function loadInfo() {
+        const response = await shareCall('info');
+        if (await handleShareError(response)) return;
+
+        share = await response.json();
+        document.title = `File Manager - ${share.name}`;
+        document.getElementById('shareName').textContent = share.name;
+
+        const meta = [];
+        if (share.size) meta.push(share.size);
+        if (share.expiresAt) meta.push(`Expires ${new Date(share.expiresAt).toLocaleString()}`);
+        if (share.downloadsLeft !== undefined) meta.push(`${share.downloadsLeft} download(s) left`);
+        document.getElementById('shareMeta').textContent = meta.join(' · ');
+
+        document.getElementById('unlockForm').style.display = 'none';
+
+        // Drops only take files, there is nothing to browse
+        if (share.permission === 'drop') {
+            const limits = [];
+            if (share.maxFileSize) limits.push(`Up to ${formatBytes(share.maxFileSize)} per file`);
+            if (share.bytesLeft !== undefined) limits.push(`${formatBytes(share.bytesLeft)} left`);
+            document.getElementById('dropLimits').textContent = limits.join(' · ');
+            document.getElementById('dropForm').style.display = 'flex';
+            return;
+        }
+
+        // Used up limits only hide their own action
+        document.getElementById('shareContent').style.display = 'block';
+        document.getElementById('uploadBtn').style.display =
+            share.permission === 'upload' && share.bytesLeft !== 0 ? '' : 'none';
+        document.getElementById('downloadAllBtn').style.display = share.downloadsLeft === 0 ? 'none' : '';
+
+        if (share.type === 'folder') {
+            loadFiles();
+        } else {
+            renderItems([{ name: share.name, type: 'file', size: share.size }]);
+            updateBreadcrumb();
+        }
+    }
+
+    async function loadFiles() {
+        const response = await shareCall(`files?${new URLSearchParams({ path: currentPath })}`);
+        if (await handleShareError(response)) return;
+
+        const data = await response.json();
+        renderItems(data.items || []);
+        updateBreadcrumb();
+    }
+
+    function updateBreadcrumb() {
+        const breadcrumb = document.getElementById('breadcrumb');
+        breadcrumb.innerHTML = '';
+
+        const parts = [share.name].concat(currentPath ? currentPath.split('/') : []);
+        parts.forEach((part, index) => {
+            if (index > 0) {
+                const separator = document.createElement('span');
+                separator.className = 'breadcrumb-separator';
+                separator.textContent = '/';
+                breadcrumb.appendChild(separator);
+            }
+
+            const link = document.createElement('button');
+            link.className = 'breadcrumb-link';
+            link.textContent = part;
+            link.onclick = () => {
+                currentPath = parts.slice(1, index + 1).join('/');
+                loadFiles();
+            };
+            breadcrumb.appendChild(link);
+        });
+    }
+
+    function renderItems(items) {
+        const fileGrid = document.getElementById('fileGrid');
+        const emptyState = document.getElementById('emptyState');
+        fileGrid.innerHTML = '';
+
+        fileGrid.style.display = items.length ? 'grid' : 'none';
+        emptyState.style.display = items.length ? 'none' : 'block';
+
+        items.forEach(item => {
+            const fileItem = document.createElement('div');
+            fileItem.className = 'file-item';
+            fileItem.onclick = () => {
+                if (item.type === 'folder') {
+                    currentPath = item.path;
+                    loadFiles();
+                } else if (share.downloadsLeft === 0) {
+                    showToast('Error', 'This link has reached its download limit.', 'destructive');
+                } else if (share.type === 'folder') {
+                    window.location.href = downloadUrl({ path: currentPath, name: item.name });
+                } else {
+                    window.location.href = downloadUrl({});
+                }
+            };
+
+            const content = document.createElement('div');
+            content.className = 'file-item-content';
+            content.innerHTML = item.type === 'folder'
+                ? '<img src="/gopher-logo.jpg" alt="Folder" class="file-icon">'
+                : `<svg class="file-icon-svg" viewBox="0 0 24 24" width="64" height="64" fill="none" stroke="currentColor" stroke-width="1.5">
+                       <path d="M13 2H6a2 2 0 0 0-2 2v16a2 2 0 0 0 2 2h12a2 2 0 0 0 2-2V9z"></path>
+                       <polyline points="13 2 13 9 20 9"></polyline>
+                   </svg>`;
+
+            const text = document.createElement('div');
+            text.className = 'text-center w-100';
+            const name = document.createElement('p');
+            name.className = 'file-name';
+            name.textContent = item.name;
+            const meta = document.createElement('p');
+            meta.className = 'file-meta';
+            meta.textContent = item.size || item.modified || '';
+            text.append(name, meta);
+            content.appendChild(text);
+
+            fileItem.appendChild(content);
+            fileGrid.appendChild(fileItem);
+        });
+    }
+
+    document.getElementById('unlockForm').onsubmit = async function(e) {
+        e.preventDefault();
+        const response = await fetch(`${base}/unlock`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ password: document.getElementById('unlockPassword').value })
+        });
+
+        const data = await response.json().catch(() => ({}));
+        if (!response.ok) {
+            if (response.status === 401) {
+                showToast('Error', 'Wrong password', 'destructive');
+            } else {
+                await handleShareError(new Response(JSON.stringify(data), { status: response.status }));
+            }
+            return;
+        }
+
+        grant = data.token || '';
+        sessionStorage.setItem(storageKey, grant);
+        loadInfo();
+    };
+
+    document.getElementById('downloadAllBtn').onclick = function() {
+        // Folders are downloaded as a ZIP archive of what is being browsed
+        if (share.type === 'folder' && currentPath) {
+            const parent = currentPath.includes('/') ? currentPath.slice(0, currentPath.lastIndexOf('/')) : '';
+            const name = currentPath.slice(currentPath.lastIndexOf('/') + 1);
+            window.location.href = downloadUrl({ path: parent, name: name });
+        } else {
+            window.location.href = downloadUrl({});
+        }
+    };
+
+    // Returns how many files were stored
+    async function uploadFiles(files, params) {
+        const formData = new FormData();
+        files.forEach(file => formData.append('files', file));
+
+        try {
+            const response = await shareCall(`upload?${new URLSearchParams(params)}`, {
+                method: 'POST',
+                body: formData
+            });
+            const data = await response.clone().json().catch(() => ({}));
+            if (response.ok && data.success) {
+                showToast('Upload Successful', `${data.uploaded} file(s) uploaded`);
+            } else if (data.files) {
+                const failed = data.files.filter(file => !file.success);
+                const details = failed.map(file => `${file.name}: ${file.error}`).join(', ');
+                showToast('Error', data.error || details || 'Error uploading files', 'destructive');
+            } else {
+                await handleShareError(response);
+            }
+            return data.uploaded || 0;
+        } catch (error) {
+            showToast('Error', 'Error uploading files', 'destructive');
+            return 0;
+        }
+    }
+
+    document.getElementById('uploadBtn').onclick = function() {
+        const input = document.createElement('input');
+        input.type = 'file';
+        input.multiple = true;
+        input.onchange = async function(e) {
+            const files = Array.from(e.target.files);
+            if (files.length === 0) return;
+
+            await uploadFiles(files, { path: currentPath });
+            loadFiles();
+        };
+        input.click();
+    };
+
+    document.getElementById('dropForm').onsubmit = async function(e) {
+        e.preventDefault();
+        const input = document.getElementById('dropFiles');
+        const files = Array.from(input.files);
+        if (files.length === 0) return;
+
+        const submit = document.getElementById('dropSubmit');
+        submit.disabled = true;
+        const uploaded = await uploadFiles(files, { uploader: document.getElementById('dropUploader').value });
+        submit.disabled = false;
+        if (uploaded > 0) {
+            input.value = '';
+            loadInfo();
+        }
+    };
+
+    loadInfo();
+});